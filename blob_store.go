@@ -0,0 +1,168 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	storage "google.golang.org/api/storage/v1"
+)
+
+// BlobStore keeps file content, such as ticket attachments, outside the datastore. Content
+// is stored per site, under names such as "tickets/<ticket uuid>/<attachment uuid>".
+type BlobStore interface {
+	// Put stores content under a name, replacing any content already stored
+	Put(site, name, contentType string, content io.Reader) error
+
+	// Get returns the content stored under a name, or ErrBlobNotFound
+	Get(site, name string) (io.ReadCloser, error)
+
+	// Delete removes the content stored under a name. Deleting missing content is not an error.
+	Delete(site, name string) error
+}
+
+var ErrBlobNotFound = errors.New("File not found")
+
+// blobName checks a site and name are safe to use as a path, and joins them.
+func blobName(site, name string) (string, error) {
+	for _, part := range append([]string{site}, strings.Split(name, "/")...) {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "\\\x00") {
+			return "", errors.New("Invalid file name: " + site + "/" + name)
+		}
+	}
+	return site + "/" + name, nil
+}
+
+// FileBlobStore keeps content in a directory of the local filesystem. It suits development,
+// and deployments running on a single server.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) *FileBlobStore {
+	return &FileBlobStore{dir: dir}
+}
+
+func (s *FileBlobStore) path(site, name string) (string, error) {
+	n, err := blobName(site, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(n)), nil
+}
+
+// Put writes content to a temporary file, then renames it, so readers never see part of a file.
+func (s *FileBlobStore) Put(site, name, contentType string, content io.Reader) error {
+	path, err := s.path(site, name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, content); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (s *FileBlobStore) Get(site, name string) (io.ReadCloser, error) {
+	path, err := s.path(site, name)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, ErrBlobNotFound
+	}
+	return f, err
+}
+
+func (s *FileBlobStore) Delete(site, name string) error {
+	path, err := s.path(site, name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// CloudStorageBlobStore keeps content in a Google Cloud Storage bucket. Objects are named
+// "<site>/<name>", and should not be made publicly readable.
+type CloudStorageBlobStore struct {
+	service *storage.Service
+	ctx     context.Context
+	bucket  string
+}
+
+// NewCloudStorageBlobStore connects to a bucket. Without options, the application default
+// credentials are used.
+func NewCloudStorageBlobStore(ctx context.Context, bucket string, opts ...option.ClientOption) (*CloudStorageBlobStore, error) {
+	service, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &CloudStorageBlobStore{service: service, ctx: ctx, bucket: bucket}, nil
+}
+
+func (s *CloudStorageBlobStore) Put(site, name, contentType string, content io.Reader) error {
+	n, err := blobName(site, name)
+	if err != nil {
+		return err
+	}
+	object := &storage.Object{Name: n, ContentType: contentType}
+	_, err = s.service.Objects.Insert(s.bucket, object).Media(content, googleapi.ContentType(contentType)).Context(s.ctx).Do()
+	return err
+}
+
+func (s *CloudStorageBlobStore) Get(site, name string) (io.ReadCloser, error) {
+	n, err := blobName(site, name)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.service.Objects.Get(s.bucket, n).Context(s.ctx).Download()
+	if isGoogleApiNotFound(err) {
+		return nil, ErrBlobNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *CloudStorageBlobStore) Delete(site, name string) error {
+	n, err := blobName(site, name)
+	if err != nil {
+		return err
+	}
+	if err := s.service.Objects.Delete(s.bucket, n).Context(s.ctx).Do(); err != nil && !isGoogleApiNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+func isGoogleApiNotFound(err error) bool {
+	var e *googleapi.Error
+	return errors.As(err, &e) && e.Code == http.StatusNotFound
+}
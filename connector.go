@@ -42,11 +42,12 @@ type ScheduledConnector struct {
 	Disabled bool
 }
 
+// GetConfig returns a config setting. Credentials are decrypted, see IsSecretConfigKey().
 func (sc *ScheduledConnector) GetConfig(key string) string {
 	key = Underscorify(key)
 	for _, k := range sc.Config {
 		if key == Underscorify(k.Key) {
-			return k.Value
+			return decryptConfigValue(k.Key, k.Value)
 		}
 	}
 	return ""
@@ -60,9 +61,10 @@ func (s *ScheduledConnector) String() string {
 	return string(b)
 }
 
-// SetConfig adds, updates, or removes a config setting.
+// SetConfig adds, updates, or removes a config setting. Credentials are encrypted, see IsSecretConfigKey().
 func (sc *ScheduledConnector) SetConfig(key, value string) {
 	ukey := Underscorify(key)
+	value = encryptConfigValue(key, value)
 	if value == "" {
 		del := -1
 		for i, k := range sc.Config {
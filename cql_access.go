@@ -8,7 +8,6 @@ import (
 	"fmt"
 	"html/template"
 	"net/smtp"
-	"strconv"
 	"strings"
 	"time"
 
@@ -154,13 +153,16 @@ func (a *CqlAccessManager) Signup(site, first_name, last_name, email, password,
 		results = append(results, "This email address already belongs to a valid user.")
 	}
 
-	if strings.ToLower(a.setting.GetWithDefault(site, "self.signup", "no")) == "no" {
+	if !a.setting.GetBool(site, "self.signup", false) {
 		results = append(results, "Self registration is not allowed at this time.")
 		return &results, "", errors.New(results[0])
 	}
 
 	smtpHostname := a.setting.GetWithDefault(site, "smtp.hostname", "")
-	smtpPassword := a.setting.GetWithDefault(site, "smtp.password", "")
+	smtpPassword, err := a.setting.GetSecret(site, "smtp.password")
+	if err != nil {
+		return nil, "", err
+	}
 	smtpPort := a.setting.GetWithDefault(site, "smtp.port", "")
 	smtpUser := a.setting.GetWithDefault(site, "smtp.user", "")
 	supportName := a.setting.GetWithDefault(site, "support_team.name", "")
@@ -203,7 +205,7 @@ func (a *CqlAccessManager) Signup(site, first_name, last_name, email, password,
 	//TODO: expiry time set to actual desired expiry time
 	rows := a.cql.Query("insert into request_token (uid, person_uuid, type, ip, expiry, data) values(?,?,'signup_confirmation',?,?,?)",
 		token.String(), token, ip, time.Now().Unix(), data).Iter()
-	err := rows.Close()
+	err = rows.Close()
 	if err != nil {
 		return nil, "", err
 	}
@@ -578,16 +580,7 @@ func (g *CqlAccessManager) Session(site, ip, cookie, userAgent, lang string) (Se
 			session.roleMap[v] = true
 		}
 
-		expiry := g.setting.GetWithDefault(site, "session.expiry", "")
-		if expiry == "" {
-			expiry = "3600"
-			g.log.Warning("System setting \"session.expiry\" not set, defaulting to 1 hour.\n")
-		}
-		e, err := strconv.ParseInt(expiry, 10, 64)
-		if err != nil {
-			e = 3600
-			g.log.Warning("System setting \"session.expiry\" is not a valid number, defaulting to 1 hour.\n")
-		}
+		e := g.setting.GetInt(site, "session.expiry", 3600)
 
 		// Check this user session hasn't hit its maximum hard limit
 		maxAge := g.setting.GetInt(site, "session.max_age", 2592000)
@@ -711,26 +704,13 @@ func (g *CqlAccessManager) createSession(site, person, firstName, lastName, emai
 		return "", perr
 	}
 
-	expiry := g.setting.GetWithDefault(site, "session.expiry", "")
-	if expiry == "" {
-		expiry = "3600"
-		g.Log().Warning("System setting \"session.expiry\" not set, defaulting to 1 hour.")
-	}
-	e, err := strconv.ParseInt(expiry, 10, 64)
-	if err != nil {
-		e = 3600
-		g.Log().Warning("System setting \"session.expiry\" is not a valid number, defaulting to 1 hour.")
-	}
+	e := g.setting.GetInt(site, "session.expiry", 3600)
 
 	token := RandomString(32)
 	now := time.Now().Unix()
-	expires := e + now
-
-	if err != nil {
-		return "", err
-	}
+	expires := int64(e) + now
 
-	err = g.cql.Query(
+	err := g.cql.Query(
 		"insert into session_token (site, person_uuid, uid, roles, expiry, created, first_name, last_name, email) "+
 			"values(?,?,?,?,?,?,?,?,?)",
 		site, personUuid, token, roles, expires, now, firstName, lastName, email).Exec()
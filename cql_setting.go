@@ -1,31 +1,40 @@
 package security
 
 import (
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gocql/gocql"
 )
 
 type CqlSetting struct {
-	cql     *gocql.Session
-	expires time.Time
-	sites   map[string]map[string]string
+	cql      *gocql.Session
+	lock     sync.Mutex
+	expires  time.Time
+	sites    map[string]map[string]string
+	origin   string
+	watchers settingWatchers
+	cancel   func()
 }
 
 func NewCqlSetting(cql *gocql.Session) Setting {
 	s := &CqlSetting{
-		cql: cql,
+		cql:    cql,
+		origin: RandomString(16),
 	}
+	s.cancel = localInvalidations.Subscribe(s.invalidate)
 	return s
 }
 
+// Close stops the setting store receiving invalidations.
+func (s *CqlSetting) Close() {
+	s.cancel()
+}
+
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *CqlSetting) Get(site, name string) *string {
-	s.refreshCache()
-
-	sm, exists := s.sites[site]
+	sm, exists := s.cache()[site]
 	if !exists {
 		return nil
 	}
@@ -40,75 +49,65 @@ func (s *CqlSetting) Get(site, name string) *string {
 }
 
 func (s *CqlSetting) GetList(site string, key string) []string {
-	content := s.Get(site, key)
-	var fields []string
-	if content != nil && strings.TrimSpace(*content) != "" {
-		fields = strings.Split(strings.TrimSpace(*content), ";")
-	}
-	//TODO: trim space?
-	return fields[:]
+	return settingList(s, site, key)
 }
 
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *CqlSetting) GetWithDefault(site, name string, defaultValue string) string {
-	s.refreshCache()
-
-	sm, exists := s.sites[site]
-	if !exists {
-		return defaultValue
-	}
-
-	value, exists := sm[strings.ToLower(name)]
-
-	if exists {
-		return value
-	}
-
-	return defaultValue
+	return settingValue(s, site, name, defaultValue)
 }
 
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *CqlSetting) GetInt(site, name string, defaultValue int) int {
-	s.refreshCache()
+	return settingInt(s, site, name, defaultValue)
+}
 
-	sm, exists := s.sites[site]
-	if !exists {
-		return defaultValue
-	}
+// Lookup a configuration setting. Loads from database only if cache has expired.
+func (s *CqlSetting) GetBool(site, name string, defaultValue bool) bool {
+	return settingBool(s, site, name, defaultValue)
+}
 
-	value, exists := sm[strings.ToLower(name)]
+// Lookup a configuration setting. Loads from database only if cache has expired.
+func (s *CqlSetting) GetDuration(site, name string, defaultValue time.Duration) time.Duration {
+	return settingDuration(s, site, name, defaultValue)
+}
 
-	if exists {
-		i, err := strconv.Atoi(value)
-		if err != nil {
-			panic(err)
-		}
-		return i
-	}
+// Lookup and decrypt a secret configuration setting.
+func (s *CqlSetting) GetSecret(site, name string) (string, error) {
+	return DecryptSecret(settingValue(s, site, name, ""))
+}
 
-	return defaultValue
+// Store a configuration setting. The cql backend does not keep an entity change log,
+// so changes are not recorded.
+func (s *CqlSetting) PutAs(site, name, value string, updator Session) error {
+	return s.Put(site, name, value)
 }
 
 // Store a configuration setting. Stores in cache, and flushes through to database.
 func (s *CqlSetting) Put(site, name, value string) error {
 	name = strings.ToLower(name)
 
-	err := s.cql.Query("update setting set value=? where site=? and name=?", value, site, name).Exec()
+	if err := ValidateSetting(name, value); err != nil {
+		return err
+	}
+	value, err := encryptSettingValue(name, value)
 	if err != nil {
 		return err
 	}
 
-	if s.sites == nil {
-		s.sites = make(map[string]map[string]string)
+	err = s.cql.Query("update setting set value=? where site=? and name=?", value, site, name).Exec()
+	if err != nil {
+		return err
 	}
 
-	sm, exists := s.sites[site]
-	if !exists {
-		sm = make(map[string]string)
-		s.sites[site] = sm
-	}
+	s.lock.Lock()
+	before := s.sites
+	s.sites = withSetting(s.sites, site, name, value)
+	after := s.sites
+	s.lock.Unlock()
 
-	s.sites[site][name] = value
+	s.watchers.notify(before, after)
+	publishInvalidation(Invalidation{Kind: InvalidateSetting, Site: site, Name: name, Origin: s.origin})
 	return nil
 }
 
@@ -116,26 +115,52 @@ func (s *CqlSetting) Put(site, name, value string) error {
 func (s *CqlSetting) List(site string) map[string]string {
 	all := make(map[string]string)
 
-	s.refreshCache()
-
-	if _, exists := s.sites[site]; !exists {
-		return all
-	}
-
 	// Return a copy of the settings map so it can't be altered
 	// by the receiving function
-	for k, v := range s.sites[site] {
+	for k, v := range s.cache()[site] {
 		all[k] = v
 	}
 
 	return all
 }
 
-// Reload settings from cache if cache has expired
-func (s *CqlSetting) refreshCache() {
-	if s.sites == nil || s.expires.Before(time.Now()) {
-		s.sites = s.load()
-		s.expires = time.Now().Add(time.Duration(CACHE_TIMEOUT) * time.Second)
+// Watch calls fn with the new effective value of a setting whenever it changes,
+// including changes made by other instances, until cancelled.
+func (s *CqlSetting) Watch(site, name string, fn func(value string)) (cancel func()) {
+	s.cache()
+	return s.watchers.add(site, name, fn)
+}
+
+// Return the cached settings, reloading them from the database if the cache has expired
+func (s *CqlSetting) cache() map[string]map[string]string {
+	s.lock.Lock()
+	if s.sites != nil && s.expires.After(time.Now()) {
+		defer s.lock.Unlock()
+		return s.sites
+	}
+	before := s.sites
+	s.sites = s.load()
+	s.expires = time.Now().Add(time.Duration(CACHE_TIMEOUT) * time.Second)
+	after := s.sites
+	s.lock.Unlock()
+
+	if before != nil && after != nil {
+		s.watchers.notify(before, after)
+	}
+	return after
+}
+
+// Expire the cache when another instance changes a setting. The settings are reloaded
+// straight away if they are being watched, otherwise when next needed.
+func (s *CqlSetting) invalidate(e Invalidation) {
+	if e.Kind != InvalidateSetting || e.Origin == s.origin {
+		return
+	}
+	s.lock.Lock()
+	s.expires = time.Time{}
+	s.lock.Unlock()
+	if s.watchers.active() {
+		s.cache()
 	}
 }
 
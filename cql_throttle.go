@@ -0,0 +1,119 @@
+package security
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// CqlThrottle stores throttle counters in the cassandra "throttle" table (see
+// setup.cql). Cassandra counter columns cannot carry a TTL, so the counters are
+// ordinary columns updated with a lightweight transaction, and every write sets
+// a TTL so that rows disappear once they no longer affect throttling.
+type CqlThrottle struct {
+	cql      *gocql.Session
+	settings Setting
+
+	// Policy used for keys not created with ThrottleKey()
+	Window   int64
+	Lockout  int64
+	Attempts int64
+}
+
+// Number of times Increment retries when a concurrent update wins the race
+const cqlThrottleRetries = 10
+
+func NewCqlThrottle(settings Setting, cql *gocql.Session) Throttle {
+	return &CqlThrottle{
+		cql:      cql,
+		settings: settings,
+		Window:   60,
+		Lockout:  60,
+		Attempts: 3, // Default to three attempts per minute, lock for one minute.
+	}
+}
+
+func (t *CqlThrottle) policy(key string) ThrottlePolicy {
+	return ThrottlePolicyForKey(t.settings, key, ThrottlePolicy{
+		Attempts:   t.Attempts,
+		Window:     t.Window,
+		Lockout:    t.Lockout,
+		MaxLockout: t.Lockout * 60,
+	})
+}
+
+func (t *CqlThrottle) IsThrottled(key string) (bool, error) {
+	status, err := t.Status(key)
+	if err != nil {
+		return false, err
+	}
+	return status.Throttled, nil
+}
+
+func (t *CqlThrottle) Status(key string) (*ThrottleStatus, error) {
+	policy := t.policy(key)
+	state, found, err := t.load(key)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return &ThrottleStatus{Remaining: policy.Attempts}, nil
+	}
+	return state.status(policy, time.Now().Unix()), nil
+}
+
+// Flag that a countable throttle event has occurred. The row is only written if it
+// has not changed since it was read, so concurrent calls to Increment are all counted.
+func (t *CqlThrottle) Increment(key string) error {
+	policy := t.policy(key)
+
+	for i := 0; i < cqlThrottleRetries; i++ {
+		state, found, err := t.load(key)
+		if err != nil {
+			return err
+		}
+		previous := state
+
+		now := time.Now().Unix()
+		state.increment(policy, now)
+		ttl := policy.MaxLockout + policy.Window
+		if state.LockedUntil-now > ttl {
+			ttl = state.LockedUntil - now
+		}
+
+		var applied bool
+		if !found {
+			applied, err = t.cql.Query("insert into throttle (name, attempts, updated, locked_until, lockouts) values (?, ?, ?, ?, ?) if not exists using ttl ?",
+				key, state.Attempts, state.Updated, state.LockedUntil, state.Lockouts, ttl).MapScanCAS(map[string]interface{}{})
+		} else {
+			applied, err = t.cql.Query("update throttle using ttl ? set attempts=?, updated=?, locked_until=?, lockouts=? where name=? if attempts=? and updated=?",
+				ttl, state.Attempts, state.Updated, state.LockedUntil, state.Lockouts, key, previous.Attempts, previous.Updated).MapScanCAS(map[string]interface{}{})
+		}
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+	}
+	return errors.New("Throttle update for " + key + " failed, too many concurrent updates")
+}
+
+func (t *CqlThrottle) Clear(key string) error {
+	return t.cql.Query("delete from throttle where name=?", key).Exec()
+}
+
+func (t *CqlThrottle) load(key string) (throttleState, bool, error) {
+	var state throttleState
+	err := t.cql.Query("select attempts, updated, locked_until, lockouts from throttle where name=?", key).
+		Consistency(gocql.Quorum).
+		Scan(&state.Attempts, &state.Updated, &state.LockedUntil, &state.Lockouts)
+	if err == gocql.ErrNotFound {
+		return state, false, nil
+	}
+	if err != nil {
+		return state, false, err
+	}
+	return state, true, nil
+}
@@ -0,0 +1,316 @@
+package security
+
+import (
+	"context"
+	crand "crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ContentSecurityPolicy builds the value of a Content-Security-Policy header.
+// The placeholder 'nonce' in a source list is replaced with the nonce that is
+// generated for each request.
+type ContentSecurityPolicy struct {
+	directives [][]string
+}
+
+// NewContentSecurityPolicy returns a policy that only allows content from the
+// same origin, and inline scripts carrying the request nonce.
+func NewContentSecurityPolicy() *ContentSecurityPolicy {
+	return (&ContentSecurityPolicy{}).
+		Set("default-src", "'self'").
+		Set("script-src", "'self'", "'nonce'").
+		Set("style-src", "'self'", "'unsafe-inline'").
+		Set("img-src", "'self'", "data:").
+		Set("font-src", "'self'", "data:").
+		Set("object-src", "'none'").
+		Set("base-uri", "'self'").
+		Set("form-action", "'self'").
+		Set("frame-ancestors", "'self'")
+}
+
+// Set replaces the sources allowed for a directive, i.e. Set("img-src", "'self'", "https:")
+func (c *ContentSecurityPolicy) Set(directive string, sources ...string) *ContentSecurityPolicy {
+	directive = strings.ToLower(directive)
+	for i, d := range c.directives {
+		if d[0] == directive {
+			c.directives[i] = append([]string{directive}, sources...)
+			return c
+		}
+	}
+	c.directives = append(c.directives, append([]string{directive}, sources...))
+	return c
+}
+
+// Add appends sources to those already allowed for a directive.
+func (c *ContentSecurityPolicy) Add(directive string, sources ...string) *ContentSecurityPolicy {
+	directive = strings.ToLower(directive)
+	for i, d := range c.directives {
+		if d[0] == directive {
+			c.directives[i] = append(d, sources...)
+			return c
+		}
+	}
+	return c.Set(directive, sources...)
+}
+
+// Remove drops a directive from the policy.
+func (c *ContentSecurityPolicy) Remove(directive string) *ContentSecurityPolicy {
+	directive = strings.ToLower(directive)
+	for i, d := range c.directives {
+		if d[0] == directive {
+			c.directives = append(c.directives[:i], c.directives[i+1:]...)
+			break
+		}
+	}
+	return c
+}
+
+// Header returns the policy as a header value, with the nonce and report
+// endpoint filled in.
+func (c *ContentSecurityPolicy) Header(nonce, reportURI string) string {
+	var parts []string
+	for _, d := range c.directives {
+		part := d[0]
+		for _, source := range d[1:] {
+			if source == "'nonce'" {
+				if nonce == "" {
+					continue
+				}
+				source = "'nonce-" + nonce + "'"
+			}
+			part = part + " " + source
+		}
+		parts = append(parts, part)
+	}
+	if reportURI != "" {
+		parts = append(parts, "report-uri "+reportURI)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// SecurityHeaders holds the browser security policy headers sent with each page.
+type SecurityHeaders struct {
+	// CSP is the content security policy. No policy is sent if nil.
+	CSP *ContentSecurityPolicy
+
+	// ReportOnly sends the policy as Content-Security-Policy-Report-Only, so
+	// violations are reported to /csp-report but not blocked.
+	ReportOnly bool
+
+	// ReportViolations adds a report-uri directive pointing at /csp-report.
+	ReportViolations bool
+
+	ReferrerPolicy            string
+	PermissionsPolicy         string
+	CrossOriginOpenerPolicy   string
+	CrossOriginResourcePolicy string
+}
+
+// DefaultSecurityHeaders returns a conservative set of headers. The content
+// security policy starts in report only mode so that violations can be found
+// in the system log before the policy is enforced.
+func DefaultSecurityHeaders() *SecurityHeaders {
+	return &SecurityHeaders{
+		CSP:                     NewContentSecurityPolicy(),
+		ReportOnly:              true,
+		ReportViolations:        true,
+		ReferrerPolicy:          "strict-origin-when-cross-origin",
+		PermissionsPolicy:       "camera=(), microphone=(), geolocation=(), payment=()",
+		CrossOriginOpenerPolicy: "same-origin",
+	}
+}
+
+var siteSecurityHeaders map[string]*SecurityHeaders
+var defaultSecurityHeaders = DefaultSecurityHeaders()
+
+// RegisterDefaultSecurityHeaders sets the headers used by sites that have no
+// headers registered with RegisterSecurityHeaders.
+func RegisterDefaultSecurityHeaders(h *SecurityHeaders) {
+	defaultSecurityHeaders = h
+}
+
+// RegisterSecurityHeaders sets the policy headers used by a particular site.
+func RegisterSecurityHeaders(site string, h *SecurityHeaders) {
+	if siteSecurityHeaders == nil {
+		siteSecurityHeaders = make(map[string]*SecurityHeaders)
+	}
+	siteSecurityHeaders[site] = h
+}
+
+// GetSecurityHeaders returns the policy headers used by a particular site.
+func GetSecurityHeaders(site string) *SecurityHeaders {
+	if h, ok := siteSecurityHeaders[site]; ok {
+		return h
+	}
+	return defaultSecurityHeaders
+}
+
+const nonceContextKey contextKey = "nonce"
+
+// NonceFromContext returns the content security policy nonce generated for
+// this request. Inline scripts in host application templates should carry
+// this value in a nonce attribute.
+func NonceFromContext(ctx context.Context) string {
+	if nonce, ok := ctx.Value(nonceContextKey).(string); ok {
+		return nonce
+	}
+	return ""
+}
+
+// nonceSession carries the request nonce alongside the session, so that
+// templates receiving a Session can use {{nonce .Session}}
+type nonceSession struct {
+	Session
+	nonce string
+}
+
+func (s *nonceSession) Nonce() string {
+	return s.nonce
+}
+
+// Nonce returns the content security policy nonce carried by a session in
+// the request context, or an empty string.
+func Nonce(session Session) string {
+	if s, ok := session.(interface{ Nonce() string }); ok {
+		return s.Nonce()
+	}
+	return ""
+}
+
+// ContentSecurity sends the security policy headers registered for the site,
+// and generates a fresh nonce for each request. The nonce is stored in the
+// request context, and attached to the context session if one is present.
+func ContentSecurity() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := GetSecurityHeaders(HostFromRequest(r))
+			if h == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			b := make([]byte, 18)
+			if _, err := crand.Read(b); err != nil {
+				panic("security: failed reading random data for csp nonce: " + err.Error())
+			}
+			nonce := base64.StdEncoding.EncodeToString(b)
+
+			if h.CSP != nil {
+				reportURI := ""
+				if h.ReportViolations {
+					reportURI = Path("/csp-report")
+				}
+				if h.ReportOnly {
+					w.Header().Set("Content-Security-Policy-Report-Only", h.CSP.Header(nonce, reportURI))
+				} else {
+					w.Header().Set("Content-Security-Policy", h.CSP.Header(nonce, reportURI))
+				}
+			}
+			if h.ReferrerPolicy != "" {
+				w.Header().Set("Referrer-Policy", h.ReferrerPolicy)
+			}
+			if h.PermissionsPolicy != "" {
+				w.Header().Set("Permissions-Policy", h.PermissionsPolicy)
+			}
+			if h.CrossOriginOpenerPolicy != "" {
+				w.Header().Set("Cross-Origin-Opener-Policy", h.CrossOriginOpenerPolicy)
+			}
+			if h.CrossOriginResourcePolicy != "" {
+				w.Header().Set("Cross-Origin-Resource-Policy", h.CrossOriginResourcePolicy)
+			}
+
+			ctx := context.WithValue(r.Context(), nonceContextKey, nonce)
+			if session := SessionFromContext(ctx); session != nil {
+				ctx = ContextWithSession(ctx, &nonceSession{Session: session, nonce: nonce})
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// CSPReportPage receives content security policy violation reports from web
+// browsers and records them in the system log.
+func CSPReportPage(t *template.Template, am AccessManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		session, _ := LookupSession(r, am)
+
+		data, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		type Violation struct {
+			DocumentURI        string `json:"document-uri"`
+			BlockedURI         string `json:"blocked-uri"`
+			ViolatedDirective  string `json:"violated-directive"`
+			EffectiveDirective string `json:"effective-directive"`
+			SourceFile         string `json:"source-file"`
+			LineNumber         int    `json:"line-number"`
+			Disposition        string `json:"disposition"`
+		}
+
+		var violations []Violation
+
+		// Older browsers send a single report using the report-uri format
+		var report struct {
+			Report *Violation `json:"csp-report"`
+		}
+		if err := json.Unmarshal(data, &report); err == nil && report.Report != nil {
+			violations = append(violations, *report.Report)
+		} else {
+			// The Reporting API sends a list of reports with camel case field names
+			var reports []struct {
+				Type string `json:"type"`
+				Body struct {
+					DocumentURL        string `json:"documentURL"`
+					BlockedURL         string `json:"blockedURL"`
+					EffectiveDirective string `json:"effectiveDirective"`
+					SourceFile         string `json:"sourceFile"`
+					LineNumber         int    `json:"lineNumber"`
+					Disposition        string `json:"disposition"`
+				} `json:"body"`
+			}
+			if err := json.Unmarshal(data, &reports); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			for _, r := range reports {
+				if r.Type != "csp-violation" {
+					continue
+				}
+				violations = append(violations, Violation{
+					DocumentURI:        r.Body.DocumentURL,
+					BlockedURI:         r.Body.BlockedURL,
+					EffectiveDirective: r.Body.EffectiveDirective,
+					SourceFile:         r.Body.SourceFile,
+					LineNumber:         r.Body.LineNumber,
+					Disposition:        r.Body.Disposition,
+				})
+			}
+		}
+
+		for i, v := range violations {
+			if i >= 10 {
+				break
+			}
+			directive := v.EffectiveDirective
+			if directive == "" {
+				directive = v.ViolatedDirective
+			}
+			am.Warning(session, `csp`, "Content security policy %s violation on %s. Blocked: %s Directive: %s Source: %s:%d",
+				v.Disposition, v.DocumentURI, v.BlockedURI, directive, v.SourceFile, v.LineNumber)
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,58 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestContentSecurityPolicy(t *testing.T) {
+
+	csp := NewContentSecurityPolicy().
+		Add("img-src", "https://images.example.com").
+		Set("frame-ancestors", "'none'").
+		Remove("form-action")
+
+	header := csp.Header("abc", "/csp-report")
+	for _, part := range []string{
+		"script-src 'self' 'nonce-abc'",
+		"img-src 'self' data: https://images.example.com",
+		"frame-ancestors 'none'",
+		"report-uri /csp-report",
+	} {
+		if !strings.Contains(header, part) {
+			t.Fatalf("ContentSecurityPolicy.Header() should contain %q. Got: %s", part, header)
+		}
+	}
+	if strings.Contains(header, "form-action") {
+		t.Fatalf("ContentSecurityPolicy.Remove() should drop directive. Got: %s", header)
+	}
+
+	// Each request gets its own nonce, which is visible to the handler
+	var nonces []string
+	h := ContentSecurity()(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		nonces = append(nonces, NonceFromContext(r.Context()))
+		if Nonce(SessionFromContext(r.Context())) != NonceFromContext(r.Context()) {
+			t.Fatalf("Nonce() should return the request nonce from the context session")
+		}
+	}))
+	site := RandomString(10) + ".com"
+	RegisterSecurityHeaders(site, &SecurityHeaders{CSP: NewContentSecurityPolicy(), ReferrerPolicy: "no-referrer"})
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "http://"+site+"/", nil)
+		r = r.WithContext(ContextWithSession(r.Context(), &GaeSession{}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !strings.Contains(w.Header().Get("Content-Security-Policy"), "'nonce-"+nonces[i]+"'") {
+			t.Fatalf("ContentSecurity() should send the request nonce in the policy. Got: %s", w.Header().Get("Content-Security-Policy"))
+		}
+		if w.Header().Get("Referrer-Policy") != "no-referrer" {
+			t.Fatalf("ContentSecurity() should send the site Referrer-Policy")
+		}
+	}
+	if nonces[0] == "" || nonces[0] == nonces[1] {
+		t.Fatalf("ContentSecurity() should generate a new nonce for every request")
+	}
+
+}
@@ -0,0 +1,166 @@
+package security
+
+import (
+	crand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// CSRFHeader is the request header that XHR and fetch() clients may use to
+// supply a CSRF token instead of a "csrf" form field.
+const CSRFHeader = "X-CSRF-Token"
+
+// CSRFField is the name of the form field used to submit a CSRF token.
+const CSRFField = "csrf"
+
+// csrfCookie holds the double-submit secret for visitors who are not signed in.
+const csrfCookie = "zx"
+
+var csrfExempt []string
+
+// ExemptFromCSRF excludes all request paths starting with prefix from CSRF
+// checks. This is intended for server to server endpoints such as webhooks.
+func ExemptFromCSRF(prefix string) {
+	csrfExempt = append(csrfExempt, prefix)
+}
+
+// CSRFToken returns a masked copy of the session CSRF secret suitable for
+// inclusion in a form or page. A new random mask is used on every call, so
+// the token differs each time a page is rendered, which defeats compression
+// based attacks such as BREACH.
+func CSRFToken(session Session) string {
+	if session == nil || session.CSRF() == "" {
+		return ""
+	}
+	secret := []byte(session.CSRF())
+	pad := make([]byte, len(secret))
+	if _, err := crand.Read(pad); err != nil {
+		panic("security: failed reading random data for csrf token: " + err.Error())
+	}
+	token := make([]byte, len(secret)*2)
+	copy(token, pad)
+	for i := range secret {
+		token[len(secret)+i] = pad[i] ^ secret[i]
+	}
+	return base64.RawURLEncoding.EncodeToString(token)
+}
+
+// ValidCSRF checks the CSRF token supplied in the X-CSRF-Token header, or the
+// "csrf" form field, matches the CSRF secret of the session. Both masked tokens
+// from CSRFToken() and the raw Session.CSRF() value are accepted.
+func ValidCSRF(r *http.Request, session Session) bool {
+	if session == nil || session.CSRF() == "" {
+		return false
+	}
+	token := r.Header.Get(CSRFHeader)
+	if token == "" {
+		token = r.FormValue(CSRFField)
+	}
+	return csrfMatches(token, session.CSRF())
+}
+
+func csrfMatches(token, secret string) bool {
+	if token == "" || secret == "" {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+		return true
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(raw) != len(secret)*2 {
+		return false
+	}
+	unmasked := make([]byte, len(secret))
+	for i := range unmasked {
+		unmasked[i] = raw[i] ^ raw[len(secret)+i]
+	}
+	return subtle.ConstantTimeCompare(unmasked, []byte(secret)) == 1
+}
+
+// CSRFProtect wraps a http handler and rejects POST, PUT, PATCH and DELETE
+// requests that do not carry a valid CSRF token. Authenticated sessions are
+// checked against the secret stored with the session. Guests are given a
+// random secret in a cookie, which is checked using the double-submit pattern.
+func CSRFProtect(t *template.Template, am AccessManager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ensureCSRFCookie(w, r)
+
+		if csrfSafeMethod(r.Method) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, prefix := range csrfExempt {
+			if strings.HasPrefix(r.URL.Path, prefix) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		session, err := LookupSession(r, am)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if !ValidCSRF(r, session) {
+			am.Warning(session, `security`, "Potential CSRF attack detected: %s %s", r.Method, r.URL.String())
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfSafeMethod reports if requests using a method do not change state, and so
+// need no CSRF token.
+func csrfSafeMethod(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE":
+		return true
+	}
+	return false
+}
+
+// ensureCSRFCookie issues a double-submit secret to visitors that do not yet have
+// one. The cookie is also added to the request so it is visible to LookupSession.
+func ensureCSRFCookie(w http.ResponseWriter, r *http.Request) {
+	c, err := r.Cookie(csrfCookie)
+	if err == nil && len(c.Value) == 32 {
+		return
+	}
+	cookie := &http.Cookie{
+		Name:     csrfCookie,
+		Value:    RandomString(32),
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  time.Now().Add(time.Minute * 60 * 24 * time.Duration(COOKIE_DAYS)),
+		MaxAge:   60 * 60 * 24 * COOKIE_DAYS,
+	}
+	http.SetCookie(w, cookie)
+	if err != nil {
+		r.AddCookie(cookie)
+	}
+}
+
+// guestCSRF gives an unauthenticated session the double-submit secret held in
+// the visitors csrf cookie, so that guest forms such as signin can be protected.
+func guestCSRF(r *http.Request, session Session) Session {
+	if session == nil || session.IsAuthenticated() {
+		return session
+	}
+	c, err := r.Cookie(csrfCookie)
+	if err != nil || len(c.Value) != 32 {
+		return session
+	}
+	switch s := session.(type) {
+	case *GaeSession:
+		s.csrf = c.Value
+	case *CqlSession:
+		s.csrf = c.Value
+	}
+	return session
+}
@@ -0,0 +1,83 @@
+package security
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestCSRFToken(t *testing.T) {
+
+	session := &GaeSession{csrf: RandomString(8), authenticated: true}
+
+	// Masked tokens should differ on each call, but always validate
+	{
+		a := CSRFToken(session)
+		b := CSRFToken(session)
+		if a == b {
+			t.Fatalf("CSRFToken() should return a differently masked token on each call")
+		}
+		if !csrfMatches(a, session.CSRF()) || !csrfMatches(b, session.CSRF()) {
+			t.Fatalf("csrfMatches() should accept tokens returned by CSRFToken()")
+		}
+		if !csrfMatches(session.CSRF(), session.CSRF()) {
+			t.Fatalf("csrfMatches() should accept the raw session csrf value")
+		}
+		other := &GaeSession{csrf: RandomString(8)}
+		if csrfMatches(a, other.CSRF()) {
+			t.Fatalf("csrfMatches() should not accept a token from another session")
+		}
+		if csrfMatches("", session.CSRF()) {
+			t.Fatalf("csrfMatches() should not accept an empty token")
+		}
+	}
+
+	// Token may be supplied as a form field or a header
+	{
+		form := url.Values{}
+		form.Set(CSRFField, CSRFToken(session))
+		r := httptest.NewRequest("POST", "/z/settings", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if !ValidCSRF(r, session) {
+			t.Fatalf("ValidCSRF() should accept token in form field")
+		}
+
+		r = httptest.NewRequest("POST", "/z/api/watch", nil)
+		r.Header.Set(CSRFHeader, CSRFToken(session))
+		if !ValidCSRF(r, session) {
+			t.Fatalf("ValidCSRF() should accept token in %s header", CSRFHeader)
+		}
+
+		r = httptest.NewRequest("POST", "/z/api/watch", nil)
+		if ValidCSRF(r, session) {
+			t.Fatalf("ValidCSRF() should reject a request with no token")
+		}
+	}
+
+	// Only methods that change state need a token
+	{
+		for _, m := range []string{"GET", "HEAD"} {
+			if !csrfSafeMethod(m) {
+				t.Fatalf("csrfSafeMethod(%q) should not require a token", m)
+			}
+		}
+		for _, m := range []string{"POST", "PUT", "PATCH", "DELETE"} {
+			if csrfSafeMethod(m) {
+				t.Fatalf("csrfSafeMethod(%q) should require a token", m)
+			}
+		}
+	}
+
+	// Guest sessions take their secret from the double-submit cookie
+	{
+		guest := &GaeSession{}
+		r := httptest.NewRequest("POST", "/signin", nil)
+		r.Header.Set("Cookie", csrfCookie+"="+RandomString(32))
+		guestCSRF(r, guest)
+		if guest.CSRF() == "" {
+			t.Fatalf("guestCSRF() should set guest session csrf from cookie")
+		}
+	}
+
+}
@@ -360,6 +360,11 @@ func (c *GaeAccessManager) Setting() Setting {
 	return c.setting
 }
 
+// Throttle returns the throttle used to limit signin, signup and password reset attempts.
+func (c *GaeAccessManager) Throttle() Throttle {
+	return c.throttle
+}
+
 func (c *GaeAccessManager) PicklistStore() PicklistStore {
 	return c.picklistStore
 }
@@ -370,6 +375,18 @@ func (a *GaeAccessManager) Signup(site, first_name, last_name, email, password,
 	session := a.GuestSession(site, ip, userAgent, lang)
 	email = strings.ToLower(strings.TrimSpace(email))
 
+	// Failed signups are limited strictly. Successful signups have a separate, higher
+	// limit, so that many people signing up from behind one address are not locked out.
+	signupKey := ThrottleKey(site, ThrottleSignup, ip)
+	successKey := ThrottleKey(site, ThrottleSignupSuccess, ip)
+	for _, key := range []string{signupKey, successKey} {
+		if status, _ := a.throttle.Status(key); status != nil && status.Throttled {
+			a.Notice(session, `auth`, "Signup for '%s' blocked by throttle", email)
+			results = append(results, "Too many signup attempts were detected from your location, please wait "+throttleWait(status)+" and try again.")
+			return &results, "", nil
+		}
+	}
+
 	// Check email does not already exist
 	var items []GaePerson
 	q := datastore.NewQuery("Person").Namespace(site).Filter("Email = ", email).Limit(1)
@@ -385,10 +402,14 @@ func (a *GaeAccessManager) Signup(site, first_name, last_name, email, password,
 		results = append(results, passwordCheck...)
 	}
 
-	if strings.ToLower(a.setting.GetWithDefault(site, "self.signup", "no")) == "no" {
+	if !a.setting.GetBool(site, "self.signup", false) {
 		results = append(results, "Self registration is not allowed at this time.")
 		return &results, "", errors.New(results[0])
 	}
+	if len(results) > 0 {
+		a.throttle.Increment(signupKey)
+		return &results, "", nil
+	}
 
 	ui := &NewUserInfo{
 		Site:      site,
@@ -475,6 +496,7 @@ func (a *GaeAccessManager) Signup(site, first_name, last_name, email, password,
 		return sendResults, token.String(), err
 	}
 
+	a.throttle.Increment(successKey)
 	return nil, token.String(), nil
 }
 
@@ -488,6 +510,14 @@ func (a *GaeAccessManager) ForgotPasswordRequest(site, email, ip, userAgent, lan
 
 	a.Debug(session, `auth`, "ForgotPasswordRequest received for: %s", email)
 
+	forgotKey := ThrottleKey(site, ThrottleForgotPassword, email)
+	if throttled, _ := a.throttle.IsThrottled(forgotKey); throttled {
+		// Respond as normal, so the form does not reveal which addresses exist
+		a.Notice(session, `auth`, "ForgotPasswordRequest for %s blocked by throttle", email)
+		return "", nil
+	}
+	a.throttle.Increment(forgotKey)
+
 	syslog := NewGaeSyslogBundle(site, a.client, a.ctx)
 	defer syslog.Put()
 
@@ -593,9 +623,10 @@ func (g *GaeAccessManager) Authenticate(site, email, password, ip, userAgent, la
 	syslog.Add(`auth`, ip, `debug`, ``, fmt.Sprintf("Authentication attempt for '%s'", email))
 
 	email = strings.ToLower(strings.TrimSpace(email))
-	if throttled, _ := g.throttle.IsThrottled(email); throttled {
+	emailKey := ThrottleKey(site, ThrottleSigninEmail, email)
+	if status, _ := g.throttle.Status(emailKey); status != nil && status.Throttled {
 		syslog.Add(`auth`, ip, `info`, ``, fmt.Sprintf("Authentication for '%s' blocked by throttle", email))
-		return g.GuestSession(site, ip, userAgent, lang), "Repeated signin failures were detected from your location, please wait a few minutes and try again.", nil
+		return g.GuestSession(site, ip, userAgent, lang), "Repeated signin failures were detected from your location, please wait " + throttleWait(status) + " and try again.", nil
 	}
 
 	var items []GaePerson
@@ -607,7 +638,7 @@ func (g *GaeAccessManager) Authenticate(site, email, password, ip, userAgent, la
 	}
 	if len(items) > 0 {
 		if items[0].password == nil || *items[0].password == "" {
-			g.throttle.Increment(email)
+			g.throttle.Increment(emailKey)
 			syslog.Add(`auth`, ip, `warn`, items[0].Uuid(), fmt.Sprintf("Authentication for '%s' blocked. Account has no password.", email))
 			return session, "Invalid email address or password.", nil
 		}
@@ -631,7 +662,7 @@ func (g *GaeAccessManager) Authenticate(site, email, password, ip, userAgent, la
 			}
 
 			if !externallyAuthenticated {
-				g.throttle.Increment(email)
+				g.throttle.Increment(emailKey)
 				syslog.Add(`auth`, ip, `notice`, items[0].Uuid(), fmt.Sprintf("Authentication for '%s' failed. Incorrect password.", email))
 				return g.GuestSession(site, ip, userAgent, lang), "Invalid email address or password.", nil
 			}
@@ -674,15 +705,16 @@ func (g *GaeAccessManager) Authenticate(site, email, password, ip, userAgent, la
 	}
 
 	// User lookup failed
-	if throttled, _ := g.throttle.IsThrottled(ip); throttled {
+	ipKey := ThrottleKey(site, ThrottleSigninIP, ip)
+	if status, _ := g.throttle.Status(ipKey); status != nil && status.Throttled {
 		// An invalid email address was entered. If this occurs too many times, stop reporting
 		// back the normal "Invalid email address or password" message prevent the signin form
 		// revealing to a bot that this email address/password combination is invalid.
 		syslog.Add(`auth`, ip, `debug`, ``, fmt.Sprintf("Authentication for '%s' blocked by throttle", email))
-		return g.GuestSession(site, ip, userAgent, lang), "Repeated signin failures were detected, please wait a few minutes and try again.", nil
+		return g.GuestSession(site, ip, userAgent, lang), "Repeated signin failures were detected, please wait " + throttleWait(status) + " and try again.", nil
 	}
 
-	g.throttle.Increment(ip)
+	g.throttle.Increment(ipKey)
 	syslog.Add(`auth`, ip, `notice`, ``, fmt.Sprintf("Authentication for '%s' failed: Unknown email address.", email))
 	return g.GuestSession(site, ip, userAgent, lang), "Invalid email address or password.", nil
 }
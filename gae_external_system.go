@@ -31,6 +31,9 @@ func (es *GaeExternalSystem) Uuid() string {
 
 func (es *GaeExternalSystem) Describe() string {
 	for _, e := range es.EConfig {
+		if IsSecretConfigKey(e.Key) {
+			continue
+		}
 		val := strings.ToLower(e.Value)
 		if strings.HasPrefix(strings.ToLower(e.Value), "http://") || strings.HasPrefix(strings.ToLower(e.Value), "https://") {
 			u, err := url.Parse(val)
@@ -41,8 +44,10 @@ func (es *GaeExternalSystem) Describe() string {
 			return val
 		}
 	}
-	if len(es.EConfig) > 0 {
-		return es.EConfig[0].Value
+	for _, e := range es.EConfig {
+		if !IsSecretConfigKey(e.Key) {
+			return e.Value
+		}
 	}
 	return es.EType
 }
@@ -51,18 +56,21 @@ func (es *GaeExternalSystem) Config() []KeyValue {
 	return es.EConfig
 }
 
+// GetConfig returns a config setting. Credentials are decrypted, see IsSecretConfigKey().
 func (es *GaeExternalSystem) GetConfig(key string) string {
 	key = Underscorify(key)
 	for _, k := range es.EConfig {
 		if key == Underscorify(k.Key) {
-			return k.Value
+			return decryptConfigValue(k.Key, k.Value)
 		}
 	}
 	return ""
 }
 
+// SetConfig adds, updates, or removes a config setting. Credentials are encrypted, see IsSecretConfigKey().
 func (es *GaeExternalSystem) SetConfig(key, value string) {
 	ukey := Underscorify(key)
+	value = encryptConfigValue(key, value)
 	if value == "" {
 		del := -1
 		for i, k := range es.EConfig {
@@ -76,9 +84,9 @@ func (es *GaeExternalSystem) SetConfig(key, value string) {
 		}
 		return
 	}
-	for _, k := range es.EConfig {
+	for i, k := range es.EConfig {
 		if ukey == Underscorify(k.Key) {
-			k.Value = value
+			es.EConfig[i].Value = value
 			return
 		}
 	}
@@ -228,9 +236,11 @@ func (am *GaeAccessManager) AddExternalSystem(etype string, config []KeyValue, u
 		return nil, err
 	}
 	i := &GaeExternalSystem{
-		EUuid:   uuid.String(),
-		EType:   etype,
-		EConfig: config,
+		EUuid: uuid.String(),
+		EType: etype,
+	}
+	for _, kv := range config {
+		i.EConfig = append(i.EConfig, KeyValue{kv.Key, encryptConfigValue(kv.Key, kv.Value)})
 	}
 
 	k := datastore.NameKey("ExternalSystem", i.Uuid(), nil)
@@ -254,8 +264,31 @@ func (am *GaeAccessManager) DeleteExternalSystem(uuid string, updator Session) e
 	return nil
 }
 
+// UpdateExternalSystem replaces the configuration of an external system. Credentials are
+// encrypted unless they already are.
 func (am *GaeAccessManager) UpdateExternalSystem(uuid string, config []KeyValue, updator Session) error {
-	return errors.New("Unimplemented")
+	if uuid == "" {
+		return errors.New("Invalid UUID")
+	}
+
+	k := datastore.NameKey("ExternalSystem", uuid, nil)
+	k.Namespace = updator.Site()
+
+	i := new(GaeExternalSystem)
+	if err := am.client.Get(am.ctx, k, i); err != nil {
+		return err
+	}
+	i.EConfig = nil
+	for _, kv := range config {
+		i.EConfig = append(i.EConfig, KeyValue{kv.Key, encryptConfigValue(kv.Key, kv.Value)})
+	}
+
+	if _, err := am.client.Put(am.ctx, k, i); err != nil {
+		return err
+	}
+	am.systemCache.Remove(uuid)
+
+	return nil
 }
 
 func SyncExternalSystemId(fieldName string, a, b *[]ExternalSystemId, bulk EntityAuditLogCollection) bool {
@@ -0,0 +1,177 @@
+package security
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// GaeInvalidationBus shares invalidations between App Engine instances through version
+// stamps kept in the datastore. Publishing increments the stamp for a site, and each
+// instance polls the stamps, announcing an invalidation to its subscribers whenever a
+// stamp has changed.
+type GaeInvalidationBus struct {
+	client   *datastore.Client
+	ctx      context.Context
+	interval time.Duration
+
+	lock        sync.Mutex
+	next        int
+	subscribers map[int]func(e Invalidation)
+	seen        map[string]int64
+	stop        chan bool
+}
+
+// CacheVersion is the datastore entity holding the version stamp for a kind of cached
+// data belonging to a site.
+type CacheVersion struct {
+	Kind    string
+	Site    string
+	Name    string
+	Origin  string
+	Version int64
+	Updated time.Time
+}
+
+func NewGaeInvalidationBus(client *datastore.Client, ctx context.Context, interval time.Duration) *GaeInvalidationBus {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+	return &GaeInvalidationBus{
+		client:      client,
+		ctx:         ctx,
+		interval:    interval,
+		subscribers: make(map[int]func(e Invalidation)),
+	}
+}
+
+func (b *GaeInvalidationBus) Publish(e Invalidation) error {
+	key := e.Kind + "|" + e.Site
+	k := datastore.NameKey("CacheVersion", key, nil)
+	var version int64
+	_, err := b.client.RunInTransaction(b.ctx, func(tx *datastore.Transaction) error {
+		var v CacheVersion
+		if err := tx.Get(k, &v); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		v.Kind = e.Kind
+		v.Site = e.Site
+		v.Name = e.Name
+		v.Origin = e.Origin
+		v.Version++
+		v.Updated = time.Now()
+		version = v.Version
+		_, err := tx.Put(k, &v)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// Subscribers in this process are told immediately. The new version is marked as
+	// seen, unless other changes have also been made since the last check.
+	b.lock.Lock()
+	if b.seen != nil && b.seen[key] == version-1 {
+		b.seen[key] = version
+	}
+	b.lock.Unlock()
+	b.deliver(e)
+	return nil
+}
+
+// Subscribe registers a subscriber, and begins polling for changes if not already polling.
+func (b *GaeInvalidationBus) Subscribe(fn func(e Invalidation)) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	if b.stop == nil {
+		b.stop = make(chan bool)
+		go b.poll(b.stop)
+	}
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// Close stops polling for changes.
+func (b *GaeInvalidationBus) Close() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.stop != nil {
+		close(b.stop)
+		b.stop = nil
+	}
+}
+
+func (b *GaeInvalidationBus) poll(stop chan bool) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	for {
+		if err := b.check(); err != nil {
+			fmt.Printf("Failed checking cache versions: %v\n", err)
+		}
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check compares the version stamps with those last seen, and announces each change.
+func (b *GaeInvalidationBus) check() error {
+	var versions []CacheVersion
+	q := datastore.NewQuery("CacheVersion").Limit(5000)
+	if _, err := b.client.GetAll(b.ctx, q, &versions); err != nil {
+		return err
+	}
+
+	b.lock.Lock()
+	first := b.seen == nil
+	if first {
+		b.seen = make(map[string]int64)
+	}
+	var changes []Invalidation
+	for _, v := range versions {
+		key := v.Kind + "|" + v.Site
+		last, found := b.seen[key]
+		b.seen[key] = v.Version
+		if first || v.Version == last {
+			continue
+		}
+		e := Invalidation{Kind: v.Kind, Site: v.Site}
+		if found && v.Version == last+1 {
+			// Only the most recent change is recorded, so the name of the setting is
+			// only known if there has been exactly one change since the last check.
+			e.Name = v.Name
+			e.Origin = v.Origin
+		}
+		changes = append(changes, e)
+	}
+	b.lock.Unlock()
+
+	for _, e := range changes {
+		b.deliver(e)
+	}
+	return nil
+}
+
+func (b *GaeInvalidationBus) deliver(e Invalidation) {
+	b.lock.Lock()
+	subscribers := make([]func(e Invalidation), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	b.lock.Unlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+}
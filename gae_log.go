@@ -322,6 +322,11 @@ func (am *GaeAccessManager) AddEntityChangeLog(ec EntityAuditLogCollection, requ
 		return errors.New("Invalid entity uuid.")
 	}
 
+	return putEntityChangeLog(am.client, am.ctx, requestor.Site(), e)
+}
+
+// putEntityChangeLog stores a change log entry beneath the entity it describes.
+func putEntityChangeLog(client *datastore.Client, ctx context.Context, site string, e *GaeEntityAuditLogCollection) error {
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		return err
@@ -329,11 +334,11 @@ func (am *GaeAccessManager) AddEntityChangeLog(ec EntityAuditLogCollection, requ
 	e.Uuid = uuid.String()
 
 	pkey := datastore.NameKey("EntityChange", e.EntityUuid, nil)
-	pkey.Namespace = requestor.Site()
+	pkey.Namespace = site
 	key := datastore.NameKey("EntityChange", e.Uuid, pkey)
-	key.Namespace = requestor.Site()
+	key.Namespace = site
 
-	if _, err := am.client.Put(am.ctx, key, e); err != nil {
+	if _, err := client.Put(ctx, key, e); err != nil {
 		return err
 	}
 
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -13,8 +14,11 @@ import (
 type GaePicklistStore struct {
 	client    *datastore.Client
 	ctx       context.Context
+	lock      sync.Mutex
 	expires   time.Time
 	picklists map[string]map[string]map[string]PicklistItem //host -> picklist -> values
+	origin    string
+	cancel    func()
 }
 
 func NewGaePicklistStore(projectID string, client *datastore.Client, ctx context.Context) PicklistStore {
@@ -22,10 +26,17 @@ func NewGaePicklistStore(projectID string, client *datastore.Client, ctx context
 	ps := &GaePicklistStore{
 		client: client,
 		ctx:    ctx,
+		origin: RandomString(16),
 	}
+	ps.cancel = localInvalidations.Subscribe(ps.invalidate)
 	return ps
 }
 
+// Close stops the picklist store receiving invalidations.
+func (s *GaePicklistStore) Close() {
+	s.cancel()
+}
+
 type GaePicklistItem struct {
 	Picklist    string
 	Key         string
@@ -60,26 +71,16 @@ func (pi *GaePicklistItem) GetPicklistName() string {
 }
 
 func (s *GaePicklistStore) GetPicklists(site string) (map[string]map[string]PicklistItem, error) {
-	err := s.refreshCache(site)
-	if err != nil {
-		return nil, err
-	}
-
-	return s.picklists[site], nil
+	return s.refreshCache(site)
 }
 
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *GaePicklistStore) GetPicklist(site, picklist string) (map[string]PicklistItem, error) {
-	err := s.refreshCache(site)
+	sitePicklists, err := s.refreshCache(site)
 	if err != nil {
 		return nil, err
 	}
 
-	sitePicklists, exists := s.picklists[site]
-	if !exists {
-		return nil, nil
-	}
-
 	value, exists := sitePicklists[strings.ToLower(picklist)]
 	if exists {
 		return value, nil
@@ -90,16 +91,11 @@ func (s *GaePicklistStore) GetPicklist(site, picklist string) (map[string]Pickli
 
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *GaePicklistStore) GetPicklistOrdered(site, picklist string) ([]PicklistItem, error) {
-	err := s.refreshCache(site)
+	sitePicklists, err := s.refreshCache(site)
 	if err != nil {
 		return nil, err
 	}
 
-	sitePicklists, exists := s.picklists[site]
-	if !exists {
-		return nil, nil
-	}
-
 	if value, exists := sitePicklists[strings.ToLower(picklist)]; exists {
 		results := make([]PicklistItem, 0, len(value))
 		for _, v := range value {
@@ -161,16 +157,8 @@ func (s *GaePicklistStore) DeprecatePicklistItem(site, picklist, key string) err
 		if _, err := s.client.Put(s.ctx, k, &i); err != nil {
 			return err
 		}
-		pl, err := s.GetPicklist(site, picklist)
-		if err != nil {
-			return err
-		}
-
-		value, exists := pl[key]
-		if exists {
-			value.(*GaePicklistItem).Deprecated = true
-			return nil
-		}
+		s.changed(site, picklist)
+		s.cacheItem(site, &i)
 	}
 
 	return nil
@@ -192,16 +180,8 @@ func (s *GaePicklistStore) TogglePicklistItem(site, picklist, key string) error
 	if _, err := s.client.Put(s.ctx, k, &i); err != nil {
 		return err
 	}
-	pl, err := s.GetPicklist(site, picklist)
-	if err != nil {
-		return err
-	}
-
-	value, exists := pl[key]
-	if exists {
-		value.(*GaePicklistItem).Deprecated = i.Deprecated
-		return nil
-	}
+	s.changed(site, picklist)
+	s.cacheItem(site, &i)
 
 	return nil
 }
@@ -224,22 +204,8 @@ func (s *GaePicklistStore) AddPicklistItem(site, picklist, key, value, descripti
 	if _, err := s.client.Put(s.ctx, k, i); err != nil {
 		return err
 	}
-
-	// Get the sites full picklists set
-	if s.picklists == nil {
-		s.picklists = make(map[string]map[string]map[string]PicklistItem)
-	}
-	_, exists := s.picklists[site]
-	if !exists {
-		s.picklists[site] = make(map[string]map[string]PicklistItem)
-	}
-
-	_, exists = s.picklists[site][picklist]
-	if !exists {
-		s.picklists[site][picklist] = make(map[string]PicklistItem)
-	}
-
-	s.picklists[site][picklist][key] = i
+	s.changed(site, picklist)
+	s.cacheItem(site, i)
 
 	return nil
 }
@@ -262,42 +228,80 @@ func (s *GaePicklistStore) AddPicklistItemDeprecated(site, picklist, key, value,
 	if _, err := s.client.Put(s.ctx, k, i); err != nil {
 		return err
 	}
-
-	// Get the sites full picklists set
-	if s.picklists == nil {
-		s.picklists = make(map[string]map[string]map[string]PicklistItem)
-	}
-	_, exists := s.picklists[site]
-	if !exists {
-		s.picklists[site] = make(map[string]map[string]PicklistItem)
-	}
-
-	_, exists = s.picklists[site][picklist]
-	if !exists {
-		s.picklists[site][picklist] = make(map[string]PicklistItem)
-	}
-
-	s.picklists[site][picklist][key] = i
+	s.changed(site, picklist)
+	s.cacheItem(site, i)
 
 	return nil
 }
 
-// Reload settings from cache if cache has expired
-func (s *GaePicklistStore) refreshCache(site string) error {
+// Reload picklists from the database if the cache has expired, returning those of the site.
+// The cached maps are never changed once stored, so they may be read without the lock.
+func (s *GaePicklistStore) refreshCache(site string) (map[string]map[string]PicklistItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if s.picklists == nil || s.picklists[site] == nil || s.expires.Before(time.Now()) {
-		if s.picklists == nil {
-			s.picklists = make(map[string]map[string]map[string]PicklistItem)
-		}
 		s.expires = time.Now().Add(time.Duration(PICKLIST_CACHE_TIMEOUT) * time.Second)
 		rs, err := s.load(site)
 		if err != nil {
 			s.picklists = nil
-			return err
+			return nil, err
 		}
-		s.picklists[site] = rs
+		s.picklists = withSitePicklists(s.picklists, site, rs)
 	}
 
-	return nil
+	return s.picklists[site], nil
+}
+
+// Replace an item in the cached picklists of a site. Sites not yet cached are left to be
+// loaded when next needed.
+func (s *GaePicklistStore) cacheItem(site string, i *GaePicklistItem) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.picklists[site] == nil {
+		return
+	}
+	s.picklists = withPicklistItem(s.picklists, site, i)
+}
+
+// withSitePicklists returns a copy of the cached picklists with those of one site replaced.
+func withSitePicklists(sites map[string]map[string]map[string]PicklistItem, site string, picklists map[string]map[string]PicklistItem) map[string]map[string]map[string]PicklistItem {
+	updated := make(map[string]map[string]map[string]PicklistItem, len(sites)+1)
+	for k, v := range sites {
+		updated[k] = v
+	}
+	updated[site] = picklists
+	return updated
+}
+
+// withPicklistItem returns a copy of the cached picklists with one item added or replaced,
+// copying only the maps on the path to the item.
+func withPicklistItem(sites map[string]map[string]map[string]PicklistItem, site string, i *GaePicklistItem) map[string]map[string]map[string]PicklistItem {
+	sp := make(map[string]map[string]PicklistItem, len(sites[site])+1)
+	for k, v := range sites[site] {
+		sp[k] = v
+	}
+	pl := make(map[string]PicklistItem, len(sp[i.Picklist])+1)
+	for k, v := range sp[i.Picklist] {
+		pl[k] = v
+	}
+	pl[i.Key] = i
+	sp[i.Picklist] = pl
+	return withSitePicklists(sites, site, sp)
+}
+
+// Tell other instances that a picklist has changed
+func (s *GaePicklistStore) changed(site, picklist string) {
+	publishInvalidation(Invalidation{Kind: InvalidatePicklist, Site: site, Name: picklist, Origin: s.origin})
+}
+
+// Discard the cached picklists of a site when another instance changes them
+func (s *GaePicklistStore) invalidate(e Invalidation) {
+	if e.Kind != InvalidatePicklist || e.Origin == s.origin {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.picklists, e.Site)
 }
 
 // Lookup all settings from the database
@@ -213,29 +213,12 @@ func (g *GaeAccessManager) createSession(site, person, firstName, lastName, emai
 		return "", perr
 	}
 
-	// NOTE: If the datastore fails, reading this setting will fail, resulting in an update to a defult seting.
-	expiry := g.setting.GetWithDefault(site, "session.expiry", "")
-	if expiry == "" {
-		expiry = "3600"
-		g.setting.Put(site, `session.expiry`, `3600`)
-	}
-	e, err := strconv.Atoi(expiry)
-	if err != nil {
-		e = 3600
-		// If parsing a valid setting failed, it is not a valid number, reset to default
-		if expiry != "" {
-			g.setting.Put(site, `session.expiry`, `3600`)
-		}
-	}
+	e := g.setting.GetInt(site, "session.expiry", 3600)
 
 	token := RandomString(32)
 	now := time.Now()
 	expires := now.Add(time.Duration(e) * time.Second)
 
-	if err != nil {
-		return "", err
-	}
-
 	session := &GaeSession{
 		site:          site,
 		ip:            ip,
@@ -262,7 +245,7 @@ func (g *GaeAccessManager) createSession(site, person, firstName, lastName, emai
 	//tkn := token[0:len(token)/2] + "..."
 	//g.Log().Debug("Created session \"%s\" for user %v.", tkn, personUuid)
 
-	return token, err
+	return token, nil
 }
 
 // Request the session information associated the site hostname and cookie in the web request
@@ -3,8 +3,8 @@ package security
 import (
 	"context"
 	"fmt"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"cloud.google.com/go/datastore"
@@ -13,10 +13,14 @@ import (
 )
 
 type GaeSetting struct {
-	client  *datastore.Client
-	ctx     context.Context
-	expires time.Time
-	sites   map[string]map[string]string
+	client   *datastore.Client
+	ctx      context.Context
+	lock     sync.Mutex
+	expires  time.Time
+	sites    map[string]map[string]string
+	origin   string
+	watchers settingWatchers
+	cancel   func()
 }
 
 func NewGaeSetting(projectId string) (Setting, *datastore.Client, context.Context) {
@@ -39,15 +43,20 @@ func NewGaeSetting(projectId string) (Setting, *datastore.Client, context.Contex
 	s := &GaeSetting{
 		client: client,
 		ctx:    ctx,
+		origin: RandomString(16),
 	}
+	s.cancel = localInvalidations.Subscribe(s.invalidate)
 	return s, client, ctx
 }
 
+// Close stops the setting store receiving invalidations.
+func (s *GaeSetting) Close() {
+	s.cancel()
+}
+
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *GaeSetting) Get(site, name string) *string {
-	s.refreshCache()
-
-	sm, exists := s.sites[site]
+	sm, exists := s.cache()[site]
 	if !exists {
 		return nil
 	}
@@ -62,63 +71,59 @@ func (s *GaeSetting) Get(site, name string) *string {
 }
 
 func (s *GaeSetting) GetList(site string, key string) []string {
-	content := s.Get(site, key)
-	var fields []string
-	if content != nil && strings.TrimSpace(*content) != "" {
-		fields = strings.Split(strings.TrimSpace(*content), ";")
-	}
-	//TODO: trim space?
-	return fields[:]
+	return settingList(s, site, key)
 }
 
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *GaeSetting) GetWithDefault(site, name string, defaultValue string) string {
-	s.refreshCache()
-
-	sm, exists := s.sites[site]
-	if !exists {
-		return defaultValue
-	}
-
-	value, exists := sm[strings.ToLower(name)]
-
-	if exists {
-		return value
-	}
-
-	return defaultValue
+	return settingValue(s, site, name, defaultValue)
 }
 
 // Lookup a configuration setting. Loads from database only if cache has expired.
 func (s *GaeSetting) GetInt(site, name string, defaultValue int) int {
-	s.refreshCache()
-
-	sm, exists := s.sites[site]
-	if !exists {
-		return defaultValue
-	}
+	return settingInt(s, site, name, defaultValue)
+}
 
-	value, exists := sm[strings.ToLower(name)]
+// Lookup a configuration setting. Loads from database only if cache has expired.
+func (s *GaeSetting) GetBool(site, name string, defaultValue bool) bool {
+	return settingBool(s, site, name, defaultValue)
+}
 
-	if exists {
-		i, err := strconv.Atoi(value)
-		if err != nil {
-			panic(err)
-		}
-		return i
-	}
+// Lookup a configuration setting. Loads from database only if cache has expired.
+func (s *GaeSetting) GetDuration(site, name string, defaultValue time.Duration) time.Duration {
+	return settingDuration(s, site, name, defaultValue)
+}
 
-	return defaultValue
+// Lookup and decrypt a secret configuration setting.
+func (s *GaeSetting) GetSecret(site, name string) (string, error) {
+	return DecryptSecret(settingValue(s, site, name, ""))
 }
 
 // Store a configuration setting. Stores in cache, and flushes through to database.
 func (s *GaeSetting) Put(site, name, value string) error {
+	return s.PutAs(site, name, value, nil)
+}
+
+// Store a configuration setting, and record the change in the entity change log.
+func (s *GaeSetting) PutAs(site, name, value string, updator Session) error {
 	name = strings.ToLower(name)
 
+	if err := ValidateSetting(name, value); err != nil {
+		return err
+	}
+	value, err := encryptSettingValue(name, value)
+	if err != nil {
+		return err
+	}
+
 	oldValue := s.Get(site, name)
 	if oldValue != nil && *oldValue == value {
 		return nil
 	}
+	previous := ""
+	if oldValue != nil {
+		previous = *oldValue
+	}
 
 	type SI struct {
 		Site  string
@@ -131,17 +136,21 @@ func (s *GaeSetting) Put(site, name, value string) error {
 		return err
 	}
 
-	if s.sites == nil {
-		s.sites = make(map[string]map[string]string)
-	}
+	s.lock.Lock()
+	before := s.sites
+	s.sites = withSetting(s.sites, site, name, value)
+	after := s.sites
+	s.lock.Unlock()
 
-	sm, exists := s.sites[site]
-	if !exists {
-		sm = make(map[string]string)
-		s.sites[site] = sm
-	}
+	s.watchers.notify(before, after)
+	publishInvalidation(Invalidation{Kind: InvalidateSetting, Site: site, Name: name, Origin: s.origin})
 
-	s.sites[site][name] = value
+	bulk := newSettingChangeLog(name, previous, value, updator)
+	if item := bulk.Items[0]; item.OldValue != item.NewValue {
+		if err := putEntityChangeLog(s.client, s.ctx, site, bulk); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -149,26 +158,52 @@ func (s *GaeSetting) Put(site, name, value string) error {
 func (s *GaeSetting) List(site string) map[string]string {
 	all := make(map[string]string)
 
-	s.refreshCache()
-
-	if _, exists := s.sites[site]; !exists {
-		return all
-	}
-
 	// Return a copy of the settings map so it can't be altered
 	// by the receiving function
-	for k, v := range s.sites[site] {
+	for k, v := range s.cache()[site] {
 		all[k] = v
 	}
 
 	return all
 }
 
-// Reload settings from cache if cache has expired
-func (s *GaeSetting) refreshCache() {
-	if s.sites == nil || s.expires.Before(time.Now()) {
-		s.sites = s.load()
-		s.expires = time.Now().Add(time.Duration(CACHE_TIMEOUT) * time.Second)
+// Watch calls fn with the new effective value of a setting whenever it changes,
+// including changes made by other instances, until cancelled.
+func (s *GaeSetting) Watch(site, name string, fn func(value string)) (cancel func()) {
+	s.cache()
+	return s.watchers.add(site, name, fn)
+}
+
+// Return the cached settings, reloading them from the database if the cache has expired
+func (s *GaeSetting) cache() map[string]map[string]string {
+	s.lock.Lock()
+	if s.sites != nil && s.expires.After(time.Now()) {
+		defer s.lock.Unlock()
+		return s.sites
+	}
+	before := s.sites
+	s.sites = s.load()
+	s.expires = time.Now().Add(time.Duration(CACHE_TIMEOUT) * time.Second)
+	after := s.sites
+	s.lock.Unlock()
+
+	if before != nil && after != nil {
+		s.watchers.notify(before, after)
+	}
+	return after
+}
+
+// Expire the cache when another instance changes a setting. The settings are reloaded
+// straight away if they are being watched, otherwise when next needed.
+func (s *GaeSetting) invalidate(e Invalidation) {
+	if e.Kind != InvalidateSetting || e.Origin == s.origin {
+		return
+	}
+	s.lock.Lock()
+	s.expires = time.Time{}
+	s.lock.Unlock()
+	if s.watchers.active() {
+		s.cache()
 	}
 }
 
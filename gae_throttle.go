@@ -12,14 +12,17 @@ type GaeThrottle struct {
 	ctx      context.Context
 	settings Setting
 
+	// Policy used for keys not created with ThrottleKey()
 	Window   int64
 	Lockout  int64
 	Attempts int64
 }
 
 type GaeThrottleItem struct {
-	Attempts int64
-	Updated  int64
+	Attempts    int64
+	Updated     int64
+	LockedUntil int64
+	Lockouts    int64
 }
 
 func NewGaeThrottle(settings Setting, client *datastore.Client, ctx context.Context) Throttle {
@@ -34,70 +37,76 @@ func NewGaeThrottle(settings Setting, client *datastore.Client, ctx context.Cont
 	return t
 }
 
+func (t *GaeThrottle) policy(key string) ThrottlePolicy {
+	return ThrottlePolicyForKey(t.settings, key, ThrottlePolicy{
+		Attempts:   t.Attempts,
+		Window:     t.Window,
+		Lockout:    t.Lockout,
+		MaxLockout: t.Lockout * 60,
+	})
+}
+
 func (t *GaeThrottle) IsThrottled(key string) (bool, error) {
+	status, err := t.Status(key)
+	if err != nil {
+		return false, err
+	}
+	return status.Throttled, nil
+}
+
+// Status returns the remaining attempts for a key, and the time a locked key unlocks.
+func (t *GaeThrottle) Status(key string) (*ThrottleStatus, error) {
 	var item GaeThrottleItem
+	policy := t.policy(key)
 
 	k := datastore.NameKey("Throttle", key, nil)
 	err := t.client.Get(t.ctx, k, &item)
-
 	if err == datastore.ErrNoSuchEntity {
-		return false, nil
+		return &ThrottleStatus{Remaining: policy.Attempts}, nil
 	}
 	if err != nil {
-		return false, err
-	}
-
-	if item.Attempts <= t.Attempts {
-		return false, nil
-	}
-	// Max attempts hit
-
-	now := time.Now().Unix()
-
-	if item.Updated+t.Lockout > now {
-		// We are within the lockout period
-		return true, nil
+		return nil, err
 	}
 
-	return false, nil
+	state := item.state(policy)
+	return state.status(policy, time.Now().Unix()), nil
 }
 
 // Flag that a countable throttle event has occurred. For example: Signin failure,
-// password reset request. Note that two concurrent calls to Increment may result
-// in only one countable event being registered.
+// password reset request. The counter is updated within a transaction so concurrent
+// calls to Increment are all counted.
 func (t *GaeThrottle) Increment(key string) error {
-	var item GaeThrottleItem
+	policy := t.policy(key)
 	k := datastore.NameKey("Throttle", key, nil)
-	err := t.client.Get(t.ctx, k, &item)
-
-	now := time.Now().Unix()
 
-	if err != nil && err != datastore.ErrNoSuchEntity {
-		return err
-	}
-	if err == datastore.ErrNoSuchEntity {
-		item.Attempts = 1
-		item.Updated = now
-	} else {
-		if item.Updated < now-t.Window {
-			// Last hit is dated longer than the window period, reset counter
-			item.Attempts = 1
-			item.Updated = now
-		} else {
-			// Last hit is dated within the window period, increment counter
-			item.Attempts = item.Attempts + 1
-			item.Updated = now
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		var item GaeThrottleItem
+		err := tx.Get(k, &item)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
 		}
-	}
 
-	if _, err := t.client.Put(t.ctx, k, &item); err != nil {
-		return err
-	}
+		state := item.state(policy)
+		state.increment(policy, time.Now().Unix())
+		item = GaeThrottleItem(state)
 
-	return nil
+		_, err = tx.Put(k, &item)
+		return err
+	})
+	return err
 }
 
 func (t *GaeThrottle) Clear(key string) error {
 	k := datastore.NameKey("Throttle", key, nil)
 	return t.client.Delete(t.ctx, k)
 }
+
+// state converts a stored item to throttle state. Items written before lockouts were
+// recorded are treated as locked for one lockout period after the last attempt.
+func (i GaeThrottleItem) state(policy ThrottlePolicy) throttleState {
+	s := throttleState(i)
+	if s.LockedUntil == 0 && s.Attempts > policy.Attempts {
+		s.LockedUntil = s.Updated + policy.Lockout
+	}
+	return s
+}
@@ -1,8 +1,11 @@
 package security
 
 import (
+	"bytes"
 	"context"
 	"errors"
+	"io"
+	"sort"
 	"strings"
 	"time"
 
@@ -30,8 +33,16 @@ type GaeTicket struct {
 	watchedBy     []TicketViewer
 	userAgent     string
 	responseCount int64
+	responseTerms []string // Search terms found in responses to the ticket
 	created       *time.Time
 	actionAfter   *time.Time
+	firstResponse *time.Time
+	resolved      *time.Time
+	escalations   []TicketEscalation
+	attachments   []TicketAttachment
+	updated       *time.Time
+	links         []TicketLink
+	mergedInto    *TicketLink
 }
 
 func (t *GaeTicket) ParentType() string {
@@ -110,6 +121,39 @@ func (t *GaeTicket) ActionAfter() *time.Time {
 	return t.actionAfter
 }
 
+func (t *GaeTicket) FirstResponse() *time.Time {
+	return t.firstResponse
+}
+
+func (t *GaeTicket) Resolved() *time.Time {
+	return t.resolved
+}
+
+// Updated is when the ticket was last changed. Tickets saved before changes were recorded
+// return their creation time.
+func (t *GaeTicket) Updated() *time.Time {
+	if t.updated == nil {
+		return t.created
+	}
+	return t.updated
+}
+
+func (t *GaeTicket) Attachments() []TicketAttachment {
+	return t.attachments
+}
+
+func (t *GaeTicket) Links() []TicketLink {
+	return t.links
+}
+
+func (t *GaeTicket) MergedInto() *TicketLink {
+	return t.mergedInto
+}
+
+func (t *GaeTicket) Escalations() []TicketEscalation {
+	return t.escalations
+}
+
 // Information about a support ticket
 type GaeTicketResponse struct {
 	uuid              string
@@ -119,9 +163,11 @@ type GaeTicketResponse struct {
 	personDisplayName string
 	subject           string
 	message           string
+	internal          bool
 	ip                string
 	userAgent         string
 	created           *time.Time
+	attachments       []TicketAttachment
 }
 
 func (r *GaeTicketResponse) Uuid() string {
@@ -152,6 +198,10 @@ func (r *GaeTicketResponse) Message() string {
 	return r.message
 }
 
+func (r *GaeTicketResponse) Internal() bool {
+	return r.internal
+}
+
 func (r *GaeTicketResponse) IP() string {
 	return r.ip
 }
@@ -164,6 +214,10 @@ func (r *GaeTicketResponse) Created() *time.Time {
 	return r.created
 }
 
+func (r *GaeTicketResponse) Attachments() []TicketAttachment {
+	return r.attachments
+}
+
 func NewGaeTicketManager(client *datastore.Client, ctx context.Context, am AccessManager) *GaeTicketManager {
 	s := &GaeTicketManager{
 		client: client,
@@ -174,9 +228,22 @@ func NewGaeTicketManager(client *datastore.Client, ctx context.Context, am Acces
 }
 
 type GaeTicketManager struct {
-	client *datastore.Client
-	ctx    context.Context
-	am     AccessManager
+	client    *datastore.Client
+	ctx       context.Context
+	am        AccessManager
+	blobStore BlobStore
+	scanner   AttachmentScanner
+}
+
+// SetBlobStore sets where attachment content is kept. Files can not be attached to
+// tickets until a store is set.
+func (t *GaeTicketManager) SetBlobStore(store BlobStore) {
+	t.blobStore = store
+}
+
+// SetAttachmentScanner sets a check, such as a virus scan, made on each file before it is attached.
+func (t *GaeTicketManager) SetAttachmentScanner(scanner AttachmentScanner) {
+	t.scanner = scanner
 }
 
 // GetTicket looks up a parentless ticket by ticked uuid
@@ -191,6 +258,9 @@ func (t *GaeTicketManager) GetTicket(uuid string, session Session) (Ticket, erro
 	} else if err != nil {
 		return nil, err
 	}
+	if !canViewTicket(session, &ticket) {
+		return nil, ErrTicketPermissionDenied
+	}
 
 	return &ticket, nil
 }
@@ -210,12 +280,34 @@ func (t *GaeTicketManager) GetTicketWithParent(parentType, parentUuid, uuid stri
 	} else if err != nil {
 		return nil, err
 	}
+	if !canViewTicket(session, &ticket) {
+		return nil, ErrTicketPermissionDenied
+	}
 
 	return &ticket, nil
 }
 
+// FindTicket looks up a ticket by uuid, whether or not it has a parent object
+func (t *GaeTicketManager) FindTicket(uuid string, session Session) (Ticket, error) {
+	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("UUID =", uuid).Limit(1)
+	tickets, err := t.getTickets(q)
+	if err != nil {
+		return nil, err
+	}
+	if len(tickets) == 0 {
+		return nil, nil
+	}
+	if !canViewTicket(session, tickets[0]) {
+		return nil, ErrTicketPermissionDenied
+	}
+	return tickets[0], nil
+}
+
 // GetTicketsByStatus returns all tickets with this status. For example: list all open tickets in the system.
 func (t *GaeTicketManager) GetTicketsByStatus(status TicketStatus, session Session) ([]Ticket, error) {
+	if !isTicketSupport(session) {
+		return nil, ErrTicketPermissionDenied
+	}
 	var tickets []Ticket
 
 	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("Status =", string(status)).Order("-Created").Limit(200)
@@ -249,14 +341,14 @@ func (t *GaeTicketManager) GetTicketsByEmail(email string, session Session) ([]T
 		tickets = append(tickets, e)
 	}
 
-	return tickets[:], nil
+	return visibleTickets(session, tickets), nil
 }
 
 // GetTicketsByPersonUuid returns all tickets created by a specific person
 func (t *GaeTicketManager) GetTicketsByPersonUuid(personUuid string, session Session) ([]Ticket, error) {
 	var tickets []Ticket
 
-	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("PersonUuid =", personUuid).Order("-Created").Limit(200)
+	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("PersonUUID =", personUuid).Order("-Created").Limit(200)
 	it := t.client.Run(t.ctx, q)
 	for {
 		e := new(GaeTicket)
@@ -268,7 +360,7 @@ func (t *GaeTicketManager) GetTicketsByPersonUuid(personUuid string, session Ses
 		tickets = append(tickets, e)
 	}
 
-	return tickets, nil
+	return visibleTickets(session, tickets), nil
 }
 
 // GetTicketsByParentUuid returns all ticket
@@ -290,7 +382,7 @@ func (t *GaeTicketManager) GetTicketsByParentRecord(parentType, parentUuid strin
 		tickets = append(tickets, e)
 	}
 
-	return tickets, nil
+	return visibleTickets(session, tickets), nil
 }
 func (t *GaeTicketManager) GetTicketsByStatusParentRecord(status TicketStatus, parentType, parentUuid string, session Session) ([]Ticket, error) {
 	var tickets []Ticket
@@ -310,32 +402,430 @@ func (t *GaeTicketManager) GetTicketsByStatusParentRecord(status TicketStatus, p
 		tickets = append(tickets, e)
 	}
 
+	return visibleTickets(session, tickets), nil
+}
+
+// GetTicketsByAssignee returns the tickets assigned to a person
+func (t *GaeTicketManager) GetTicketsByAssignee(personUuid string, session Session) ([]Ticket, error) {
+	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("AssignedTo =", personUuid).Order("-Created").Limit(200)
+	tickets, err := t.getTickets(q)
+	if err != nil {
+		return nil, err
+	}
+	return visibleTickets(session, tickets), nil
+}
+
+// GetTicketsByTag returns the tickets with a tag
+func (t *GaeTicketManager) GetTicketsByTag(tag string, session Session) ([]Ticket, error) {
+	if !isTicketSupport(session) {
+		return nil, ErrTicketPermissionDenied
+	}
+	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("TagKeys =", strings.ToLower(strings.TrimSpace(tag))).Order("-Created").Limit(200)
+	return t.getTickets(q)
+}
+
+// GetTicketsByType returns the tickets of a type
+func (t *GaeTicketManager) GetTicketsByType(ticketType TicketType, session Session) ([]Ticket, error) {
+	if !isTicketSupport(session) {
+		return nil, ErrTicketPermissionDenied
+	}
+	q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("Type =", string(ticketType)).Order("-Created").Limit(200)
+	return t.getTickets(q)
+}
+
+// GetTicketsByActionAfter returns open tickets whose ActionAfter time is before a time, earliest first
+func (t *GaeTicketManager) GetTicketsByActionAfter(before time.Time, session Session) ([]Ticket, error) {
+	if !isTicketSupport(session) {
+		return nil, ErrTicketPermissionDenied
+	}
+	workflow, err := t.workflow(session.Site())
+	if err != nil {
+		return nil, err
+	}
+
+	var tickets []Ticket
+	for _, status := range workflow.OpenStatuses() {
+		q := datastore.NewQuery("Ticket").Namespace(session.Site()).Filter("Status =", string(status)).Filter("ActionAfter <=", before).Order("ActionAfter").Limit(200)
+		found, err := t.getTickets(q)
+		if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, found...)
+	}
+	sort.SliceStable(tickets, func(i, j int) bool {
+		return tickets[i].ActionAfter().Before(*tickets[j].ActionAfter())
+	})
+	return tickets, nil
+}
+
+// checkTicketAccess returns ErrTicketPermissionDenied if a session may not see a ticket
+func (t *GaeTicketManager) checkTicketAccess(k *datastore.Key, session Session) error {
+	if isTicketSupport(session) {
+		return nil
+	}
+	var ticket GaeTicket
+	if err := t.client.Get(t.ctx, k, &ticket); err != nil {
+		return err
+	}
+	if !canViewTicket(session, &ticket) {
+		return ErrTicketPermissionDenied
+	}
+	return nil
+}
+
+// QueryTickets returns a page of the tickets matching every field set in a filter, newest
+// first, and a cursor for the next page. People other than support desk staff must filter
+// by themselves or a parent record, and only see the tickets visible to them.
+func (t *GaeTicketManager) QueryTickets(filter TicketFilter, cursor string, limit int, session Session) ([]Ticket, string, error) {
+	if !isTicketSupport(session) && !isPersonalTicketFilter(filter, session) {
+		return nil, "", ErrTicketPermissionDenied
+	}
+	q, err := ticketFilterQuery(filter, session.Site())
+	if err != nil {
+		return nil, "", err
+	}
+	if limit <= 0 {
+		limit = 50
+	} else if limit > 500 {
+		limit = 500
+	}
+	if cursor != "" {
+		c, err := datastore.DecodeCursor(cursor)
+		if err != nil {
+			return nil, "", errors.New("Invalid ticket cursor.")
+		}
+		q = q.Start(c)
+	}
+
+	// One more ticket than asked for is read, to learn if there is a next page. Tickets the
+	// session may not see are skipped, and more are read until the page is full.
+	if isTicketSupport(session) {
+		q = q.Limit(limit + 1)
+	}
+	var tickets []Ticket
+	var end datastore.Cursor
+	next := ""
+	it := t.client.Run(t.ctx, q)
+	for {
+		e := new(GaeTicket)
+		if _, err := it.Next(e); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, "", err
+		}
+		if !canViewTicket(session, e) {
+			continue
+		}
+		if len(tickets) == limit {
+			next = end.String()
+			break
+		}
+		tickets = append(tickets, e)
+		if len(tickets) == limit {
+			if end, err = it.Cursor(); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	return tickets, next, nil
+}
+
+// ticketFilterQuery builds the query for a filter. Equality filters are combined by the
+// datastore using the indexes of each property with Created, or Updated, in index.yaml.
+func ticketFilterQuery(f TicketFilter, site string) (*datastore.Query, error) {
+	q := datastore.NewQuery("Ticket").Namespace(site)
+	if (f.ParentType == "") != (f.ParentUuid == "") {
+		return nil, errors.New("Tickets must be filtered by both the type and uuid of a parent record.")
+	}
+	if f.ParentType != "" {
+		pk := datastore.NameKey(f.ParentType, f.ParentUuid, nil)
+		pk.Namespace = site
+		q = q.Ancestor(pk)
+	}
+	if f.Status != "" {
+		q = q.Filter("Status =", string(f.Status))
+	}
+	if f.Type != "" {
+		q = q.Filter("Type =", string(f.Type))
+	}
+	if tag := strings.ToLower(strings.TrimSpace(f.Tag)); tag != "" {
+		q = q.Filter("TagKeys =", tag)
+	}
+	if f.AssignedTo != "" {
+		q = q.Filter("AssignedTo =", f.AssignedTo)
+	}
+	if f.PersonUuid != "" {
+		q = q.Filter("PersonUUID =", f.PersonUuid)
+	}
+	if f.Email != "" {
+		q = q.Filter("Email =", f.Email)
+	}
+
+	// The datastore allows a range on only one property, which must also order the results.
+	// Tickets saved before their updated time was recorded are only found by created time.
+	order, after, before := "Created", f.CreatedAfter, f.CreatedBefore
+	if f.UpdatedAfter != nil || f.UpdatedBefore != nil {
+		if after != nil || before != nil {
+			return nil, errors.New("Tickets can not be filtered by both their created and updated times.")
+		}
+		order, after, before = "Updated", f.UpdatedAfter, f.UpdatedBefore
+	}
+	if after != nil {
+		q = q.Filter(order+" >=", *after)
+	}
+	if before != nil {
+		q = q.Filter(order+" <", *before)
+	}
+	return q.Order("-" + order), nil
+}
+
+func (t *GaeTicketManager) workflow(site string) (*TicketWorkflow, error) {
+	return GetTicketWorkflow(t.am.Setting(), t.am.PicklistStore(), site)
+}
+
+func (t *GaeTicketManager) getTickets(q *datastore.Query) ([]Ticket, error) {
+	var tickets []Ticket
+
+	it := t.client.Run(t.ctx, q)
+	for {
+		e := new(GaeTicket)
+		if _, err := it.Next(e); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		tickets = append(tickets, e)
+	}
+
 	return tickets, nil
 }
 
-func (t *GaeTicketManager) GetTicketResponses(uuid string) ([]TicketResponse, error) {
+// GetTicketResponses returns the responses to a parentless ticket, oldest first
+func (t *GaeTicketManager) GetTicketResponses(uuid string, session Session) ([]TicketResponse, error) {
+	return t.GetParentedTicketResponses("", "", uuid, session)
+}
+
+// GetParentedTicketResponses returns the responses to a ticket with a specific parent object, oldest first
+func (t *GaeTicketManager) GetParentedTicketResponses(parentType, parentUuid, uuid string, session Session) ([]TicketResponse, error) {
+	var pk *datastore.Key = nil
+	if parentType != "" && parentUuid != "" {
+		pk = datastore.NameKey(parentType, parentUuid, nil)
+		pk.Namespace = session.Site()
+	}
+	k := datastore.NameKey("Ticket", uuid, pk)
+	k.Namespace = session.Site()
+
+	if err := t.checkTicketAccess(k, session); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
 	var responses []TicketResponse
+	q := datastore.NewQuery("TicketResponse").Namespace(session.Site()).Ancestor(k).Limit(1000)
+	it := t.client.Run(t.ctx, q)
+	for {
+		e := new(GaeTicketResponse)
+		if _, err := it.Next(e); err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		responses = append(responses, e)
+	}
+
+	sort.SliceStable(responses, func(i, j int) bool {
+		ci, cj := responses[i].Created(), responses[j].Created()
+		if ci == nil || cj == nil {
+			return ci == nil && cj != nil
+		}
+		return ci.Before(*cj)
+	})
 
-	return responses, nil
+	return visibleTicketResponses(session, responses), nil
 }
 
+// SearchTickets returns the first page of tickets matching every keyword, best matches first
 func (t *GaeTicketManager) SearchTickets(keyword string, session Session) ([]Ticket, error) {
+	tickets, _, err := t.SearchTicketsPage(keyword, 0, 50, session)
+	return tickets, err
+}
+
+// SearchTicketsPage returns a page of tickets matching every keyword, best matches first, and
+// the total number of matching tickets. Keywords are matched against the subject, message,
+// tags, requester name and email, and responses of each ticket.
+func (t *GaeTicketManager) SearchTicketsPage(keyword string, offset, limit int, session Session) ([]Ticket, int, error) {
+	if !isTicketSupport(session) {
+		return nil, 0, ErrTicketPermissionDenied
+	}
+	terms := SearchTerms(keyword)
+	if len(terms) == 0 {
+		return []Ticket{}, 0, nil
+	}
+
+	// Every matching ticket is read, one batch at a time, so that all of them are ranked
+	// and counted before the page is taken.
+	q := datastore.NewQuery("Ticket").Namespace(session.Site())
+	for _, term := range terms {
+		q = q.Filter("SearchTags =", term)
+	}
+
 	var tickets []Ticket
+	scores := make(map[string]int)
+	var cursor *datastore.Cursor
+	for {
+		bq := q.Limit(500)
+		if cursor != nil {
+			bq = bq.Start(*cursor)
+		}
+		count := 0
+		it := t.client.Run(t.ctx, bq)
+		for {
+			e := new(GaeTicket)
+			if _, err := it.Next(e); err == iterator.Done {
+				break
+			} else if err != nil {
+				return nil, 0, err
+			}
+			count++
+			if score := ticketSearchScore(e, e.responseTerms, terms); score > 0 {
+				scores[e.uuid] = score
+				tickets = append(tickets, e)
+			}
+		}
+		if count < 500 {
+			break
+		}
+		next, err := it.Cursor()
+		if err != nil {
+			return nil, 0, err
+		}
+		cursor = &next
+	}
+	rankTickets(tickets, scores)
 
-	return tickets, nil
+	total := len(tickets)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > total {
+		offset = total
+	}
+	if limit <= 0 || offset+limit > total {
+		limit = total - offset
+	}
+	return tickets[offset : offset+limit], total, nil
+}
+
+// ReindexTickets rebuilds the search terms of every ticket of a site from the ticket and
+// its responses, returning the number of tickets indexed. Tickets raised before search
+// was added have no search terms until they are reindexed.
+func (t *GaeTicketManager) ReindexTickets(session Session) (int, error) {
+	if !isTicketSupport(session) {
+		return 0, ErrTicketPermissionDenied
+	}
+
+	count := 0
+	var cursor *datastore.Cursor
+	for {
+		q := datastore.NewQuery("Ticket").Namespace(session.Site()).KeysOnly().Limit(100)
+		if cursor != nil {
+			q = q.Start(*cursor)
+		}
+		var keys []*datastore.Key
+		it := t.client.Run(t.ctx, q)
+		for {
+			k, err := it.Next(nil)
+			if err == iterator.Done {
+				break
+			} else if err != nil {
+				return count, err
+			}
+			keys = append(keys, k)
+		}
+		for _, k := range keys {
+			if err := t.reindexTicket(k); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if len(keys) < 100 {
+			return count, nil
+		}
+		next, err := it.Cursor()
+		if err != nil {
+			return count, err
+		}
+		cursor = &next
+	}
+}
+
+// reindexTicket collects the search terms of the responses to a ticket, and saves the
+// ticket so that its search tags are rebuilt.
+func (t *GaeTicketManager) reindexTicket(k *datastore.Key) error {
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		var ticket GaeTicket
+		if err := tx.Get(k, &ticket); err != nil {
+			return err
+		}
+		var responses []*GaeTicketResponse
+		q := datastore.NewQuery("TicketResponse").Namespace(k.Namespace).Ancestor(k).Transaction(tx).Limit(1000)
+		if _, err := t.client.GetAll(t.ctx, q, &responses); err != nil {
+			return err
+		}
+		ticket.responseTerms = nil
+		for _, r := range responses {
+			if !r.internal {
+				ticket.responseTerms = append(ticket.responseTerms, SearchTerms(r.subject, r.message)...)
+			}
+		}
+		_, err := tx.Put(k, &ticket)
+		return err
+	})
+	return err
 }
 
 func (t *GaeTicketManager) AddTicket(status TicketStatus, ticketType TicketType, personUuid, firstName, lastName, email, subject, message string, actionAfter *time.Time, tags []string, assignedTo, watchedBy []TicketViewer, session Session) (Ticket, error) {
 	return t.AddTicketWithParent("", "", status, ticketType, personUuid, firstName, lastName, email, subject, message, actionAfter, tags, assignedTo, watchedBy, session)
 }
 
+// AddTicketWithParent raises a ticket. Anyone may raise a ticket for themselves, but only
+// support desk staff may raise one for someone else, assign it, add other watchers, choose
+// its status or set its ActionAfter time.
 func (t *GaeTicketManager) AddTicketWithParent(parentType, parentUuid string, status TicketStatus, ticketType TicketType, personUuid, firstName, lastName, email, subject, message string, actionAfter *time.Time, tags []string, assignedTo, watchedBy []TicketViewer, session Session) (Ticket, error) {
 	var ticket GaeTicket
 
+	if !isTicketSupport(session) && ((personUuid != "" && personUuid != session.PersonUuid()) || len(assignedTo) > 0 || actionAfter != nil) {
+		return nil, ErrTicketPermissionDenied
+	}
+	// Watchers see the ticket and are sent its notifications, so people other than support
+	// desk staff may only add themselves
+	if !isTicketSupport(session) {
+		for _, w := range watchedBy {
+			if session.PersonUuid() == "" || w.Uuid != session.PersonUuid() {
+				return nil, ErrTicketPermissionDenied
+			}
+		}
+	}
+
 	uuid, err := uuid.NewUUID()
 	if err != nil {
 		return nil, err
 	}
+	workflow, err := t.workflow(session.Site())
+	if err != nil {
+		return nil, err
+	}
+	// Only support desk staff may raise a ticket in a status other than the first
+	if !isTicketSupport(session) {
+		status = workflow.DefaultStatus()
+	}
+	if !workflow.ValidStatus(status) {
+		return nil, ErrInvalidTicketStatus
+	}
+	if !workflow.definesType(ticketType) {
+		return nil, ErrInvalidTicketType
+	}
 	now := time.Now()
 
 	ticket.uuid = uuid.String()
@@ -354,6 +844,10 @@ func (t *GaeTicketManager) AddTicketWithParent(parentType, parentUuid string, st
 	ticket.ip = session.IP()
 	ticket.userAgent = session.UserAgent()
 	ticket.created = &now
+	ticket.updated = &now
+	if !workflow.IsOpen(status) {
+		ticket.resolved = &now
+	}
 
 	var pk *datastore.Key = nil
 	if parentType != "" && parentUuid != "" {
@@ -368,6 +862,8 @@ func (t *GaeTicketManager) AddTicketWithParent(parentType, parentUuid string, st
 		return nil, err
 	}
 
+	queueTicketNotification(t.am, TicketCreatedEvent, &ticket, "", nil, session)
+
 	err = t.am.TriggerNotificationEvent(session.Site()+"."+string(ticketType), session)
 	if err != nil {
 		//TODO: What should we do here?
@@ -384,13 +880,58 @@ func (t *GaeTicketManager) AddTicketResponse(ticketUuid string, status TicketSta
 
 // AddTicketResponse adds a child record to the datastore containing a response. The status of the parent ticket will be updated if required. Subject and Message fields are optional.
 func (t *GaeTicketManager) AddParentedTicketResponse(recordType string, recordUuid string, ticketUuid string, status TicketStatus, subject, message string, session Session) error {
+	return t.addTicketResponse(recordType, recordUuid, ticketUuid, status, subject, message, false, nil, session)
+}
+
+// AddParentedTicketResponseWithAttachments adds a response, or with internal set a note, with files attached to it.
+func (t *GaeTicketManager) AddParentedTicketResponseWithAttachments(recordType, recordUuid, ticketUuid string, status TicketStatus, subject, message string, internal bool, files []TicketFile, session Session) error {
+	if internal && strings.TrimSpace(message) == "" && len(files) == 0 {
+		return errors.New("Please enter a note.")
+	}
+	return t.addTicketResponse(recordType, recordUuid, ticketUuid, status, subject, message, internal, files, session)
+}
+
+// AddTicketNote adds an internal note to a ticket, seen only by staff. The ticket status is unchanged.
+func (t *GaeTicketManager) AddTicketNote(ticketUuid, message string, session Session) error {
+	return t.AddParentedTicketNote("", "", ticketUuid, message, session)
+}
+
+// AddParentedTicketNote adds an internal note to a ticket with a specific parent object.
+func (t *GaeTicketManager) AddParentedTicketNote(recordType, recordUuid, ticketUuid, message string, session Session) error {
+	if strings.TrimSpace(message) == "" {
+		return errors.New("Please enter a note.")
+	}
+	return t.addTicketResponse(recordType, recordUuid, ticketUuid, "", "", message, true, nil, session)
+}
+
+func (t *GaeTicketManager) addTicketResponse(recordType string, recordUuid string, ticketUuid string, status TicketStatus, subject, message string, internal bool, files []TicketFile, session Session) error {
 	if session == nil {
 		return errors.New("Session variable must be specified")
 	}
+	if internal && !isTicketSupport(session) {
+		return ErrTicketPermissionDenied
+	}
+	if len(files) > 0 {
+		if err := t.checkTicketAccess(ticketKey(recordType, recordUuid, ticketUuid, session), session); err != nil {
+			return err
+		}
+	}
+
+	// Files are stored first, and removed again if the response can not be saved
+	attachments, err := t.storeTicketFiles(ticketUuid, files, session)
+	if err != nil {
+		return err
+	}
 
 	now := time.Now()
 	uuid, err := uuid.NewUUID()
 	if err != nil {
+		t.deleteTicketFiles(ticketUuid, attachments, session)
+		return err
+	}
+	workflow, err := t.workflow(session.Site())
+	if err != nil {
+		t.deleteTicketFiles(ticketUuid, attachments, session)
 		return err
 	}
 
@@ -405,9 +946,10 @@ func (t *GaeTicketManager) AddParentedTicketResponse(recordType string, recordUu
 	}
 
 	// Ticket is fetched to check if the ticket status has been changed, and to update the response counter
+	var ticket GaeTicket
+	event := TicketEvent("")
 	_, err = t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
-
-		var ticket GaeTicket
+		event = ""
 		err = tx.Get(pk, &ticket)
 		if err == datastore.ErrNoSuchEntity {
 			return err
@@ -415,14 +957,53 @@ func (t *GaeTicketManager) AddParentedTicketResponse(recordType string, recordUu
 			return err
 		}
 
-		if ticket.status == status && message == "" && subject == "" {
+		// People other than support desk staff may reply, and reopen a ticket, but not
+		// otherwise change its status
+		if !canViewTicket(session, &ticket) {
+			return ErrTicketPermissionDenied
+		}
+		if !isTicketSupport(session) && status != ticket.status && status != workflow.DefaultStatus() {
+			return ErrTicketPermissionDenied
+		}
+
+		if internal {
+			status = ticket.status
+		}
+		if isTicketSupport(session) && !workflow.CanChange(ticket.status, status) {
+			return ErrTicketStatusChange
+		}
+		if ticket.status == status && message == "" && subject == "" && len(attachments) == 0 {
 			// There is literally nothing to save
 			return nil
 		}
 
+		switch {
+		case internal:
+			event = TicketNoteEvent
+		case message != "" || subject != "" || len(attachments) > 0:
+			event = TicketReplyEvent
+		default:
+			event = TicketStatusEvent
+		}
+
+		// The first reply from someone other than the requester, and when the ticket was
+		// closed, are kept for measuring the ticket against its SLA targets
+		if event == TicketReplyEvent && ticket.firstResponse == nil && isTicketResponder(&ticket, session) {
+			ticket.firstResponse = &now
+		}
+		if workflow.IsOpen(status) {
+			ticket.resolved = nil
+		} else if workflow.IsOpen(ticket.status) || ticket.resolved == nil {
+			ticket.resolved = &now
+		}
+
 		// If ticket status has changed, parent must be updated
 		ticket.status = status
 		ticket.responseCount = ticket.responseCount + 1
+		ticket.updated = &now
+		if !internal {
+			ticket.responseTerms = append(ticket.responseTerms, SearchTerms(subject, message)...)
+		}
 		if _, err := tx.Put(pk, &ticket); err != nil {
 			return err
 		}
@@ -434,8 +1015,12 @@ func (t *GaeTicketManager) AddParentedTicketResponse(recordType string, recordUu
 		response.uuid = uuid.String()
 		response.ticketUuid = ticket.uuid
 		response.status = status
+		response.personUuid = session.PersonUuid()
+		response.personDisplayName = session.DisplayName()
 		response.subject = subject
 		response.message = message
+		response.internal = internal
+		response.attachments = attachments
 		response.created = &now
 		response.userAgent = session.UserAgent()
 		response.ip = session.IP()
@@ -443,22 +1028,381 @@ func (t *GaeTicketManager) AddParentedTicketResponse(recordType string, recordUu
 		return err
 	})
 	if err != nil {
+		t.deleteTicketFiles(ticketUuid, attachments, session)
 		t.am.Error(session, `ticket`, "AddTicketResponse() failed. Error: %v", err)
 		return err
 	}
 
+	if event != "" {
+		queueTicketNotification(t.am, event, &ticket, uuid.String(), nil, session)
+	}
 	return nil
 }
 
-func (t *GaeTicketManager) Setting() Setting {
-	return t.am.Setting()
-}
+// AddTicketAttachments attaches files to a ticket itself, such as screenshots sent with feedback
+func (t *GaeTicketManager) AddTicketAttachments(parentType, parentUuid, ticketUuid string, files []TicketFile, session Session) ([]TicketAttachment, error) {
+	k := ticketKey(parentType, parentUuid, ticketUuid, session)
+	if err := t.checkTicketAccess(k, session); err != nil {
+		return nil, err
+	}
 
-func (t *GaeTicketManager) PicklistStore() PicklistStore {
-	return t.am.PicklistStore()
-}
+	attachments, err := t.storeTicketFiles(ticketUuid, files, session)
+	if err != nil || len(attachments) == 0 {
+		return nil, err
+	}
 
-func (p *GaeTicket) LoadKey(k *datastore.Key) error {
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(ticketUuid, session.PersonUuid(), session.DisplayName())
+	for _, a := range attachments {
+		bulk.AddItem("Attachment", "", a.Filename)
+	}
+
+	_, err = t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		var ticket GaeTicket
+		if err := tx.Get(k, &ticket); err != nil {
+			return err
+		}
+		now := time.Now()
+		ticket.attachments = append(ticket.attachments, attachments...)
+		ticket.updated = &now
+		_, err := tx.Put(k, &ticket)
+		return err
+	})
+	if err != nil {
+		t.deleteTicketFiles(ticketUuid, attachments, session)
+		t.am.Error(session, `ticket`, "AddTicketAttachments() failed. Error: %v", err)
+		return nil, err
+	}
+	return attachments, putEntityChangeLog(t.client, t.ctx, session.Site(), bulk)
+}
+
+// OpenTicketAttachment returns a file attached to a ticket or one of its responses, and its content
+func (t *GaeTicketManager) OpenTicketAttachment(parentType, parentUuid, ticketUuid, uuid string, session Session) (*TicketAttachment, TicketResponse, io.ReadCloser, error) {
+	if t.blobStore == nil {
+		return nil, nil, nil, nil
+	}
+	var ticket GaeTicket
+	err := t.client.Get(t.ctx, ticketKey(parentType, parentUuid, ticketUuid, session), &ticket)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, nil, nil, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	if !canViewTicket(session, &ticket) {
+		return nil, nil, nil, ErrTicketPermissionDenied
+	}
+
+	attachment, response := findTicketAttachment(&ticket, nil, uuid)
+	if attachment == nil {
+		responses, err := t.GetParentedTicketResponses(parentType, parentUuid, ticketUuid, session)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		if attachment, response = findTicketAttachment(&ticket, responses, uuid); attachment == nil {
+			return nil, nil, nil, nil
+		}
+	}
+
+	content, err := t.blobStore.Get(session.Site(), ticketAttachmentBlobName(ticketUuid, uuid))
+	if err == ErrBlobNotFound {
+		return nil, nil, nil, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	return attachment, response, content, nil
+}
+
+// storeTicketFiles checks every file against the limits of the site, and the attachment
+// scanner, before any is stored.
+func (t *GaeTicketManager) storeTicketFiles(ticketUuid string, files []TicketFile, session Session) ([]TicketAttachment, error) {
+	if len(files) == 0 {
+		return nil, nil
+	}
+	if t.blobStore == nil {
+		return nil, errors.New("Files can not be attached to tickets on this site.")
+	}
+
+	var attachments []TicketAttachment
+	for _, f := range files {
+		a, err := checkTicketFile(t.am.Setting(), session.Site(), f)
+		if err != nil {
+			return nil, err
+		}
+		if t.scanner != nil {
+			if err := t.scanner(session.Site(), a.Filename, f.Data); err != nil {
+				t.am.Warning(session, `ticket`, "Attachment %s rejected by scanner. Error: %v", a.Filename, err)
+				return nil, err
+			}
+		}
+		id, err := uuid.NewUUID()
+		if err != nil {
+			return nil, err
+		}
+		a.Uuid = id.String()
+		attachments = append(attachments, *a)
+	}
+
+	for i, a := range attachments {
+		if err := t.blobStore.Put(session.Site(), ticketAttachmentBlobName(ticketUuid, a.Uuid), a.ContentType, bytes.NewReader(files[i].Data)); err != nil {
+			t.deleteTicketFiles(ticketUuid, attachments[:i], session)
+			t.am.Error(session, `ticket`, "Storing attachment failed. Error: %v", err)
+			return nil, err
+		}
+	}
+	return attachments, nil
+}
+
+func (t *GaeTicketManager) deleteTicketFiles(ticketUuid string, attachments []TicketAttachment, session Session) {
+	for _, a := range attachments {
+		if err := t.blobStore.Delete(session.Site(), ticketAttachmentBlobName(ticketUuid, a.Uuid)); err != nil {
+			t.am.Error(session, `ticket`, "Removing attachment %s failed. Error: %v", a.Uuid, err)
+		}
+	}
+}
+
+// UpdateTicket changes the tags, assignees and watchers of a ticket, recording the change in the ticket history
+func (t *GaeTicketManager) UpdateTicket(parentType, parentUuid, uuid string, tags []string, assignedTo, watchedBy []TicketViewer, session Session) error {
+	if !isTicketSupport(session) {
+		return ErrTicketPermissionDenied
+	}
+	var pk *datastore.Key = nil
+	if parentType != "" && parentUuid != "" {
+		pk = datastore.NameKey(parentType, parentUuid, nil)
+		pk.Namespace = session.Site()
+	}
+	k := datastore.NameKey("Ticket", uuid, pk)
+	k.Namespace = session.Site()
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(uuid, session.PersonUuid(), session.DisplayName())
+
+	var ticket GaeTicket
+	var assigned []string
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		bulk.Items = nil
+		assigned = nil
+
+		if err := tx.Get(k, &ticket); err != nil {
+			return err
+		}
+
+		if a, b := strings.Join(ticket.tags, ", "), strings.Join(tags, ", "); a != b {
+			bulk.AddItem("Tags", a, b)
+			ticket.tags = tags
+		}
+		if a, b := ticketViewerNames(ticket.assignedTo), ticketViewerNames(assignedTo); a != b || !sameTicketViewers(ticket.assignedTo, assignedTo) {
+			bulk.AddItem("AssignedTo", a, b)
+			for _, v := range assignedTo {
+				if !hasTicketViewer(ticket.assignedTo, v.Uuid) {
+					assigned = append(assigned, v.Uuid)
+				}
+			}
+			ticket.assignedTo = assignedTo
+		}
+		if a, b := ticketViewerNames(ticket.watchedBy), ticketViewerNames(watchedBy); a != b || !sameTicketViewers(ticket.watchedBy, watchedBy) {
+			bulk.AddItem("WatchedBy", a, b)
+			ticket.watchedBy = watchedBy
+		}
+		if len(bulk.Items) == 0 {
+			return nil
+		}
+		now := time.Now()
+		ticket.updated = &now
+
+		_, err := tx.Put(k, &ticket)
+		return err
+	})
+	if err != nil {
+		t.am.Error(session, `ticket`, "UpdateTicket() failed. Error: %v", err)
+		return err
+	}
+
+	if len(assigned) > 0 {
+		queueTicketNotification(t.am, TicketAssignedEvent, &ticket, "", assigned, session)
+	}
+	if len(bulk.Items) > 0 {
+		return putEntityChangeLog(t.client, t.ctx, session.Site(), bulk)
+	}
+	return nil
+}
+
+// SetTicketActionAfter changes, or with nil clears, the time after which a ticket needs attention
+func (t *GaeTicketManager) SetTicketActionAfter(parentType, parentUuid, uuid string, actionAfter *time.Time, session Session) error {
+	if !isTicketSupport(session) {
+		return ErrTicketPermissionDenied
+	}
+	k := ticketKey(parentType, parentUuid, uuid, session)
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(uuid, session.PersonUuid(), session.DisplayName())
+
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		bulk.Items = nil
+
+		var ticket GaeTicket
+		if err := tx.Get(k, &ticket); err != nil {
+			return err
+		}
+		if a, b := ticketTimeString(ticket.actionAfter), ticketTimeString(actionAfter); a != b {
+			bulk.AddItem("ActionAfter", a, b)
+		} else {
+			return nil
+		}
+		now := time.Now()
+		ticket.actionAfter = actionAfter
+		ticket.updated = &now
+		_, err := tx.Put(k, &ticket)
+		return err
+	})
+	if err != nil {
+		t.am.Error(session, `ticket`, "SetTicketActionAfter() failed. Error: %v", err)
+		return err
+	}
+	if len(bulk.Items) > 0 {
+		return putEntityChangeLog(t.client, t.ctx, session.Site(), bulk)
+	}
+	return nil
+}
+
+// EscalateTicket adds tags and assignees to a ticket, recording why it was escalated. A ticket
+// is escalated for missing each SLA target only once, so false is returned if it already has
+// been. Escalating a ticket because its ActionAfter time has passed clears it, and false is
+// returned if the time has since been changed.
+func (t *GaeTicketManager) EscalateTicket(parentType, parentUuid, uuid string, reason TicketEscalation, tags []string, assignTo []TicketViewer, session Session) (bool, error) {
+	if !isTicketSupport(session) {
+		return false, ErrTicketPermissionDenied
+	}
+	k := ticketKey(parentType, parentUuid, uuid, session)
+	now := time.Now()
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(uuid, session.PersonUuid(), session.DisplayName())
+
+	var ticket GaeTicket
+	var assigned []string
+	escalated := false
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		bulk.Items = nil
+		assigned = nil
+		escalated = false
+
+		if err := tx.Get(k, &ticket); err != nil {
+			return err
+		}
+		if reason == TicketActionAfterEscalation {
+			if ticket.actionAfter == nil || ticket.actionAfter.After(now) {
+				return nil
+			}
+			bulk.AddItem("ActionAfter", ticketTimeString(ticket.actionAfter), "")
+			ticket.actionAfter = nil
+		} else {
+			for _, e := range ticket.escalations {
+				if e == reason {
+					return nil
+				}
+			}
+			ticket.escalations = append(ticket.escalations, reason)
+		}
+		bulk.AddItem("Escalated", "", string(reason))
+
+		before := strings.Join(ticket.tags, ", ")
+		for _, tag := range tags {
+			if !hasTicketTag(&ticket, tag) {
+				ticket.tags = append(ticket.tags, tag)
+			}
+		}
+		if after := strings.Join(ticket.tags, ", "); before != after {
+			bulk.AddItem("Tags", before, after)
+		}
+		names := ticketViewerNames(ticket.assignedTo)
+		for _, v := range assignTo {
+			if !hasTicketViewer(ticket.assignedTo, v.Uuid) {
+				ticket.assignedTo = append(ticket.assignedTo, v)
+				assigned = append(assigned, v.Uuid)
+			}
+		}
+		if len(assigned) > 0 {
+			bulk.AddItem("AssignedTo", names, ticketViewerNames(ticket.assignedTo))
+		}
+
+		escalated = true
+		ticket.updated = &now
+		_, err := tx.Put(k, &ticket)
+		return err
+	})
+	if err != nil {
+		t.am.Error(session, `ticket`, "EscalateTicket() failed. Error: %v", err)
+		return false, err
+	}
+	if !escalated {
+		return false, nil
+	}
+
+	if len(assigned) > 0 {
+		queueTicketNotification(t.am, TicketAssignedEvent, &ticket, "", assigned, session)
+	}
+	return true, putEntityChangeLog(t.client, t.ctx, session.Site(), bulk)
+}
+
+func ticketKey(parentType, parentUuid, uuid string, session Session) *datastore.Key {
+	var pk *datastore.Key = nil
+	if parentType != "" && parentUuid != "" {
+		pk = datastore.NameKey(parentType, parentUuid, nil)
+		pk.Namespace = session.Site()
+	}
+	k := datastore.NameKey("Ticket", uuid, pk)
+	k.Namespace = session.Site()
+	return k
+}
+
+// isTicketResponder reports if a session belongs to a known person other than the requester of a ticket
+func isTicketResponder(ticket Ticket, session Session) bool {
+	if session.PersonUuid() == "" || session.PersonUuid() == ticket.PersonUuid() {
+		return false
+	}
+	return ticket.Email() == "" || !strings.EqualFold(session.Email(), ticket.Email())
+}
+
+func ticketTimeString(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.Format("2 Jan 2006 15:04 MST")
+}
+
+func ticketViewerNames(viewers []TicketViewer) string {
+	var names []string
+	for _, v := range viewers {
+		names = append(names, v.DisplayName)
+	}
+	return strings.Join(names, ", ")
+}
+
+func sameTicketViewers(a, b []TicketViewer) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Uuid != b[i].Uuid {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *GaeTicketManager) Setting() Setting {
+	return t.am.Setting()
+}
+
+func (t *GaeTicketManager) PicklistStore() PicklistStore {
+	return t.am.PicklistStore()
+}
+
+func (t *GaeTicketManager) BlobStore() BlobStore {
+	return t.blobStore
+}
+
+func (p *GaeTicket) LoadKey(k *datastore.Key) error {
 	if k != nil && k.Parent != nil {
 		p.parentType = k.Parent.Kind
 		p.parentUuid = k.Parent.Name
@@ -467,6 +1411,10 @@ func (p *GaeTicket) LoadKey(k *datastore.Key) error {
 }
 
 func (p *GaeTicket) Load(ps []datastore.Property) error {
+	var assignedTo, assignedToNames, watchedBy, watchedByNames []interface{}
+	var links, linkTypes, linkSubjects []interface{}
+	var mergedInto, mergedIntoSubject string
+	attachments := make(map[string][]interface{})
 	for _, i := range ps {
 		switch i.Name {
 		case "UUID", "Uuid":
@@ -505,6 +1453,24 @@ func (p *GaeTicket) Load(ps []datastore.Property) error {
 		case "Tags":
 			p.tags = strings.Split(i.Value.(string), "|")
 			break
+		case "ResponseCount":
+			p.responseCount = i.Value.(int64)
+			break
+		case "ResponseTerms":
+			p.responseTerms = strings.Split(i.Value.(string), "|")
+			break
+		case "AssignedTo":
+			assignedTo = i.Value.([]interface{})
+			break
+		case "AssignedToNames":
+			assignedToNames = i.Value.([]interface{})
+			break
+		case "WatchedBy":
+			watchedBy = i.Value.([]interface{})
+			break
+		case "WatchedByNames":
+			watchedByNames = i.Value.([]interface{})
+			break
 		case "Created":
 			if i.Value != nil {
 				t := i.Value.(time.Time)
@@ -517,11 +1483,159 @@ func (p *GaeTicket) Load(ps []datastore.Property) error {
 				p.actionAfter = &t
 			}
 			break
+		case "FirstResponse":
+			if i.Value != nil {
+				t := i.Value.(time.Time)
+				p.firstResponse = &t
+			}
+			break
+		case "Resolved":
+			if i.Value != nil {
+				t := i.Value.(time.Time)
+				p.resolved = &t
+			}
+			break
+		case "Updated":
+			if i.Value != nil {
+				t := i.Value.(time.Time)
+				p.updated = &t
+			}
+			break
+		case "Escalations":
+			for _, e := range i.Value.([]interface{}) {
+				p.escalations = append(p.escalations, TicketEscalation(e.(string)))
+			}
+			break
+		case "Attachments", "AttachmentNames", "AttachmentTypes", "AttachmentSizes":
+			attachments[i.Name] = i.Value.([]interface{})
+			break
+		case "Links":
+			links = i.Value.([]interface{})
+			break
+		case "LinkTypes":
+			linkTypes = i.Value.([]interface{})
+			break
+		case "LinkSubjects":
+			linkSubjects = i.Value.([]interface{})
+			break
+		case "MergedInto":
+			mergedInto = i.Value.(string)
+			break
+		case "MergedIntoSubject":
+			mergedIntoSubject = i.Value.(string)
+			break
 		}
 	}
+	p.assignedTo = loadTicketViewers(assignedTo, assignedToNames)
+	p.watchedBy = loadTicketViewers(watchedBy, watchedByNames)
+	p.attachments = loadTicketAttachments(attachments)
+	p.links = loadTicketLinks(links, linkTypes, linkSubjects)
+	p.mergedInto = nil
+	if mergedInto != "" {
+		parentType, parentUuid, uuid := parseTicketReference(mergedInto)
+		p.mergedInto = &TicketLink{Type: TicketDuplicateOfLink, ParentType: parentType, ParentUuid: parentUuid, Uuid: uuid, Subject: mergedIntoSubject}
+	}
 	return nil
 }
 
+// loadTicketLinks reads links saved as lists of ticket references, relations and subjects
+func loadTicketLinks(refs, types, subjects []interface{}) []TicketLink {
+	var links []TicketLink
+	for i, ref := range refs {
+		var l TicketLink
+		l.ParentType, l.ParentUuid, l.Uuid = parseTicketReference(ref.(string))
+		l.Type = TicketRelatedLink
+		if i < len(types) {
+			l.Type = TicketLinkType(types[i].(string))
+		}
+		if i < len(subjects) {
+			l.Subject = subjects[i].(string)
+		}
+		links = append(links, l)
+	}
+	return links
+}
+
+func saveTicketLinks(props []datastore.Property, links []TicketLink) []datastore.Property {
+	if len(links) == 0 {
+		return props
+	}
+	var refs, types, subjects []interface{}
+	for _, l := range links {
+		refs = append(refs, ticketLinkReference(l))
+		types = append(types, string(l.Type))
+		subjects = append(subjects, l.Subject)
+	}
+	return append(props,
+		datastore.Property{Name: "Links", Value: refs, NoIndex: true},
+		datastore.Property{Name: "LinkTypes", Value: types, NoIndex: true},
+		datastore.Property{Name: "LinkSubjects", Value: subjects, NoIndex: true})
+}
+
+// loadTicketAttachments reads attachments saved as lists of uuids, names, types and sizes
+func loadTicketAttachments(lists map[string][]interface{}) []TicketAttachment {
+	var attachments []TicketAttachment
+	names, types, sizes := lists["AttachmentNames"], lists["AttachmentTypes"], lists["AttachmentSizes"]
+	for i, uuid := range lists["Attachments"] {
+		a := TicketAttachment{Uuid: uuid.(string)}
+		if i < len(names) {
+			a.Filename = names[i].(string)
+		}
+		if i < len(types) {
+			a.ContentType = types[i].(string)
+		}
+		if i < len(sizes) {
+			a.Size = sizes[i].(int64)
+		}
+		attachments = append(attachments, a)
+	}
+	return attachments
+}
+
+func saveTicketAttachments(props []datastore.Property, attachments []TicketAttachment) []datastore.Property {
+	if len(attachments) == 0 {
+		return props
+	}
+	var uuids, names, types, sizes []interface{}
+	for _, a := range attachments {
+		uuids = append(uuids, a.Uuid)
+		names = append(names, a.Filename)
+		types = append(types, a.ContentType)
+		sizes = append(sizes, a.Size)
+	}
+	return append(props,
+		datastore.Property{Name: "Attachments", Value: uuids, NoIndex: true},
+		datastore.Property{Name: "AttachmentNames", Value: names, NoIndex: true},
+		datastore.Property{Name: "AttachmentTypes", Value: types, NoIndex: true},
+		datastore.Property{Name: "AttachmentSizes", Value: sizes, NoIndex: true})
+}
+
+func loadTicketViewers(uuids, names []interface{}) []TicketViewer {
+	var viewers []TicketViewer
+	for i, uuid := range uuids {
+		v := TicketViewer{Uuid: uuid.(string)}
+		if i < len(names) {
+			v.DisplayName = names[i].(string)
+		}
+		viewers = append(viewers, v)
+	}
+	return viewers
+}
+
+func saveTicketViewers(props []datastore.Property, name string, viewers []TicketViewer) []datastore.Property {
+	if len(viewers) == 0 {
+		return props
+	}
+	var uuids, names []interface{}
+	for _, v := range viewers {
+		uuids = append(uuids, v.Uuid)
+		names = append(names, v.DisplayName)
+	}
+	return append(props,
+		datastore.Property{Name: name, Value: uuids},
+		datastore.Property{Name: name + "Names", Value: names, NoIndex: true})
+}
+
 func (p *GaeTicket) Save() ([]datastore.Property, error) {
 	props := []datastore.Property{
 		{
@@ -565,25 +1679,87 @@ func (p *GaeTicket) Save() ([]datastore.Property, error) {
 			Value: p.subject,
 		},
 		{
-			Name:  "Message",
-			Value: p.message,
+			Name:    "Message",
+			Value:   p.message,
+			NoIndex: true,
+		},
+		{
+			Name:  "ResponseCount",
+			Value: p.responseCount,
 		},
 	}
 
 	if len(p.tags) > 0 {
 		props = append(props, datastore.Property{Name: "Tags", Value: strings.Join(p.tags, "|")})
+		var keys []interface{}
+		for _, tag := range p.tags {
+			keys = append(keys, strings.ToLower(strings.TrimSpace(tag)))
+		}
+		props = append(props, datastore.Property{Name: "TagKeys", Value: keys})
+	}
+	props = saveTicketViewers(props, "AssignedTo", p.assignedTo)
+	props = saveTicketViewers(props, "WatchedBy", p.watchedBy)
+
+	// Terms found in responses are kept, so the index can be rebuilt without reading each response
+	p.responseTerms = uniqueTerms(p.responseTerms)
+	if len(p.responseTerms) > 0 {
+		props = append(props, datastore.Property{Name: "ResponseTerms", Value: strings.Join(p.responseTerms, "|"), NoIndex: true})
+	}
+
+	var searchTags []interface{}
+	for _, term := range SearchTerms(append([]string{p.subject, p.firstName, p.lastName, p.email, p.message}, p.tags...)...) {
+		searchTags = append(searchTags, term)
+	}
+	terms := make(map[interface{}]bool)
+	for _, term := range searchTags {
+		terms[term] = true
+	}
+	for _, term := range p.responseTerms {
+		if !terms[term] {
+			searchTags = append(searchTags, term)
+		}
+	}
+	if len(searchTags) > ticketSearchTermLimit {
+		searchTags = searchTags[:ticketSearchTermLimit]
+	}
+	if len(searchTags) > 0 {
+		props = append(props, datastore.Property{Name: "SearchTags", Value: searchTags})
 	}
 	if p.created != nil {
 		props = append(props, datastore.Property{Name: "Created", Value: p.created})
 	}
+	if p.updated != nil {
+		props = append(props, datastore.Property{Name: "Updated", Value: p.updated})
+	}
 	if p.actionAfter != nil {
 		props = append(props, datastore.Property{Name: "ActionAfter", Value: p.actionAfter})
 	}
+	if p.firstResponse != nil {
+		props = append(props, datastore.Property{Name: "FirstResponse", Value: p.firstResponse, NoIndex: true})
+	}
+	if p.resolved != nil {
+		props = append(props, datastore.Property{Name: "Resolved", Value: p.resolved, NoIndex: true})
+	}
+	if len(p.escalations) > 0 {
+		var escalations []interface{}
+		for _, e := range p.escalations {
+			escalations = append(escalations, string(e))
+		}
+		props = append(props, datastore.Property{Name: "Escalations", Value: escalations, NoIndex: true})
+	}
+	props = saveTicketAttachments(props, p.attachments)
+	props = saveTicketLinks(props, p.links)
+	if p.mergedInto != nil {
+		props = append(props,
+			datastore.Property{Name: "MergedInto", Value: ticketLinkReference(*p.mergedInto), NoIndex: true},
+			datastore.Property{Name: "MergedIntoSubject", Value: p.mergedInto.Subject, NoIndex: true})
+	}
 
 	return props, nil
 }
 
 func (p *GaeTicketResponse) Load(ps []datastore.Property) error {
+	attachments := make(map[string][]interface{})
 	for _, i := range ps {
 		switch i.Name {
 		case "UUID", "Uuid":
@@ -598,6 +1774,12 @@ func (p *GaeTicketResponse) Load(ps []datastore.Property) error {
 		case "PersonUUID", "PersonUuid":
 			p.personUuid = i.Value.(string)
 			break
+		case "PersonDisplayName":
+			p.personDisplayName = i.Value.(string)
+			break
+		case "Internal":
+			p.internal = i.Value.(bool)
+			break
 		case "IP":
 			p.ip = i.Value.(string)
 			break
@@ -616,8 +1798,12 @@ func (p *GaeTicketResponse) Load(ps []datastore.Property) error {
 				p.created = &t
 			}
 			break
+		case "Attachments", "AttachmentNames", "AttachmentTypes", "AttachmentSizes":
+			attachments[i.Name] = i.Value.([]interface{})
+			break
 		}
 	}
+	p.attachments = loadTicketAttachments(attachments)
 	return nil
 }
 
@@ -648,8 +1834,9 @@ func (p *GaeTicketResponse) Save() ([]datastore.Property, error) {
 			Value: p.subject,
 		},
 		{
-			Name:  "Message",
-			Value: p.message,
+			Name:    "Message",
+			Value:   p.message,
+			NoIndex: true,
 		},
 		{
 			Name:  "IP",
@@ -661,9 +1848,105 @@ func (p *GaeTicketResponse) Save() ([]datastore.Property, error) {
 		},
 	}
 
+	if p.internal {
+		props = append(props, datastore.Property{Name: "Internal", Value: p.internal})
+	}
+	props = saveTicketAttachments(props, p.attachments)
 	if p.created != nil {
 		props = append(props, datastore.Property{Name: "Created", Value: p.created})
 	}
 
 	return props, nil
 }
+
+// gaeTicketNotificationPreference is the datastore entity holding a TicketNotificationPreference
+type gaeTicketNotificationPreference struct {
+	Email   string
+	Lang    string   `datastore:",noindex"`
+	OptOut  []string `datastore:",noindex"`
+	Token   string
+	Updated time.Time
+}
+
+func (t *GaeTicketManager) GetTicketNotificationPreference(email string, session Session) (*TicketNotificationPreference, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+	if !session.HasRole("s1") && !session.HasRole("s5") && !strings.EqualFold(session.Email(), email) {
+		return nil, errors.New("Permission denied.")
+	}
+
+	k := datastore.NameKey("TicketNotificationPreference", email, nil)
+	k.Namespace = session.Site()
+	var p gaeTicketNotificationPreference
+	err := t.client.Get(t.ctx, k, &p)
+	if err == datastore.ErrNoSuchEntity {
+		return &TicketNotificationPreference{Email: email}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return p.preference(), nil
+}
+
+func (t *GaeTicketManager) GetTicketNotificationPreferenceByToken(token string, session Session) (*TicketNotificationPreference, error) {
+	if len(token) < 20 {
+		return nil, nil
+	}
+	var items []gaeTicketNotificationPreference
+	q := datastore.NewQuery("TicketNotificationPreference").Namespace(session.Site()).Filter("Token =", token).Limit(1)
+	if _, err := t.client.GetAll(t.ctx, q, &items); err != nil {
+		return nil, err
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	return items[0].preference(), nil
+}
+
+// PutTicketNotificationPreference stores a preference, creating its token if it has none.
+// Staff, the person the preference belongs to, or anyone holding its token may change it.
+func (t *GaeTicketManager) PutTicketNotificationPreference(preference *TicketNotificationPreference, session Session) error {
+	email := strings.ToLower(strings.TrimSpace(preference.Email))
+	if email == "" {
+		return errors.New("Email address must be specified")
+	}
+	k := datastore.NameKey("TicketNotificationPreference", email, nil)
+	k.Namespace = session.Site()
+
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		var existing gaeTicketNotificationPreference
+		if err := tx.Get(k, &existing); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		byToken := existing.Token != "" && preference.Token == existing.Token
+		if !byToken && !session.HasRole("s1") && !session.HasRole("s5") && !strings.EqualFold(session.Email(), email) {
+			return errors.New("Permission denied.")
+		}
+
+		p := gaeTicketNotificationPreference{
+			Email:   email,
+			Lang:    preference.Lang,
+			Token:   existing.Token,
+			Updated: time.Now(),
+		}
+		for _, e := range preference.OptOut {
+			p.OptOut = append(p.OptOut, string(e))
+		}
+		if p.Token == "" {
+			p.Token = RandomString(32)
+		}
+		if _, err := tx.Put(k, &p); err != nil {
+			return err
+		}
+		preference.Email = email
+		preference.Token = p.Token
+		return nil
+	})
+	return err
+}
+
+func (p *gaeTicketNotificationPreference) preference() *TicketNotificationPreference {
+	preference := &TicketNotificationPreference{Email: p.Email, Lang: p.Lang, Token: p.Token}
+	for _, e := range p.OptOut {
+		preference.OptOut = append(preference.OptOut, TicketEvent(e))
+	}
+	return preference
+}
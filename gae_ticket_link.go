@@ -0,0 +1,505 @@
+package security
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/google/uuid"
+	"google.golang.org/api/iterator"
+)
+
+// ticketBatchSize is the most entities written or deleted in one call to the datastore
+const ticketBatchSize = 500
+
+var errTicketMerged = errors.New("This ticket has already been merged into another.")
+var errTicketLinkNotFound = errors.New("The ticket could not be found.")
+
+// MergeTicket moves the responses, watchers, tags and attachments of a ticket into another.
+// Responses and files are copied to the surviving ticket before the merged ticket is
+// closed, and removed from it once it is. A failure part way through leaves copies behind,
+// but loses nothing.
+func (t *GaeTicketManager) MergeTicket(parentType, parentUuid, ticketUuid, intoParentType, intoParentUuid, intoUuid string, session Session) error {
+	if !isTicketSupport(session) {
+		return ErrTicketPermissionDenied
+	}
+	if ticketUuid == intoUuid {
+		return errors.New("A ticket can not be merged into itself.")
+	}
+	k := ticketKey(parentType, parentUuid, ticketUuid, session)
+	ik := ticketKey(intoParentType, intoParentUuid, intoUuid, session)
+
+	var source, target GaeTicket
+	if err := t.getLinkedTicket(k, &source); err != nil {
+		return err
+	}
+	if err := t.getLinkedTicket(ik, &target); err != nil {
+		return err
+	}
+	if source.mergedInto != nil {
+		return errTicketMerged
+	}
+	if target.mergedInto != nil {
+		return errors.New("Tickets can not be merged into a ticket that has itself been merged.")
+	}
+	workflow, err := t.workflow(session.Site())
+	if err != nil {
+		return err
+	}
+
+	// The message of the merged ticket, with the files attached to it, becomes the first of
+	// the responses moved
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return err
+	}
+	message := &GaeTicketResponse{
+		uuid:              id.String(),
+		status:            target.status,
+		personUuid:        source.personUuid,
+		personDisplayName: ticketRequesterName(&source),
+		subject:           source.subject,
+		message:           source.message,
+		ip:                source.ip,
+		userAgent:         source.userAgent,
+		created:           source.created,
+		attachments:       source.attachments,
+	}
+	moved := []*GaeTicketResponse{message}
+	var keys []*datastore.Key
+	q := datastore.NewQuery("TicketResponse").Namespace(session.Site()).Ancestor(k)
+	it := t.client.Run(t.ctx, q)
+	for {
+		e := new(GaeTicketResponse)
+		key, err := it.Next(e)
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return err
+		}
+		keys = append(keys, key)
+		moved = append(moved, e)
+	}
+
+	var files []TicketAttachment
+	var movedKeys []*datastore.Key
+	for _, r := range moved {
+		r.ticketUuid = intoUuid
+		files = append(files, r.attachments...)
+		rk := datastore.NameKey("TicketResponse", r.uuid, ik)
+		rk.Namespace = session.Site()
+		movedKeys = append(movedKeys, rk)
+	}
+	if err := t.copyTicketFiles(ticketUuid, intoUuid, files, session); err != nil {
+		return err
+	}
+	if err := t.putTicketResponses(movedKeys, moved); err != nil {
+		t.deleteTicketFiles(intoUuid, files, session)
+		t.am.Error(session, `ticket`, "MergeTicket() failed. Error: %v", err)
+		return err
+	}
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(ticketUuid, session.PersonUuid(), session.DisplayName())
+	intoBulk := &GaeEntityAuditLogCollection{}
+	intoBulk.SetEntityUuidPersonUuid(intoUuid, session.PersonUuid(), session.DisplayName())
+
+	_, err = t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		bulk.Items = nil
+		intoBulk.Items = nil
+
+		source, target = GaeTicket{}, GaeTicket{}
+		if err := tx.Get(k, &source); err != nil {
+			return err
+		}
+		if err := tx.Get(ik, &target); err != nil {
+			return err
+		}
+		if source.mergedInto != nil {
+			return errTicketMerged
+		}
+		now := time.Now()
+
+		// The requester of the merged ticket watches the survivor, so they can still see their message
+		watchers := source.watchedBy
+		if source.personUuid != "" && source.personUuid != target.personUuid {
+			watchers = append(watchers, TicketViewer{Uuid: source.personUuid, DisplayName: ticketRequesterName(&source)})
+		}
+		if merged := mergedTicketViewers(target.watchedBy, watchers); len(merged) != len(target.watchedBy) {
+			intoBulk.AddItem("WatchedBy", ticketViewerNames(target.watchedBy), ticketViewerNames(merged))
+			target.watchedBy = merged
+		}
+		if merged := mergedTicketTags(target.tags, source.tags); len(merged) != len(target.tags) {
+			intoBulk.AddItem("Tags", strings.Join(target.tags, ", "), strings.Join(merged, ", "))
+			target.tags = merged
+		}
+		intoBulk.AddItem("Merged", "", source.subject)
+		target.responseCount = target.responseCount + int64(len(moved))
+		target.responseTerms = append(target.responseTerms, SearchTerms(source.subject, source.message)...)
+		target.responseTerms = append(target.responseTerms, source.responseTerms...)
+		target.links = withTicketLink(target.links, ticketLinkTo(TicketDuplicatedByLink, &source))
+		target.updated = &now
+
+		link := ticketLinkTo(TicketDuplicateOfLink, &target)
+		bulk.AddItem("MergedInto", "", target.subject)
+		if closed := workflow.ClosedStatus(); source.status != closed {
+			bulk.AddItem("Status", workflow.StatusName(source.status), workflow.StatusName(closed))
+			if workflow.IsOpen(source.status) || source.resolved == nil {
+				source.resolved = &now
+			}
+			source.status = closed
+		}
+		source.mergedInto = &link
+		source.links = withTicketLink(source.links, link)
+		source.responseCount = 0
+		source.responseTerms = nil
+		source.attachments = nil
+		source.actionAfter = nil
+		source.updated = &now
+
+		if _, err := tx.Put(ik, &target); err != nil {
+			return err
+		}
+		_, err := tx.Put(k, &source)
+		return err
+	})
+	if err != nil {
+		if err := t.deleteTicketResponses(movedKeys); err != nil {
+			t.am.Error(session, `ticket`, "Removing copied responses failed. Error: %v", err)
+		}
+		t.deleteTicketFiles(intoUuid, files, session)
+		t.am.Error(session, `ticket`, "MergeTicket() failed. Error: %v", err)
+		return err
+	}
+
+	if err := t.deleteTicketResponses(keys); err != nil {
+		t.am.Error(session, `ticket`, "Removing merged responses of ticket %s failed. Error: %v", ticketUuid, err)
+	}
+	t.deleteTicketFiles(ticketUuid, files, session)
+
+	if err := putEntityChangeLog(t.client, t.ctx, session.Site(), bulk); err != nil {
+		return err
+	}
+	return putEntityChangeLog(t.client, t.ctx, session.Site(), intoBulk)
+}
+
+// SplitTicketResponse moves a response, and the files attached to it, into a new ticket
+// raised by the same requester. The two tickets are linked to each other.
+func (t *GaeTicketManager) SplitTicketResponse(parentType, parentUuid, ticketUuid, responseUuid, subject string, session Session) (Ticket, error) {
+	if !isTicketSupport(session) {
+		return nil, ErrTicketPermissionDenied
+	}
+	k := ticketKey(parentType, parentUuid, ticketUuid, session)
+	rk := datastore.NameKey("TicketResponse", responseUuid, k)
+	rk.Namespace = session.Site()
+
+	var ticket GaeTicket
+	var response GaeTicketResponse
+	if err := t.getLinkedTicket(k, &ticket); err != nil {
+		return nil, err
+	}
+	if err := t.client.Get(t.ctx, rk, &response); err == datastore.ErrNoSuchEntity {
+		return nil, errors.New("The response could not be found.")
+	} else if err != nil {
+		return nil, err
+	}
+	if response.internal {
+		return nil, errors.New("Internal notes can not be split into a new ticket.")
+	}
+	if subject = strings.TrimSpace(subject); subject == "" {
+		subject = ticket.subject
+	}
+	workflow, err := t.workflow(session.Site())
+	if err != nil {
+		return nil, err
+	}
+
+	id, err := uuid.NewUUID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	split := &GaeTicket{
+		parentType:  parentType,
+		parentUuid:  parentUuid,
+		uuid:        id.String(),
+		ticketType:  ticket.ticketType,
+		status:      workflow.DefaultStatus(),
+		personUuid:  ticket.personUuid,
+		firstName:   ticket.firstName,
+		lastName:    ticket.lastName,
+		email:       ticket.email,
+		subject:     subject,
+		message:     response.message,
+		ip:          response.ip,
+		userAgent:   response.userAgent,
+		tags:        ticket.tags,
+		watchedBy:   ticket.watchedBy,
+		attachments: response.attachments,
+		created:     &now,
+		updated:     &now,
+	}
+	sk := ticketKey(parentType, parentUuid, split.uuid, session)
+
+	if err := t.copyTicketFiles(ticketUuid, split.uuid, response.attachments, session); err != nil {
+		return nil, err
+	}
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(ticketUuid, session.PersonUuid(), session.DisplayName())
+	bulk.AddItem("SplitInto", "", subject)
+	splitBulk := &GaeEntityAuditLogCollection{}
+	splitBulk.SetEntityUuidPersonUuid(split.uuid, session.PersonUuid(), session.DisplayName())
+	splitBulk.AddItem("SplitFrom", "", ticket.subject)
+
+	_, err = t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		ticket = GaeTicket{}
+		if err := tx.Get(k, &ticket); err != nil {
+			return err
+		}
+		if ticket.mergedInto != nil {
+			return errTicketMerged
+		}
+		split.links = []TicketLink{ticketLinkTo(TicketSplitFromLink, &ticket)}
+		ticket.links = withTicketLink(ticket.links, ticketLinkTo(TicketSplitIntoLink, split))
+		if ticket.responseCount > 0 {
+			ticket.responseCount = ticket.responseCount - 1
+		}
+		ticket.updated = &now
+
+		if _, err := tx.Put(sk, split); err != nil {
+			return err
+		}
+		if _, err := tx.Put(k, &ticket); err != nil {
+			return err
+		}
+		return tx.Delete(rk)
+	})
+	if err != nil {
+		t.deleteTicketFiles(split.uuid, response.attachments, session)
+		t.am.Error(session, `ticket`, "SplitTicketResponse() failed. Error: %v", err)
+		return nil, err
+	}
+	t.deleteTicketFiles(ticketUuid, response.attachments, session)
+
+	queueTicketNotification(t.am, TicketCreatedEvent, split, "", nil, session)
+
+	if err := putEntityChangeLog(t.client, t.ctx, session.Site(), bulk); err != nil {
+		return split, err
+	}
+	return split, putEntityChangeLog(t.client, t.ctx, session.Site(), splitBulk)
+}
+
+// LinkTickets relates one ticket to another, and adds the inverse relation to the other ticket
+func (t *GaeTicketManager) LinkTickets(parentType, parentUuid, uuid string, linkType TicketLinkType, toParentType, toParentUuid, toUuid string, session Session) error {
+	if !isTicketSupport(session) {
+		return ErrTicketPermissionDenied
+	}
+	if uuid == toUuid {
+		return errors.New("A ticket can not be linked to itself.")
+	}
+	if !ValidTicketLinkType(linkType) {
+		return errors.New("Please select a valid relation.")
+	}
+	k := ticketKey(parentType, parentUuid, uuid, session)
+	tk := ticketKey(toParentType, toParentUuid, toUuid, session)
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(uuid, session.PersonUuid(), session.DisplayName())
+	toBulk := &GaeEntityAuditLogCollection{}
+	toBulk.SetEntityUuidPersonUuid(toUuid, session.PersonUuid(), session.DisplayName())
+
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		bulk.Items = nil
+		toBulk.Items = nil
+
+		var ticket, other GaeTicket
+		if err := tx.Get(k, &ticket); err == datastore.ErrNoSuchEntity {
+			return errTicketLinkNotFound
+		} else if err != nil {
+			return err
+		}
+		if err := tx.Get(tk, &other); err == datastore.ErrNoSuchEntity {
+			return errTicketLinkNotFound
+		} else if err != nil {
+			return err
+		}
+
+		link := ticketLinkTo(linkType, &other)
+		back := ticketLinkTo(linkType.Inverse(), &ticket)
+		if existing := findTicketLink(ticket.links, toUuid); existing != nil {
+			if existing.Type == linkType {
+				return nil
+			}
+			bulk.AddItem("Link", ticketLinkDescription(*existing), ticketLinkDescription(link))
+		} else {
+			bulk.AddItem("Link", "", ticketLinkDescription(link))
+		}
+		if existing := findTicketLink(other.links, uuid); existing != nil {
+			toBulk.AddItem("Link", ticketLinkDescription(*existing), ticketLinkDescription(back))
+		} else {
+			toBulk.AddItem("Link", "", ticketLinkDescription(back))
+		}
+
+		now := time.Now()
+		ticket.links = withTicketLink(ticket.links, link)
+		ticket.updated = &now
+		other.links = withTicketLink(other.links, back)
+		other.updated = &now
+		if _, err := tx.Put(k, &ticket); err != nil {
+			return err
+		}
+		_, err := tx.Put(tk, &other)
+		return err
+	})
+	if err != nil {
+		t.am.Error(session, `ticket`, "LinkTickets() failed. Error: %v", err)
+		return err
+	}
+	if len(bulk.Items) == 0 {
+		return nil
+	}
+	if err := putEntityChangeLog(t.client, t.ctx, session.Site(), bulk); err != nil {
+		return err
+	}
+	return putEntityChangeLog(t.client, t.ctx, session.Site(), toBulk)
+}
+
+// UnlinkTickets removes the link between two tickets from both of them. The link is
+// removed from the first ticket even if the other no longer exists.
+func (t *GaeTicketManager) UnlinkTickets(parentType, parentUuid, uuid, toUuid string, session Session) error {
+	if !isTicketSupport(session) {
+		return ErrTicketPermissionDenied
+	}
+	k := ticketKey(parentType, parentUuid, uuid, session)
+
+	bulk := &GaeEntityAuditLogCollection{}
+	bulk.SetEntityUuidPersonUuid(uuid, session.PersonUuid(), session.DisplayName())
+	toBulk := &GaeEntityAuditLogCollection{}
+	toBulk.SetEntityUuidPersonUuid(toUuid, session.PersonUuid(), session.DisplayName())
+
+	_, err := t.client.RunInTransaction(t.ctx, func(tx *datastore.Transaction) error {
+		bulk.Items = nil
+		toBulk.Items = nil
+
+		var ticket GaeTicket
+		if err := tx.Get(k, &ticket); err == datastore.ErrNoSuchEntity {
+			return errTicketLinkNotFound
+		} else if err != nil {
+			return err
+		}
+		link := findTicketLink(ticket.links, toUuid)
+		if link == nil {
+			return nil
+		}
+		now := time.Now()
+		bulk.AddItem("Link", ticketLinkDescription(*link), "")
+		ticket.links = withoutTicketLink(ticket.links, toUuid)
+		ticket.updated = &now
+		if _, err := tx.Put(k, &ticket); err != nil {
+			return err
+		}
+
+		var other GaeTicket
+		tk := ticketKey(link.ParentType, link.ParentUuid, link.Uuid, session)
+		if err := tx.Get(tk, &other); err == datastore.ErrNoSuchEntity {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if back := findTicketLink(other.links, uuid); back != nil {
+			toBulk.AddItem("Link", ticketLinkDescription(*back), "")
+			other.links = withoutTicketLink(other.links, uuid)
+			other.updated = &now
+			_, err := tx.Put(tk, &other)
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		t.am.Error(session, `ticket`, "UnlinkTickets() failed. Error: %v", err)
+		return err
+	}
+	if len(bulk.Items) > 0 {
+		if err := putEntityChangeLog(t.client, t.ctx, session.Site(), bulk); err != nil {
+			return err
+		}
+	}
+	if len(toBulk.Items) > 0 {
+		return putEntityChangeLog(t.client, t.ctx, session.Site(), toBulk)
+	}
+	return nil
+}
+
+// getLinkedTicket reads a ticket to be merged, split or linked
+func (t *GaeTicketManager) getLinkedTicket(k *datastore.Key, ticket *GaeTicket) error {
+	if err := t.client.Get(t.ctx, k, ticket); err == datastore.ErrNoSuchEntity {
+		return errTicketLinkNotFound
+	} else if err != nil {
+		return err
+	}
+	return nil
+}
+
+// copyTicketFiles copies attachment content from one ticket to another. Copies already made
+// are removed if one fails.
+func (t *GaeTicketManager) copyTicketFiles(fromUuid, toUuid string, attachments []TicketAttachment, session Session) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+	if t.blobStore == nil {
+		return errors.New("Files can not be attached to tickets on this site.")
+	}
+	for i, a := range attachments {
+		content, err := t.blobStore.Get(session.Site(), ticketAttachmentBlobName(fromUuid, a.Uuid))
+		if err == ErrBlobNotFound {
+			continue
+		} else if err != nil {
+			t.deleteTicketFiles(toUuid, attachments[:i], session)
+			return err
+		}
+		err = t.blobStore.Put(session.Site(), ticketAttachmentBlobName(toUuid, a.Uuid), a.ContentType, content)
+		content.Close()
+		if err != nil {
+			t.deleteTicketFiles(toUuid, attachments[:i], session)
+			t.am.Error(session, `ticket`, "Copying attachment %s failed. Error: %v", a.Uuid, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *GaeTicketManager) putTicketResponses(keys []*datastore.Key, responses []*GaeTicketResponse) error {
+	for i := 0; i < len(keys); i += ticketBatchSize {
+		end := i + ticketBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if _, err := t.client.PutMulti(t.ctx, keys[i:end], responses[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *GaeTicketManager) deleteTicketResponses(keys []*datastore.Key) error {
+	for i := 0; i < len(keys); i += ticketBatchSize {
+		end := i + ticketBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := t.client.DeleteMulti(t.ctx, keys[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ticketRequesterName returns the name of the person who raised a ticket, for display
+func ticketRequesterName(ticket Ticket) string {
+	if name := strings.TrimSpace(ticket.FirstName() + " " + ticket.LastName()); name != "" {
+		return name
+	}
+	return ticket.Email()
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"html/template"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
@@ -20,11 +21,61 @@ type Page struct {
 	Class   string
 }
 
+// HttpOptions controls how the security package pages are attached to a web server.
+type HttpOptions struct {
+	// Mux receives the security package routes. Defaults to http.DefaultServeMux.
+	Mux ServeMux
+
+	// PathPrefix is prepended to every route and link, i.e. "/auth".
+	PathPrefix string
+
+	// Disable lists page paths that should not be registered, i.e. "/signup".
+	Disable []string
+
+	// Override replaces the handler registered for a page path.
+	Override map[string]http.Handler
+
+	// Middleware wraps every page. If nil, it is set to DefaultMiddleware()
+	// so that host applications can wrap their own handlers with the same chain.
+	Middleware []Middleware
+
+	// RateLimits maps page paths to the rate limiter protecting them. If nil, it
+	// is set to DefaultRateLimits() using an in memory TokenBucketThrottle. Set to
+	// an empty map to disable rate limiting.
+	RateLimits map[string]*RateLimiter
+}
+
+// ServeMux is satisfied by http.ServeMux and most third party routers.
+type ServeMux interface {
+	Handle(pattern string, handler http.Handler)
+}
+
+var pathPrefix string
+
+// Path returns the path of a security package page, including any PathPrefix
+// configured in HttpOptions.
+func Path(path string) string {
+	return pathPrefix + path
+}
+
 // Register pages specific to the security package
 func RegisterHttpHandlers(am AccessManager, tm TicketManager, defaultTimezone *time.Location, log log.Log) (*template.Template, error) {
+	return RegisterHttpHandlersWithOptions(am, tm, defaultTimezone, log, &HttpOptions{})
+}
+
+// RegisterHttpHandlersWithOptions registers pages specific to the security package
+// against the mux, path prefix and middleware chain provided in the options.
+func RegisterHttpHandlersWithOptions(am AccessManager, tm TicketManager, defaultTimezone *time.Location, log log.Log, options *HttpOptions) (*template.Template, error) {
 	if themes == nil {
 		themes = make(map[string]Theme)
 	}
+	if options == nil {
+		options = &HttpOptions{}
+	}
+	if options.Mux == nil {
+		options.Mux = http.DefaultServeMux
+	}
+	pathPrefix = strings.TrimSuffix(options.PathPrefix, "/")
 
 	st := template.New("page")
 	fm := template.FuncMap{
@@ -56,6 +107,11 @@ func RegisterHttpHandlers(am AccessManager, tm TicketManager, defaultTimezone *t
 			}
 			return template.HTML(i.GetValue()), nil
 		},
+		"csrf":  CSRFToken,
+		"nonce": Nonce,
+		"prefix": func() string {
+			return pathPrefix
+		},
 		"ampm": func(hour int) string {
 			if hour < 12 {
 				return strconv.Itoa(hour) + "am"
@@ -86,7 +142,12 @@ func RegisterHttpHandlers(am AccessManager, tm TicketManager, defaultTimezone *t
 		SignupTemplate,
 		settingsTemplate,
 		settingEditTemplate,
+		settingHistoryTemplate,
+		settingsImportTemplate,
 		systemlogTemplate,
+		ticketsTemplate,
+		ticketTemplate,
+		ticketNotificationsTemplate,
 	} {
 		var err error
 		st, err = st.Parse(page)
@@ -96,43 +157,96 @@ func RegisterHttpHandlers(am AccessManager, tm TicketManager, defaultTimezone *t
 		}
 	}
 
-	http.HandleFunc("/signin", SigninPage(st, am))
-	http.HandleFunc("/signout", SignoutPage(st, am))
-	http.HandleFunc("/signup", SignupPage(st, am))
-	http.HandleFunc("/forgot/", ForgotPage(st, am))
-	http.HandleFunc("/activate/", ActivatePage(st, am))
-	http.HandleFunc("/reset.password/", ResetPasswordPage(st, am))
-	http.HandleFunc("/z/accounts", AccountsPage(st, am))
-	http.HandleFunc("/z/account.details/", AccountDetailsPage(st, am))
-	http.HandleFunc("/z/api/", ApiPage(st, am))
-	http.HandleFunc("/z/audit", SystemlogPage(st, am))
-	http.HandleFunc("/z/connectors", ConnectorsPage(st, am))
-	http.HandleFunc("/z/external.system.create", ExternalSystemCreatePage(st, am))
-	http.HandleFunc("/z/feedback", FeedbackPage(st, am, tm))
-	http.HandleFunc("/z/picklist/", PicklistPage(st, am))
-	http.HandleFunc("/z/run_connectors", RunConnectorsPage(st, am, defaultTimezone))
-	http.HandleFunc("/z/settings", SettingsPage(st, am))
-	http.HandleFunc("/z/task", TaskHandlerPage(st, am))
-	http.HandleFunc("/i/loading.gif", BinaryFile(&loadingGif, 604800))
-
-	http.HandleFunc("/font/fa-regular-400.eot", BinaryFile(&FAregularEOT, 604800))
-	http.HandleFunc("/font/fa-regular-400.ttf", BinaryFile(&FAregularTTF, 604800))
-	http.HandleFunc("/font/fa-regular-400.woff", BinaryFile(&FAregularWOFF, 604800))
-
-	http.HandleFunc("/font/fa-brands-400.eot", BinaryFile(&FAbrandsEOT, 604800))
-	http.HandleFunc("/font/fa-brands-400.ttf", BinaryFile(&FAbrandsTTF, 604800))
-	http.HandleFunc("/font/fa-brands-400.woff", BinaryFile(&FAbrandsWOFF, 604800))
-
-	http.HandleFunc("/font/fa-solid-900.eot", BinaryFile(&FAsolidEOT, 604800))
-	http.HandleFunc("/font/fa-solid-900.ttf", BinaryFile(&FAsolidTTF, 604800))
-	http.HandleFunc("/font/fa-solid-900.woff", BinaryFile(&FAsolidWOFF, 604800))
-
-	http.HandleFunc("/font/materialicons.eot", BinaryFile(&materialIconsEot, 604800))
-	http.HandleFunc("/font/materialicons.ttf", BinaryFile(&materialIconsTtf, 604800))
-	http.HandleFunc("/font/materialicons.woff", BinaryFile(&materialIconsWoff, 604800))
+	if options.Middleware == nil {
+		options.Middleware = DefaultMiddleware(st, am, log)
+	}
+	if options.RateLimits == nil {
+		options.RateLimits = DefaultRateLimits(NewTokenBucketThrottle(am.Setting()))
+	}
+	ExemptFromCSRF("/z/task")
+	ExemptFromCSRF("/csp-report")
+	ExemptFromCSRF("/z/ticket.email")
+
+	pages := []struct {
+		path    string
+		handler func(w http.ResponseWriter, r *http.Request)
+	}{
+		{"/signin", SigninPage(st, am)},
+		{"/signout", SignoutPage(st, am)},
+		{"/signup", SignupPage(st, am)},
+		{"/forgot/", ForgotPage(st, am)},
+		{"/activate/", ActivatePage(st, am)},
+		{"/csp-report", CSPReportPage(st, am)},
+		{"/reset.password/", ResetPasswordPage(st, am)},
+		{"/ip.bypass/", IPBypassPage(st, am)},
+		{"/ticket.notifications/", TicketNotificationsPage(st, am, tm)},
+		{"/z/accounts", AccountsPage(st, am)},
+		{"/z/account.details/", AccountDetailsPage(st, am)},
+		{"/z/api/", ApiPage(st, am)},
+		{"/z/audit", SystemlogPage(st, am)},
+		{"/z/connectors", ConnectorsPage(st, am)},
+		{"/z/external.system.create", ExternalSystemCreatePage(st, am)},
+		{"/z/feedback", FeedbackPage(st, am, tm)},
+		{"/z/picklist/", PicklistPage(st, am)},
+		{"/z/run_connectors", RunConnectorsPage(st, am, defaultTimezone)},
+		{"/z/run_ticket_escalation", RunTicketEscalationPage(st, am, tm)},
+		{"/z/settings", SettingsPage(st, am)},
+		{"/z/task", TaskHandlerPage(st, am)},
+		{"/z/ticket/", TicketPage(st, am, tm)},
+		{"/z/ticket.attachment/", TicketAttachmentPage(st, am, tm)},
+		{"/z/ticket.email", TicketEmailPage(st, am, tm)},
+		{"/z/tickets", TicketsPage(st, am, tm)},
+	}
+	for _, page := range pages {
+		if isDisabledPage(page.path, options.Disable) {
+			continue
+		}
+		var h http.Handler = http.HandlerFunc(page.handler)
+		if o, ok := options.Override[page.path]; ok && o != nil {
+			h = o
+		}
+		middleware := options.Middleware
+		if limiter, ok := options.RateLimits[page.path]; ok && limiter != nil {
+			middleware = append(middleware[:len(middleware):len(middleware)], limiter.Middleware(st, am))
+		}
+		handle(options, page.path, Chain(h, middleware...))
+	}
+
+	files := []struct {
+		path string
+		data *[]byte
+	}{
+		{"/i/loading.gif", &loadingGif},
+
+		{"/font/fa-regular-400.eot", &FAregularEOT},
+		{"/font/fa-regular-400.ttf", &FAregularTTF},
+		{"/font/fa-regular-400.woff", &FAregularWOFF},
+
+		{"/font/fa-brands-400.eot", &FAbrandsEOT},
+		{"/font/fa-brands-400.ttf", &FAbrandsTTF},
+		{"/font/fa-brands-400.woff", &FAbrandsWOFF},
+
+		{"/font/fa-solid-900.eot", &FAsolidEOT},
+		{"/font/fa-solid-900.ttf", &FAsolidTTF},
+		{"/font/fa-solid-900.woff", &FAsolidWOFF},
+
+		{"/font/materialicons.eot", &materialIconsEot},
+		{"/font/materialicons.ttf", &materialIconsTtf},
+		{"/font/materialicons.woff", &materialIconsWoff},
+	}
+	for _, file := range files {
+		if isDisabledPage(file.path, options.Disable) {
+			continue
+		}
+		handle(options, file.path, http.HandlerFunc(BinaryFile(file.data, 604800)))
+	}
 
 	am.RegisterTaskHandler("connector", connectorTask(am))
 	am.RegisterTaskHandler("ip-lookup", ipLookupTask(am))
+	am.RegisterTaskHandler("secret-rotate", secretRotateTask(am))
+	am.RegisterTaskHandler("ticket-escalate", ticketEscalateTask(am, tm))
+	am.RegisterTaskHandler("ticket-notify", ticketNotifyTask(am, tm))
+	am.RegisterTaskHandler("ticket-reindex", ticketReindexTask(am, tm))
 
 	// Set a default theme in case the user of the framework doesnt set the default theme
 	if defaultTheme == nil {
@@ -142,6 +256,24 @@ func RegisterHttpHandlers(am AccessManager, tm TicketManager, defaultTimezone *t
 	return st, nil
 }
 
+// handle registers a handler against the mux, with the path prefix applied.
+// The prefix is removed before the handler sees the request.
+func handle(options *HttpOptions, path string, h http.Handler) {
+	if pathPrefix != "" {
+		h = http.StripPrefix(pathPrefix, h)
+	}
+	options.Mux.Handle(pathPrefix+path, h)
+}
+
+func isDisabledPage(path string, disabled []string) bool {
+	for _, d := range disabled {
+		if d == path {
+			return true
+		}
+	}
+	return false
+}
+
 var firsts map[string]bool
 
 func FirstRequestOnSite(site string, am AccessManager) {
@@ -160,47 +292,6 @@ func FirstRequestOnSiteWait(site string, am AccessManager, wait bool) {
 	firsts[site] = true
 	syslog.Add(`startup`, ``, `debug`, ``, "First access to site "+site+" since appserver start")
 
-	val := am.Setting().Get(site, "self.signup")
-	if val == nil || *val == "" {
-		am.Setting().Put(site, "self.signup", "no")
-	}
-	val = am.Setting().Get(site, "session.expiry")
-	if val == nil {
-		am.Setting().Put(site, "session.expiry", "900")
-	}
-	val = am.Setting().Get(site, "smtp.hostname")
-	if val == nil {
-		am.Setting().Put(site, "smtp.hostname", "smtp.example.com")
-	}
-	val = am.Setting().Get(site, "smtp.port")
-	if val == nil {
-		am.Setting().Put(site, "smtp.port", "587")
-	}
-	val = am.Setting().Get(site, "smtp.user")
-	if val == nil {
-		am.Setting().Put(site, "smtp.user", "support@example.com")
-	}
-	val = am.Setting().Get(site, "smtp.password")
-	if val == nil {
-		am.Setting().Put(site, "smtp.password", "password")
-	}
-	val = am.Setting().Get(site, "support_team.name")
-	if val == nil {
-		am.Setting().Put(site, "support_team.name", "Unknown")
-	}
-	val = am.Setting().Get(site, "support_team.email")
-	if val == nil {
-		am.Setting().Put(site, "support_team.email", "support@example.com")
-	}
-	val = am.Setting().Get(site, "support_team.reply.email")
-	if val == nil {
-		am.Setting().Put(site, "support_team.reply.email", "")
-	}
-	val = am.Setting().Get(site, "support_team.bounce.email")
-	if val == nil {
-		am.Setting().Put(site, "support_team.bounce.email", "")
-	}
-
 	if wait {
 		prefilPicklists(site, am)
 		am.RunVirtualHostSetupHandler(site)
@@ -243,15 +334,13 @@ func prefilPicklists(site string, am AccessManager) {
 		&GaePicklistItem{"day", "thursday", "Thursday", "", false, 5},
 		&GaePicklistItem{"day", "friday", "Friday", "", false, 6},
 		&GaePicklistItem{"day", "saturday", "Saturday", "", false, 7},
-		&GaePicklistItem{"ticket.type", "f", "Feedback", "General feedback comment", false, 1},
-		&GaePicklistItem{"ticket.type", "s", "Technical Support", "General support request", false, 2},
-		&GaePicklistItem{"ticket.type", "c", "Complaint", "Customer complaint", false, 3},
 	}
 	for _, x := range items {
 		if i, _ := ps.GetPicklistItem(site, x.GetPicklistName(), x.GetKey()); i == nil || i.GetValue() == "" {
 			ps.AddPicklistItem(site, x.GetPicklistName(), x.GetKey(), x.GetValue(), x.GetDescription(), x.GetIndex())
 		}
 	}
+	prefilTicketPicklists(site, ps)
 
 	list, err = ps.GetPicklist(site, "country")
 	if err != nil {
@@ -369,6 +458,30 @@ func ShowErrorNotFound(w http.ResponseWriter, r *http.Request, t *template.Templ
 	}
 }
 
+func ShowErrorTooManyRequests(w http.ResponseWriter, r *http.Request, t *template.Template, session Session, wait string) {
+	w.WriteHeader(http.StatusTooManyRequests)
+	type Page struct {
+		Session         Session
+		SiteName        string
+		SiteDescription string
+		Title           []string
+		Slug            string
+		Wait            string
+		Today           time.Time
+	}
+	err := t.ExecuteTemplate(w, "error_too_many_requests", &Page{
+		session,
+		session.Theme().Name(),
+		session.Theme().Description(),
+		[]string{"Too many requests"},
+		"",
+		wait,
+		time.Now()})
+	if err != nil {
+		panic(fmt.Sprintf("Error displaying error page: %v", err))
+	}
+}
+
 func ShowErrorForbidden(w http.ResponseWriter, r *http.Request, t *template.Template, session Session) {
 	w.WriteHeader(http.StatusForbidden)
 	type Page struct {
@@ -462,39 +575,33 @@ func RegisterHostMapping(from, to string) {
 	hostMap = append(hostMap, []string{from, to})
 }
 
-// Extract user IP address from the http request header. Trust proxy or load balancer header information when connection is behind local network device such as proxy or load balancer.
+// Extract user IP address from the http request. Proxy or load balancer headers are only
+// believed when the connection comes from a trusted proxy, see SetTrustedProxies(). The
+// entries of the forwarding header, see SetForwardingHeader(), are walked from right to
+// left, each trusted proxy is skipped, and the first address that is not a trusted proxy
+// is the client address.
 func IpFromRequest(r *http.Request) string {
 	ip := r.RemoteAddr
-
-	if strings.HasPrefix(ip, "[") {
-		p := strings.Split(ip, "]")
-		ip = p[0][1:]
-	} else if strings.Contains(ip, ":") {
-		p := strings.Split(ip, ":")
-		ip = p[0]
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
 	}
 
-	// Trust proxy/forwarded information if the source IP is a local ip address.
-	// This fails in some cases, such as if the web server and load balancer or
-	// reverse proxy use public IP addresses.
+	if !IsTrustedProxy(net.ParseIP(ip)) {
+		return ip
+	}
 
-	if strings.HasPrefix(ip, "10.") || strings.HasPrefix(ip, "172.") || strings.HasPrefix(ip, "192.168.") || strings.HasPrefix(ip, "127.") || strings.HasPrefix(ip, "0:0:0:0") || strings.HasPrefix(ip, "169.254.") {
-		var providedIp string
-		if len(r.Header.Get("HTTP_X_FORWARDED_FOR")) > 0 {
-			providedIp = r.Header.Get("HTTP_X_FORWARDED_FOR")
+	hops := forwardedFor(r)
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := parseHop(hops[i])
+		if hop == nil {
+			// Unparseable entries, i.e. "unknown" or obfuscated identifiers, cant be
+			// traced any further. The last proxy to touch the request is the best guess.
+			break
 		}
-		if len(r.Header.Get("X-Forwarded-For")) > 0 {
-			providedIp = r.Header.Get("X-Forwarded-For")
+		ip = hop.String()
+		if !IsTrustedProxy(hop) {
+			break
 		}
-
-		if len(providedIp) > 0 {
-			i := strings.Index(providedIp, ",")
-			if i > 0 {
-				providedIp = providedIp[0 : i]
-			}
-			return strings.TrimSpace(providedIp)
-		}
-
 	}
 
 	return ip
@@ -502,6 +609,10 @@ func IpFromRequest(r *http.Request) string {
 
 // Inspect the cookie and IP address of a request and return associated session information
 func LookupSession(r *http.Request, am AccessManager) (Session, error) {
+	if session := SessionFromContext(r.Context()); session != nil {
+		return session, nil
+	}
+
 	ua := r.Header.Get("User-Agent")
 	lang := r.Header.Get("Accept-Language")
 	l := strings.Index(lang, ",")
@@ -520,7 +631,7 @@ func LookupSession(r *http.Request, am AccessManager) (Session, error) {
 		if err == http.ErrNoCookie {
 			err = nil
 		}
-		return am.GuestSession(HostFromRequest(r), IpFromRequest(r), ua, lang), err
+		return guestCSRF(r, am.GuestSession(HostFromRequest(r), IpFromRequest(r), ua, lang)), err
 	}
 	token := ""
 	if cookie != nil && cookie.Value != "" {
@@ -529,7 +640,8 @@ func LookupSession(r *http.Request, am AccessManager) (Session, error) {
 	if len(token) > 256 {
 		token = ""
 	}
-	return am.Session(HostFromRequest(r), IpFromRequest(r), token, ua, lang)
+	session, err := am.Session(HostFromRequest(r), IpFromRequest(r), token, ua, lang)
+	return guestCSRF(r, session), err
 }
 
 // Rudimentary checks on email address
@@ -563,7 +675,7 @@ var SecurityHeader = `
 		<meta name="apple-mobile-web-app-status-bar-style" content="black">
 		<meta name="viewport" content="width=device-width, initial-scale=1.0, user-scalable=1.0, minimum-scale=1.0, maximum-scale=1.0, viewport-fit=cover">
 		<link rel="apple-touch-icon" href="/apple-touch-icon.png" />
-{{if .Session.IsIOS}}<script type="text/javascript">
+{{if .Session.IsIOS}}<script nonce="{{nonce $.Session}}" type="text/javascript">
 var ieh = function (event) {
     if (('standalone' in window.navigator) && window.navigator.standalone) {
         if ( event.target.tagName.toLowerCase() !== 'a' || event.target.hostname !== window.location.hostname ) return;
@@ -577,10 +689,10 @@ window.addEventListener('click', ieh, true);
 		<style type="text/css">
 			@font-face {
 				font-family: 'FontAwesomeSolid';
-				src: url('/font/fa-solid-900.eot');
-				src: url('/font/fa-solid-900.eot?#iefix')
-				format('embedded-opentype'), url('/font/fa-solid-900.woff')
-				format('woff'), url('/font/fa-solid-900.ttf') format('truetype');
+				src: url('{{prefix}}/font/fa-solid-900.eot');
+				src: url('{{prefix}}/font/fa-solid-900.eot?#iefix')
+				format('embedded-opentype'), url('{{prefix}}/font/fa-solid-900.woff')
+				format('woff'), url('{{prefix}}/font/fa-solid-900.ttf') format('truetype');
 				font-weight: normal;
 				font-style: normal
 			}
@@ -879,6 +991,72 @@ Sorry, but you do not appear to have permission to access this page. Consider re
 </p>
 
 
+<div>
+<a class="button orange"  href="/">Go back to the home page</a>
+</div>
+
+</body></html>
+{{end}}
+
+{{define "error_too_many_requests"}}
+<html>
+	<head>
+		<title>Too many requests &mdash; {{.Session.Theme.Name}}</title>
+		<meta property="og:site_name" content="{{.Session.Theme.Name}}"/>
+		<meta name="apple-mobile-web-app-title" content="{{.Session.Theme.Name}}">
+		<style type="text/css">
+body, h1, h2, h3, div, p { font-family: Helvetica Neue, Helvetica, Arial, Sans-sersif }
+body { margin-left: auto; margin-right: auto; max-width: 40em; margin-top: 5%; }
+.button {
+	display: inline-block;
+	outline: none;
+	cursor: pointer;
+	text-align: center;
+	text-decoration: none;
+	font: 14px/100% Arial, Helvetica, sans-serif;
+	padding: .5em 2em .55em;
+	text-shadow: 0 1px 1px rgba(0,0,0,.3);
+	border-radius: .5em; -webkit-border-radius: .5em; -moz-border-radius: .5em;
+	box-shadow: 0 1px 2px rgba(0,0,0,.2); -webkit-box-shadow: 0 1px 2px rgba(0,0,0,.2); -moz-box-shadow: 0 1px 2px rgba(0,0,0,.2);
+}
+.button:hover {
+	text-decoration: none;
+}
+.button:active {
+	position: relative;
+	top: 1px;
+}
+
+.orange {
+	color: #fef4e9;
+	border: solid 1px #da7c0c;
+	background: #f78d1d;
+	background: -webkit-gradient(linear, left top, left bottom, from(#faa51a), to(#f47a20));
+	background: -moz-linear-gradient(top,  #faa51a,  #f47a20);
+	filter:  progid:DXImageTransform.Microsoft.gradient(startColorstr='#faa51a', endColorstr='#f47a20');
+}
+.orange:hover {
+	background: #f47c20;
+	background: -webkit-gradient(linear, left top, left bottom, from(#f88e11), to(#f06015));
+	background: -moz-linear-gradient(top,  #f88e11,  #f06015);
+	filter:  progid:DXImageTransform.Microsoft.gradient(startColorstr='#f88e11', endColorstr='#f06015');
+}
+.orange:active {
+	color: #fcd3a5;
+	background: -webkit-gradient(linear, left top, left bottom, from(#f47a20), to(#faa51a));
+	background: -moz-linear-gradient(top,  #f47a20,  #faa51a);
+	filter:  progid:DXImageTransform.Microsoft.gradient(startColorstr='#f47a20', endColorstr='#faa51a');
+}
+		</style>
+	</head>
+<body>
+
+<h1>Too many requests &mdash; {{.Session.Theme.Name}}</h1>
+<p>
+Sorry, but too many requests have been received from your location. Please wait {{.Wait}} and try again.
+</p>
+
+
 <div>
 <a class="button orange"  href="/">Go back to the home page</a>
 </div>
@@ -971,14 +1149,15 @@ var AdminTemplate = `
                 <meta http-equiv="Content-Type" content="text/html; charset=UTF-8">
 				<meta name="viewport" content="width=device-width, initial-scale=1.0, user-scalable=1.0, minimum-scale=1.0, maximum-scale=1.0, viewport-fit=cover">
 				<meta name="description" content="{{.Session.Theme.Description}}">
+				<meta name="csrf-token" content="{{csrf .Session}}">
 				<meta name="apple-mobile-web-app-title" content="{{.Session.Theme.Name}}">
 				<meta name="apple-mobile-web-app-capable" content="yes">
 				<link rel="apple-touch-icon" href="/favicon.ico" />
 				<style type="text/css">
-                        @font-face { font-family: 'FontAwesome'; src: url('/font/fa-regular-400.eot'); src: url('/font/fa-regular-400.eot?#iefix') format('embedded-opentype'), url('/font/fa-regular-400.woff') format('woff'), url('/font/fa-regular-400.ttf') format('truetype'); font-weight: normal; font-style: normal }
-                        @font-face { font-family: 'FontAwesomeBrands'; src: url('/font/fa-brands-400.eot'); src: url('/font/fa-brands-400.eot?#iefix') format('embedded-opentype'), url('/font/fa-brands-400.woff') format('woff'), url('/font/fa-brands-400.ttf') format('truetype'); font-weight: normal; font-style: normal }
-                        @font-face { font-family: 'FontAwesomeSolid'; src: url('/font/fa-solid-900.eot'); src: url('/font/fa-solid-900.eot?#iefix') format('embedded-opentype'), url('/font/fa-solid-900.woff') format('woff'), url('/font/fa-solid-900.ttf') format('truetype'); font-weight: normal; font-style: normal }
-                        @font-face { font-family: 'MaterialIcons'; src: url('/font/materialicons.eot'); src: url('/font/materialicons.eot?#iefix') format('embedded-opentype'), url('/font/materialicons.woff') format('woff'), url('/font/materialicons.ttf') format('truetype'); font-weight: normal; font-style: normal }
+                        @font-face { font-family: 'FontAwesome'; src: url('{{prefix}}/font/fa-regular-400.eot'); src: url('{{prefix}}/font/fa-regular-400.eot?#iefix') format('embedded-opentype'), url('{{prefix}}/font/fa-regular-400.woff') format('woff'), url('{{prefix}}/font/fa-regular-400.ttf') format('truetype'); font-weight: normal; font-style: normal }
+                        @font-face { font-family: 'FontAwesomeBrands'; src: url('{{prefix}}/font/fa-brands-400.eot'); src: url('{{prefix}}/font/fa-brands-400.eot?#iefix') format('embedded-opentype'), url('{{prefix}}/font/fa-brands-400.woff') format('woff'), url('{{prefix}}/font/fa-brands-400.ttf') format('truetype'); font-weight: normal; font-style: normal }
+                        @font-face { font-family: 'FontAwesomeSolid'; src: url('{{prefix}}/font/fa-solid-900.eot'); src: url('{{prefix}}/font/fa-solid-900.eot?#iefix') format('embedded-opentype'), url('{{prefix}}/font/fa-solid-900.woff') format('woff'), url('{{prefix}}/font/fa-solid-900.ttf') format('truetype'); font-weight: normal; font-style: normal }
+                        @font-face { font-family: 'MaterialIcons'; src: url('{{prefix}}/font/materialicons.eot'); src: url('{{prefix}}/font/materialicons.eot?#iefix') format('embedded-opentype'), url('{{prefix}}/font/materialicons.woff') format('woff'), url('{{prefix}}/font/materialicons.ttf') format('truetype'); font-weight: normal; font-style: normal }
 
 			html {
 				overflow-x:hidden;
@@ -1048,6 +1227,7 @@ var AdminTemplate = `
 			div#buttons a.p > span:before { content: "\f00b"; }
 			div#buttons a.l > span:before { content: "\f543"; }
 			div#buttons a.x > span:before { content: "\f2f1"; }
+			div#buttons a.t > span:before { content: "\f3ff"; }
 			div#content {
 				padding: 1.5em;
 				font-size: 0.95em;
@@ -1249,6 +1429,12 @@ var AdminTemplate = `
 			div#actions a.delete::before {
 				content: "\f2ed";
 			}
+			div#actions a.export::before {
+				content: "\f56e";
+			}
+			div#actions a.import::before {
+				content: "\f56f";
+			}
 			div#actions a.new_person::before {
 				font-family: MaterialIcons;
 				content: "\e7fe";
@@ -1308,13 +1494,13 @@ var AdminTemplate = `
 				content: "\f015";
 				padding-right:0.3em;
 			}
-			#footer a[href^="/z/feedback"]::before {
+			#footer a[href^="{{prefix}}/z/feedback"]::before {
 				font-family: FontAwesome;
 				margin-left: 0.7em;
 				content: "\f075";
 				padding-right:0.3em;
 			}
-			#footer a[href^="/signout"]::before {
+			#footer a[href^="{{prefix}}/signout"]::before {
 				font-family: FontAwesomeSolid;
 				margin-left: 0.7em;
 				content: "\f2f5";
@@ -1396,15 +1582,20 @@ var AdminTemplate = `
                 </style>
 </head>
 <body class="admin">
-	<div id="logo" onclick="window.location='/'"></div>
+	<div id="logo"></div>
 	<div id="header">
 		<div id="buttons">
-			<span onclick="window.location='/z/accounts'"><a href="/z/accounts" class="a"><span>Accounts</span></a></span><span onclick="window.location='/z/picklist'"><a href="/z/picklist/" class="p"><span>Lists</span></a></span><span onclick="window.location='/z/audit'"><a href="/z/audit" class="l"><span>Audit</span></a></span>{{if .Session.HasRole "c6"}}<span onclick="window.location='/z/connectors'"><a href="/z/connectors" class="x"><span>Connector</span></a></span>{{end}}<span onclick="window.location='/z/settings'"><a href="/z/settings" class="s"><span>Settings</span></a></span>
+			<span><a href="{{prefix}}/z/accounts" class="a"><span>Accounts</span></a></span><span><a href="{{prefix}}/z/picklist/" class="p"><span>Lists</span></a></span><span><a href="{{prefix}}/z/audit" class="l"><span>Audit</span></a></span>{{if .Session.HasRole "s5"}}<span><a href="{{prefix}}/z/tickets" class="t"><span>Tickets</span></a></span>{{end}}{{if .Session.HasRole "c6"}}<span><a href="{{prefix}}/z/connectors" class="x"><span>Connector</span></a></span>{{end}}<span><a href="{{prefix}}/z/settings" class="s"><span>Settings</span></a></span>
 		</div>
 		<div id="signout">
-			<a href="/signout"><img style="height:1.3em; width:1.3em" src="data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAEgAAABICAQAAAD/5HvMAAABE0lEQVR4Ae3ZAQYCURSF4Vcwe2ii9haREghtL2iaBSQwlFpCAfgDPIBDzjVx/xV8PJd33ZJlWZZJ0bBjwNXAlqboMeeGuxszlTOhI6KOiQZaEdVKA/VE1WugD1G9NRC1YghqCUqQUoKYc6INAwmcO/CgDQGJHCrJDNI4KskP2gDopIgnO4ok/xTrJB3kJ+kgP8kAcpF0kJ+kg/ykH0D8kEAyg3SSH6STxgV6sYgH6Rw/SOfEj/1B4eggP0cH+Tk6yM/RQW6OAWTgGL6wOicexFrgRK9BAid6URQ4wav0U+cYQTWWXCrHDTJEghKUoPfYTgsXour/9Dw1pSOiM9OiRcsVd1dmRY+GPQOu7vIROMuyLPsCX05DXhbIXwMAAAAASUVORK5CYII="/></a>
+			<a href="{{prefix}}/signout"><img style="height:1.3em; width:1.3em" src="data:image/png;base64,iVBORw0KGgoAAAANSUhEUgAAAEgAAABICAQAAAD/5HvMAAABE0lEQVR4Ae3ZAQYCURSF4Vcwe2ii9haREghtL2iaBSQwlFpCAfgDPIBDzjVx/xV8PJd33ZJlWZZJ0bBjwNXAlqboMeeGuxszlTOhI6KOiQZaEdVKA/VE1WugD1G9NRC1YghqCUqQUoKYc6INAwmcO/CgDQGJHCrJDNI4KskP2gDopIgnO4ok/xTrJB3kJ+kgP8kAcpF0kJ+kg/ykH0D8kEAyg3SSH6STxgV6sYgH6Rw/SOfEj/1B4eggP0cH+Tk6yM/RQW6OAWTgGL6wOicexFrgRK9BAid6URQ4wav0U+cYQTWWXCrHDTJEghKUoPfYTgsXour/9Dw1pSOiM9OiRcsVd1dmRY+GPQOu7vIROMuyLPsCX05DXhbIXwMAAAAASUVORK5CYII="/></a>
 		</div>
 	</div>
+<script nonce="{{nonce $.Session}}">
+document.getElementById('logo').addEventListener('click', function() { window.location = '/'; });
+var hb = document.querySelectorAll('#buttons > span');
+for (var i = 0; i < hb.length; i++) { hb[i].addEventListener('click', function() { window.location = this.querySelector('a').href; }); }
+</script>
 	<div id="content">
 {{end}}
 
@@ -1412,7 +1603,7 @@ var AdminTemplate = `
 {{define "admin_footer"}}
         </div>
         <div id="footer">
-Currently signed in as {{.Session.FirstName}} {{.Session.LastName}}.<br><a href="/z/feedback">Feedback</a> <a href="/">Home</a> <a href="/signout">Sign out</a>.
+Currently signed in as {{.Session.FirstName}} {{.Session.LastName}}.<br><a href="{{prefix}}/z/feedback">Feedback</a> <a href="/">Home</a> <a href="{{prefix}}/signout">Sign out</a>.
         </div>
 </body>
 </html>
@@ -0,0 +1,176 @@
+package security
+
+import (
+	"fmt"
+	"sync"
+)
+
+const (
+	InvalidateSetting  = "setting"
+	InvalidatePicklist = "picklist"
+)
+
+// Invalidation announces that cached data has changed, so that every instance
+// holding a copy of it can discard its copy.
+type Invalidation struct {
+	Kind   string // InvalidateSetting or InvalidatePicklist
+	Site   string
+	Name   string // Name of the setting or picklist changed, or empty if not known
+	Origin string // Identifies the cache that made the change, so it may ignore its own announcements
+}
+
+// InvalidationBus delivers invalidations to the caches of every instance. Settings and
+// picklist stores publish an invalidation each time they store a change, and discard
+// their cached copy of a site when they receive one.
+type InvalidationBus interface {
+	Publish(e Invalidation) error
+
+	// Subscribe registers a function to be called with each invalidation published,
+	// returning a function that cancels the subscription.
+	Subscribe(fn func(e Invalidation)) (cancel func())
+}
+
+// Settings and picklist stores subscribe to localInvalidations, which receives the
+// invalidations delivered by the configured bus.
+var localInvalidations = NewMemoryInvalidationBus()
+var invalidationBus InvalidationBus = localInvalidations
+var invalidationBusCancel func()
+var invalidationBusLock sync.RWMutex
+
+// DefaultInvalidationBus returns the bus that settings and picklist stores publish to.
+// Unless changed with SetInvalidationBus(), it only reaches caches in the current process.
+func DefaultInvalidationBus() InvalidationBus {
+	invalidationBusLock.RLock()
+	defer invalidationBusLock.RUnlock()
+	return invalidationBus
+}
+
+// SetInvalidationBus changes the bus used to share changes with other instances, i.e.
+//
+//	am, err, client, ctx := NewGaeAccessManager(projectId, locationId, timezone)
+//	SetInvalidationBus(NewGaeInvalidationBus(client, ctx, 5*time.Second))
+func SetInvalidationBus(bus InvalidationBus) {
+	invalidationBusLock.Lock()
+	defer invalidationBusLock.Unlock()
+	if invalidationBusCancel != nil {
+		invalidationBusCancel()
+		invalidationBusCancel = nil
+	}
+	if bus == nil {
+		bus = localInvalidations
+	}
+	invalidationBus = bus
+	if bus != localInvalidations {
+		invalidationBusCancel = bus.Subscribe(func(e Invalidation) {
+			localInvalidations.Publish(e)
+		})
+	}
+}
+
+// publishInvalidation announces a change to every instance.
+func publishInvalidation(e Invalidation) {
+	if err := DefaultInvalidationBus().Publish(e); err != nil {
+		fmt.Printf("Failed publishing %s change %s: %v\n", e.Kind, e.Name, err)
+	}
+}
+
+// MemoryInvalidationBus delivers invalidations to subscribers in the current process,
+// as they are published. It is suitable for single instance deployments and tests.
+type MemoryInvalidationBus struct {
+	lock        sync.RWMutex
+	next        int
+	subscribers map[int]func(e Invalidation)
+}
+
+func NewMemoryInvalidationBus() *MemoryInvalidationBus {
+	return &MemoryInvalidationBus{subscribers: make(map[int]func(e Invalidation))}
+}
+
+func (b *MemoryInvalidationBus) Publish(e Invalidation) error {
+	b.lock.RLock()
+	subscribers := make([]func(e Invalidation), 0, len(b.subscribers))
+	for _, fn := range b.subscribers {
+		subscribers = append(subscribers, fn)
+	}
+	b.lock.RUnlock()
+
+	for _, fn := range subscribers {
+		fn(e)
+	}
+	return nil
+}
+
+func (b *MemoryInvalidationBus) Subscribe(fn func(e Invalidation)) func() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	id := b.next
+	b.next++
+	b.subscribers[id] = fn
+	return func() {
+		b.lock.Lock()
+		defer b.lock.Unlock()
+		delete(b.subscribers, id)
+	}
+}
+
+// LocalPubSub stands in for a publish/subscribe service, such as Cloud Pub/Sub, when
+// developing or testing locally. Each bus returned by Bus() behaves as a separate
+// instance connected to the same topic. Invalidations are delivered asynchronously,
+// in the order published, to subscribers of every bus. Publish never blocks, so an
+// invalidation is dropped for a subscriber that has fallen too far behind, as it
+// could be by a real publish/subscribe service.
+type LocalPubSub struct {
+	lock          sync.RWMutex
+	next          int
+	subscriptions map[int]chan Invalidation
+}
+
+func NewLocalPubSub() *LocalPubSub {
+	return &LocalPubSub{subscriptions: make(map[int]chan Invalidation)}
+}
+
+// Bus returns an InvalidationBus connected to the topic.
+func (p *LocalPubSub) Bus() InvalidationBus {
+	return &localPubSubBus{p}
+}
+
+type localPubSubBus struct {
+	topic *LocalPubSub
+}
+
+func (b *localPubSubBus) Publish(e Invalidation) error {
+	b.topic.lock.RLock()
+	defer b.topic.lock.RUnlock()
+	for _, c := range b.topic.subscriptions {
+		select {
+		case c <- e:
+		default:
+			fmt.Printf("Dropped %s invalidation for %s, the subscriber is not keeping up.\n", e.Kind, e.Site)
+		}
+	}
+	return nil
+}
+
+func (b *localPubSubBus) Subscribe(fn func(e Invalidation)) func() {
+	c := make(chan Invalidation, 100)
+	go func() {
+		for e := range c {
+			fn(e)
+		}
+	}()
+
+	p := b.topic
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	id := p.next
+	p.next++
+	p.subscriptions[id] = c
+	return func() {
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		if _, found := p.subscriptions[id]; found {
+			delete(p.subscriptions, id)
+			close(c)
+		}
+	}
+}
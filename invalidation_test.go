@@ -0,0 +1,115 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInvalidationBus(t *testing.T) {
+	// In process delivery is immediate
+	{
+		b := NewMemoryInvalidationBus()
+		var received []Invalidation
+		cancel := b.Subscribe(func(e Invalidation) { received = append(received, e) })
+		b.Publish(Invalidation{Kind: InvalidateSetting, Site: "a", Name: "x"})
+		if len(received) != 1 || received[0].Name != "x" {
+			t.Fatalf("MemoryInvalidationBus delivered %v", received)
+		}
+		cancel()
+		b.Publish(Invalidation{Kind: InvalidateSetting, Site: "a", Name: "y"})
+		if len(received) != 1 {
+			t.Fatalf("MemoryInvalidationBus delivered to a cancelled subscription")
+		}
+	}
+
+	// Each LocalPubSub bus reaches subscribers of every other bus on the topic
+	{
+		topic := NewLocalPubSub()
+		one, two := topic.Bus(), topic.Bus()
+		received := make(chan Invalidation, 10)
+		cancel := two.Subscribe(func(e Invalidation) { received <- e })
+		defer cancel()
+		one.Publish(Invalidation{Kind: InvalidatePicklist, Site: "b", Name: "sex"})
+		select {
+		case e := <-received:
+			if e.Kind != InvalidatePicklist || e.Site != "b" || e.Name != "sex" {
+				t.Fatalf("LocalPubSub delivered %v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("LocalPubSub did not deliver the invalidation")
+		}
+	}
+
+	// A subscriber that is not keeping up does not block publishers
+	{
+		topic := NewLocalPubSub()
+		stuck := make(chan bool)
+		cancel := topic.Bus().Subscribe(func(e Invalidation) { <-stuck })
+		defer cancel()
+		defer close(stuck)
+		done := make(chan bool)
+		go func() {
+			for i := 0; i < 500; i++ {
+				topic.Bus().Publish(Invalidation{Kind: InvalidateSetting, Site: "d"})
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("LocalPubSub Publish() blocked on a slow subscriber")
+		}
+	}
+
+	// Invalidations from the configured bus reach local subscribers
+	{
+		topic := NewLocalPubSub()
+		SetInvalidationBus(topic.Bus())
+		defer SetInvalidationBus(nil)
+		received := make(chan Invalidation, 10)
+		cancel := localInvalidations.Subscribe(func(e Invalidation) { received <- e })
+		defer cancel()
+		topic.Bus().Publish(Invalidation{Kind: InvalidateSetting, Site: "c", Name: "z"})
+		select {
+		case e := <-received:
+			if e.Site != "c" {
+				t.Fatalf("SetInvalidationBus() delivered %v", e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("SetInvalidationBus() did not deliver the invalidation")
+		}
+	}
+}
+
+func TestSettingWatchers(t *testing.T) {
+	var w settingWatchers
+	var values []string
+	cancel := w.add("a.com", "Custom.Watched", func(value string) { values = append(values, value) })
+
+	before := map[string]map[string]string{"a.com": {"custom.other": "1"}}
+	after := withSetting(before, "a.com", "custom.other", "2")
+	w.notify(before, after)
+	if len(values) != 0 {
+		t.Fatalf("Watcher called for a change to a different setting: %v", values)
+	}
+	if before["a.com"]["custom.other"] != "1" {
+		t.Fatalf("withSetting() altered the original cache")
+	}
+
+	// A change to a global setting changes the effective value for the site
+	before, after = after, withSetting(after, GlobalSettingSite, "custom.watched", "g")
+	w.notify(before, after)
+	before, after = after, withSetting(after, "a.com", "custom.watched", "s")
+	w.notify(before, after)
+	before, after = after, withSetting(after, GlobalSettingSite, "custom.watched", "h")
+	w.notify(before, after)
+	if len(values) != 2 || values[0] != "g" || values[1] != "s" {
+		t.Fatalf("Watcher called with %v, expected [g s]", values)
+	}
+
+	cancel()
+	w.notify(after, withSetting(after, "a.com", "custom.watched", "t"))
+	if len(values) != 2 || w.active() {
+		t.Fatalf("Watcher called after being cancelled")
+	}
+}
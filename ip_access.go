@@ -0,0 +1,294 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Per site settings holding ip address ranges in CIDR notation, separated by
+// semicolons, i.e. "10.0.0.0/8;192.168.1.0/24". Single addresses are also accepted.
+//
+// The ip.allow and ip.deny lists apply to every page. The ip.admin.allow and
+// ip.admin.deny lists also apply to the administration pages, which are only
+// available to people holding administrative roles. An empty allow list allows
+// all addresses that are not denied.
+const (
+	IPAllowSetting      = "ip.allow"
+	IPDenySetting       = "ip.deny"
+	IPAdminAllowSetting = "ip.admin.allow"
+	IPAdminDenySetting  = "ip.admin.deny"
+
+	// IPBypassSecretSetting holds the key used to sign emergency bypass links.
+	// Bypass links are disabled if this setting is empty.
+	IPBypassSecretSetting = "ip.bypass.secret"
+)
+
+// AdminPaths lists the path prefixes of administration pages subject to the
+// ip.admin.allow and ip.admin.deny lists.
+var AdminPaths = []string{"/z/"}
+
+// ipAccessExempt lists paths that are never blocked. Task handlers are called
+// by the task queue, and the bypass page must be reachable to work at all.
+var ipAccessExempt = []string{"/z/task", "/ip.bypass/"}
+
+// How long an emergency bypass lasts after its link is followed
+var IPBypassPeriod = 4 * time.Hour
+
+const ipBypassCookie = "zb"
+
+// ipBypassUsed records bypass links that have been followed, so that each link works
+// once. The access manager throttle is used instead when it is available, so that
+// all instances of the application see the same record.
+var ipBypassUsed = NewMemoryThrottle(nil)
+
+func init() {
+	DefaultThrottlePolicies["ip.bypass"] = ThrottlePolicy{Attempts: 0, Window: 86400 * 7, Lockout: 86400 * 7, MaxLockout: 86400 * 7}
+
+	RegisterSetting(SettingDefinition{Name: IPAllowSetting, Type: SettingList, Validate: validateIPAccessList,
+		Description: "Addresses permitted to use the site, i.e. 10.0.0.0/8;192.168.1.0/24. Leave empty to permit all addresses."})
+	RegisterSetting(SettingDefinition{Name: IPDenySetting, Type: SettingList, Validate: validateIPAccessList,
+		Description: "Addresses never permitted to use the site."})
+	RegisterSetting(SettingDefinition{Name: IPAdminAllowSetting, Type: SettingList, Validate: validateIPAccessList,
+		Description: "Addresses permitted to use the administration pages. Leave empty to permit all addresses."})
+	RegisterSetting(SettingDefinition{Name: IPAdminDenySetting, Type: SettingList, Validate: validateIPAccessList,
+		Description: "Addresses never permitted to use the administration pages."})
+	RegisterSetting(SettingDefinition{Name: IPBypassSecretSetting, Type: SettingSecret,
+		Description: "Key used to sign emergency bypass links. Bypass links are disabled if empty."})
+}
+
+// validateIPAccessList rejects address lists containing entries that ipAccessList() would ignore.
+func validateIPAccessList(value string) error {
+	for _, entry := range strings.FieldsFunc(value, func(c rune) bool { return c == ';' || c == ',' || c == ' ' || c == '\n' }) {
+		if net.ParseIP(entry) == nil {
+			if _, _, err := net.ParseCIDR(entry); err != nil {
+				return fmt.Errorf("%s is not an ip address or range", entry)
+			}
+		}
+	}
+	return nil
+}
+
+// IPAccessAllowed reports whether a site permits requests from an ip address to a path,
+// according to the allow and deny lists stored in the site settings.
+func IPAccessAllowed(settings Setting, site, path string, ip net.IP) (bool, string) {
+	for _, prefix := range ipAccessExempt {
+		if strings.HasPrefix(path, prefix) {
+			return true, ""
+		}
+	}
+
+	if ok, reason := ipListAllows(settings, site, IPAllowSetting, IPDenySetting, ip); !ok {
+		return false, reason
+	}
+	for _, prefix := range AdminPaths {
+		if strings.HasPrefix(path, prefix) {
+			return ipListAllows(settings, site, IPAdminAllowSetting, IPAdminDenySetting, ip)
+		}
+	}
+	return true, ""
+}
+
+func ipListAllows(settings Setting, site, allowSetting, denySetting string, ip net.IP) (bool, string) {
+	deny := ipAccessList(settings, site, denySetting)
+	if ipInList(ip, deny) {
+		return false, "address is in " + denySetting
+	}
+	allow := ipAccessList(settings, site, allowSetting)
+	if len(allow) > 0 && !ipInList(ip, allow) {
+		return false, "address is not in " + allowSetting
+	}
+	return true, ""
+}
+
+// ipAccessList parses an address list setting. Invalid entries are ignored, so that
+// a typo does not lock every user out of the site.
+func ipAccessList(settings Setting, site, name string) []*net.IPNet {
+	if settings == nil {
+		return nil
+	}
+	value := settings.GetWithDefault(site, name, "")
+	var nets []*net.IPNet
+	for _, entry := range strings.FieldsFunc(value, func(c rune) bool { return c == ';' || c == ',' || c == ' ' || c == '\n' }) {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				if ip.To4() != nil {
+					entry = entry + "/32"
+				} else {
+					entry = entry + "/128"
+				}
+			}
+		}
+		if _, n, err := net.ParseCIDR(entry); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+func ipInList(ip net.IP, nets []*net.IPNet) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IPAccessControl blocks requests from addresses that a site does not permit, before
+// any attempt to authenticate the request. Blocked requests are recorded in the system
+// log. A browser holding a valid emergency bypass cookie is allowed through.
+func IPAccessControl(am AccessManager) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			site := HostFromRequest(r)
+			ipAddress := IpFromRequest(r)
+
+			allowed, reason := IPAccessAllowed(am.Setting(), site, r.URL.Path, net.ParseIP(ipAddress))
+			if allowed {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			session := am.GuestSession(site, ipAddress, r.UserAgent(), "")
+			secret, err := ipBypassSecret(am.Setting(), site)
+			if err != nil {
+				am.Warning(session, `ipaccess`, "Failed reading %s setting: %v", IPBypassSecretSetting, err)
+			}
+			if validIPBypassCookie(secret, site, ipAddress, r) {
+				am.Notice(session, `ipaccess`, "Request from %s to %s %s allowed by emergency bypass (%s)", ipAddress, r.Method, r.URL.Path, reason)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			am.Warning(session, `ipaccess`, "Blocked request from %s to %s %s: %s", ipAddress, r.Method, r.URL.Path, reason)
+			if wantsJSON(r) {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "{\"error\":\"Access from your network is not permitted\"}")
+				return
+			}
+			http.Error(w, "Access from your network is not permitted.", http.StatusForbidden)
+		})
+	}
+}
+
+// NewIPBypassLink returns a signed link that lifts the ip address restrictions of
+// a site for IPBypassPeriod, for the browser that follows it. The link can be
+// followed once, before it expires, which must be within seven days. The site must
+// have an ip.bypass.secret setting.
+func NewIPBypassLink(settings Setting, site string, expires time.Duration) (string, error) {
+	if expires > 7*24*time.Hour {
+		return "", errors.New("Emergency bypass links must expire within seven days")
+	}
+	secret, err := ipBypassSecret(settings, site)
+	if err != nil {
+		return "", err
+	}
+	if secret == "" {
+		return "", errors.New("Emergency bypass links require the " + IPBypassSecretSetting + " setting")
+	}
+	payload := strconv.FormatInt(time.Now().Add(expires).Unix(), 10) + "." + RandomString(16)
+	return "https://" + site + Path("/ip.bypass/") + payload + "." + ipBypassSignature(secret, "link", site, payload), nil
+}
+
+// IPBypassPage redeems an emergency bypass link, setting a cookie that lets the
+// browser past the ip address restrictions from its current address.
+func IPBypassPage(t *template.Template, am AccessManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		site := HostFromRequest(r)
+		ipAddress := IpFromRequest(r)
+		session := am.GuestSession(site, ipAddress, r.UserAgent(), "")
+
+		token := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		parts := strings.Split(token, ".")
+		secret, err := ipBypassSecret(am.Setting(), site)
+		if err != nil {
+			am.Warning(session, `ipaccess`, "Failed reading %s setting: %v", IPBypassSecretSetting, err)
+		}
+		if len(parts) != 3 || secret == "" {
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+		payload := parts[0] + "." + parts[1]
+		expiry, err := strconv.ParseInt(parts[0], 10, 64)
+		if err != nil || expiry < time.Now().Unix() || !hmac.Equal([]byte(parts[2]), []byte(ipBypassSignature(secret, "link", site, payload))) {
+			am.Warning(session, `ipaccess`, "Invalid or expired emergency bypass link used from %s", ipAddress)
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+
+		used := ipBypassUsed
+		if m, ok := am.(interface{ Throttle() Throttle }); ok {
+			used = m.Throttle()
+		}
+		key := ThrottleKey(site, "ip.bypass", parts[1])
+		if u, err := used.IsThrottled(key); err != nil || u {
+			am.Warning(session, `ipaccess`, "Emergency bypass link reused from %s", ipAddress)
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+		if err := used.Increment(key); err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+
+		until := strconv.FormatInt(time.Now().Add(IPBypassPeriod).Unix(), 10)
+		http.SetCookie(w, &http.Cookie{
+			Name:     ipBypassCookie,
+			Value:    until + "." + ipBypassSignature(secret, "cookie", site, ipAddress+"|"+until),
+			Path:     "/",
+			Expires:  time.Now().Add(IPBypassPeriod),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+		am.Warning(session, `ipaccess`, "Emergency bypass of ip address restrictions granted to %s until %s", ipAddress, time.Now().Add(IPBypassPeriod).Format(time.RFC3339))
+		http.Redirect(w, r, Path("/z/accounts"), http.StatusSeeOther)
+	}
+}
+
+// ipBypassSecret returns the key used to sign bypass links, or an empty string if it
+// is not set or can not be decrypted, which disables bypass links.
+func ipBypassSecret(settings Setting, site string) (string, error) {
+	secret, err := settings.GetSecret(site, IPBypassSecretSetting)
+	if err != nil {
+		return "", err
+	}
+	return secret, nil
+}
+
+// validIPBypassCookie checks the bypass cookie was signed with the secret, issued to this
+// ip address and has not expired
+func validIPBypassCookie(secret, site, ipAddress string, r *http.Request) bool {
+	c, err := r.Cookie(ipBypassCookie)
+	if err != nil {
+		return false
+	}
+	parts := strings.Split(c.Value, ".")
+	if secret == "" || len(parts) != 2 {
+		return false
+	}
+	until, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || until < time.Now().Unix() {
+		return false
+	}
+	return hmac.Equal([]byte(parts[1]), []byte(ipBypassSignature(secret, "cookie", site, ipAddress+"|"+parts[0])))
+}
+
+func ipBypassSignature(secret, purpose, site, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(purpose + "|" + site + "|" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
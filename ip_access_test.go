@@ -0,0 +1,109 @@
+package security
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ipTestSetting provides the Setting methods used by the ip access checks
+type ipTestSetting struct {
+	Setting
+	values map[string]string
+}
+
+func (s *ipTestSetting) GetWithDefault(site, name, defaultValue string) string {
+	if v, ok := s.values[name]; ok {
+		return v
+	}
+	return defaultValue
+}
+
+func (s *ipTestSetting) GetSecret(site, name string) (string, error) {
+	return DecryptSecret(s.GetWithDefault(site, name, ""))
+}
+
+func TestIPAccessAllowed(t *testing.T) {
+	settings := &ipTestSetting{values: map[string]string{
+		IPDenySetting:       "203.0.113.7",
+		IPAdminAllowSetting: "10.0.0.0/8; 192.168.1.0/24, not-an-address",
+	}}
+
+	tests := []struct {
+		path    string
+		ip      string
+		allowed bool
+	}{
+		{"/signin", "198.51.100.1", true},
+		{"/signin", "203.0.113.7", false},
+		{"/z/accounts", "198.51.100.1", false},
+		{"/z/accounts", "10.1.2.3", true},
+		{"/z/accounts", "192.168.1.20", true},
+		{"/z/task", "198.51.100.1", true},
+		{"/ip.bypass/abc", "203.0.113.7", true},
+	}
+	for _, test := range tests {
+		allowed, reason := IPAccessAllowed(settings, "example.com", test.path, net.ParseIP(test.ip))
+		if allowed != test.allowed {
+			t.Fatalf("IPAccessAllowed(%s, %s) should be %v, got %v (%s)", test.path, test.ip, test.allowed, allowed, reason)
+		}
+	}
+}
+
+func TestIPBypassCookie(t *testing.T) {
+	settings := &ipTestSetting{values: map[string]string{IPBypassSecretSetting: "secret"}}
+
+	if _, err := NewIPBypassLink(settings, "example.com", 30*24*time.Hour); err == nil {
+		t.Fatalf("NewIPBypassLink() should refuse links valid for more than seven days")
+	}
+	link, err := NewIPBypassLink(settings, "example.com", time.Hour)
+	if err != nil || !strings.HasPrefix(link, "https://example.com/ip.bypass/") {
+		t.Fatalf("NewIPBypassLink() returned %q, %v", link, err)
+	}
+
+	until := "9999999999"
+	r := httptest.NewRequest("GET", "/z/accounts", nil)
+	r.Header.Set("Cookie", ipBypassCookie+"="+until+"."+ipBypassSignature("secret", "cookie", "example.com", "10.0.0.1|"+until))
+	if !validIPBypassCookie("secret", "example.com", "10.0.0.1", r) {
+		t.Fatalf("validIPBypassCookie() should accept a cookie issued to this address")
+	}
+	if validIPBypassCookie("secret", "example.com", "10.0.0.2", r) {
+		t.Fatalf("validIPBypassCookie() should reject a cookie issued to another address")
+	}
+}
+
+func TestIPBypassEncryptedSecret(t *testing.T) {
+	k, err := ParseSecretKeyring("k1=" + GenerateSecretKey())
+	if err != nil {
+		t.Fatalf("ParseSecretKeyring() failed: %v", err)
+	}
+	previous := DefaultSecretKeyring()
+	SetSecretKeyring(k)
+	defer SetSecretKeyring(previous)
+
+	sealed, err := EncryptSecret("secret")
+	if err != nil || !IsEncryptedSecret(sealed) {
+		t.Fatalf("EncryptSecret() failed: %v", err)
+	}
+	settings := &ipTestSetting{values: map[string]string{IPBypassSecretSetting: sealed}}
+
+	// Links are signed with the decrypted secret, as IPBypassPage checks them
+	link, err := NewIPBypassLink(settings, "example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("NewIPBypassLink() failed: %v", err)
+	}
+	parts := strings.Split(link[strings.LastIndex(link, "/")+1:], ".")
+	if len(parts) != 3 || parts[2] != ipBypassSignature("secret", "link", "example.com", parts[0]+"."+parts[1]) {
+		t.Fatalf("NewIPBypassLink() should sign links with the decrypted secret: %s", link)
+	}
+
+	until := "9999999999"
+	r := httptest.NewRequest("GET", "/z/accounts", nil)
+	r.Header.Set("Cookie", ipBypassCookie+"="+until+"."+ipBypassSignature("secret", "cookie", "example.com", "10.0.0.1|"+until))
+	secret, err := ipBypassSecret(settings, "example.com")
+	if err != nil || !validIPBypassCookie(secret, "example.com", "10.0.0.1", r) {
+		t.Fatalf("validIPBypassCookie() should check cookies with the decrypted secret: %v", err)
+	}
+}
@@ -0,0 +1,142 @@
+package security
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+const memoryThrottleShards = 32
+
+// How often, in seconds, each shard is swept for keys that no longer affect throttling
+const memoryThrottleEvictInterval = 60
+
+// MemoryThrottle keeps throttle counters in process memory. It is suitable for
+// single node deployments and tests. Keys are spread across shards so that
+// concurrent requests rarely contend for the same lock, and keys that have
+// been idle long enough to no longer matter are periodically evicted.
+type MemoryThrottle struct {
+	settings Setting
+	shards   throttleShards
+
+	// Policy used for keys not created with ThrottleKey()
+	Window   int64
+	Lockout  int64
+	Attempts int64
+}
+
+type throttleShards [memoryThrottleShards]memoryThrottleShard
+
+type memoryThrottleShard struct {
+	sync.Mutex
+	items   map[string]*memoryThrottleItem
+	evicted int64
+}
+
+type memoryThrottleItem struct {
+	state   throttleState
+	tat     int64 // Theoretical arrival time in nanoseconds, used by TokenBucketThrottle
+	expires int64 // Time after which the item can be forgotten
+}
+
+func NewMemoryThrottle(settings Setting) Throttle {
+	t := &MemoryThrottle{
+		settings: settings,
+		Window:   60,
+		Lockout:  60,
+		Attempts: 3, // Default to three attempts per minute, lock for one minute.
+	}
+	t.shards.init()
+	return t
+}
+
+func (t *MemoryThrottle) policy(key string) ThrottlePolicy {
+	return ThrottlePolicyForKey(t.settings, key, ThrottlePolicy{
+		Attempts:   t.Attempts,
+		Window:     t.Window,
+		Lockout:    t.Lockout,
+		MaxLockout: t.Lockout * 60,
+	})
+}
+
+func (t *MemoryThrottle) IsThrottled(key string) (bool, error) {
+	status, err := t.Status(key)
+	if err != nil {
+		return false, err
+	}
+	return status.Throttled, nil
+}
+
+func (t *MemoryThrottle) Status(key string) (*ThrottleStatus, error) {
+	policy := t.policy(key)
+	now := time.Now().Unix()
+
+	shard := t.shards.get(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.evict(now)
+
+	item, found := shard.items[key]
+	if !found {
+		return &ThrottleStatus{Remaining: policy.Attempts}, nil
+	}
+	return item.state.status(policy, now), nil
+}
+
+func (t *MemoryThrottle) Increment(key string) error {
+	policy := t.policy(key)
+	now := time.Now().Unix()
+
+	shard := t.shards.get(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.evict(now)
+
+	item, found := shard.items[key]
+	if !found {
+		item = &memoryThrottleItem{}
+		shard.items[key] = item
+	}
+	item.state.increment(policy, now)
+
+	item.expires = item.state.Updated + policy.MaxLockout + policy.Window
+	if item.state.LockedUntil > item.expires {
+		item.expires = item.state.LockedUntil
+	}
+	return nil
+}
+
+func (t *MemoryThrottle) Clear(key string) error {
+	shard := t.shards.get(key)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.items, key)
+	return nil
+}
+
+func (s *throttleShards) init() {
+	for i := range s {
+		s[i].items = make(map[string]*memoryThrottleItem)
+	}
+}
+
+// get returns the shard responsible for a key
+func (s *throttleShards) get(key string) *memoryThrottleShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &s[h.Sum32()%memoryThrottleShards]
+}
+
+// evict removes expired items from the shard if it has not been swept recently.
+// The caller must hold the shard lock.
+func (s *memoryThrottleShard) evict(now int64) {
+	if s.evicted > now-memoryThrottleEvictInterval {
+		return
+	}
+	s.evicted = now
+	for key, item := range s.items {
+		if item.expires < now {
+			delete(s.items, key)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package security
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"runtime/debug"
+	"time"
+
+	"github.com/zaddok/log"
+)
+
+// Middleware wraps a http handler with additional behaviour, such as logging
+// or session lookup.
+type Middleware func(http.Handler) http.Handler
+
+// Chain wraps a handler with a list of middleware. The first middleware in the
+// list is the outermost, and sees the request first.
+func Chain(h http.Handler, middleware ...Middleware) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+// DefaultMiddleware returns the middleware chain that is used to wrap the security
+// package pages when no other chain is provided. Host applications can wrap their
+// own handlers with the same chain.
+func DefaultMiddleware(t *template.Template, am AccessManager, l log.Log) []Middleware {
+	return []Middleware{
+		Recovery(am),
+		RequestLogger(l),
+		SafeHeaders(),
+		SessionLookup(am),
+		ContentSecurity(),
+		CSRFMiddleware(t, am),
+	}
+}
+
+// SafeHeaders adds the headers from AddSafeHeaders() to every response.
+func SafeHeaders() Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			AddSafeHeaders(w)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// CSRFMiddleware adapts CSRFProtect() for use in a middleware chain.
+func CSRFMiddleware(t *template.Template, am AccessManager) Middleware {
+	return func(next http.Handler) http.Handler {
+		return CSRFProtect(t, am, next)
+	}
+}
+
+// Recovery catches a panic in a page handler, records it in the system log,
+// and returns a 500 error to the browser.
+func Recovery(am AccessManager) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				if v := recover(); v != nil {
+					if v == http.ErrAbortHandler {
+						panic(v)
+					}
+					session := am.GuestSession(HostFromRequest(r), IpFromRequest(r), r.UserAgent(), "")
+					am.Error(session, `http`, "Panic serving %s %s: %v\n%s", r.Method, r.URL.Path, v, debug.Stack())
+					http.Error(w, "Internal server error", http.StatusInternalServerError)
+				}
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequestLogger writes a line to the log for every request, containing the
+// response status and the time taken to respond.
+func RequestLogger(l log.Log) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(sw, r)
+			l.Debug("%s %s %s %d %s", IpFromRequest(r), r.Method, r.URL.Path, sw.status, fmt.Sprint(time.Since(start).Round(time.Millisecond)))
+		})
+	}
+}
+
+// statusWriter records the status code sent to the browser
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
@@ -0,0 +1,35 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddlewareChain(t *testing.T) {
+
+	var order []string
+	mark := func(name string) Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				order = append(order, name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+
+	h := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		order = append(order, "handler")
+	}), mark("a"), mark("b"), SafeHeaders())
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+
+	if len(order) != 3 || order[0] != "a" || order[1] != "b" || order[2] != "handler" {
+		t.Fatalf("Chain() should run middleware in order listed, then the handler. Got: %v", order)
+	}
+	if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Fatalf("SafeHeaders() should set X-Content-Type-Options")
+	}
+
+}
@@ -16,7 +16,7 @@ func AccountDetailsPage(t *template.Template, am AccessManager) func(w http.Resp
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		if !session.HasRole("s1") {
@@ -94,9 +94,7 @@ func AccountDetailsPage(t *template.Template, am AccessManager) func(w http.Resp
 				ShowErrorForbidden(w, r, t, session)
 				return
 			}
-			csrf := r.FormValue("csrf")
-			if csrf != session.CSRF() {
-
+			if !ValidCSRF(r, session) {
 				am.Warning(session, `security`, "Potential CSRF attack detected. "+r.URL.String())
 				ShowErrorForbidden(w, r, t, session)
 				return
@@ -107,7 +105,7 @@ func AccountDetailsPage(t *template.Template, am AccessManager) func(w http.Resp
 				return
 			}
 			if len(feedback) == 0 {
-				http.Redirect(w, r, "/z/accounts?q="+url.QueryEscape(r.FormValue("q")), http.StatusTemporaryRedirect)
+				http.Redirect(w, r, Path("/z/accounts?q=")+url.QueryEscape(r.FormValue("q")), http.StatusTemporaryRedirect)
 				return
 			}
 			p.Feedback = feedback
@@ -178,9 +176,9 @@ var accountDetailsTemplate = `
 {{define "account_details"}}
 {{template "admin_header" .}}
 <div id="actions">
-<a href="/z/account.details/{{.Person.Uuid}}?q={{.Query}}&audit=history" class="history">History</a>
+<a href="{{prefix}}/z/account.details/{{.Person.Uuid}}?q={{.Query}}&audit=history" class="history">History</a>
 {{if not .Person.LastSignin}}
-<a href="/z/accounts?q={{.Query}}&delete={{.Person.Uuid}}&csrf={{.Session.CSRF}}" class="delete">Delete</a>
+<a href="{{prefix}}/z/accounts?q={{.Query}}&delete={{.Person.Uuid}}&csrf={{csrf .Session}}" class="delete">Delete</a>
 {{end}}
 </div>
 
@@ -200,7 +198,7 @@ var accountDetailsTemplate = `
 }
 
 </style>
-<div style="margin-top: -1.7rem"><a class="back" href="/z/accounts?q={{.Query}}">Back</a></div>
+<div style="margin-top: -1.7rem"><a class="back" href="{{prefix}}/z/accounts?q={{.Query}}">Back</a></div>
 
 <div id="editform">
 <h1>{{.Person.FirstName}} {{.Person.LastName}}</h1>
@@ -209,7 +207,7 @@ var accountDetailsTemplate = `
 
 <form method="post">
 <input type="hidden" name="q" value="{{.Query}}"/>
-<input type="hidden" name="csrf" value="{{.Session.CSRF}}"/>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <table id="account_view" class="form">
 	<tr>
 		<th>First Name</th>
@@ -251,6 +249,10 @@ var accountDetailsTemplate = `
 		<th>Picklists</th>
 		<td><input type="checkbox" name="s4" value="s4"{{if .Person.HasRole "s4"}} checked="checked"{{end}}> Manage Picklists</td>
 	</tr>
+	<tr>
+		<th>Support Desk</th>
+		<td><input type="checkbox" name="s5" value="s5"{{if .Person.HasRole "s5"}} checked="checked"{{end}}> Work on support tickets</td>
+	</tr>
 
 	<tr><td>&nbsp;</td><td></td></tr>
 
@@ -274,7 +276,7 @@ var accountDetailsTemplate = `
 var accountHistoryTemplate = `
 {{define "account_history"}}
 {{template "admin_header" .}}
-<div style="margin-top: -0.9rem"><a class="back" href="/z/account.details/{{.Person.Uuid}}?q={{.Query}}">Back</a></div>
+<div style="margin-top: -0.9rem"><a class="back" href="{{prefix}}/z/account.details/{{.Person.Uuid}}?q={{.Query}}">Back</a></div>
 
 <h1>Change History for {{.Person.FirstName}} {{.Person.LastName}}</h1>
 
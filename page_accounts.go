@@ -16,7 +16,7 @@ func AccountsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		if !session.HasRole("s1") {
@@ -55,8 +55,7 @@ func AccountsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 			p.Email = r.FormValue("email")
 
 			if r.Method == "POST" {
-				csrf := r.FormValue("csrf")
-				if csrf != session.CSRF() {
+				if !ValidCSRF(r, session) {
 					am.Warning(session, `security`, "Potential CSRF attack detected. "+r.URL.String())
 					ShowErrorForbidden(w, r, t, session)
 					return
@@ -69,7 +68,7 @@ func AccountsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 				}
 				if len(feedback) == 0 {
 					// Saved with no errors
-					http.Redirect(w, r, "/z/accounts?q="+url.QueryEscape(r.FormValue("q")), http.StatusTemporaryRedirect)
+					http.Redirect(w, r, Path("/z/accounts?q=")+url.QueryEscape(r.FormValue("q")), http.StatusTemporaryRedirect)
 					return
 				}
 				p.Feedback = feedback
@@ -90,7 +89,7 @@ func AccountsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 		var feedback []string
 
 		if r.FormValue("delete") != "" {
-			if !session.HasRole("s3") || r.FormValue("csrf") != session.CSRF() {
+			if !session.HasRole("s3") || !ValidCSRF(r, session) {
 				ShowErrorForbidden(w, r, t, session)
 				return
 			}
@@ -214,7 +213,7 @@ var accountsTemplate = `
 {{if .Query}}
 <div id="actions">
 {{if $.Session.HasRole "s3"}}
-<a href="/z/accounts?q={{.Query}}&new=create" class="new_person">New Account</a>
+<a href="{{prefix}}/z/accounts?q={{.Query}}&new=create" class="new_person">New Account</a>
 {{end}}
 </div>
 {{end}}
@@ -227,7 +226,7 @@ var accountsTemplate = `
 {{end}}
 <h1>Accounts</h1>
 <div class="search">
-<form method="get" action="/z/accounts">
+<form method="get" action="{{prefix}}/z/accounts">
 <div id="q"><input type="search" name="q" id="qi" value="{{.Query}}" placeholder="First name, Last name, or Student number"/></div>
 </form>
 </div>
@@ -241,9 +240,9 @@ var accountsTemplate = `
 	</tr>
 {{range .Accounts}}{{if .Email}}
 	<tr>
-		<td><a href="/z/account.details/{{.Uuid}}?q={{$.Query}}">{{.FirstName}} {{.LastName}}</a></td>
-		<td><a href="/z/account.details/{{.Uuid}}?q={{$.Query}}">{{.Email}}</a></td>
-		<td><a href="/z/account.details/{{.Uuid}}?q={{$.Query}}">{{.LastSignin | log_date}}</a></td>
+		<td><a href="{{prefix}}/z/account.details/{{.Uuid}}?q={{$.Query}}">{{.FirstName}} {{.LastName}}</a></td>
+		<td><a href="{{prefix}}/z/account.details/{{.Uuid}}?q={{$.Query}}">{{.Email}}</a></td>
+		<td><a href="{{prefix}}/z/account.details/{{.Uuid}}?q={{$.Query}}">{{.LastSignin | log_date}}</a></td>
 	</tr>
 {{end}}{{end}}
 </table>
@@ -252,7 +251,7 @@ var accountsTemplate = `
 {{end}}{{end}}
 </div>
 
-<script type="text/javascript">
+<script nonce="{{nonce $.Session}}" type="text/javascript">
 	document.getElementById('qi').focus();
 </script>
 {{template "admin_footer" .}}
@@ -279,14 +278,14 @@ var accountCreateTemplate = `
 }
 
 </style>
-<div style="margin-top: -0.7rem"><a class="back" href="/z/accounts?q={{.Query}}">Back</a></div>
+<div style="margin-top: -0.7rem"><a class="back" href="{{prefix}}/z/accounts?q={{.Query}}">Back</a></div>
 
 {{if .Feedback}}<div class="feedback error">{{if eq 1 (len .Feedback)}}<p>{{index .Feedback 0}}</p>{{else}}<ul>{{range .Feedback}}<li>{{.}}</li>{{end}}</ul>{{end}}</div>{{end}}
 
 <div id="editform">
 <h1>New Account</h1>
 
-<form method="post"><input type="hidden" name="q" value="{{.Query}}"/><input type="hidden" name="csrf" value="{{.Session.CSRF}}"/>
+<form method="post"><input type="hidden" name="q" value="{{.Query}}"/><input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <table id="account_view" class="form">
 	<tr>
 		<th>First Name</th>
@@ -325,6 +324,10 @@ var accountCreateTemplate = `
 		<th>Picklists</th>
 		<td><input type="checkbox" name="s4" value="s4"> Manage Picklists</td>
 	</tr>
+	<tr>
+		<th>Support Desk</th>
+		<td><input type="checkbox" name="s5" value="s5"> Work on support tickets</td>
+	</tr>
 
 	<tr><td>&nbsp;</td><td></td></tr>
 
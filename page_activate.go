@@ -56,7 +56,7 @@ func ActivatePage(t *template.Template, am AccessManager) func(w http.ResponseWr
 		if err != nil {
 			p.Errors = append(p.Errors, fmt.Sprintf("Activation problem: %s", err))
 		}
-		p.AllowSignup = !(strings.ToLower(am.Setting().GetWithDefault(HostFromRequest(r), "self.signup", "no")) == "no")
+		p.AllowSignup = am.Setting().GetBool(HostFromRequest(r), "self.signup", false)
 
 		err = t.ExecuteTemplate(w, "signin_page", p)
 		if err != nil {
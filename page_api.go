@@ -22,6 +22,13 @@ func ApiPage(t *template.Template, am AccessManager) func(w http.ResponseWriter,
 			return
 		}
 
+		if !csrfSafeMethod(r.Method) && !ValidCSRF(r, session) {
+			am.Warning(session, `security`, "Potential CSRF attack detected: %s %s", r.Method, r.URL.String())
+			w.WriteHeader(403)
+			w.Write([]byte(`{"error":"Invalid CSRF token"}`))
+			return
+		}
+
 		path := r.URL.Path[1:]
 		parts := strings.Split(path, "/")
 		command := parts[len(parts)-1]
@@ -25,7 +25,7 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		if !session.HasRole("c6") {
@@ -70,6 +70,12 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 			LogCollection          []LogCollection
 		}
 
+		// Deleting, pausing and running a connector change state, so are only done on POST
+		if (r.FormValue("delete") != "" || r.FormValue("pause") != "" || r.FormValue("run") != "") && r.Method != "POST" {
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+
 		if r.FormValue("delete") != "" {
 			err := am.DeleteScheduledConnector(r.FormValue("delete"), session)
 			if err != nil {
@@ -138,7 +144,7 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 					if err != nil {
 						w.Write([]byte("AAARGH!!!! " + err.Error() + "\n"))
 					}
-					http.Redirect(w, r, "/z/connectors", http.StatusSeeOther)
+					http.Redirect(w, r, Path("/z/connectors"), http.StatusSeeOther)
 					return
 				} else {
 					ShowError(w, r, t, err, session)
@@ -198,7 +204,12 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 				if len(x) > 1 {
 					cs.Type = x[1]
 				}
-				cs.Value = p.ScheduledConnector.GetConfig(x[0])
+				if IsSecretConfigKey(x[0]) {
+					// Credentials are never sent back to the browser
+					cs.Type = "secret"
+				} else {
+					cs.Value = p.ScheduledConnector.GetConfig(x[0])
+				}
 				//cs.Value = r.FormValue(cs.FieldName)
 				p.Config = append(p.Config, cs)
 			}
@@ -211,14 +222,19 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 				connector.Frequency = r.FormValue("frequency")
 
 				for _, x := range cType.Config {
-					connector.SetConfig(x[0], r.FormValue("cv_"+strings.ToLower(strings.Replace(x[0], " ", "_", -1))))
+					value := r.FormValue("cv_" + strings.ToLower(strings.Replace(x[0], " ", "_", -1)))
+					if value == "" && IsSecretConfigKey(x[0]) {
+						// An empty credential leaves the current credential unchanged
+						continue
+					}
+					connector.SetConfig(x[0], value)
 				}
 				err := am.UpdateScheduledConnector(connector, session)
 				if err != nil {
 					ShowError(w, r, t, err, session)
 					return
 				}
-				http.Redirect(w, r, "/z/connectors", http.StatusSeeOther)
+				http.Redirect(w, r, Path("/z/connectors"), http.StatusSeeOther)
 			} else {
 				Render(r, w, t, "connector_edit", p)
 				return
@@ -273,7 +289,11 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 					if len(x) > 1 {
 						cs.Type = x[1]
 					}
-					cs.Value = r.FormValue(cs.FieldName)
+					if IsSecretConfigKey(x[0]) {
+						cs.Type = "secret"
+					} else {
+						cs.Value = r.FormValue(cs.FieldName)
+					}
 					p.Config = append(p.Config, cs)
 				}
 
@@ -290,7 +310,7 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 					for _, x := range cType.Config {
 						kv := KeyValue{
 							Key:   strings.ToLower(strings.Replace(x[0], " ", "_", -1)),
-							Value: r.FormValue("cv_" + strings.ToLower(strings.Replace(x[0], " ", "_", -1))),
+							Value: encryptConfigValue(x[0], r.FormValue("cv_"+strings.ToLower(strings.Replace(x[0], " ", "_", -1)))),
 						}
 						scheduled.Config = append(scheduled.Config, &kv)
 					}
@@ -299,7 +319,7 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 						ShowError(w, r, t, err, session)
 						return
 					}
-					http.Redirect(w, r, "/z/connectors", http.StatusSeeOther)
+					http.Redirect(w, r, Path("/z/connectors"), http.StatusSeeOther)
 				} else {
 					Render(r, w, t, "connector_add", p)
 					return
@@ -346,7 +366,7 @@ func ConnectorsPage(t *template.Template, am AccessManager) func(w http.Response
 var connectorAddTemplate = `
 {{define "connector_add"}}
 {{template "admin_header" .}}
-<div style="margin-top: -0.7rem"><a class="back" href="/z/connectors">Back</a></div>
+<div style="margin-top: -0.7rem"><a class="back" href="{{prefix}}/z/connectors">Back</a></div>
 
 <style type="text/css">
 #editform table {
@@ -423,7 +443,7 @@ td a.add::before {
 
 <form method="post">
 <input type="hidden" name="add" value="{{.Connector.Label}}" />
-<input type="hidden" name="csrf" value="{{.Session.CSRF}}"/>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <table id="connector_add" class="form">
 {{if .Connector.ExternalSystemPicker}}
 	<tr><td colspan="2"><h3 class="external">External System</h3></td></tr>
@@ -433,7 +453,7 @@ td a.add::before {
 {{range .ExternalSystems}}
 		<option value="{{.Uuid}}"{{if eq $.Uuid .Uuid}}selected{{end}}>{{.Describe}}</option>
 {{end}}
-		</select> <a href="/z/external.system.create?type={{.Connector.SystemType}}&connector={{.Connector.Label}}" class="add">Add External System</a>
+		</select> <a href="{{prefix}}/z/external.system.create?type={{.Connector.SystemType}}&connector={{.Connector.Label}}" class="add">Add External System</a>
 		</td>
 	</tr>
 	<tr><td>&nbsp;</td><td></td></tr>
@@ -471,6 +491,8 @@ td a.add::before {
 		<td>
 {{if eq .Type "bool"}}
 			<input type="checkbox" name="{{.FieldName}}" value="true"{{if eq .Value "true"}} checked{{end}}>
+{{else if eq .Type "secret"}}
+			<input type="password" name="{{.FieldName}}" value="" autocomplete="new-password">
 {{else}}
 			<input type="text" name="{{.FieldName}}" value="{{.Value}}">
 {{end}}
@@ -491,7 +513,7 @@ td a.add::before {
 var connectorEditTemplate = `
 {{define "connector_edit"}}
 {{template "admin_header" .}}
-<div style="margin-top: -0.7rem"><a class="back" href="/z/connectors">Back</a></div>
+<div style="margin-top: -0.7rem"><a class="back" href="{{prefix}}/z/connectors">Back</a></div>
 
 <style type="text/css">
 #editform table {
@@ -549,7 +571,7 @@ h3.config::before {
 
 <form method="post">
 <input type="hidden" name="edit" value="{{.ScheduledConnector.Uuid}}" />
-<input type="hidden" name="csrf" value="{{.Session.CSRF}}"/>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 
 <table id="connector_edit" class="form">
 {{if .ConnectorType.ExternalSystemPicker}}
@@ -594,6 +616,8 @@ h3.config::before {
 		<td>
 {{if eq .Type "bool"}}
 			<input type="checkbox" name="{{.FieldName}}" value="true"{{if eq .Value "true"}} checked{{end}}>
+{{else if eq .Type "secret"}}
+			<input type="password" name="{{.FieldName}}" value="" autocomplete="new-password">
 {{else}}
 			<input type="text" name="{{.FieldName}}" value="{{.Value}}">
 {{end}}
@@ -633,27 +657,39 @@ li.dir-1::before {
 	content: "\f30a";
 }
 
+table.connectors td form {
+	display: inline;
+	margin: 0;
+}
+table.connectors td button {
+	border: none;
+	background: none;
+	padding: 0;
+	cursor: pointer;
+}
 table.connectors td a,
-table.connectors td a:visited {
+table.connectors td a:visited,
+table.connectors td button {
 	font-size: 0.9em;
 	color: #aaa;
 }
-table.connectors td a::before {
+table.connectors td a::before,
+table.connectors td button::before {
 	font-family: FontAwesomeSolid;
 	opacity: 0.5;
 	padding-right: 0.3em;
 	padding-left: 0.6em;
 }
-table.connectors td a.pause::before {
+table.connectors td .pause::before {
 	content: "\f04c";
 }
-table.connectors td a.run::before {
+table.connectors td .run::before {
 	content: "\f2f1";
 }
-table.connectors td a.edit::before {
+table.connectors td .edit::before {
 	content: "\f044";
 }
-table.connectors td a.delete::before {
+table.connectors td .delete::before {
 	content: "\f2ed";
 	font-family: FontAwesome;
 }
@@ -692,22 +728,21 @@ tr.disabled td {
 	<td style="vertical-align:middle; text-align:center">{{if eq .ScheduledConnector.Frequency "daily"}}{{ampm .ScheduledConnector.Hour}}{{end}}{{if eq .ScheduledConnector.Frequency "weekly"}}((.ScheduledConnector.Day}} {{ampm .ScheduledConnector.Hour}}{{end}}</td>
 	<td style="vertical-align:middle">{{.ScheduledConnector.LastRun | log_date}}</td>
 	<td style="vertical-align:middle">
-		<a class="pause" href="/z/connectors?pause={{.ScheduledConnector.Uuid}}"></a>
+		<form method="post" action="{{prefix}}/z/connectors"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><button type="submit" name="pause" value="{{.ScheduledConnector.Uuid}}" class="pause" title="Pause"></button></form>
 {{if ne .ScheduledConnector.Label "formsite-student-course-import"}}
-		<a class="edit" href="/z/connectors?edit={{.ScheduledConnector.Uuid}}"></a>
+		<a class="edit" href="{{prefix}}/z/connectors?edit={{.ScheduledConnector.Uuid}}"></a>
 {{else}}
 		<a class="edit" href="/z/connector/formsite.map?uuid={{.ScheduledConnector.Uuid}}"></a>
 {{end}}
-		<a class="run" href="/z/connectors?run={{.ScheduledConnector.Uuid}}"></a>
-		<a class="delete" href="/z/connectors?delete={{.ScheduledConnector.Uuid}}"></a>
+		<form method="post" action="{{prefix}}/z/connectors"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><button type="submit" name="run" value="{{.ScheduledConnector.Uuid}}" class="run" title="Run"></button><button type="submit" name="delete" value="{{.ScheduledConnector.Uuid}}" class="delete" title="Delete"></button></form>
 	</td>
 </tr>
 {{end}}
 </tbody>
 </table>
 
-<script src='/tablesort.js'></script>
-<script>new Tablesort(document.getElementById('scheduled_connectors'));</script>
+<script nonce="{{nonce $.Session}}" src='/tablesort.js'></script>
+<script nonce="{{nonce $.Session}}">new Tablesort(document.getElementById('scheduled_connectors'));</script>
 
 {{else}}
 <p>There are no connectors scheduled to run. You can configure scheduled connectors below.</p>
@@ -717,7 +752,7 @@ tr.disabled td {
 <ul class="connectors" style="list-style:none">
 {{range .Connectors}}
 <li class="dir{{.Direction}}"><img src="{{.SystemIcon}}" style="width:1.3em; height: 1.3em" /> {{.Name}} 
-{{if ne .Label "formsite-student-course-import"}}<a href="/z/connectors?add={{.Label}}">Add</a>{{else}}<a href="/z/connector/formsite.add1?add={{.Label}}">Add</a>{{end}}
+{{if ne .Label "formsite-student-course-import"}}<a href="{{prefix}}/z/connectors?add={{.Label}}">Add</a>{{else}}<a href="/z/connector/formsite.add1?add={{.Label}}">Add</a>{{end}}
 </li>
 {{end}}
 </ul>
@@ -725,7 +760,7 @@ tr.disabled td {
 <h3>Recent Connector Activity</h3>
 <ul>
 {{range .LogCollection}}
-<li><a href="/z/connectors?log={{.Uuid}}">{{.Began | log_date}} {{.Component}}</a></li>
+<li><a href="{{prefix}}/z/connectors?log={{.Uuid}}">{{.Began | log_date}} {{.Component}}</a></li>
 {{end}}
 </ul>
 
@@ -734,7 +769,7 @@ tr.disabled td {
 
 {{define "connector_log"}}
 {{template "admin_header" .}}
-<div style="margin-top: -0.7rem"><a class="back" href="/z/connectors">Back</a></div>
+<div style="margin-top: -0.7rem"><a class="back" href="{{prefix}}/z/connectors">Back</a></div>
 
 <style type="text/css">
 tr.DEBUG td {
@@ -759,7 +794,7 @@ tr td:first-child {
 
 <h1>Connector Log: ({{len .LogEntry}} lines)</h1>
 
-<script>
+<script nonce="{{nonce $.Session}}">
 var tdi = false
 function toggleDebug() {
 		if (tdi == false) {
@@ -769,10 +804,13 @@ function toggleDebug() {
 		}
 		tdi = !tdi
 }
+document.addEventListener('DOMContentLoaded', function() {
+	document.getElementById('toggle_debug').addEventListener('click', function(e) { e.preventDefault(); toggleDebug(); });
+});
 </script>
 
 <div class="togglebar" style="text-align:right; font-size: 0.85em; color: #999">
-<a onclick="toggleDebug()">Show Debug Messages</a>
+<a id="toggle_debug" href="#">Show Debug Messages</a>
 </div>
 
 <table>
@@ -28,7 +28,7 @@ func ExternalSystemCreatePage(t *template.Template, am AccessManager) func(w htt
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		if !session.HasRole("c6") && !session.HasRole("s1") {
@@ -45,18 +45,18 @@ func ExternalSystemCreatePage(t *template.Template, am AccessManager) func(w htt
 			ConnectorLabel: r.FormValue(`connector`),
 		}
 		if p.SystemType == `Mailchimp` {
-			p.Config = append(p.Config, &ConfSet{"Mailchimp API Key", "mailchimp.key", "", "string"})
+			p.Config = append(p.Config, &ConfSet{"Mailchimp API Key", "mailchimp.key", "", "secret"})
 		}
 		if p.SystemType == `Moodle` {
 			p.Config = append(p.Config, &ConfSet{"Moodle URL", "moodle.url", "", "string"})
-			p.Config = append(p.Config, &ConfSet{"Moodle API Key", "moodle.key", "", "string"})
+			p.Config = append(p.Config, &ConfSet{"Moodle API Key", "moodle.key", "", "secret"})
 		}
 		if p.SystemType == `Formsite` {
 			p.Config = append(p.Config, &ConfSet{"Formsite URL", "formsite.url", "", "string"})
-			p.Config = append(p.Config, &ConfSet{"Formsite API Key", "formsite.key", "", "string"})
+			p.Config = append(p.Config, &ConfSet{"Formsite API Key", "formsite.key", "", "secret"})
 		}
 		if p.SystemType == `GoogleSheets` {
-			p.Config = append(p.Config, &ConfSet{"Client Secret", "client.secret", "", "string"})
+			p.Config = append(p.Config, &ConfSet{"Client Secret", "client.secret", "", "secret"})
 		}
 
 		if r.Method == "POST" {
@@ -70,7 +70,7 @@ func ExternalSystemCreatePage(t *template.Template, am AccessManager) func(w htt
 				if p.SystemType == "Formsite" {
 					http.Redirect(w, r, "/z/connector/formsite.add1?&external_system_uuid="+es.Uuid(), http.StatusSeeOther)
 				} else {
-					http.Redirect(w, r, "/z/connectors?add="+url.QueryEscape(r.FormValue("connector"))+"&uuid="+es.Uuid(), http.StatusSeeOther)
+					http.Redirect(w, r, Path("/z/connectors?add=")+url.QueryEscape(r.FormValue("connector"))+"&uuid="+es.Uuid(), http.StatusSeeOther)
 				}
 				return
 			}
@@ -132,7 +132,7 @@ var externalSystemCreateTemplate = `
 }
 
 </style>
-<div style="margin-top: -0.7rem"><a class="back" href="/z/connectors?add={{.ConnectorLabel}}">Back</a></div>
+<div style="margin-top: -0.7rem"><a class="back" href="{{prefix}}/z/connectors?add={{.ConnectorLabel}}">Back</a></div>
 
 {{if .Feedback}}<div class="feedback error">{{if eq 1 (len .Feedback)}}<p>{{index .Feedback 0}}</p>{{else}}<ul>{{range .Feedback}}<li>{{.}}</li>{{end}}</ul>{{end}}</div>{{end}}
 
@@ -144,7 +144,7 @@ var externalSystemCreateTemplate = `
 <form method="post">
 <input type="hidden" name="type" value="{{.SystemType}}"/>
 <input type="hidden" name="connector" value="{{.ConnectorLabel}}"/>
-<input type="hidden" name="csrf" value="{{.Session.CSRF}}"/>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <table id="course_edit" class="form">
 	<tr>
 		<th>System Type</th>
@@ -154,7 +154,7 @@ var externalSystemCreateTemplate = `
 {{range .Config}}
 	<tr>
 		<th>{{.English}}</th>
-		<td><input type="text" name="{{.FieldName}}" value="{{.Value}}"></td>
+		<td>{{if eq .Type "secret"}}<input type="password" name="{{.FieldName}}" value="" autocomplete="new-password">{{else}}<input type="text" name="{{.FieldName}}" value="{{.Value}}">{{end}}</td>
 	</tr>
 {{end}}
 
@@ -1,6 +1,7 @@
 package security
 
 import (
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
@@ -19,6 +20,7 @@ func FeedbackPage(t *template.Template, am AccessManager, tm TicketManager) func
 		CurrentUrl       string
 		Feedback         []string
 		BackLink         string
+		CanAttach        bool
 	}
 
 	return func(w http.ResponseWriter, r *http.Request) {
@@ -28,7 +30,7 @@ func FeedbackPage(t *template.Template, am AccessManager, tm TicketManager) func
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signin", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signin"), http.StatusTemporaryRedirect)
 			return
 		}
 		AddSafeHeaders(w)
@@ -42,6 +44,7 @@ func FeedbackPage(t *template.Template, am AccessManager, tm TicketManager) func
 			CurrentUrl:       r.Referer(),
 			CurrentUserAgent: session.UserAgent(),
 			CurrentIP:        session.IP(),
+			CanAttach:        tm.BlobStore() != nil,
 		}
 
 		if r.FormValue("message_subject") != "" {
@@ -68,15 +71,36 @@ func FeedbackPage(t *template.Template, am AccessManager, tm TicketManager) func
 		}
 
 		if r.Method == "POST" {
-			csrf := r.FormValue("csrf")
-			if csrf != session.CSRF() {
+			if !ValidCSRF(r, session) {
 				am.Warning(session, `security`, "Potential CSRF attack detected: "+r.URL.String())
 				ShowErrorForbidden(w, r, t, session)
 				return
 			}
 
-			_, err = tm.AddTicket(
-				TicketOpen,
+			workflow, err := GetTicketWorkflow(am.Setting(), am.PicklistStore(), session.Site())
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+
+			// Screenshots are checked before the ticket is raised, so a rejected file can be replaced
+			files, err := readTicketFiles(am.Setting(), session.Site(), r, "screenshot")
+			if err == nil && len(files) > 0 && !p.CanAttach {
+				err = errors.New("Files can not be attached to feedback on this site.")
+			}
+			for _, f := range files {
+				if err == nil {
+					_, err = checkTicketFile(am.Setting(), session.Site(), f)
+				}
+			}
+			if err != nil {
+				p.Feedback = append(p.Feedback, err.Error())
+				Render(r, w, t, "feedback_send", p)
+				return
+			}
+
+			ticket, err := tm.AddTicket(
+				workflow.DefaultStatus(),
 				TechnicalSupportTicket,
 				session.PersonUuid(),
 				session.FirstName(),
@@ -88,6 +112,9 @@ func FeedbackPage(t *template.Template, am AccessManager, tm TicketManager) func
 				[]string{"feedback"},
 				[]TicketViewer{}, []TicketViewer{},
 				session)
+			if err == nil && len(files) > 0 {
+				_, err = tm.AddTicketAttachments(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), files, session)
+			}
 
 			if err == nil {
 				if p.CurrentUrl == "" {
@@ -157,14 +184,19 @@ var feedbackTemplate = `
 
 <p>Please take a moment to submit your feedback, comments, or suggestions.</p>
 
-<form method="post" action="/z/feedback">
-<input type="hidden" name="csrf" value="{{.Session.CSRF}}"/>
+{{if .Feedback}}<div class="feedback error">{{if eq 1 (len .Feedback)}}<p>{{index .Feedback 0}}</p>{{else}}<ul>{{range .Feedback}}<li>{{.}}</li>{{end}}</ul>{{end}}</div>{{end}}
+
+<form method="post" action="{{prefix}}/z/feedback"{{if .CanAttach}} enctype="multipart/form-data"{{end}}>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <input type="hidden" name="current_url" value="{{.CurrentUrl}}"/>
 
 <b>Subject</b>
 <input type="text" name="message_subject" placeholder="Subject of your feedback or suggestion" value="{{.MessageSubject}}"/>
 <b>Details</b>
 <textarea name="message_text">{{.MessageText}}</textarea>
+{{if .CanAttach}}<b>Screenshots</b>
+<input type="file" name="screenshot" accept="image/*" multiple="multiple"/>
+{{end}}
 
 
 <input type="submit" value="Send Feedback">
@@ -64,7 +64,8 @@ var ForgotTemplate = `
 	<h2>{{.Session.Theme.Name}}</h2>
 </div>
 
-<form method="post" action="/forgot/" id="forgot">
+<form method="post" action="{{prefix}}/forgot/" id="forgot">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <h3>Request Password Reset Email</h3>
 
 <label for="forgot_email">
@@ -79,7 +80,7 @@ var ForgotTemplate = `
 
 </form>
 
-<script type="text/javascript">
+<script nonce="{{nonce $.Session}}" type="text/javascript">
 	document.getElementById('forgot_email').focus();
 </script>
 
@@ -16,7 +16,7 @@ func PicklistPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		AddSafeHeaders(w)
@@ -126,11 +126,11 @@ var picklistTemplate = `
 {{define "picklist_admin"}}
 {{template "admin_header" .}}
 <div class="submenu">
-<a href="/z/picklist/" class="picklist">Drop-down menus</a>
-<a href="/z/organisations">Organisations</a>
+<a href="{{prefix}}/z/picklist/" class="picklist">Drop-down menus</a>
+<a href="{{prefix}}/z/organisations">Organisations</a>
 </div>
 <div id="actions">
-{{if $.Session.HasRole "s4"}}<a href="javascript:document.getElementById('myModal').style.display='block'" class="note">Add Item</a>{{end}}
+{{if $.Session.HasRole "s4"}}<a href="#" id="show_modal" class="note">Add Item</a>{{end}}
 </div>
 
 <style type="text/css">
@@ -256,7 +256,7 @@ table { margin-left: auto; margin-right: auto; }
 <div class="picklist_menu">
 <ul>
 {{range .Picklists}}
-<li><a href="/z/picklist/{{.}}">{{.}}</a></li>
+<li><a href="{{prefix}}/z/picklist/{{.}}">{{.}}</a></li>
 {{end}}
 </ul>
 </div>
@@ -279,7 +279,7 @@ table { margin-left: auto; margin-right: auto; }
 	<td>{{.Key}}</td>
 	<td>{{.Value}}</td>
 	<td>{{.Description}}</td>
-	<td><a class="{{if .IsDeprecated}}deprecated{{else}}not_deprecated{{end}}"{{if $.Session.HasRole "s4"}} href="/z/picklist/{{.Picklist}}?toggle={{.Key}}"{{end}}></a></td>
+	<td><a class="{{if .IsDeprecated}}deprecated{{else}}not_deprecated{{end}}"{{if $.Session.HasRole "s4"}} href="{{prefix}}/z/picklist/{{.Picklist}}?toggle={{.Key}}"{{end}}></a></td>
 	<td>{{.Index}}</td>
 </tr>
 {{end}}
@@ -287,9 +287,9 @@ table { margin-left: auto; margin-right: auto; }
 </table>
 </div>
 
-<script src='/tablesort.js'></script>
-<script src='/tablesort.number.js'></script>
-<script>new Tablesort(document.getElementById('picklist_item_table'));</script>
+<script nonce="{{nonce $.Session}}" src='/tablesort.js'></script>
+<script nonce="{{nonce $.Session}}" src='/tablesort.number.js'></script>
+<script nonce="{{nonce $.Session}}">new Tablesort(document.getElementById('picklist_item_table'));</script>
 
 
 <div id="myModal" class="modal">
@@ -299,6 +299,7 @@ table { margin-left: auto; margin-right: auto; }
     <h2>Add Picklist Item</h2>
   </div>
   <form method="post">
+  <input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 	<div class="modal-body">
 	<table>
 		<tr><th>Key</th><td><input type="text" name="key" placeholder="key"/></td></tr>
@@ -312,10 +313,12 @@ table { margin-left: auto; margin-right: auto; }
   </div>
 </div>
 </div>
-<script type="text/javascript">
+<script nonce="{{nonce $.Session}}" type="text/javascript">
 var modal = document.getElementById('myModal');
 var span = document.getElementsByClassName("close")[0];
 span.onclick = function() { modal.style.display = "none"; }
+var show = document.getElementById('show_modal');
+if (show) { show.onclick = function(e) { e.preventDefault(); modal.style.display = "block"; } }
 window.onclick = function(event) { if (event.target == modal) { modal.style.display = "none"; } }
 </script>
 
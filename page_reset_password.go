@@ -102,7 +102,8 @@ var ResetPasswordTemplate = `
 	<h2>{{.Session.Theme.Name}}</h2>
 </div>
 
-<form method="post" action="/reset.password/{{.Token}}" id="forgot">
+<form method="post" action="{{prefix}}/reset.password/{{.Token}}" id="forgot">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <h3>Request Password Account Password</h3>
 
 <label for="new_password1">
@@ -121,7 +122,7 @@ var ResetPasswordTemplate = `
 
 </form>
 
-<script type="text/javascript">
+<script nonce="{{nonce $.Session}}" type="text/javascript">
 	document.getElementById('new_password1').focus();
 </script>
 
@@ -0,0 +1,53 @@
+package security
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var lastTicketEscalationCheck time.Time
+
+// RunTicketEscalationPage is called by cron to escalate the open tickets of each site
+// that have passed their ActionAfter time, or missed an SLA target.
+func RunTicketEscalationPage(t *template.Template, am AccessManager, tm TicketManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+
+		if lastTicketEscalationCheck.Unix()+60*5 > now.Unix() && r.FormValue("go") == "" {
+			w.Write([]byte("Sleeping. Try again shortly."))
+			return
+		}
+
+		for _, virtualHost := range am.AvailableSites() {
+			if virtualHost == "" || virtualHost == "keyspaces" {
+				continue
+			}
+			if !am.Setting().GetBool(virtualHost, "ticket.escalation", true) {
+				w.Write([]byte(fmt.Sprintf(" - %s (disabled)\n", virtualHost)))
+				continue
+			}
+
+			if virtualHost == "localhost" || strings.HasPrefix(virtualHost, "dev") {
+				// Tasks are not available in the development environment
+				count, err := NewTicketEscalator(am, tm).Escalate(virtualHost, now)
+				if err != nil {
+					w.Write([]byte("Unhandled error: " + err.Error() + "\n"))
+					continue
+				}
+				w.Write([]byte(fmt.Sprintf(" - %s (%d escalated)\n", virtualHost, count)))
+				continue
+			}
+			if err := queueTicketEscalation(am, virtualHost); err != nil {
+				w.Write([]byte("Unhandled error: " + err.Error() + "\n"))
+				continue
+			}
+			w.Write([]byte(fmt.Sprintf(" - %s (queued)\n", virtualHost)))
+		}
+
+		lastTicketEscalationCheck = now
+		w.Write([]byte("OK"))
+	}
+}
@@ -1,10 +1,13 @@
 package security
 
 import (
+	"errors"
 	"html/template"
 	"net/http"
+	"net/url"
 	"sort"
 	"strings"
+	"time"
 )
 
 func SettingsPage(t *template.Template, am AccessManager) func(w http.ResponseWriter, r *http.Request) {
@@ -15,11 +18,11 @@ func SettingsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		if !session.HasRole("s1") {
@@ -28,61 +31,247 @@ func SettingsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 		}
 		AddSafeHeaders(w)
 
+		type EditPageInfo struct {
+			Page
+			Key        string
+			Value      string
+			Definition *SettingDefinition
+			Errors     []string
+			Layer      SettingLayer // Layer the effective value comes from
+			Effective  string       // Effective value, if it does not come from the site layer
+			EnvName    string
+		}
+
 		key := strings.TrimSpace(r.FormValue("key"))
 		value := strings.TrimSpace(r.FormValue("value"))
 		if key != "" {
-			if !session.HasRole("s2") {
+			if !session.HasRole("s2") || r.Method != "POST" {
 				ShowErrorForbidden(w, r, t, session)
 				return
 			}
-			err := am.Setting().Put(session.Site(), key, value)
-			if err != nil {
-				ShowError(w, r, t, err, session)
+			d := LookupSettingDefinition(key)
+			if err := ValidateSetting(key, value); err != nil {
+				p := &EditPageInfo{
+					Page: Page{
+						Session: session,
+						Title:   []string{"Edit setting", "System Settings"}},
+					Key:        key,
+					Value:      value,
+					Definition: d,
+					Errors:     []string{err.Error()},
+				}
+				Render(r, w, t, "setting_edit", p)
 				return
 			}
+			// Secrets are never sent to the browser, so an empty value leaves the secret unchanged
+			if d == nil || d.Type != SettingSecret || value != "" {
+				err := am.Setting().PutAs(session.Site(), key, value, session)
+				if err != nil {
+					ShowError(w, r, t, err, session)
+					return
+				}
+			}
 		}
 
 		delete := strings.TrimSpace(r.FormValue("delete"))
 		if delete != "" {
-			if !session.HasRole("s2") {
+			if !session.HasRole("s2") || r.Method != "POST" {
 				ShowErrorForbidden(w, r, t, session)
 				return
 			}
-			err := am.Setting().Put(session.Site(), delete, "")
+			err := am.Setting().PutAs(session.Site(), delete, "", session)
 			if err != nil {
 				ShowError(w, r, t, err, session)
 				return
 			}
 		}
 
-		edit := strings.TrimSpace(r.FormValue("edit"))
-		if edit != "" {
+		export := strings.TrimSpace(r.FormValue("export"))
+		if export != "" {
+			if !session.HasRole("s2") {
+				ShowErrorForbidden(w, r, t, session)
+				return
+			}
+			// Secrets are never sent to the browser, use ExportSiteConfig() to copy them between sites
+			c, err := ExportSiteConfig(am, session.Site(), false)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+			data, err := c.Marshal(export)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+			if export == SiteConfigJSON {
+				w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			} else {
+				export = SiteConfigYAML
+				w.Header().Set("Content-Type", "application/yaml; charset=utf-8")
+			}
+			w.Header().Set("Content-Disposition", "attachment; filename=\"settings."+export+"\"")
+			w.Write(data)
+			return
+		}
 
-			type PageInfo struct {
+		if r.FormValue("import") != "" {
+			if !session.HasRole("s2") {
+				ShowErrorForbidden(w, r, t, session)
+				return
+			}
+			type ImportPageInfo struct {
 				Page
-				Key   string
-				Value string
+				Document string
+				DryRun   bool
+				Applied  bool
+				Changes  []SiteConfigChange
+				Errors   []string
 			}
-			value := am.Setting().GetWithDefault(session.Site(), edit, "")
+			p := &ImportPageInfo{
+				Page: Page{
+					Session: session,
+					Title:   []string{"Import settings", "System Settings"}},
+				Document: r.FormValue("document"),
+				DryRun:   r.FormValue("dry_run") != "" || r.Method != "POST",
+			}
+			if strings.TrimSpace(p.Document) != "" && r.Method == "POST" {
+				c, err := ParseSiteConfig([]byte(p.Document))
+				if err == nil {
+					p.Changes, err = ApplySiteConfig(am, session.Site(), c, session, true)
+				}
+				if err == nil && !p.DryRun {
+					for _, change := range p.Changes {
+						if change.Kind == "picklist" && !session.HasRole("s4") {
+							ShowErrorForbidden(w, r, t, session)
+							return
+						}
+					}
+					p.Changes, err = ApplySiteConfig(am, session.Site(), c, session, false)
+					p.Applied = err == nil
+				}
+				if err != nil {
+					p.Errors = append(p.Errors, err.Error())
+				}
+			}
+			Render(r, w, t, "settings_import", p)
+			return
+		}
+
+		history := strings.TrimSpace(r.FormValue("history"))
+		if history != "" {
+			changeLog, err := am.GetEntityChangeLog(SettingEntityUuid(history), session)
 			if err != nil {
 				ShowError(w, r, t, err, session)
 				return
 			}
+
+			rollback := strings.TrimSpace(r.FormValue("rollback"))
+			if rollback != "" && r.Method == "POST" {
+				if !session.HasRole("s2") {
+					ShowErrorForbidden(w, r, t, session)
+					return
+				}
+				var change EntityAuditLogCollection
+				for _, c := range changeLog {
+					if c.GetUuid() == rollback && len(c.GetItems()) > 0 {
+						change = c
+					}
+				}
+				if change == nil {
+					ShowErrorNotFound(w, r, t, session)
+					return
+				}
+				value := change.GetItems()[0].GetNewValue()
+				if IsRedactedSettingValue(value) {
+					ShowError(w, r, t, errors.New("Secret settings can not be rolled back, as their values are not recorded."), session)
+					return
+				}
+				if err := am.Setting().PutAs(session.Site(), history, value, session); err != nil {
+					ShowError(w, r, t, err, session)
+					return
+				}
+				http.Redirect(w, r, Path("/z/settings?history=")+url.QueryEscape(history), http.StatusSeeOther)
+				return
+			}
+
+			type Change struct {
+				Uuid       string
+				Date       time.Time
+				PersonName string
+				OldValue   string
+				NewValue   string
+				Restore    bool // The value set by this change can be restored
+			}
+			type PageInfo struct {
+				Page
+				Key     string
+				Changes []Change
+			}
 			p := &PageInfo{
+				Page: Page{
+					Session: session,
+					Title:   []string{"Setting history", "System Settings"}},
+				Key: history,
+			}
+			current := ""
+			if v := am.Setting().Get(session.Site(), history); v != nil {
+				current = settingAuditValue(history, *v)
+			}
+			for _, c := range changeLog {
+				for _, i := range c.GetItems() {
+					p.Changes = append(p.Changes, Change{
+						Uuid:       c.GetUuid(),
+						Date:       c.GetDate(),
+						PersonName: c.GetPersonName(),
+						OldValue:   i.GetOldValue(),
+						NewValue:   i.GetNewValue(),
+						Restore:    session.HasRole("s2") && i.GetNewValue() != current && !IsRedactedSettingValue(i.GetNewValue()),
+					})
+				}
+			}
+			Render(r, w, t, "setting_history", p)
+			return
+		}
+
+		edit := strings.TrimSpace(r.FormValue("edit"))
+		if edit != "" {
+			d := LookupSettingDefinition(edit)
+			value := ""
+			if v := am.Setting().Get(session.Site(), edit); v != nil {
+				value = *v
+			}
+			if d != nil && d.Type == SettingSecret {
+				value = ""
+			}
+			p := &EditPageInfo{
 				Page: Page{
 					Session: session,
 					Title:   []string{"Edit setting", "System Settings"}},
-				Key:   edit,
-				Value: value,
+				Key:        edit,
+				Value:      value,
+				Definition: d,
+				EnvName:    SettingEnvName(edit),
+			}
+			p.Effective, p.Layer, _ = ResolveSetting(am.Setting(), session.Site(), edit)
+			if p.Layer == SettingLayerSite || (d != nil && d.Type == SettingSecret) {
+				p.Effective = ""
 			}
 			Render(r, w, t, "setting_edit", p)
 
 			return
 		}
 
+		type SettingRow struct {
+			Key         string
+			Value       string
+			Layer       SettingLayer // Where the value shown comes from
+			Secret      bool
+			Description string
+		}
+
 		type PageInfo struct {
 			Page
-			Settings [][]string
+			Settings []SettingRow
 		}
 
 		err = r.ParseForm()
@@ -91,15 +280,30 @@ func SettingsPage(t *template.Template, am AccessManager) func(w http.ResponseWr
 			return
 		}
 
-		var values [][]string
+		var values []SettingRow
 
-		items := am.Setting().List(session.Site())
-		for k, v := range items {
-			values = append(values, []string{k, v})
+		names := make(map[string]bool)
+		for _, d := range SettingDefinitions() {
+			names[d.Name] = true
+		}
+		for k := range am.Setting().List(GlobalSettingSite) {
+			names[k] = true
+		}
+		for k := range am.Setting().List(session.Site()) {
+			names[k] = true
+		}
+		for k := range names {
+			row := SettingRow{Key: k}
+			row.Value, row.Layer, _ = ResolveSetting(am.Setting(), session.Site(), k)
+			if d := LookupSettingDefinition(k); d != nil {
+				row.Secret = d.Type == SettingSecret
+				row.Description = d.Description
+			}
+			values = append(values, row)
 		}
 
 		sort.Slice(values, func(i, j int) bool {
-			return values[j][0] > values[i][0]
+			return values[j].Key > values[i].Key
 		})
 
 		p := &PageInfo{
@@ -119,7 +323,9 @@ var settingsTemplate = `
 {{template "admin_header" .}}
 <div id="actions">
 {{if $.Session.HasRole "s2"}}
-<a href="javascript:document.getElementById('myModal').style.display='block'" class="note">Add Setting</a>
+<a href="#" id="show_modal" class="note">Add Setting</a>
+<a href="{{prefix}}/z/settings?export=yaml" class="export">Export</a>
+<a href="{{prefix}}/z/settings?import=1" class="import">Import</a>
 {{end}}
 </div>
 
@@ -148,18 +354,34 @@ var settingsTemplate = `
 }
 @keyframes animatetop { from {top: -300px; opacity: 0} to {top: 0; opacity: 1} }
 
-table tr:hover a.delete::before {
+form.delete {
+	margin: 0;
+}
+form.delete button {
+	border: none;
+	background: none;
+	padding: 0;
+	cursor: pointer;
+}
+table tr:hover form.delete button::before {
 	opacity: 0.5;
 }
-table tr:hover a.delete:hover::before {
+table tr:hover form.delete button:hover::before {
 	opacity: 0.5;
 	color: red;
 }
-a.delete::before {
+form.delete button::before {
 	font-family: FontAwesome;
 	content: "\f2ed";
 	opacity: 0.1;
 }
+td.default, td.default a, td.global, td.global a, td.environment, td.environment a {
+	color: #999;
+}
+td.layer {
+	color: #aac;
+	font-size: 0.8em;
+}
 </style>
 
 {{if .Settings}}{{else}}
@@ -172,15 +394,17 @@ a.delete::before {
 	<tr>
 		<th>Name</th>
 		<th>Value</th>
+		<th>Source</th>
 	</tr>
-	{{range .Settings}}{{$k := index . 0}}{{$v := index . 1}}{{if ne $k "smtp.password"}}
-	<tr>
-		<td>{{if $.Session.HasRole "s2"}}<a href="/z/settings?edit={{$k}}">{{$k}}</a>{{else}}{{$k}}{{end}}</td>
-		<td>{{if $.Session.HasRole "s2"}}<a href="/z/settings?edit={{$k}}">{{$v}}{{else}}{{$v}}{{end}}</a></td>
-		<td>{{if $.Session.HasRole "s2"}}<a href="/z/settings?delete={{$k}}" class="delete"></a>{{end}}</td>
-		<td>{{if $.Session.HasRole "s2"}}<a href="/z/settings?edit={{$k}}" class="edit"></a>{{end}}</td>
+	{{range .Settings}}{{$k := .Key}}
+	<tr{{if .Description}} title="{{.Description}}"{{end}}>
+		<td>{{if $.Session.HasRole "s2"}}<a href="{{prefix}}/z/settings?edit={{$k}}">{{$k}}</a>{{else}}{{$k}}{{end}}</td>
+		<td class="{{.Layer}}">{{if .Secret}}{{if .Value}}********{{end}}{{else if $.Session.HasRole "s2"}}<a href="{{prefix}}/z/settings?edit={{$k}}">{{.Value}}</a>{{else}}{{.Value}}{{end}}</td>
+		<td class="layer">{{if ne .Layer "site"}}{{.Layer}}{{end}}</td>
+		<td>{{if and ($.Session.HasRole "s2") (eq .Layer "site")}}<form method="post" class="delete"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><input type="hidden" name="delete" value="{{$k}}"/><button type="submit" title="Delete"></button></form>{{end}}</td>
+		<td>{{if $.Session.HasRole "s2"}}<a href="{{prefix}}/z/settings?edit={{$k}}" class="edit"></a>{{end}}</td>
 	</tr>
-{{end}}{{end}}
+{{end}}
 </table>
 {{else}}
 <p style="text-align:center; color: #a55;">No settings found.</p>
@@ -195,6 +419,7 @@ a.delete::before {
     <h2>Add System Setting</h2>
   </div>
   <form method="post">
+  <input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 	<div class="modal-body">
 	<table>
 	<tr><th>Key</th><td><input type="text" name="key" placeholder="setting.key"/></td></tr>
@@ -206,10 +431,12 @@ a.delete::before {
   </div>
 </div>
 </div>
-<script type="text/javascript">
+<script nonce="{{nonce $.Session}}" type="text/javascript">
 var modal = document.getElementById('myModal');
 var span = document.getElementsByClassName("close")[0];
 span.onclick = function() { modal.style.display = "none"; }
+var show = document.getElementById('show_modal');
+if (show) { show.onclick = function(e) { e.preventDefault(); modal.style.display = "block"; } }
 window.onclick = function(event) { if (event.target == modal) { modal.style.display = "none"; } }
 </script>
 
@@ -221,7 +448,8 @@ window.onclick = function(event) { if (event.target == modal) { modal.style.disp
 var settingEditTemplate = `
 {{define "setting_edit"}}
 {{template "admin_header" .}}
-<div style="margin-top: -0.8rem"><a class="back" href="/z/settings">Settings</a></div>
+<div style="margin-top: -0.8rem"><a class="back" href="{{prefix}}/z/settings">Settings</a></div>
+<div id="actions"><a href="{{prefix}}/z/settings?history={{.Key}}" class="history">History</a></div>
 
 <style type="text/css">
 #editform table {
@@ -237,13 +465,20 @@ var settingEditTemplate = `
 #editform table th {
         vertical-align:top;
 }
+#editform p.help {
+        color: #777;
+        margin: 0.3em 0 0 0;
+        max-width: 30em;
+}
 
 </style>
 
 <div id="editform">
 <h1>Edit Setting</h1>
+{{if .Errors}}<div class="feedback error">{{if eq 1 (len .Errors)}}<p>{{index .Errors 0}}</p>{{else}}<ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}</div>{{end}}
 
 <form method="post">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <table id="setting_edit" class="form"><input type="hidden" name="key" value="{{.Key}}"/>
         <tr>
                 <th>Key</th>
@@ -251,9 +486,24 @@ var settingEditTemplate = `
         </tr>
         <tr>
                 <th>Value</th>
-                <td><input type="text" name="value" value="{{.Value}}"/></td>
+                <td>{{with .Definition}}{{if .Allowed}}{{if eq .Type "list"}}<textarea name="value" rows="4" cols="40">{{$.Value}}</textarea>{{else}}<select name="value"><option value=""{{if eq $.Value ""}} selected{{end}}>Default ({{.Default}})</option>{{range .Allowed}}<option value="{{.}}"{{if eq $.Value .}} selected{{end}}>{{.}}</option>{{end}}</select>{{end}}
+                {{else if eq .Type "bool"}}<select name="value"><option value=""{{if eq $.Value ""}} selected{{end}}>Default ({{.Default}})</option><option value="yes"{{if eq $.Value "yes"}} selected{{end}}>yes</option><option value="no"{{if eq $.Value "no"}} selected{{end}}>no</option></select>
+                {{else if eq .Type "int"}}<input type="number" name="value" value="{{$.Value}}" placeholder="{{.Default}}"/>
+                {{else if eq .Type "email"}}<input type="email" name="value" value="{{$.Value}}" placeholder="{{.Default}}"/>
+                {{else if eq .Type "url"}}<input type="url" name="value" value="{{$.Value}}" placeholder="{{.Default}}"/>
+                {{else if eq .Type "secret"}}<input type="password" name="value" value="" autocomplete="new-password" placeholder="Unchanged"/>
+                {{else if eq .Type "list"}}<textarea name="value" rows="4" cols="40" placeholder="{{.Default}}">{{$.Value}}</textarea>
+                {{else}}<input type="text" name="value" value="{{$.Value}}" placeholder="{{.Default}}"/>{{end}}
+                {{if .Description}}<p class="help">{{.Description}}</p>{{end}}
+                {{else}}<input type="text" name="value" value="{{.Value}}"/>{{end}}</td>
         </tr>
 
+{{if eq .Layer "environment"}}
+        <tr><th>Source</th><td>Overridden by the environment ({{.EnvName}}){{if .Effective}}: {{.Effective}}{{end}}. Changes made here have no effect.</td></tr>
+{{else if eq .Layer "global"}}
+        <tr><th>Source</th><td>Global setting{{if .Effective}}: {{.Effective}}{{end}}. A value entered here applies to this site only.</td></tr>
+{{end}}
+
         <tr><td>&nbsp;</td><td></td></tr>
 
         <tr><td></td><td><input type="submit" value="Save"></td></tr>
@@ -263,3 +513,120 @@ var settingEditTemplate = `
 {{template "admin_footer" .}}
 {{end}}
 `
+
+var settingHistoryTemplate = `
+{{define "setting_history"}}
+{{template "admin_header" .}}
+<div style="margin-top: -0.8rem"><a class="back" href="{{prefix}}/z/settings?edit={{.Key}}">{{.Key}}</a></div>
+
+<style type="text/css">
+h1 {
+	text-align:center;
+}
+.audit_set {
+	background: rgba(204, 204, 238, 0.35) !important;
+	margin-left: auto;
+	margin-right: auto;
+	border-radius: 0.5em;
+	min-width: 20em;
+	padding: 0.8em;
+	max-width: 40em;
+	margin-top: 1em;
+}
+.audit_set td span.update::before { font-family: FontAwesomeSolid; content:"\f35a"; padding: 0 0.5em; }
+.audit_set form { text-align: right; margin: 0; }
+</style>
+
+<h1>Change History for {{.Key}}</h1>
+
+{{if .Changes}}{{range .Changes}}
+<div class="audit_set">
+<table style="width:100%;margin-top:-0.4em;margin-left:-0.4em;color:#77c;"><tr><td>{{audit_time .Date}}</td><td style="text-align:right">{{.PersonName}}</td></tr></table>
+<table style="width:100%">
+<tr>
+	<td style="text-align:right;white-space:nowrap;width:45%">{{if .OldValue}}{{.OldValue}}{{else}}<i>empty</i>{{end}}</td>
+	<td style="width:1%"><span class="update"></span></td>
+	<td style="text-align:left;width:45%">{{if .NewValue}}{{.NewValue}}{{else}}<i>empty</i>{{end}}</td>
+	<td>{{if .Restore}}<form method="post"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><input type="hidden" name="history" value="{{$.Key}}"/><input type="hidden" name="rollback" value="{{.Uuid}}"/><input type="submit" value="Restore"/></form>{{end}}</td>
+</tr>
+</table>
+</div>
+{{end}}{{else}}
+<p style="text-align:center; color: #a55;">No changes have been recorded.</p>
+{{end}}
+
+{{template "admin_footer" .}}
+{{end}}
+`
+
+var settingsImportTemplate = `
+{{define "settings_import"}}
+{{template "admin_header" .}}
+<div style="margin-top: -0.8rem"><a class="back" href="{{prefix}}/z/settings">Settings</a></div>
+
+<style type="text/css">
+#importform {
+	max-width: 50em;
+	margin-left: auto;
+	margin-right: auto;
+}
+#importform h1 {
+	text-align: center;
+}
+#importform textarea {
+	width: 100%;
+	min-height: 20em;
+	font-family: monospace;
+}
+#importform p.help {
+	color: #777;
+}
+table.changes td.add { color: #484; }
+table.changes td.change { color: #448; }
+table.changes td.secret { color: #999; }
+</style>
+
+<div id="importform">
+<h1>Import Settings</h1>
+{{if .Errors}}<div class="feedback error">{{if eq 1 (len .Errors)}}<p>{{index .Errors 0}}</p>{{else}}<ul>{{range .Errors}}<li>{{.}}</li>{{end}}</ul>{{end}}</div>{{end}}
+{{if .Applied}}<div class="feedback success"><p>{{len .Changes}} change{{if ne 1 (len .Changes)}}s{{end}} applied.</p></div>{{end}}
+
+{{if .Document}}{{if not .Errors}}
+<h2>{{if .Applied}}Changes made{{else}}Changes that would be made{{end}}</h2>
+{{if .Changes}}
+<table class="changes">
+	<tr>
+		<th>Type</th>
+		<th>Name</th>
+		<th>Current</th>
+		<th>New</th>
+	</tr>
+	{{range .Changes}}
+	<tr>
+		<td>{{.Kind}}</td>
+		<td class="{{.Action}}">{{.Name}}</td>
+		<td{{if .Secret}} class="secret"{{end}}>{{if .Secret}}{{if .Old}}********{{end}}{{else}}{{.Old}}{{end}}</td>
+		<td{{if .Secret}} class="secret"{{end}}>{{if .Secret}}{{if .New}}********{{end}}{{else}}{{.New}}{{end}}</td>
+	</tr>
+	{{end}}
+</table>
+{{else}}
+<p>This site already matches the document.</p>
+{{end}}
+{{end}}{{end}}
+
+<form method="post">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
+<input type="hidden" name="import" value="1"/>
+<p class="help">Paste a YAML or JSON document exported from this or another site. Settings, list items and themes not in the document are left unchanged.</p>
+<textarea name="document" placeholder="settings:">{{.Document}}</textarea>
+<p>
+<input type="submit" name="dry_run" value="Preview Changes"/>
+<input type="submit" name="apply" value="Apply Changes"/>
+</p>
+</form>
+</div>
+
+{{template "admin_footer" .}}
+{{end}}
+`
@@ -48,11 +48,11 @@ func SigninPage(t *template.Template, am AccessManager) func(w http.ResponseWrit
 			}
 			//p.TermsAndConditions = len(strings.TrimSpace(r.FormValue("terms_and_conditions"))) > 0 ||
 			//	len(strings.TrimSpace(r.FormValue("i_agree"))) > 0
-			p.AllowSignup = !(strings.ToLower(am.Setting().GetWithDefault(HostFromRequest(r), "self.signup", "no")) == "no")
+			p.AllowSignup = am.Setting().GetBool(HostFromRequest(r), "self.signup", false)
 			if failure != "" {
 				p.Errors = append(p.Errors, failure)
 			}
-			p.AllowSignup = !(strings.ToLower(am.Setting().GetWithDefault(HostFromRequest(r), "self.signup", "no")) == "no")
+			p.AllowSignup = am.Setting().GetBool(HostFromRequest(r), "self.signup", false)
 
 			err = t.ExecuteTemplate(w, "signin_page", p)
 			if err != nil {
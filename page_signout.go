@@ -38,6 +38,6 @@ func SignoutPage(t *template.Template, am AccessManager) func(w http.ResponseWri
 			http.SetCookie(w, cookie)
 		}
 
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		http.Redirect(w, r, Path("/"), http.StatusTemporaryRedirect)
 	}
 }
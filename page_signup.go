@@ -38,7 +38,7 @@ func SignupPage(t *template.Template, am AccessManager) func(w http.ResponseWrit
 		FirstRequestOnSite(session.Site(), am)
 
 		if session.IsAuthenticated() {
-			http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/"), http.StatusTemporaryRedirect)
 			return
 		}
 
@@ -56,13 +56,7 @@ func SignupPage(t *template.Template, am AccessManager) func(w http.ResponseWrit
 		}
 		//p.TermsAndConditions = len(strings.TrimSpace(r.FormValue("terms_and_conditions"))) > 0 ||
 		//	len(strings.TrimSpace(r.FormValue("i_agree"))) > 0
-		selfSignup := strings.ToLower(am.Setting().GetWithDefault(HostFromRequest(r), "self.signup", "no"))
-		if selfSignup != "yes" && selfSignup != "no" {
-			selfSignup = "no"
-			am.Setting().Put(HostFromRequest(r), "self.signup", selfSignup)
-			am.Warning(session, `security`, "Setting default self.signup setting to no on host %s", HostFromRequest(r))
-		}
-		p.AllowSignup = !(strings.ToLower(am.Setting().GetWithDefault(HostFromRequest(r), "self.signup", "no")) == "no")
+		p.AllowSignup = am.Setting().GetBool(HostFromRequest(r), "self.signup", false)
 
 		baseUrl := am.Setting().GetWithDefault(session.Site(), "base.url", "")
 		if baseUrl != "" {
@@ -170,6 +164,7 @@ var SignupTemplate = `
 </div>
 
 <form method="post" action="{{.BaseUrl}}/signin" id="signin">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <input type="hidden" name="r" value="{{.Referer}}">
 <h3>Sign in</h3>
 
@@ -195,6 +190,7 @@ var SignupTemplate = `
 <div id="signup_box">
 
 <form method="post" action="{{.BaseUrl}}/signup" id="signup">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
 <h3>Sign up</h3>
 
 <label for="firstname">
@@ -227,7 +223,7 @@ var SignupTemplate = `
 </div>
 {{end}}
 
-<script type="text/javascript">
+<script nonce="{{nonce $.Session}}" type="text/javascript">
 if(document.getElementById('signin_email').value!="") {
 	 document.getElementById('signin_password').focus();
 } else {
@@ -19,7 +19,7 @@ func SystemlogPage(t *template.Template, am AccessManager) func(w http.ResponseW
 			return
 		}
 		if !session.IsAuthenticated() {
-			http.Redirect(w, r, "/signup", http.StatusTemporaryRedirect)
+			http.Redirect(w, r, Path("/signup"), http.StatusTemporaryRedirect)
 			return
 		}
 		AddSafeHeaders(w)
@@ -71,7 +71,7 @@ table#system_log tr.debug td {
 
 <h1 style="text-align:center; margin-bottom: 1.5em">System Log</h1>
 
-<script>
+<script nonce="{{nonce $.Session}}">
 var tdi = false
 function toggleDebug() {
 		if (tdi == false) {
@@ -81,10 +81,13 @@ function toggleDebug() {
 		}
 		tdi = !tdi
 }
+document.addEventListener('DOMContentLoaded', function() {
+	document.getElementById('toggle_debug').addEventListener('click', function(e) { e.preventDefault(); toggleDebug(); });
+});
 </script>
 
 <div class="togglebar" style="text-align:right; font-size: 0.85em; color: #999">
-<a onclick="toggleDebug()">Show Debug Messages</a>
+<a id="toggle_debug" href="#">Show Debug Messages</a>
 </div>
 
 {{if .Entries}}
@@ -0,0 +1,95 @@
+package security
+
+import (
+	"html/template"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ticketAttachmentPath returns the download address of a file attached to a ticket.
+func ticketAttachmentPath(t Ticket, a TicketAttachment) string {
+	p := Path("/z/ticket.attachment/") + url.PathEscape(t.Uuid()) + "/" + url.PathEscape(a.Uuid)
+	if t.ParentType() != "" {
+		p = p + "?pt=" + url.QueryEscape(t.ParentType()) + "&pu=" + url.QueryEscape(t.ParentUuid())
+	}
+	return p
+}
+
+// ticketAttachmentLinks maps the uuid of each file attached to a ticket, or to its
+// responses, to its download address.
+func ticketAttachmentLinks(t Ticket, responses []TicketResponse) map[string]string {
+	links := make(map[string]string)
+	for _, a := range t.Attachments() {
+		links[a.Uuid] = ticketAttachmentPath(t, a)
+	}
+	for _, r := range responses {
+		for _, a := range r.Attachments() {
+			links[a.Uuid] = ticketAttachmentPath(t, a)
+		}
+	}
+	return links
+}
+
+// TicketAttachmentPage sends a file attached to a ticket, at /z/ticket.attachment/<ticket uuid>/<uuid>.
+// The ticket manager decides who may see each file.
+func TicketAttachmentPage(t *template.Template, am AccessManager, tm TicketManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := LookupSession(r, am)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if !session.IsAuthenticated() {
+			http.Redirect(w, r, Path("/signin"), http.StatusTemporaryRedirect)
+			return
+		}
+		AddSafeHeaders(w)
+
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		if len(parts) < 2 {
+			ShowErrorNotFound(w, r, t, session)
+			return
+		}
+		ticketUuid, uuid := parts[len(parts)-2], parts[len(parts)-1]
+		parentType := r.FormValue("pt")
+		parentUuid := r.FormValue("pu")
+
+		attachment, _, content, err := tm.OpenTicketAttachment(parentType, parentUuid, ticketUuid, uuid, session)
+		if err == ErrTicketPermissionDenied {
+			am.Warning(session, `ticket`, "Download of attachment %s refused. Ticket %s", uuid, ticketUuid)
+			ShowErrorForbidden(w, r, t, session)
+			return
+		} else if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if attachment == nil {
+			ShowErrorNotFound(w, r, t, session)
+			return
+		}
+		defer content.Close()
+
+		// Only images are shown in the browser, other files are always downloaded. The sandbox
+		// stops any script in a file from running with access to the site.
+		disposition := "attachment"
+		contentType := attachment.ContentType
+		switch contentType {
+		case "image/png", "image/jpeg", "image/gif", "image/webp":
+			disposition = "inline"
+		case "text/plain":
+			contentType = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", contentType)
+		w.Header().Set("Content-Length", strconv.FormatInt(attachment.Size, 10))
+		w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": attachment.Filename}))
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		if _, err := io.Copy(w, content); err != nil {
+			am.Error(session, `ticket`, "Sending attachment %s failed. Error: %v", uuid, err)
+		}
+	}
+}
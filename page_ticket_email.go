@@ -0,0 +1,85 @@
+package security
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// TicketEmailPage receives inbound email from a mail service, and adds each message to
+// a ticket. The raw MIME message is posted either as the request body, or as the
+// "message", "body-mime" or "email" form field. The service must send the key held in
+// the "ticket.email.webhook.secret" setting, as a bearer token or the "key" parameter.
+func TicketEmailPage(t *template.Template, am AccessManager, tm TicketManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		AddSafeHeaders(w)
+		w.Header().Set("Content-Type", "application/json")
+
+		site := HostFromRequest(r)
+		session := am.GuestSession(site, IpFromRequest(r), r.UserAgent(), "")
+
+		secret, err := am.Setting().GetSecret(site, "ticket.email.webhook.secret")
+		if err != nil {
+			internalError(w, err)
+			return
+		}
+		key := r.URL.Query().Get("key")
+		if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[0:7], "bearer ") {
+			key = auth[7:]
+		}
+		if secret == "" || subtle.ConstantTimeCompare([]byte(key), []byte(secret)) != 1 {
+			am.Warning(session, `ticket`, "Inbound email rejected, invalid key. %s", session.IP())
+			w.WriteHeader(403)
+			w.Write([]byte(`{"error":"Permission denied"}`))
+			return
+		}
+		if r.Method != "POST" {
+			w.WriteHeader(405)
+			w.Write([]byte(`{"error":"Method not allowed"}`))
+			return
+		}
+
+		var message []byte
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") || strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+			if err := r.ParseMultipartForm(inboundEmailMaxSize); err != nil && err != http.ErrNotMultipart {
+				invalidParameter(w, "Invalid form data")
+				return
+			}
+			for _, field := range []string{"message", "body-mime", "email"} {
+				if v := r.FormValue(field); v != "" {
+					message = []byte(v)
+					break
+				}
+			}
+		} else {
+			message, err = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, inboundEmailMaxSize))
+			if err != nil {
+				invalidParameter(w, "Failed reading message")
+				return
+			}
+		}
+		if len(message) == 0 {
+			invalidParameter(w, "Message not found")
+			return
+		}
+
+		ticket, err := NewTicketEmailIngester(am, tm).IngestMessage(site, bytes.NewReader(message))
+		if err != nil {
+			am.Error(session, `ticket`, "Inbound email could not be added to a ticket. %v", err)
+			internalError(w, err)
+			return
+		}
+		if ticket == nil {
+			w.WriteHeader(202)
+			w.Write([]byte(`{"status":"ignored"}`))
+			return
+		}
+		b, _ := json.Marshal(map[string]string{"status": "ok", "ticket": ticket.Uuid()})
+		w.WriteHeader(200)
+		w.Write(b)
+	}
+}
@@ -0,0 +1,119 @@
+package security
+
+import (
+	"html/template"
+	"net/http"
+	"strings"
+)
+
+// TicketNotificationsPage lets a person choose which ticket notifications they receive.
+// It is reached through the link included in each notification, which holds a token
+// identifying the person, so no sign in is required.
+func TicketNotificationsPage(t *template.Template, am AccessManager, tm TicketManager) func(w http.ResponseWriter, r *http.Request) {
+
+	type EventChoice struct {
+		Event       TicketEvent
+		Description string
+		Wanted      bool
+	}
+	type PageInfo struct {
+		Page
+		Token     string
+		Email     string
+		Events    []EventChoice
+		Successes []string
+		Errors    []string
+	}
+	descriptions := map[TicketEvent]string{
+		TicketCreatedEvent:  "A ticket is raised",
+		TicketReplyEvent:    "Someone replies to a ticket",
+		TicketNoteEvent:     "Support staff add a note to a ticket",
+		TicketStatusEvent:   "The status of a ticket changes",
+		TicketAssignedEvent: "A ticket is assigned to me",
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := LookupSession(r, am)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		AddSafeHeaders(w)
+
+		token := strings.Trim(strings.TrimPrefix(r.URL.Path, Path("/ticket.notifications/")), "/")
+		preference, err := tm.GetTicketNotificationPreferenceByToken(token, session)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if preference == nil {
+			ShowErrorNotFound(w, r, t, session)
+			return
+		}
+
+		p := &PageInfo{
+			Page: Page{
+				Session: session,
+				Title:   []string{"Ticket Notifications"},
+				Class:   "signin",
+			},
+			Token: token,
+			Email: preference.Email,
+		}
+
+		if r.Method == "POST" {
+			if !ValidCSRF(r, session) {
+				am.Warning(session, `security`, "Potential CSRF attack detected: "+r.URL.String())
+				ShowErrorForbidden(w, r, t, session)
+				return
+			}
+			preference.OptOut = nil
+			for _, e := range TicketEvents {
+				if r.FormValue(string(e)) == "" {
+					preference.OptOut = append(preference.OptOut, e)
+				}
+			}
+			if err := tm.PutTicketNotificationPreference(preference, session); err != nil {
+				p.Errors = append(p.Errors, err.Error())
+			} else {
+				p.Successes = append(p.Successes, "Your choices have been saved.")
+			}
+		}
+
+		for _, e := range TicketEvents {
+			p.Events = append(p.Events, EventChoice{e, descriptions[e], preference.Wants(e)})
+		}
+		Render(r, w, t, "ticket_notifications", p)
+	}
+}
+
+var ticketNotificationsTemplate = `
+{{define "ticket_notifications"}}
+{{template "security_header" .}}
+
+{{if .Successes}}<div class="feedback success">{{range .Successes}}<p>{{.}}</p>{{end}}</div>{{end}}
+{{if .Errors}}<div class="feedback error">{{range .Errors}}<p>{{.}}</p>{{end}}</div>{{end}}
+
+<style type="text/css">
+#notifications label { display: block; text-align: left; margin: 0.4em 0; }
+</style>
+
+<div id="signin_box">
+
+<div id="site_banner">
+	<h2>Ticket Notifications</h2>
+</div>
+
+<form method="post" action="{{prefix}}/ticket.notifications/{{.Token}}" id="notifications">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
+<p>Email {{.Email}} when:</p>
+{{range .Events}}
+<label><input type="checkbox" name="{{.Event}}" value="yes"{{if .Wanted}} checked="checked"{{end}}/> {{.Description}}</label>
+{{end}}
+<label><input type="submit" value="Save"/></label>
+</form>
+
+</div>
+{{template "security_footer" .}}
+{{end}}
+`
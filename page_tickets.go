@@ -0,0 +1,728 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errTicketAssignee = errors.New("Tickets may only be assigned to support desk staff.")
+var errTicketActionAfter = errors.New("Please enter a valid date and time.")
+var errTicketDate = errors.New("Please enter a valid date.")
+var errTicketNotFound = errors.New("No ticket was found with that reference.")
+
+// ticketStatusChangeError explains why a ticket can not be moved to a status.
+func ticketStatusChangeError(workflow *TicketWorkflow, ticket Ticket, status TicketStatus) error {
+	if !workflow.ValidStatus(status) {
+		return ErrInvalidTicketStatus
+	}
+	return fmt.Errorf("\"%s\" can not be changed from %s to %s.", ticket.Subject(), workflow.StatusName(ticket.Status()), workflow.StatusName(status))
+}
+
+// ticketReference identifies a ticket, and its parent object if it has one, in a form value.
+func ticketReference(t Ticket) string {
+	return t.ParentType() + "|" + t.ParentUuid() + "|" + t.Uuid()
+}
+
+func parseTicketReference(ref string) (string, string, string) {
+	parts := strings.Split(ref, "|")
+	if len(parts) != 3 {
+		return "", "", ref
+	}
+	return parts[0], parts[1], parts[2]
+}
+
+// lookupTicket returns a ticket, with or without a parent object.
+func lookupTicket(tm TicketManager, parentType, parentUuid, uuid string, session Session) (Ticket, error) {
+	if parentType != "" {
+		return tm.GetTicketWithParent(parentType, parentUuid, uuid, session)
+	}
+	return tm.GetTicket(uuid, session)
+}
+
+// ticketPath returns the address of the support desk page for a ticket.
+func ticketPath(t Ticket) string {
+	return ticketLinkPath(TicketLink{ParentType: t.ParentType(), ParentUuid: t.ParentUuid(), Uuid: t.Uuid()})
+}
+
+// TicketsPage shows the support desk queues, filtered by status, assignee, tag, type
+// or keyword, and allows the status of several tickets to be changed at once.
+func TicketsPage(t *template.Template, am AccessManager, tm TicketManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := LookupSession(r, am)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if !session.IsAuthenticated() {
+			http.Redirect(w, r, Path("/signin"), http.StatusTemporaryRedirect)
+			return
+		}
+		if !session.HasRole(TicketSupportRole) {
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+		AddSafeHeaders(w)
+
+		sla, err := GetTicketSLAConfig(am.Setting(), am.PicklistStore(), session.Site())
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		workflow := sla.Workflow
+
+		status := TicketStatus(strings.TrimSpace(r.FormValue("status")))
+		assignee := strings.TrimSpace(r.FormValue("assignee"))
+		tag := strings.TrimSpace(r.FormValue("tag"))
+		ticketType := TicketType(strings.TrimSpace(r.FormValue("type")))
+		query := strings.TrimSpace(r.FormValue("q"))
+		from := strings.TrimSpace(r.FormValue("from"))
+		to := strings.TrimSpace(r.FormValue("to"))
+		if assignee == "me" {
+			assignee = session.PersonUuid()
+		}
+		if status == "" && assignee == "" && tag == "" && ticketType == "" && query == "" && from == "" && to == "" {
+			status = workflow.DefaultStatus()
+		}
+
+		if r.Method == "POST" {
+			if !ValidCSRF(r, session) {
+				am.Warning(session, `security`, "Potential CSRF attack detected. "+r.URL.String())
+				ShowErrorForbidden(w, r, t, session)
+				return
+			}
+			newStatus := TicketStatus(r.FormValue("bulk_status"))
+			if !workflow.ValidStatus(newStatus) {
+				ShowError(w, r, t, ErrInvalidTicketStatus, session)
+				return
+			}
+
+			// Every ticket is checked before any is changed
+			var selected []Ticket
+			for _, ref := range r.Form["ticket"] {
+				parentType, parentUuid, uuid := parseTicketReference(ref)
+				ticket, err := lookupTicket(tm, parentType, parentUuid, uuid, session)
+				if err != nil {
+					ShowError(w, r, t, err, session)
+					return
+				}
+				if ticket == nil {
+					continue
+				}
+				if !workflow.CanChange(ticket.Status(), newStatus) {
+					ShowError(w, r, t, ticketStatusChangeError(workflow, ticket, newStatus), session)
+					return
+				}
+				selected = append(selected, ticket)
+			}
+			for _, ticket := range selected {
+				if err := tm.AddParentedTicketResponse(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), newStatus, "", "", session); err != nil {
+					ShowError(w, r, t, err, session)
+					return
+				}
+			}
+			http.Redirect(w, r, Path("/z/tickets?")+r.URL.RawQuery, http.StatusSeeOther)
+			return
+		}
+
+		filter := TicketFilter{Status: status, Type: ticketType, Tag: tag, AssignedTo: assignee}
+		if from != "" {
+			d, err := time.ParseInLocation("2006-01-02", from, sla.Hours.Location)
+			if err != nil {
+				ShowError(w, r, t, errTicketDate, session)
+				return
+			}
+			filter.CreatedAfter = &d
+		}
+		if to != "" {
+			d, err := time.ParseInLocation("2006-01-02", to, sla.Hours.Location)
+			if err != nil {
+				ShowError(w, r, t, errTicketDate, session)
+				return
+			}
+			d = d.AddDate(0, 0, 1)
+			filter.CreatedBefore = &d
+		}
+
+		var filtered []Ticket
+		next := ""
+		if query != "" {
+			// Search results are paged by offset, which is carried in the cursor
+			offset, _ := strconv.Atoi(r.FormValue("cursor"))
+			if offset < 0 {
+				offset = 0
+			}
+			tickets, total, err := tm.SearchTicketsPage(query, offset, 100, session)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+			if len(tickets) > 0 && offset+len(tickets) < total {
+				next = strconv.Itoa(offset + len(tickets))
+			}
+			// Apply the remaining filters to the tickets found
+			for _, i := range tickets {
+				if status != "" && i.Status() != status {
+					continue
+				}
+				if ticketType != "" && i.Type() != ticketType {
+					continue
+				}
+				if tag != "" && !hasTicketTag(i, tag) {
+					continue
+				}
+				if assignee != "" && !hasTicketViewer(i.AssignedTo(), assignee) {
+					continue
+				}
+				if (filter.CreatedAfter != nil && i.Created().Before(*filter.CreatedAfter)) || (filter.CreatedBefore != nil && !i.Created().Before(*filter.CreatedBefore)) {
+					continue
+				}
+				filtered = append(filtered, i)
+			}
+		} else {
+			filtered, next, err = tm.QueryTickets(filter, r.FormValue("cursor"), 100, session)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+		}
+
+		type TicketRow struct {
+			Ticket
+			Reference string
+			Link      string
+			SLA       *TicketSLA
+		}
+		type PageInfo struct {
+			Page
+			Tickets  []TicketRow
+			Status   TicketStatus
+			Assignee string
+			Mine     bool
+			Tag      string
+			Type     TicketType
+			Query    string
+			From     string
+			To       string
+			Next     string
+			Statuses []TicketStatusOption
+			Types    []TicketTypeOption
+			Workflow *TicketWorkflow
+		}
+		p := &PageInfo{
+			Page: Page{
+				Session: session,
+				Title:   []string{"Support Desk"},
+			},
+			Status:   status,
+			Assignee: assignee,
+			Mine:     assignee != "" && assignee == session.PersonUuid(),
+			Tag:      tag,
+			Type:     ticketType,
+			Query:    query,
+			From:     from,
+			To:       to,
+			Statuses: workflow.Statuses,
+			Types:    workflow.Types,
+			Workflow: workflow,
+		}
+		if next != "" {
+			values := r.URL.Query()
+			values.Set("cursor", next)
+			p.Next = Path("/z/tickets?") + values.Encode()
+		}
+		now := time.Now()
+		for _, i := range filtered {
+			p.Tickets = append(p.Tickets, TicketRow{i, ticketReference(i), ticketPath(i), sla.Evaluate(i, now)})
+		}
+
+		Render(r, w, t, "tickets", p)
+	}
+}
+
+func hasTicketTag(ticket Ticket, tag string) bool {
+	for _, t := range ticket.Tags() {
+		if strings.EqualFold(strings.TrimSpace(t), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTicketViewer(viewers []TicketViewer, uuid string) bool {
+	for _, v := range viewers {
+		if v.Uuid == uuid {
+			return true
+		}
+	}
+	return false
+}
+
+func withoutTicketViewer(viewers []TicketViewer, uuid string) []TicketViewer {
+	var remaining []TicketViewer
+	for _, v := range viewers {
+		if v.Uuid != uuid {
+			remaining = append(remaining, v)
+		}
+	}
+	return remaining
+}
+
+// TicketPage shows a ticket with its responses and history, and lets staff reply, add
+// internal notes, and change who the ticket is assigned to and watched by.
+func TicketPage(t *template.Template, am AccessManager, tm TicketManager) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session, err := LookupSession(r, am)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if !session.IsAuthenticated() {
+			http.Redirect(w, r, Path("/signin"), http.StatusTemporaryRedirect)
+			return
+		}
+		if !session.HasRole(TicketSupportRole) {
+			ShowErrorForbidden(w, r, t, session)
+			return
+		}
+		AddSafeHeaders(w)
+
+		path := r.URL.Path[1:]
+		parts := strings.Split(path, "/")
+		uuid := parts[len(parts)-1]
+		parentType := r.FormValue("pt")
+		parentUuid := r.FormValue("pu")
+
+		ticket, err := lookupTicket(tm, parentType, parentUuid, uuid, session)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		if ticket == nil {
+			ShowErrorNotFound(w, r, t, session)
+			return
+		}
+
+		if r.Method == "POST" {
+			if !ValidCSRF(r, session) {
+				am.Warning(session, `security`, "Potential CSRF attack detected. "+r.URL.String())
+				ShowErrorForbidden(w, r, t, session)
+				return
+			}
+			next, err := updateTicketWithFormValues(am, tm, ticket, session, r)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+			http.Redirect(w, r, next, http.StatusSeeOther)
+			return
+		}
+
+		// A merged ticket is kept only to point to the ticket it was merged into
+		if m := ticket.MergedInto(); m != nil && r.FormValue("stub") == "" {
+			http.Redirect(w, r, ticketLinkPath(*m), http.StatusSeeOther)
+			return
+		}
+
+		responses, err := tm.GetParentedTicketResponses(parentType, parentUuid, uuid, session)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		changeLog, err := am.GetEntityChangeLog(uuid, session)
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+
+		// Staff a ticket may be assigned to. Accounts can only be listed by administrators.
+		var staff []TicketViewer
+		if session.HasRole("s1") {
+			people, err := am.GetPeople(session)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+			for _, person := range people {
+				if person.HasRole(TicketSupportRole) && !hasTicketViewer(ticket.AssignedTo(), person.Uuid()) {
+					staff = append(staff, TicketViewer{Uuid: person.Uuid(), DisplayName: person.DisplayName()})
+				}
+			}
+			sort.Slice(staff, func(i, j int) bool {
+				return strings.ToLower(staff[i].DisplayName) < strings.ToLower(staff[j].DisplayName)
+			})
+		}
+
+		sla, err := GetTicketSLAConfig(am.Setting(), am.PicklistStore(), session.Site())
+		if err != nil {
+			ShowError(w, r, t, err, session)
+			return
+		}
+		actionAfter := ""
+		if ticket.ActionAfter() != nil {
+			actionAfter = ticket.ActionAfter().In(sla.Hours.Location).Format("2006-01-02T15:04")
+		}
+
+		type PageInfo struct {
+			Page
+			Ticket      Ticket
+			SLA         *TicketSLA
+			ActionAfter string
+			Zone        string
+			Link        string
+			Responses   []TicketResponse
+			Attachments map[string]string
+			CanAttach   bool
+			Links       map[string]string
+			LinkTypes   []TicketLinkType
+			EntityAudit []EntityAuditLogCollection
+			Staff       []TicketViewer
+			Statuses    []TicketStatusOption
+			Workflow    *TicketWorkflow
+			Assigned    bool
+			Watching    bool
+		}
+		p := &PageInfo{
+			Page: Page{
+				Session: session,
+				Title:   []string{ticket.Subject(), "Support Desk"},
+			},
+			Ticket:      ticket,
+			SLA:         sla.Evaluate(ticket, time.Now()),
+			ActionAfter: actionAfter,
+			Zone:        sla.Hours.Location.String(),
+			Link:        ticketPath(ticket),
+			Responses:   responses,
+			Attachments: ticketAttachmentLinks(ticket, responses),
+			CanAttach:   tm.BlobStore() != nil,
+			Links:       ticketLinkPaths(ticket),
+			LinkTypes:   TicketLinkTypes,
+			EntityAudit: changeLog,
+			Staff:       staff,
+			Statuses:    sla.Workflow.NextStatuses(ticket.Status()),
+			Workflow:    sla.Workflow,
+			Assigned:    hasTicketViewer(ticket.AssignedTo(), session.PersonUuid()),
+			Watching:    hasTicketViewer(ticket.WatchedBy(), session.PersonUuid()),
+		}
+		Render(r, w, t, "ticket", p)
+	}
+}
+
+// updateTicketWithFormValues applies the action submitted from the ticket page, and returns
+// the address of the ticket to show next.
+func updateTicketWithFormValues(am AccessManager, tm TicketManager, ticket Ticket, session Session, r *http.Request) (string, error) {
+	me := TicketViewer{Uuid: session.PersonUuid(), DisplayName: session.DisplayName()}
+	assignedTo := ticket.AssignedTo()
+	watchedBy := ticket.WatchedBy()
+	tags := ticket.Tags()
+	next := ticketPath(ticket)
+
+	switch r.FormValue("action") {
+	case "reply":
+		status := TicketStatus(r.FormValue("status"))
+		workflow, err := GetTicketWorkflow(am.Setting(), am.PicklistStore(), session.Site())
+		if err != nil {
+			return "", err
+		}
+		if !workflow.CanChange(ticket.Status(), status) {
+			return "", ticketStatusChangeError(workflow, ticket, status)
+		}
+		files, err := readTicketFiles(am.Setting(), session.Site(), r, "attachment")
+		if err != nil {
+			return "", err
+		}
+		return next, tm.AddParentedTicketResponseWithAttachments(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), status,
+			strings.TrimSpace(r.FormValue("subject")), strings.TrimSpace(r.FormValue("message")), false, files, session)
+	case "note":
+		files, err := readTicketFiles(am.Setting(), session.Site(), r, "attachment")
+		if err != nil {
+			return "", err
+		}
+		return next, tm.AddParentedTicketResponseWithAttachments(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), "",
+			"", strings.TrimSpace(r.FormValue("message")), true, files, session)
+	case "assign":
+		uuid := r.FormValue("person")
+		if uuid == "" || uuid == me.Uuid {
+			assignedTo = append(withoutTicketViewer(assignedTo, me.Uuid), me)
+		} else if !hasTicketViewer(assignedTo, uuid) {
+			person, err := am.GetPerson(uuid, session)
+			if err != nil {
+				return "", err
+			}
+			if person == nil || !person.HasRole(TicketSupportRole) {
+				return "", errTicketAssignee
+			}
+			assignedTo = append(assignedTo, TicketViewer{Uuid: person.Uuid(), DisplayName: person.DisplayName()})
+		}
+	case "unassign":
+		assignedTo = withoutTicketViewer(assignedTo, r.FormValue("person"))
+	case "watch":
+		watchedBy = append(withoutTicketViewer(watchedBy, me.Uuid), me)
+	case "unwatch":
+		watchedBy = withoutTicketViewer(watchedBy, me.Uuid)
+	case "action_after":
+		var actionAfter *time.Time
+		if value := strings.TrimSpace(r.FormValue("action_after")); value != "" && r.FormValue("clear") == "" {
+			sla, err := GetTicketSLAConfig(am.Setting(), am.PicklistStore(), session.Site())
+			if err != nil {
+				return "", err
+			}
+			t, err := time.ParseInLocation("2006-01-02T15:04", value, sla.Hours.Location)
+			if err != nil {
+				return "", errTicketActionAfter
+			}
+			actionAfter = &t
+		}
+		return next, tm.SetTicketActionAfter(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), actionAfter, session)
+	case "tags":
+		tags = nil
+		for _, tag := range strings.Split(r.FormValue("tags"), ",") {
+			if tag = strings.TrimSpace(tag); tag != "" && !strings.Contains(tag, "|") {
+				tags = append(tags, tag)
+			}
+		}
+	case "link":
+		other, err := findTicketInput(tm, r.FormValue("ticket"), session)
+		if err != nil {
+			return "", err
+		}
+		return next, tm.LinkTickets(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), TicketLinkType(r.FormValue("relation")),
+			other.ParentType(), other.ParentUuid(), other.Uuid(), session)
+	case "unlink":
+		return next, tm.UnlinkTickets(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), r.FormValue("ticket"), session)
+	case "merge":
+		into, err := findTicketInput(tm, r.FormValue("ticket"), session)
+		if err != nil {
+			return "", err
+		}
+		if err := tm.MergeTicket(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), into.ParentType(), into.ParentUuid(), into.Uuid(), session); err != nil {
+			return "", err
+		}
+		return ticketPath(into), nil
+	case "split":
+		split, err := tm.SplitTicketResponse(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), r.FormValue("response"), r.FormValue("subject"), session)
+		if err != nil {
+			return "", err
+		}
+		return ticketPath(split), nil
+	default:
+		return next, nil
+	}
+	return next, tm.UpdateTicket(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), tags, assignedTo, watchedBy, session)
+}
+
+// findTicketInput looks up a ticket entered by staff as a uuid or the address of its page.
+func findTicketInput(tm TicketManager, value string, session Session) (Ticket, error) {
+	uuid := parseTicketInput(value)
+	if uuid == "" {
+		return nil, errTicketNotFound
+	}
+	ticket, err := tm.FindTicket(uuid, session)
+	if err != nil {
+		return nil, err
+	}
+	if ticket == nil {
+		return nil, errTicketNotFound
+	}
+	return ticket, nil
+}
+
+var ticketsTemplate = `
+{{define "tickets"}}
+{{template "admin_header" .}}
+<div id="actions">
+<a href="{{prefix}}/z/tickets?assignee=me&status={{.Workflow.DefaultStatus}}" class="note">My Tickets</a>
+</div>
+
+<style type="text/css">
+#ticket_filters { text-align: center; margin-bottom: 1em; }
+#ticket_filters select, #ticket_filters input { font-size: 0.9rem; }
+#ticket_filters a { margin: 0 0.4em; }
+#ticket_filters a.selected { font-weight: bold; color: #000; text-decoration: none; }
+table#tickets { margin-left: auto; margin-right: auto; }
+table#tickets td.tags, table#tickets td.assigned, table#tickets td.created { color: #888; font-size: 0.85em; }
+table#tickets td.sla { font-size: 0.85em; white-space: nowrap; }
+.sla.breached { color: #c33; font-weight: bold; }
+.sla.met { color: #393; }
+#bulk { text-align: center; margin-top: 1em; }
+</style>
+
+<h1 style="text-align:center; margin-bottom: 1em">Support Desk</h1>
+
+<form method="get" id="ticket_filters">
+<div>{{range .Statuses}}{{if or (not .Deprecated) (eq .Status $.Status)}}<a href="{{prefix}}/z/tickets?status={{.Status}}{{if $.Mine}}&assignee=me{{end}}"{{if eq .Status $.Status}} class="selected"{{end}} title="{{.Description}}">{{.Name}}</a>{{end}}{{end}}</div>
+<input type="hidden" name="status" value="{{.Status}}"/>
+<select name="assignee">
+	<option value="">Anyone</option>
+	<option value="me"{{if .Mine}} selected="selected"{{end}}>Assigned to me</option>
+</select>
+<select name="type">
+	<option value="">All types</option>
+	{{range .Types}}{{if or (not .Deprecated) (eq .Type $.Type)}}<option value="{{.Type}}"{{if eq .Type $.Type}} selected="selected"{{end}}>{{.Name}}</option>{{end}}{{end}}
+</select>
+<input type="text" name="tag" value="{{.Tag}}" placeholder="Tag" style="width: 8em"/>
+<input type="date" name="from" value="{{.From}}" title="Created from"/> to <input type="date" name="to" value="{{.To}}" title="Created to"/>
+<input type="search" name="q" value="{{.Query}}" placeholder="Search"/>
+<input type="submit" value="Filter"/>
+</form>
+
+{{if .Tickets}}
+<form method="post">
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
+<table id="tickets">
+	<tr>
+		<th></th>
+		<th>Subject</th>
+		<th>From</th>
+		<th>Type</th>
+		<th>Status</th>
+		<th>Tags</th>
+		<th>Assigned</th>
+		<th>Responses</th>
+		<th>SLA</th>
+		<th>Created</th>
+	</tr>
+	{{range .Tickets}}
+	<tr>
+		<td><input type="checkbox" name="ticket" value="{{.Reference}}"/></td>
+		<td><a href="{{.Link}}">{{if .Subject}}{{.Subject}}{{else}}(No subject){{end}}</a></td>
+		<td>{{if .Email}}{{.FirstName}} {{.LastName}} &lt;{{.Email}}&gt;{{else if .PersonUuid}}{{with person .PersonUuid $.Session}}{{.DisplayName}}{{end}}{{end}}</td>
+		<td>{{$.Workflow.TypeName .Type}}</td>
+		<td>{{$.Workflow.StatusName .Status}}</td>
+		<td class="tags">{{range $i, $t := .Tags}}{{if $i}}, {{end}}<a href="{{prefix}}/z/tickets?tag={{$t}}">{{$t}}</a>{{end}}</td>
+		<td class="assigned">{{range $i, $v := .AssignedTo}}{{if $i}}, {{end}}{{$v.DisplayName}}{{end}}</td>
+		<td>{{.ResponseCount}}</td>
+		<td>{{with .SLA}}<span class="sla {{if eq .Status "breached"}}breached{{else if eq .Status "met"}}met{{end}}">{{.Status}}</span>{{end}}</td>
+		<td class="created">{{log_date .Created}}</td>
+	</tr>
+	{{end}}
+</table>
+<div id="bulk">
+Change selected tickets to
+<select name="bulk_status">
+	{{range .Statuses}}{{if not .Deprecated}}<option value="{{.Status}}">{{.Name}}</option>{{end}}{{end}}
+</select>
+<input type="submit" value="Update"/>
+</div>
+</form>
+{{if .Next}}<p style="text-align:center"><a href="{{.Next}}">Next page</a></p>{{end}}
+{{else}}
+<p style="text-align:center; color: #a55;">No tickets found.</p>
+{{end}}
+
+{{template "admin_footer" .}}
+{{end}}
+`
+
+var ticketTemplate = `
+{{define "ticket"}}
+{{template "admin_header" .}}
+<div style="margin-top: -0.8rem"><a class="back" href="{{prefix}}/z/tickets">Support Desk</a></div>
+
+<style type="text/css">
+#ticket { max-width: 50em; margin-left: auto; margin-right: auto; }
+#ticket h1 { text-align: center; }
+#ticket table.details { margin-left: auto; margin-right: auto; margin-bottom: 1em; }
+#ticket table.details th { text-align: right; vertical-align: top; padding-right: 1em; }
+#ticket table.details form { display: inline; }
+#ticket .message { border-radius: 0.5em; background: #f4f4f8; padding: 0.8em; margin-top: 1em; white-space: pre-wrap; }
+#ticket .message .by { color: #77c; font-size: 0.85em; margin-bottom: 0.5em; white-space: normal; }
+#ticket .message .by span.status { float: right; }
+#ticket .message.internal { background: #fdf6d8; border: 1px dashed #d8c26a; }
+#ticket .message.internal .by::before { font-family: FontAwesomeSolid; content: "\f070"; padding-right: 0.4em; }
+#ticket form.reply { margin-top: 1.5em; }
+#ticket form.reply textarea { width: 100%; height: 8em; font-size: 1rem; box-sizing: border-box; }
+#ticket form.reply input[type=text] { width: 100%; font-size: 1rem; box-sizing: border-box; margin-bottom: 0.3em; }
+#ticket h3 { margin-top: 1.5em; }
+#ticket .sla.breached { color: #c33; font-weight: bold; }
+#ticket .sla.met { color: #393; }
+#ticket .message ul.attachments { list-style: none; margin: 0.5em 0 0 0; padding: 0; white-space: normal; font-size: 0.9em; }
+#ticket .message ul.attachments li::before { font-family: FontAwesomeSolid; content: "\f0c6"; padding-right: 0.4em; }
+#ticket .message form.split { text-align: right; white-space: normal; font-size: 0.85em; margin-top: 0.5em; }
+#ticket p.merged { text-align: center; background: #fdf6d8; padding: 0.5em; }
+</style>
+
+<div id="ticket">
+<h1>{{if .Ticket.Subject}}{{.Ticket.Subject}}{{else}}(No subject){{end}}</h1>
+{{with .Ticket.MergedInto}}<p class="merged">This ticket was merged into <a href="{{index $.Links .Uuid}}">{{if .Subject}}{{.Subject}}{{else}}(No subject){{end}}</a>.</p>{{end}}
+
+<table class="details">
+	<tr><th>From</th><td>{{if .Ticket.Email}}{{.Ticket.FirstName}} {{.Ticket.LastName}} &lt;{{.Ticket.Email}}&gt;{{else if .Ticket.PersonUuid}}{{with person .Ticket.PersonUuid $.Session}}{{.DisplayName}}{{end}}{{end}}</td></tr>
+	<tr><th>Type</th><td><a href="{{prefix}}/z/tickets?type={{.Ticket.Type}}">{{.Workflow.TypeName .Ticket.Type}}</a></td></tr>
+	<tr><th>Status</th><td>{{.Workflow.StatusName .Ticket.Status}}</td></tr>
+	<tr><th>Created</th><td>{{log_date .Ticket.Created}}</td></tr>
+	{{with .SLA}}<tr><th>SLA</th><td>
+		<span class="sla {{if eq .Status "breached"}}breached{{else if eq .Status "met"}}met{{end}}">{{.Status}}</span> ({{.Policy}})
+		{{if .FirstResponseDue}}<br>First response due {{log_date .FirstResponseDue}}{{if .FirstResponse}}, responded {{log_date .FirstResponse}}{{end}}{{end}}
+		{{if .ResolutionDue}}<br>Resolution due {{log_date .ResolutionDue}}{{if .Resolved}}, resolved {{log_date .Resolved}}{{end}}{{end}}
+	</td></tr>{{end}}
+	<tr><th>Action After</th><td>
+		<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/><input type="hidden" name="action" value="action_after"/><input type="datetime-local" name="action_after" value="{{.ActionAfter}}"/> {{.Zone}} <input type="submit" value="Save"/>{{if .ActionAfter}} <input type="submit" name="clear" value="Clear"/>{{end}}</form>
+	</td></tr>
+	<tr><th>Assigned To</th><td>
+		{{range .Ticket.AssignedTo}}<form method="post" action="{{$.Link}}"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><input type="hidden" name="action" value="unassign"/><input type="hidden" name="person" value="{{.Uuid}}"/>{{.DisplayName}} <input type="submit" value="Remove"/></form><br>{{end}}
+		{{if not .Assigned}}<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/><input type="hidden" name="action" value="assign"/><input type="submit" value="Assign to me"/></form>{{end}}
+		{{if .Staff}}<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/><input type="hidden" name="action" value="assign"/><select name="person">{{range .Staff}}<option value="{{.Uuid}}">{{.DisplayName}}</option>{{end}}</select> <input type="submit" value="Assign"/></form>{{end}}
+	</td></tr>
+	<tr><th>Watched By</th><td>
+		{{range $i, $v := .Ticket.WatchedBy}}{{if $i}}, {{end}}{{$v.DisplayName}}{{end}}
+		<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/>{{if .Watching}}<input type="hidden" name="action" value="unwatch"/><input type="submit" value="Stop watching"/>{{else}}<input type="hidden" name="action" value="watch"/><input type="submit" value="Watch"/>{{end}}</form>
+	</td></tr>
+	<tr><th>Tags</th><td>
+		<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/><input type="hidden" name="action" value="tags"/><input type="text" name="tags" value="{{range $i, $t := .Ticket.Tags}}{{if $i}}, {{end}}{{$t}}{{end}}" placeholder="tag, tag"/> <input type="submit" value="Save"/></form>
+	</td></tr>
+	<tr><th>Links</th><td>
+		{{range .Ticket.Links}}<form method="post" action="{{$.Link}}"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><input type="hidden" name="action" value="unlink"/><input type="hidden" name="ticket" value="{{.Uuid}}"/>{{.Type.Name}} <a href="{{index $.Links .Uuid}}">{{if .Subject}}{{.Subject}}{{else}}(No subject){{end}}</a> <input type="submit" value="Remove"/></form><br>{{end}}
+		<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/><input type="hidden" name="action" value="link"/><select name="relation">{{range .LinkTypes}}<option value="{{.}}">{{.Name}}</option>{{end}}</select> <input type="text" name="ticket" placeholder="Ticket address or id"/> <input type="submit" value="Link"/></form>
+	</td></tr>
+	{{if not .Ticket.MergedInto}}<tr><th>Merge</th><td>
+		<form method="post" action="{{.Link}}"><input type="hidden" name="csrf" value="{{csrf .Session}}"/><input type="hidden" name="action" value="merge"/><input type="text" name="ticket" placeholder="Ticket address or id"/> <input type="submit" value="Merge into ticket"/></form>
+	</td></tr>{{end}}
+</table>
+
+<div class="message">
+<div class="by">{{log_date .Ticket.Created}}</div>
+{{.Ticket.Message}}{{if .Ticket.Attachments}}<ul class="attachments">{{range .Ticket.Attachments}}<li><a href="{{index $.Attachments .Uuid}}">{{.Filename}}</a> ({{.SizeText}})</li>{{end}}</ul>{{end}}
+</div>
+
+{{range .Responses}}
+<div class="message{{if .Internal}} internal{{end}}">
+<div class="by">{{if .Internal}}Internal note by {{else}}{{if .Subject}}<b>{{.Subject}}</b> &mdash; {{end}}{{end}}{{.PersonDisplayName}}, {{log_date .Created}}{{if not .Internal}}<span class="status">{{$.Workflow.StatusName .Status}}</span>{{end}}</div>
+{{.Message}}{{if .Attachments}}<ul class="attachments">{{range .Attachments}}<li><a href="{{index $.Attachments .Uuid}}">{{.Filename}}</a> ({{.SizeText}})</li>{{end}}</ul>{{end}}{{if not .Internal}}<form method="post" action="{{$.Link}}" class="split"><input type="hidden" name="csrf" value="{{csrf $.Session}}"/><input type="hidden" name="action" value="split"/><input type="hidden" name="response" value="{{.Uuid}}"/><input type="text" name="subject" placeholder="Subject of new ticket"/> <input type="submit" value="Split into new ticket"/></form>{{end}}
+</div>
+{{end}}
+
+<form method="post" action="{{.Link}}" class="reply"{{if .CanAttach}} enctype="multipart/form-data"{{end}}>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
+<input type="hidden" name="action" value="reply"/>
+<h3>Reply</h3>
+<input type="text" name="subject" placeholder="Subject (optional)"/>
+<textarea name="message" placeholder="Reply to the person who raised this ticket"></textarea>
+{{if .CanAttach}}<input type="file" name="attachment" multiple="multiple"/><br>{{end}}
+Status <select name="status">{{range .Statuses}}<option value="{{.Status}}"{{if eq .Status $.Ticket.Status}} selected="selected"{{end}}>{{.Name}}</option>{{end}}</select>
+<input type="submit" value="Send Reply"/>
+</form>
+
+<form method="post" action="{{.Link}}" class="reply"{{if .CanAttach}} enctype="multipart/form-data"{{end}}>
+<input type="hidden" name="csrf" value="{{csrf .Session}}"/>
+<input type="hidden" name="action" value="note"/>
+<h3>Internal Note</h3>
+<textarea name="message" placeholder="Notes are only seen by support desk staff"></textarea>
+{{if .CanAttach}}<input type="file" name="attachment" multiple="multiple"/><br>{{end}}
+<input type="submit" value="Add Note"/>
+</form>
+
+{{if .EntityAudit}}
+<h3>History</h3>
+{{template "show_history" .}}
+{{end}}
+</div>
+
+{{template "admin_footer" .}}
+{{end}}
+`
@@ -39,4 +39,7 @@ type PicklistStore interface {
 	DeprecatePicklistItem(site, picklist, key string) error
 	TogglePicklistItem(site, picklist, key string) error
 	GetPicklists(site string) (map[string]map[string]PicklistItem, error)
+
+	// Close stops the picklist store receiving invalidations, so that it can be discarded.
+	Close()
 }
@@ -109,3 +109,18 @@ func TestPicklistStore(t *testing.T) {
 	}
 
 }
+
+func TestPicklistCacheCopyOnWrite(t *testing.T) {
+	male := &GaePicklistItem{Picklist: "sex", Key: "m", Value: "Male"}
+	sites := withSitePicklists(nil, "a.test.com", map[string]map[string]PicklistItem{"sex": {"m": male}})
+	cached := sites["a.test.com"]
+
+	updated := withPicklistItem(sites, "a.test.com", &GaePicklistItem{Picklist: "sex", Key: "m", Value: "Male", Deprecated: true})
+	updated = withPicklistItem(updated, "a.test.com", &GaePicklistItem{Picklist: "sex", Key: "f", Value: "Female"})
+	if cached["sex"]["m"] != male || len(cached["sex"]) != 1 {
+		t.Fatalf("withPicklistItem() changed a picklist that may be being read: %v", cached["sex"])
+	}
+	if !updated["a.test.com"]["sex"]["m"].IsDeprecated() || len(updated["a.test.com"]["sex"]) != 2 {
+		t.Fatalf("withPicklistItem() returned %v", updated["a.test.com"]["sex"])
+	}
+}
@@ -0,0 +1,203 @@
+package security
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// RateLimitKey identifies the client that a request is counted against. It
+// returns an empty string if the request should not be rate limited.
+type RateLimitKey func(r *http.Request, session Session) string
+
+// RateLimitByIP counts requests against the client ip address.
+func RateLimitByIP(r *http.Request, session Session) string {
+	return "ip:" + IpFromRequest(r)
+}
+
+// RateLimitByPerson counts requests against the signed in person, or against the
+// client ip address if nobody is signed in.
+func RateLimitByPerson(r *http.Request, session Session) string {
+	if session != nil && session.IsAuthenticated() {
+		return "person:" + session.PersonUuid()
+	}
+	return RateLimitByIP(r, session)
+}
+
+// RateLimitByToken returns a RateLimitKey that counts requests against the API token
+// sent in the Authorization or X-API-Key header, once valid reports that the token
+// belongs to a real credential. Requests without a valid token are counted by
+// RateLimitByPerson(), so a client can not escape the limit by sending a new token
+// with each request. Only a hash of the token is used in the throttle key.
+func RateLimitByToken(valid func(r *http.Request, token string) bool) RateLimitKey {
+	return func(r *http.Request, session Session) string {
+		token := r.Header.Get("X-API-Key")
+		if auth := r.Header.Get("Authorization"); token == "" && len(auth) > 7 && strings.EqualFold(auth[0:7], "bearer ") {
+			token = strings.TrimSpace(auth[7:])
+		}
+		if token == "" || valid == nil || !valid(r, token) {
+			return RateLimitByPerson(r, session)
+		}
+		sum := sha256.Sum256([]byte(token))
+		return "token:" + hex.EncodeToString(sum[0:12])
+	}
+}
+
+// RateLimitByRoute counts all requests to a route group together, regardless of
+// which client sent them.
+func RateLimitByRoute(r *http.Request, session Session) string {
+	return "route"
+}
+
+// RateLimiter limits how often a group of routes may be used. The limit for a
+// group can be changed per site with the settings "throttle.ratelimit.<group>.attempts"
+// and "throttle.ratelimit.<group>.window".
+type RateLimiter struct {
+	// Group names the route group, and is used in throttle keys and settings.
+	Group string
+
+	// Throttle records the requests. A TokenBucketThrottle is most suitable.
+	Throttle Throttle
+
+	// Key identifies the client that each request is counted against.
+	Key RateLimitKey
+
+	// Methods lists the request methods that are counted, i.e. "POST". All
+	// methods are counted if empty.
+	Methods []string
+}
+
+// NewRateLimiter returns a rate limiter for a group of routes, and registers the
+// default policy for the group. The policy Lockout is used by throttles that lock
+// out a key, and is ignored by a TokenBucketThrottle.
+func NewRateLimiter(group string, throttle Throttle, policy ThrottlePolicy, key RateLimitKey, methods ...string) *RateLimiter {
+	RegisterThrottlePolicy(rateLimitClass(group), policy)
+	return &RateLimiter{
+		Group:    group,
+		Throttle: throttle,
+		Key:      key,
+		Methods:  methods,
+	}
+}
+
+// DefaultRateLimits returns the rate limiters used to protect security package
+// pages that can be abused by anonymous or automated clients.
+func DefaultRateLimits(throttle Throttle) map[string]*RateLimiter {
+	return map[string]*RateLimiter{
+		"/signup":     NewRateLimiter("signup", throttle, ThrottlePolicy{Attempts: 10, Window: 600, Lockout: 600, MaxLockout: 3600}, RateLimitByIP, "POST"),
+		"/forgot/":    NewRateLimiter("forgot", throttle, ThrottlePolicy{Attempts: 10, Window: 600, Lockout: 600, MaxLockout: 3600}, RateLimitByIP, "POST"),
+		"/z/feedback": NewRateLimiter("feedback", throttle, ThrottlePolicy{Attempts: 10, Window: 600, Lockout: 600, MaxLockout: 3600}, RateLimitByPerson, "POST"),
+		"/z/api/":     NewRateLimiter("api", throttle, ThrottlePolicy{Attempts: 120, Window: 60, Lockout: 60, MaxLockout: 600}, RateLimitByPerson),
+	}
+}
+
+func rateLimitClass(group string) string {
+	return "ratelimit." + group
+}
+
+func (l *RateLimiter) counts(r *http.Request) bool {
+	if len(l.Methods) == 0 {
+		return true
+	}
+	for _, m := range l.Methods {
+		if strings.EqualFold(m, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware returns middleware that counts requests, and responds with 429 Too
+// Many Requests once a client exceeds the limit. RateLimit-Limit, RateLimit-Remaining
+// and RateLimit-Reset headers are sent with counted requests, and clients that
+// exceed the limit are recorded in the system log.
+func (l *RateLimiter) Middleware(t *template.Template, am AccessManager) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !l.counts(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			session, err := LookupSession(r, am)
+			if err != nil {
+				ShowError(w, r, t, err, session)
+				return
+			}
+			client := l.Key(r, session)
+			if client == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := ThrottleKey(session.Site(), rateLimitClass(l.Group), client)
+			policy := ThrottlePolicyForKey(am.Setting(), key, ThrottlePolicy{})
+
+			status, err := l.Throttle.Status(key)
+			if err != nil {
+				// Fail open, a throttle outage should not take the site down
+				am.Warning(session, `ratelimit`, "Rate limit lookup for %s failed: %v", key, err)
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !status.Throttled {
+				err = l.Throttle.Increment(key)
+				if err == nil {
+					status, err = l.Throttle.Status(key)
+				}
+				if err != nil {
+					am.Warning(session, `ratelimit`, "Rate limit update for %s failed: %v", key, err)
+					next.ServeHTTP(w, r)
+					return
+				}
+				if status.Throttled {
+					am.Warning(session, `ratelimit`, "Rate limit for %s exceeded by %s (%s) on %s %s", l.Group, client, IpFromRequest(r), r.Method, r.URL.Path)
+				}
+			}
+
+			setRateLimitHeaders(w, policy, status)
+			if status.Throttled {
+				retryAfter := rateLimitReset(status)
+				w.Header().Set("Retry-After", fmt.Sprintf("%d", retryAfter))
+				if wantsJSON(r) {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusTooManyRequests)
+					json.NewEncoder(w).Encode(map[string]interface{}{"error": "Too many requests", "retry_after": retryAfter})
+					return
+				}
+				ShowErrorTooManyRequests(w, r, t, session, throttleWait(status))
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitReset returns the number of seconds until a throttled client may try again
+func rateLimitReset(status *ThrottleStatus) int64 {
+	if status.Unlock == nil {
+		return 0
+	}
+	seconds := int64(time.Until(*status.Unlock).Seconds() + 0.999)
+	if seconds < 0 {
+		return 0
+	}
+	return seconds
+}
+
+// setRateLimitHeaders sends the RateLimit headers described in the IETF
+// "RateLimit header fields for HTTP" draft.
+func setRateLimitHeaders(w http.ResponseWriter, policy ThrottlePolicy, status *ThrottleStatus) {
+	w.Header().Set("RateLimit-Limit", fmt.Sprintf("%d", policy.Attempts))
+	w.Header().Set("RateLimit-Remaining", fmt.Sprintf("%d", status.Remaining))
+	if status.Throttled {
+		w.Header().Set("RateLimit-Reset", fmt.Sprintf("%d", rateLimitReset(status)))
+	} else {
+		w.Header().Set("RateLimit-Reset", fmt.Sprintf("%d", policy.Window))
+	}
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Attempts, policy.Window))
+}
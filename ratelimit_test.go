@@ -0,0 +1,86 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// rateLimitTestManager provides the few AccessManager methods used by RateLimiter
+type rateLimitTestManager struct {
+	AccessManager
+	warnings int
+}
+
+func (m *rateLimitTestManager) Setting() Setting {
+	return nil
+}
+
+func (m *rateLimitTestManager) Warning(session Session, component, message string, args ...interface{}) {
+	m.warnings++
+}
+
+func TestRateLimiter(t *testing.T) {
+	am := &rateLimitTestManager{}
+	valid := func(r *http.Request, token string) bool {
+		return token == "token-a" || token == "token-b"
+	}
+	limiter := NewRateLimiter("test", NewTokenBucketThrottle(nil), ThrottlePolicy{Attempts: 2, Window: 60}, RateLimitByToken(valid), "POST")
+
+	reached := 0
+	h := limiter.Middleware(nil, am)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached++
+	}))
+
+	request := func(method, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/z/api/test", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		r = r.WithContext(ContextWithSession(r.Context(), &GaeSession{site: "example.com"}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		w := request("POST", "token-a")
+		if w.Code != http.StatusOK {
+			t.Fatalf("RateLimiter should allow request %d, got %d", i+1, w.Code)
+		}
+		if w.Header().Get("RateLimit-Limit") != "2" {
+			t.Fatalf("RateLimiter should send RateLimit-Limit: 2, got %q", w.Header().Get("RateLimit-Limit"))
+		}
+	}
+
+	w := request("POST", "token-a")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("RateLimiter should reject the third request, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") == "" || w.Header().Get("RateLimit-Remaining") != "0" {
+		t.Fatalf("RateLimiter should send Retry-After and RateLimit-Remaining headers, got %v", w.Header())
+	}
+	if am.warnings != 1 {
+		t.Fatalf("RateLimiter should log the offender once, logged %d times", am.warnings)
+	}
+
+	// Other clients and uncounted methods are unaffected
+	if w := request("POST", "token-b"); w.Code != http.StatusOK {
+		t.Fatalf("RateLimiter should allow a different token, got %d", w.Code)
+	}
+	if w := request("GET", "token-a"); w.Code != http.StatusOK {
+		t.Fatalf("RateLimiter should not count GET requests, got %d", w.Code)
+	}
+	if reached != 4 {
+		t.Fatalf("RateLimiter should have passed four requests through, not %d", reached)
+	}
+
+	// Tokens that are not valid are counted against the client ip address, so a new
+	// token with each request does not escape the limit
+	for i, token := range []string{"random-1", "random-2"} {
+		if w := request("POST", token); w.Code != http.StatusOK {
+			t.Fatalf("RateLimiter should allow request %d with an unknown token, got %d", i+1, w.Code)
+		}
+	}
+	if w := request("POST", "random-3"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("RateLimiter should count unknown tokens together, got %d", w.Code)
+	}
+}
@@ -0,0 +1,438 @@
+package security
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Secrets, such as the smtp.password setting and external system api keys, are stored
+// using envelope encryption. Each value is encrypted with its own random data key, and
+// the data key is encrypted with a key from the keyring. Rotating the keyring only
+// requires the data keys to be re-encrypted, which the "secret-rotate" task does.
+//
+// The keyring is loaded from the file named by SECURITY_SECRET_KEYRING, or from the
+// SECURITY_SECRET_KEYS environment variable. Both hold "id=base64key" pairs, one per
+// line or separated by semicolons. The last key listed is used to encrypt new values,
+// the others are kept so that older values can still be decrypted.
+const (
+	SecretKeyringFileEnv = "SECURITY_SECRET_KEYRING"
+	SecretKeysEnv        = "SECURITY_SECRET_KEYS"
+)
+
+const secretPrefix = "enc1:"
+
+var ErrSecretKeyNotFound = errors.New("The key used to encrypt this secret is not in the keyring")
+
+type SecretKeyring struct {
+	keys    map[string]cipher.AEAD
+	audit   map[string][]byte // Keys derived from each key, for hashing secrets recorded in change logs
+	current string
+}
+
+var secretKeyring *SecretKeyring
+var secretKeyringOnce sync.Once
+
+// DefaultSecretKeyring returns the keyring configured by the environment, or nil if
+// no keyring is configured, in which case secrets are stored unencrypted.
+func DefaultSecretKeyring() *SecretKeyring {
+	secretKeyringOnce.Do(func() {
+		if secretKeyring != nil {
+			return
+		}
+		var err error
+		if path := os.Getenv(SecretKeyringFileEnv); path != "" {
+			secretKeyring, err = LoadSecretKeyring(path)
+		} else if keys := os.Getenv(SecretKeysEnv); keys != "" {
+			secretKeyring, err = ParseSecretKeyring(keys)
+		} else {
+			fmt.Println("No secret keyring configured. Secret settings will be stored unencrypted.")
+		}
+		if err != nil {
+			fmt.Printf("Failed loading secret keyring: %v\n", err)
+		}
+	})
+	return secretKeyring
+}
+
+// SetSecretKeyring replaces the keyring configured by the environment.
+func SetSecretKeyring(k *SecretKeyring) {
+	secretKeyringOnce.Do(func() {})
+	secretKeyring = k
+}
+
+// LoadSecretKeyring reads a keyring file containing "id=base64key" lines.
+func LoadSecretKeyring(path string) (*SecretKeyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ParseSecretKeyring(strings.Join(lines, "\n"))
+}
+
+// ParseSecretKeyring reads "id=base64key" pairs separated by newlines or semicolons.
+// Blank lines and lines starting with # are ignored. Keys must be 32 bytes long.
+func ParseSecretKeyring(text string) (*SecretKeyring, error) {
+	k := &SecretKeyring{keys: make(map[string]cipher.AEAD), audit: make(map[string][]byte)}
+	for _, line := range strings.FieldsFunc(text, func(c rune) bool { return c == '\n' || c == ';' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("Keyring entry should be in the form id=base64key")
+		}
+		id := strings.TrimSpace(line[:i])
+		if strings.Contains(id, ":") {
+			return nil, fmt.Errorf("Keyring id %s must not contain a colon", id)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("Keyring entry %s is not valid base64: %v", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("Keyring entry %s must be 32 bytes, not %d", id, len(key))
+		}
+		aead, err := newSecretAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		k.audit[id] = hmacSHA256(key, []byte("setting-audit"))
+		k.current = id
+	}
+	if k.current == "" {
+		return nil, errors.New("Keyring contains no keys")
+	}
+	return k, nil
+}
+
+// GenerateSecretKey returns a new random key suitable for adding to a keyring.
+func GenerateSecretKey() string {
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// AuditHash returns a keyed hash of a secret, derived from the current key. It shows
+// when a secret changes, without allowing guesses of the secret to be checked against it.
+func (k *SecretKeyring) AuditHash(plaintext string) string {
+	return hex.EncodeToString(hmacSHA256(k.audit[k.current], []byte(plaintext)))
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// Current returns the id of the key used to encrypt new values.
+func (k *SecretKeyring) Current() string {
+	return k.current
+}
+
+// Encrypt seals a value with a new data key, which is in turn sealed with the current key.
+func (k *SecretKeyring) Encrypt(plaintext string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	aead, err := newSecretAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := secretSeal(aead, []byte(plaintext))
+	if err != nil {
+		return "", err
+	}
+	wrapped, err := secretSeal(k.keys[k.current], dek)
+	if err != nil {
+		return "", err
+	}
+	return secretPrefix + k.current + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a value sealed by Encrypt(). Values that were not encrypted are returned unchanged.
+func (k *SecretKeyring) Decrypt(value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return value, nil
+	}
+	id, dek, sealed, err := k.open(value)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newSecretAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := secretOpen(aead, sealed)
+	if err != nil {
+		return "", fmt.Errorf("Failed decrypting secret sealed with key %s: %v", id, err)
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt seals the data key of a value with the current key. It reports false if the
+// value is already sealed with the current key. Unencrypted values are encrypted.
+func (k *SecretKeyring) Reencrypt(value string) (string, bool, error) {
+	if !IsEncryptedSecret(value) {
+		if value == "" {
+			return value, false, nil
+		}
+		encrypted, err := k.Encrypt(value)
+		return encrypted, err == nil, err
+	}
+	id, dek, sealed, err := k.open(value)
+	if err != nil {
+		return value, false, err
+	}
+	if id == k.current {
+		return value, false, nil
+	}
+	wrapped, err := secretSeal(k.keys[k.current], dek)
+	if err != nil {
+		return value, false, err
+	}
+	return secretPrefix + k.current + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(sealed), true, nil
+}
+
+// open returns the key id, the unwrapped data key and the sealed value.
+func (k *SecretKeyring) open(value string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(value, secretPrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("Encrypted secret is malformed")
+	}
+	key, found := k.keys[parts[0]]
+	if !found {
+		return parts[0], nil, nil, ErrSecretKeyNotFound
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return parts[0], nil, nil, err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return parts[0], nil, nil, err
+	}
+	dek, err := secretOpen(key, wrapped)
+	if err != nil {
+		return parts[0], nil, nil, fmt.Errorf("Failed decrypting data key with key %s: %v", parts[0], err)
+	}
+	return parts[0], dek, sealed, nil
+}
+
+func newSecretAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func secretSeal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func secretOpen(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("Sealed value is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// IsEncryptedSecret reports whether a stored value was encrypted by a keyring.
+func IsEncryptedSecret(value string) bool {
+	return strings.HasPrefix(value, secretPrefix)
+}
+
+// EncryptSecret encrypts a value with the default keyring. Empty values, values
+// that are already encrypted, and all values when no keyring is configured, are
+// returned unchanged.
+func EncryptSecret(value string) (string, error) {
+	k := DefaultSecretKeyring()
+	if k == nil || value == "" || IsEncryptedSecret(value) {
+		return value, nil
+	}
+	return k.Encrypt(value)
+}
+
+// DecryptSecret decrypts a value with the default keyring. Unencrypted values are returned unchanged.
+func DecryptSecret(value string) (string, error) {
+	if !IsEncryptedSecret(value) {
+		return value, nil
+	}
+	k := DefaultSecretKeyring()
+	if k == nil {
+		return "", ErrSecretKeyNotFound
+	}
+	return k.Decrypt(value)
+}
+
+// encryptSettingValue encrypts the value of a setting registered as a secret.
+func encryptSettingValue(name, value string) (string, error) {
+	if d := LookupSettingDefinition(name); d == nil || d.Type != SettingSecret {
+		return value, nil
+	}
+	return EncryptSecret(value)
+}
+
+// IsSecretConfigKey reports whether an external system or connector configuration
+// key holds a credential, i.e. "moodle.key", "client.secret" or "API Token".
+func IsSecretConfigKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, suffix := range []string{"key", "secret", "password", "token"} {
+		if key == suffix {
+			return true
+		}
+		for _, sep := range []string{".", "_", " ", "-"} {
+			if strings.HasSuffix(key, sep+suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// decryptConfigValue decrypts a configuration value, returning an empty string if the
+// value can not be decrypted, so that a credential is never passed on still encrypted.
+func decryptConfigValue(key, value string) string {
+	plaintext, err := DecryptSecret(value)
+	if err != nil {
+		fmt.Printf("Failed decrypting configuration value %s: %v\n", key, err)
+		return ""
+	}
+	return plaintext
+}
+
+// encryptConfigValue encrypts a configuration value if its key names a credential.
+func encryptConfigValue(key, value string) string {
+	if !IsSecretConfigKey(key) {
+		return value
+	}
+	encrypted, err := EncryptSecret(value)
+	if err != nil {
+		fmt.Printf("Failed encrypting configuration value %s: %v\n", key, err)
+		return value
+	}
+	return encrypted
+}
+
+// secretRotateTask re-encrypts the secrets of a site, and the global settings, with the
+// current keyring key.
+func secretRotateTask(am AccessManager) func(session Session, message map[string]interface{}) error {
+	return func(session Session, message map[string]interface{}) error {
+		k := DefaultSecretKeyring()
+		if k == nil {
+			am.Warning(session, `security`, "Task(%s): no secret keyring configured", message["type"].(string))
+			return nil
+		}
+
+		count := 0
+		for _, site := range []string{session.Site(), GlobalSettingSite} {
+			for name, value := range am.Setting().List(site) {
+				if d := LookupSettingDefinition(name); d == nil || d.Type != SettingSecret {
+					continue
+				}
+				updated, changed, err := k.Reencrypt(value)
+				if err != nil {
+					am.Error(session, `security`, "Task(%s): failed re-encrypting setting %s: %v", message["type"].(string), name, err)
+					continue
+				}
+				if changed {
+					if err := am.Setting().Put(site, name, updated); err != nil {
+						return err
+					}
+					count++
+				}
+			}
+		}
+
+		systems, err := am.GetExternalSystems(session)
+		if err != nil {
+			return err
+		}
+		for _, es := range systems {
+			config := es.Config()
+			changed := false
+			for i, kv := range config {
+				if !IsSecretConfigKey(kv.Key) {
+					continue
+				}
+				updated, c, err := k.Reencrypt(kv.Value)
+				if err != nil {
+					am.Error(session, `security`, "Task(%s): failed re-encrypting external system %s %s: %v", message["type"].(string), es.Uuid(), kv.Key, err)
+					continue
+				}
+				if c {
+					config[i].Value = updated
+					changed = true
+					count++
+				}
+			}
+			if changed {
+				if err := am.UpdateExternalSystem(es.Uuid(), config, session); err != nil {
+					return err
+				}
+			}
+		}
+
+		connectors, err := am.GetScheduledConnectors(session)
+		if err != nil {
+			return err
+		}
+		for _, sc := range connectors {
+			changed := false
+			for _, kv := range sc.Config {
+				if !IsSecretConfigKey(kv.Key) {
+					continue
+				}
+				updated, c, err := k.Reencrypt(kv.Value)
+				if err != nil {
+					am.Error(session, `security`, "Task(%s): failed re-encrypting connector %s %s: %v", message["type"].(string), sc.Uuid, kv.Key, err)
+					continue
+				}
+				if c {
+					kv.Value = updated
+					changed = true
+					count++
+				}
+			}
+			if changed {
+				if err := am.UpdateScheduledConnector(sc, session); err != nil {
+					return err
+				}
+			}
+		}
+
+		am.Info(session, `security`, "Task(%s): re-encrypted %d secrets with key %s", message["type"].(string), count, k.Current())
+		return nil
+	}
+}
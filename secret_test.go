@@ -0,0 +1,95 @@
+package security
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSecretKeyring(t *testing.T) {
+	key1 := GenerateSecretKey()
+	key2 := GenerateSecretKey()
+
+	old, err := ParseSecretKeyring("# test keyring\nk1=" + key1)
+	if err != nil {
+		t.Fatalf("ParseSecretKeyring() failed: %v", err)
+	}
+	if _, err := ParseSecretKeyring("k1=c2hvcnQ="); err == nil {
+		t.Fatalf("ParseSecretKeyring() should reject short keys")
+	}
+
+	sealed, err := old.Encrypt("password")
+	if err != nil {
+		t.Fatalf("Encrypt() failed: %v", err)
+	}
+	if !IsEncryptedSecret(sealed) || strings.Contains(sealed, "password") {
+		t.Fatalf("Encrypt() returned an unencrypted value: %s", sealed)
+	}
+	if v, err := old.Decrypt(sealed); err != nil || v != "password" {
+		t.Fatalf("Decrypt() should return \"password\", not %q %v", v, err)
+	}
+	if v, err := old.Decrypt("plain"); err != nil || v != "plain" {
+		t.Fatalf("Decrypt() should return unencrypted values unchanged, not %q %v", v, err)
+	}
+
+	// Rotate to a new key, keeping the old key to decrypt older values
+	rotated, err := ParseSecretKeyring("k1=" + key1 + ";k2=" + key2)
+	if err != nil {
+		t.Fatalf("ParseSecretKeyring() failed: %v", err)
+	}
+	if rotated.Current() != "k2" {
+		t.Fatalf("The last key should be current, not %s", rotated.Current())
+	}
+	resealed, changed, err := rotated.Reencrypt(sealed)
+	if err != nil || !changed {
+		t.Fatalf("Reencrypt() should re-encrypt a value sealed with an old key: %v", err)
+	}
+	if !strings.HasPrefix(resealed, secretPrefix+"k2:") {
+		t.Fatalf("Reencrypt() should seal with the current key: %s", resealed)
+	}
+	if _, changed, _ := rotated.Reencrypt(resealed); changed {
+		t.Fatalf("Reencrypt() should not change a value sealed with the current key")
+	}
+	if v, err := rotated.Decrypt(resealed); err != nil || v != "password" {
+		t.Fatalf("Decrypt() after rotation should return \"password\", not %q %v", v, err)
+	}
+	if _, err := old.Decrypt(resealed); err != ErrSecretKeyNotFound {
+		t.Fatalf("Decrypt() with a keyring missing the key should fail with ErrSecretKeyNotFound, not %v", err)
+	}
+}
+
+func TestSecretConfig(t *testing.T) {
+	k, err := ParseSecretKeyring("k1=" + GenerateSecretKey())
+	if err != nil {
+		t.Fatalf("ParseSecretKeyring() failed: %v", err)
+	}
+	previous := DefaultSecretKeyring()
+	SetSecretKeyring(k)
+	defer SetSecretKeyring(previous)
+
+	for key, secret := range map[string]bool{"moodle.key": true, "client.secret": true, "API Token": true, "moodle.url": false, "monkey": false} {
+		if IsSecretConfigKey(key) != secret {
+			t.Errorf("IsSecretConfigKey(%q) should return %v", key, secret)
+		}
+	}
+
+	es := &GaeExternalSystem{EType: "Moodle"}
+	es.SetConfig("moodle.url", "https://moodle.example.com/")
+	es.SetConfig("moodle.key", "abc123")
+	es.SetConfig("moodle.key", "def456")
+	if len(es.Config()) != 2 || !IsEncryptedSecret(es.Config()[1].Value) {
+		t.Fatalf("SetConfig() should store the api key encrypted: %v", es.Config())
+	}
+	if v := es.GetConfig("moodle.key"); v != "def456" {
+		t.Fatalf("GetConfig() should decrypt the api key, not return %q", v)
+	}
+	if es.Describe() != "moodle.example.com" {
+		t.Fatalf("Describe() should not reveal the api key: %s", es.Describe())
+	}
+
+	if v, err := encryptSettingValue("smtp.password", "password"); err != nil || !IsEncryptedSecret(v) {
+		t.Fatalf("encryptSettingValue() should encrypt smtp.password: %q %v", v, err)
+	}
+	if v, _ := encryptSettingValue("smtp.user", "support@example.com"); v != "support@example.com" {
+		t.Fatalf("encryptSettingValue() should not encrypt smtp.user: %q", v)
+	}
+}
@@ -0,0 +1,107 @@
+package security
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type contextKey string
+
+const sessionContextKey contextKey = "session"
+
+// SessionLookup resolves the session associated with the request cookie and
+// stores it in the request context, so that subsequent calls to LookupSession
+// or SessionFromContext do not need to query the datastore again.
+func SessionLookup(am AccessManager) Middleware {
+	return func(next http.Handler) http.Handler {
+		lookup := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ensureCSRFCookie(w, r)
+			session, err := LookupSession(r, am)
+			if err != nil || session == nil {
+				// Leave it to the page handler to report the error
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ContextWithSession(r.Context(), session)))
+		})
+		// Requests from addresses the site does not permit never reach authentication
+		return IPAccessControl(am)(lookup)
+	}
+}
+
+// ContextWithSession returns a copy of the context that carries the session.
+func ContextWithSession(ctx context.Context, session Session) context.Context {
+	return context.WithValue(ctx, sessionContextKey, session)
+}
+
+// SessionFromContext returns the session stored in the context by SessionLookup,
+// or nil if the request has not passed through SessionLookup.
+func SessionFromContext(ctx context.Context) Session {
+	if session, ok := ctx.Value(sessionContextKey).(Session); ok {
+		return session
+	}
+	return nil
+}
+
+// RequireAuth only allows requests from authenticated sessions through to the
+// handler. Browsers are redirected to the signin page, API clients receive 401.
+func RequireAuth(am AccessManager) Middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session, err := LookupSession(r, am)
+			if err != nil {
+				guest := am.GuestSession(HostFromRequest(r), IpFromRequest(r), r.UserAgent(), "")
+				am.Error(guest, `http`, "Session lookup failed: %v", err)
+			}
+			if err != nil || session == nil || !session.IsAuthenticated() {
+				if wantsJSON(r) {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(http.StatusUnauthorized)
+					w.Write([]byte(`{"error":"Not Authenticated"}`))
+					return
+				}
+				http.Redirect(w, r, Path("/signin")+"?r="+url.QueryEscape(Path(r.URL.Path)), http.StatusSeeOther)
+				return
+			}
+			next.ServeHTTP(w, r.WithContext(ContextWithSession(r.Context(), session)))
+		})
+	}
+}
+
+// RequirePermission only allows requests from authenticated sessions that have
+// every one of the listed roles. Sessions missing a role receive 403.
+func RequirePermission(t *template.Template, am AccessManager, roles ...string) Middleware {
+	return func(next http.Handler) http.Handler {
+		return RequireAuth(am)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			session := SessionFromContext(r.Context())
+			for _, role := range roles {
+				if !session.HasRole(role) {
+					am.Notice(session, `security`, "Access to %s by %s requires role %s", r.URL.Path, session.DisplayName(), role)
+					if wantsJSON(r) {
+						w.Header().Set("Content-Type", "application/json")
+						w.WriteHeader(http.StatusForbidden)
+						w.Write([]byte(`{"error":"Permission Denied"}`))
+						return
+					}
+					ShowErrorForbidden(w, r, t, session)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		}))
+	}
+}
+
+// wantsJSON guesses if the request came from a script rather than a browser page load.
+func wantsJSON(r *http.Request) bool {
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		return true
+	}
+	if r.Header.Get("X-Requested-With") == "XMLHttpRequest" {
+		return true
+	}
+	return strings.HasPrefix(Path(r.URL.Path), Path("/z/api/"))
+}
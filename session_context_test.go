@@ -0,0 +1,69 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequireAuth(t *testing.T) {
+
+	reached := false
+	h := RequireAuth(nil)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+		if SessionFromContext(r.Context()) == nil {
+			t.Fatalf("SessionFromContext() should return the session inside RequireAuth()")
+		}
+	}))
+
+	// Guest browser requests are redirected to signin
+	{
+		r := httptest.NewRequest("GET", "/z/accounts", nil)
+		r = r.WithContext(ContextWithSession(r.Context(), &GaeSession{}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if reached {
+			t.Fatalf("RequireAuth() should not allow guest sessions through")
+		}
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/signin?r=%2Fz%2Faccounts" {
+			t.Fatalf("RequireAuth() should redirect to signin. Got: %d %s", w.Code, w.Header().Get("Location"))
+		}
+	}
+
+	// Redirects keep the path prefix the page was served under
+	{
+		pathPrefix = "/app"
+		defer func() { pathPrefix = "" }()
+		r := httptest.NewRequest("GET", "/z/accounts", nil)
+		r = r.WithContext(ContextWithSession(r.Context(), &GaeSession{}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusSeeOther || w.Header().Get("Location") != "/app/signin?r=%2Fapp%2Fz%2Faccounts" {
+			t.Fatalf("RequireAuth() should redirect to signin under the prefix. Got: %d %s", w.Code, w.Header().Get("Location"))
+		}
+		pathPrefix = ""
+	}
+
+	// Guest API requests receive 401
+	{
+		r := httptest.NewRequest("POST", "/z/api/watch", nil)
+		r = r.WithContext(ContextWithSession(r.Context(), &GaeSession{}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("RequireAuth() should return 401 to api requests. Got: %d", w.Code)
+		}
+	}
+
+	// Authenticated requests reach the handler
+	{
+		r := httptest.NewRequest("GET", "/z/accounts", nil)
+		r = r.WithContext(ContextWithSession(r.Context(), &GaeSession{authenticated: true}))
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if !reached {
+			t.Fatalf("RequireAuth() should allow authenticated sessions through")
+		}
+	}
+
+}
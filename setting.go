@@ -1,12 +1,35 @@
 package security
 
+import "time"
+
 const CACHE_TIMEOUT = 60
 
+// Setting stores per site configuration values. Settings declared with RegisterSetting()
+// are validated when stored, and fall back to their registered default when unset.
 type Setting interface {
 	Get(site, name string) *string
 	GetWithDefault(site, name, defaultValue string) string
 	GetInt(site, name string, defaultValue int) int
+	GetBool(site, name string, defaultValue bool) bool
+	GetDuration(site, name string, defaultValue time.Duration) time.Duration
 	GetList(site, name string) []string
+
+	// GetSecret returns the decrypted value of a secret setting. Other methods return
+	// secret settings as they are stored, which is encrypted if a keyring is configured.
+	GetSecret(site, name string) (string, error)
+
 	Put(site, name, value string) error
+
+	// PutAs stores a setting, recording the person making the change in the setting history.
+	// Put records changes as being made by the system.
+	PutAs(site, name, value string, updator Session) error
+
 	List(site string) map[string]string
+
+	// Watch calls fn with the new effective value of a setting each time it changes,
+	// including when changed by another instance, see SetInvalidationBus().
+	Watch(site, name string, fn func(value string)) (cancel func())
+
+	// Close stops the setting store receiving invalidations, so that it can be discarded.
+	Close()
 }
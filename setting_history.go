@@ -0,0 +1,65 @@
+package security
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Changes to settings are recorded in the entity change log. Each setting name has
+// its own entity uuid, which is the same for every site, as each site keeps its
+// change log in its own namespace.
+var settingNamespace = uuid.MustParse("4f0e4bb4-3c44-4d6e-9a53-6b1c1cde0a51")
+
+// Prefix of the value recorded in place of a secret setting value
+const redactedSettingPrefix = "redacted:"
+
+// SettingEntityUuid returns the entity uuid that changes to a setting are recorded against.
+func SettingEntityUuid(name string) string {
+	return uuid.NewSHA1(settingNamespace, []byte(strings.ToLower(name))).String()
+}
+
+// settingAuditKey hashes secrets recorded in the change log when no secret keyring is
+// configured. It is random, so the hashes only show changes made by this instance.
+var settingAuditKey = []byte(RandomString(32))
+
+// settingAuditValue returns the value to record in the change log for a setting.
+// Secrets are recorded as a short keyed hash of their value, which shows when a secret
+// was changed without revealing it, or allowing guesses to be tested against it. The
+// hash is keyed from the secret keyring. Encrypted values are decrypted before hashing,
+// so that re-encrypting a secret is not recorded as a change.
+func settingAuditValue(name, value string) string {
+	if d := LookupSettingDefinition(name); (d == nil || d.Type != SettingSecret) && !IsEncryptedSecret(value) {
+		return value
+	}
+	if value == "" {
+		return ""
+	}
+	plaintext, err := DecryptSecret(value)
+	if err != nil {
+		return redactedSettingPrefix
+	}
+	sum := hex.EncodeToString(hmacSHA256(settingAuditKey, []byte(plaintext)))
+	if k := DefaultSecretKeyring(); k != nil {
+		sum = k.AuditHash(plaintext)
+	}
+	return redactedSettingPrefix + sum[0:12]
+}
+
+// IsRedactedSettingValue reports whether a change log value was recorded in place of a secret.
+func IsRedactedSettingValue(value string) bool {
+	return strings.HasPrefix(value, redactedSettingPrefix)
+}
+
+// newSettingChangeLog describes a change to a setting, made by updator, or by the system if updator is nil.
+func newSettingChangeLog(name, oldValue, newValue string, updator Session) *GaeEntityAuditLogCollection {
+	bulk := &GaeEntityAuditLogCollection{}
+	if updator != nil && updator.IsAuthenticated() {
+		bulk.SetEntityUuidPersonUuid(SettingEntityUuid(name), updator.PersonUuid(), updator.DisplayName())
+	} else {
+		bulk.SetEntityUuidPersonUuid(SettingEntityUuid(name), "", "System")
+	}
+	bulk.AddItem(strings.ToLower(name), settingAuditValue(name, oldValue), settingAuditValue(name, newValue))
+	return bulk
+}
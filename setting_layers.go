@@ -0,0 +1,122 @@
+package security
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SettingLayer identifies where the effective value of a setting came from. Settings
+// are resolved from the first layer holding a value, in the order: environment, site,
+// global, then the default registered with RegisterSetting().
+type SettingLayer string
+
+const (
+	SettingLayerEnvironment SettingLayer = "environment"
+	SettingLayerSite        SettingLayer = "site"
+	SettingLayerGlobal      SettingLayer = "global"
+	SettingLayerDefault     SettingLayer = "default"
+)
+
+// GlobalSettingSite is the site name that global settings are stored against. Global
+// settings apply to every site that does not have its own value. It is reserved, as
+// no host name can be "*", and is not empty so that it can be a cassandra partition key.
+const GlobalSettingSite = "*"
+
+// Environment overrides apply to every site, and can not be changed from the settings
+// page. A setting is overridden by an environment variable named after the setting,
+// in upper case, with dots replaced by underscores and prefixed with SETTING_, i.e.
+// SETTING_SMTP_HOSTNAME, or by a "name=value" line in the file named by the
+// SECURITY_SETTINGS_FILE environment variable. Environment variables take precedence.
+const (
+	SettingEnvPrefix = "SETTING_"
+	SettingsFileEnv  = "SECURITY_SETTINGS_FILE"
+)
+
+var settingsFile map[string]string
+var settingsFileOnce sync.Once
+
+// SettingEnvName returns the name of the environment variable that overrides a setting.
+func SettingEnvName(name string) string {
+	return SettingEnvPrefix + strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// settingOverride returns the environment override of a setting, if there is one.
+func settingOverride(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if value, found := os.LookupEnv(SettingEnvName(name)); found {
+		return value, true
+	}
+	settingsFileOnce.Do(func() {
+		if path := os.Getenv(SettingsFileEnv); path != "" {
+			var err error
+			if settingsFile, err = loadSettingsFile(path); err != nil {
+				fmt.Printf("Failed loading settings file %s: %v\n", path, err)
+			}
+		}
+	})
+	value, found := settingsFile[name]
+	return value, found
+}
+
+// loadSettingsFile reads "name=value" lines. Blank lines and lines starting with # are ignored.
+func loadSettingsFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.Index(line, "=")
+		if i < 1 {
+			return nil, fmt.Errorf("line %d should be in the form name=value", n)
+		}
+		name := strings.ToLower(strings.TrimSpace(line[:i]))
+		value := strings.TrimSpace(line[i+1:])
+		if err := ValidateSetting(name, value); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		values[name] = value
+	}
+	return values, scanner.Err()
+}
+
+// ResolveSetting returns the effective value of a setting for a site, and the layer it
+// came from. It reports false if no layer holds a value. An empty value stored for a
+// registered setting is treated as unset, so that the next layer applies.
+func ResolveSetting(s Setting, site, name string) (string, SettingLayer, bool) {
+	return resolveSetting(s.Get, site, name)
+}
+
+// resolveSetting resolves a setting using the supplied lookup of stored values.
+func resolveSetting(get func(site, name string) *string, site, name string) (string, SettingLayer, bool) {
+	if value, found := settingOverride(name); found {
+		return value, SettingLayerEnvironment, true
+	}
+
+	d := LookupSettingDefinition(name)
+	isSet := func(value *string) bool {
+		return value != nil && (d == nil || strings.TrimSpace(*value) != "")
+	}
+	if value := get(site, name); isSet(value) {
+		return *value, SettingLayerSite, true
+	}
+	if site != GlobalSettingSite {
+		if value := get(GlobalSettingSite, name); isSet(value) {
+			return *value, SettingLayerGlobal, true
+		}
+	}
+	if d != nil && d.Default != "" {
+		return d.Default, SettingLayerDefault, true
+	}
+	return "", "", false
+}
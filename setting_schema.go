@@ -0,0 +1,256 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SettingType string
+
+const (
+	SettingString   SettingType = "string"
+	SettingInt      SettingType = "int"
+	SettingBool     SettingType = "bool"
+	SettingDuration SettingType = "duration" // Go duration, i.e. "15m", or a number of seconds
+	SettingEmail    SettingType = "email"
+	SettingURL      SettingType = "url"
+	SettingList     SettingType = "list" // Values separated by semicolons
+	SettingSecret   SettingType = "secret"
+)
+
+// SettingDefinition describes a setting that a package reads, so that its value can be
+// checked when stored, and so that the settings page can show a suitable editor.
+type SettingDefinition struct {
+	Name        string
+	Type        SettingType
+	Default     string
+	Description string
+
+	// Allowed lists the only values accepted, or for a list setting, the only
+	// values accepted in the list. Any value is accepted if empty.
+	Allowed []string
+
+	// Validate optionally applies an additional check to non empty values.
+	Validate func(value string) error
+}
+
+var settingDefinitions = map[string]*SettingDefinition{}
+var settingDefinitionsLock sync.RWMutex
+
+// RegisterSetting declares a setting. The registered default is used whenever the
+// setting has no value for a site, see ResolveSetting(), in preference to the default
+// supplied by a caller of GetWithDefault(), GetInt(), GetBool() or GetDuration().
+func RegisterSetting(d SettingDefinition) {
+	d.Name = strings.ToLower(strings.TrimSpace(d.Name))
+	if d.Name == "" {
+		panic("RegisterSetting() requires a setting name")
+	}
+	if d.Type == "" {
+		d.Type = SettingString
+	}
+	if err := d.check(d.Default); err != nil {
+		panic(fmt.Sprintf("RegisterSetting() default for %s is invalid: %v", d.Name, err))
+	}
+
+	settingDefinitionsLock.Lock()
+	defer settingDefinitionsLock.Unlock()
+	settingDefinitions[d.Name] = &d
+}
+
+// LookupSettingDefinition returns the definition of a registered setting, or nil.
+func LookupSettingDefinition(name string) *SettingDefinition {
+	settingDefinitionsLock.RLock()
+	defer settingDefinitionsLock.RUnlock()
+	if d, found := settingDefinitions[strings.ToLower(name)]; found {
+		c := *d
+		return &c
+	}
+	return nil
+}
+
+// SettingDefinitions returns all registered settings, sorted by name.
+func SettingDefinitions() []SettingDefinition {
+	settingDefinitionsLock.RLock()
+	defer settingDefinitionsLock.RUnlock()
+	var all []SettingDefinition
+	for _, d := range settingDefinitions {
+		all = append(all, *d)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+	return all
+}
+
+// ValidateSetting checks a value is acceptable for a setting. Unregistered settings
+// accept any value, and an empty value is always accepted as it resets a registered
+// setting to its default.
+func ValidateSetting(name, value string) error {
+	d := LookupSettingDefinition(name)
+	if d == nil {
+		return nil
+	}
+	if err := d.check(value); err != nil {
+		return fmt.Errorf("Invalid value for setting \"%s\": %v", d.Name, err)
+	}
+	return nil
+}
+
+func (d *SettingDefinition) check(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	values := []string{value}
+	switch d.Type {
+	case SettingInt:
+		if _, err := strconv.Atoi(value); err != nil {
+			return errors.New("must be a whole number")
+		}
+	case SettingBool:
+		if _, ok := parseSettingBool(value); !ok {
+			return errors.New("must be yes or no")
+		}
+	case SettingDuration:
+		if _, ok := parseSettingDuration(value); !ok {
+			return errors.New("must be a number of seconds or a duration such as 15m")
+		}
+	case SettingEmail:
+		if _, err := mail.ParseAddress(value); err != nil {
+			return errors.New("must be an email address")
+		}
+	case SettingURL:
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("must be an absolute url")
+		}
+	case SettingList:
+		values = splitSettingList(value)
+	}
+
+	if len(d.Allowed) > 0 {
+		for _, v := range values {
+			found := false
+			for _, a := range d.Allowed {
+				if strings.EqualFold(v, a) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("must be one of: %s", strings.Join(d.Allowed, ", "))
+			}
+		}
+	}
+	if d.Validate != nil {
+		return d.Validate(value)
+	}
+	return nil
+}
+
+// settingValue returns the effective value of a setting, see ResolveSetting(), falling
+// back to the supplied default if no layer holds a value.
+func settingValue(s Setting, site, name, defaultValue string) string {
+	if value, _, found := ResolveSetting(s, site, name); found {
+		return value
+	}
+	return defaultValue
+}
+
+func settingInt(s Setting, site, name string, defaultValue int) int {
+	if i, err := strconv.Atoi(strings.TrimSpace(settingValue(s, site, name, ""))); err == nil {
+		return i
+	}
+	return defaultValue
+}
+
+func settingBool(s Setting, site, name string, defaultValue bool) bool {
+	if b, ok := parseSettingBool(settingValue(s, site, name, "")); ok {
+		return b
+	}
+	return defaultValue
+}
+
+func settingDuration(s Setting, site, name string, defaultValue time.Duration) time.Duration {
+	if d, ok := parseSettingDuration(settingValue(s, site, name, "")); ok {
+		return d
+	}
+	return defaultValue
+}
+
+func settingList(s Setting, site, name string) []string {
+	return splitSettingList(settingValue(s, site, name, ""))
+}
+
+func splitSettingList(value string) []string {
+	var fields []string
+	for _, f := range strings.Split(value, ";") {
+		if f = strings.TrimSpace(f); f != "" {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+func parseSettingBool(value string) (bool, bool) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "yes", "y", "true", "on", "1":
+		return true, true
+	case "no", "n", "false", "off", "0":
+		return false, true
+	}
+	return false, false
+}
+
+func parseSettingDuration(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(i) * time.Second, true
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return d, true
+	}
+	return 0, false
+}
+
+func init() {
+	RegisterSetting(SettingDefinition{Name: "self.signup", Type: SettingBool, Default: "no", Allowed: []string{"yes", "no"},
+		Description: "Allow visitors to create their own account."})
+	RegisterSetting(SettingDefinition{Name: "base.url", Type: SettingURL,
+		Description: "Address of the site used in links sent by email, i.e. https://www.example.com"})
+	RegisterSetting(SettingDefinition{Name: "session.expiry", Type: SettingInt, Default: "900",
+		Description: "Seconds of inactivity before a user is signed out."})
+	RegisterSetting(SettingDefinition{Name: "session.max_age", Type: SettingInt, Default: "2592000",
+		Description: "Seconds after signing in that a user must sign in again, regardless of activity."})
+	RegisterSetting(SettingDefinition{Name: "activation_token.max_age", Type: SettingInt, Default: "2592000",
+		Description: "Seconds an account activation link remains valid."})
+	RegisterSetting(SettingDefinition{Name: "password_reset_token.max_age", Type: SettingInt, Default: "93600",
+		Description: "Seconds a password reset link remains valid."})
+	RegisterSetting(SettingDefinition{Name: "smtp.hostname", Default: "smtp.example.com",
+		Description: "Mail server used to send email."})
+	RegisterSetting(SettingDefinition{Name: "smtp.port", Type: SettingInt, Default: "587",
+		Description: "Mail server port, usually 587."})
+	RegisterSetting(SettingDefinition{Name: "smtp.user", Default: "support@example.com",
+		Description: "Username used to sign in to the mail server."})
+	RegisterSetting(SettingDefinition{Name: "smtp.password", Type: SettingSecret,
+		Description: "Password used to sign in to the mail server."})
+	RegisterSetting(SettingDefinition{Name: "support_team.name", Default: "Unknown",
+		Description: "Name that email is sent from."})
+	RegisterSetting(SettingDefinition{Name: "support_team.email", Type: SettingEmail, Default: "support@example.com",
+		Description: "Address that email is sent from."})
+	RegisterSetting(SettingDefinition{Name: "support_team.reply.email", Type: SettingEmail,
+		Description: "Address that replies to email should be sent to, if not the support team address."})
+	RegisterSetting(SettingDefinition{Name: "support_team.bounce.email", Type: SettingEmail,
+		Description: "Address that undeliverable email should be returned to."})
+}
@@ -1,8 +1,12 @@
 package security
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 )
 
 // Test settings
@@ -49,3 +53,188 @@ func TestSettings(t *testing.T) {
 	}
 
 }
+
+// schemaTestSetting provides the Setting methods used by the typed setting helpers
+type schemaTestSetting struct {
+	Setting
+	values map[string]string
+}
+
+func (s *schemaTestSetting) Get(site, name string) *string {
+	if v, found := s.values[name]; found {
+		return &v
+	}
+	return nil
+}
+
+func TestSettingSchema(t *testing.T) {
+	RegisterSetting(SettingDefinition{Name: "test.schema.mode", Allowed: []string{"fast", "slow"}, Default: "slow"})
+	RegisterSetting(SettingDefinition{Name: "test.schema.wait", Type: SettingDuration, Default: "90s"})
+
+	for _, c := range []struct {
+		name, value string
+		valid       bool
+	}{
+		{"session.expiry", "3600", true},
+		{"session.expiry", "an hour", false},
+		{"self.signup", "yes", true},
+		{"self.signup", "true", false},
+		{"support_team.email", "help@example.com", true},
+		{"support_team.email", "help", false},
+		{"base.url", "https://www.example.com", true},
+		{"base.url", "www.example.com", false},
+		{"test.schema.mode", "fast", true},
+		{"test.schema.mode", "medium", false},
+		{"test.schema.wait", "15m", true},
+		{"test.schema.wait", "soon", false},
+		{IPAllowSetting, "10.0.0.0/8; 192.168.1.1", true},
+		{IPAllowSetting, "10.0.0.0/8; not-an-address", false},
+		{"session.expiry", "", true},
+		{"unregistered.setting", "anything", true},
+	} {
+		err := ValidateSetting(c.name, c.value)
+		if c.valid && err != nil {
+			t.Errorf("ValidateSetting(%q, %q) failed: %v", c.name, c.value, err)
+		}
+		if !c.valid && err == nil {
+			t.Errorf("ValidateSetting(%q, %q) should fail", c.name, c.value)
+		}
+	}
+
+	s := &schemaTestSetting{values: map[string]string{"session.expiry": "", "self.signup": "yes", "test.schema.wait": "120", "other": "x;  y;"}}
+	if v := settingInt(s, "", "session.expiry", 3600); v != 900 {
+		t.Errorf("settingInt() should return registered default 900 for an empty value, not %d", v)
+	}
+	if v := settingBool(s, "", "self.signup", false); !v {
+		t.Errorf("settingBool() should return true for \"yes\"")
+	}
+	if v := settingDuration(s, "", "test.schema.wait", 0); v != 2*time.Minute {
+		t.Errorf("settingDuration() should read a number as seconds, not %v", v)
+	}
+	if v := settingValue(s, "", "test.schema.mode", "fast"); v != "slow" {
+		t.Errorf("settingValue() should prefer the registered default, not %q", v)
+	}
+	if v := settingValue(s, "", "unregistered.setting", "fallback"); v != "fallback" {
+		t.Errorf("settingValue() should use the supplied default for unregistered settings, not %q", v)
+	}
+	if v := settingList(s, "", "other"); len(v) != 2 || v[1] != "y" {
+		t.Errorf("settingList() should trim and drop empty values, not %q", v)
+	}
+}
+
+func TestSettingAuditValue(t *testing.T) {
+	if SettingEntityUuid("smtp.user") != SettingEntityUuid("SMTP.User") || SettingEntityUuid("smtp.user") == SettingEntityUuid("smtp.port") {
+		t.Fatalf("SettingEntityUuid() should be unique to each setting name, ignoring case")
+	}
+	if v := settingAuditValue("smtp.user", "support@example.com"); v != "support@example.com" {
+		t.Fatalf("settingAuditValue() should record ordinary settings unchanged, not %q", v)
+	}
+	v := settingAuditValue("smtp.password", "password")
+	if !IsRedactedSettingValue(v) || strings.Contains(v, "password") {
+		t.Fatalf("settingAuditValue() should redact secret settings, not return %q", v)
+	}
+	if settingAuditValue("smtp.password", "password") != v || settingAuditValue("smtp.password", "other") == v {
+		t.Fatalf("settingAuditValue() should record the same hash for the same secret")
+	}
+	sum := sha256.Sum256([]byte("password"))
+	if strings.Contains(v, hex.EncodeToString(sum[:])[0:12]) {
+		t.Fatalf("settingAuditValue() should not record a plain hash of a secret")
+	}
+
+	// With a keyring, secrets are hashed with a key derived from it
+	k, err := ParseSecretKeyring("k1=" + GenerateSecretKey())
+	if err != nil {
+		t.Fatalf("ParseSecretKeyring() failed: %v", err)
+	}
+	previous := DefaultSecretKeyring()
+	SetSecretKeyring(k)
+	defer SetSecretKeyring(previous)
+	keyed := settingAuditValue("smtp.password", "password")
+	if keyed == v || !IsRedactedSettingValue(keyed) || settingAuditValue("smtp.password", "password") != keyed {
+		t.Fatalf("settingAuditValue() should hash secrets with a key from the keyring, not return %q", keyed)
+	}
+	sealed, err := EncryptSecret("password")
+	if err != nil {
+		t.Fatalf("EncryptSecret() failed: %v", err)
+	}
+	if settingAuditValue("smtp.password", sealed) != keyed {
+		t.Fatalf("settingAuditValue() should hash the decrypted value of a secret")
+	}
+
+	bulk := newSettingChangeLog("smtp.port", "587", "25", nil)
+	if bulk.GetPersonName() != "System" || len(bulk.Items) != 1 || bulk.Items[0].OldValue != "587" || bulk.Items[0].NewValue != "25" {
+		t.Fatalf("newSettingChangeLog() recorded the wrong change: %v", bulk)
+	}
+}
+
+// layerTestSetting holds settings for several sites, including the global site
+type layerTestSetting struct {
+	Setting
+	sites map[string]map[string]string
+}
+
+func (s *layerTestSetting) Get(site, name string) *string {
+	if v, found := s.sites[site][name]; found {
+		return &v
+	}
+	return nil
+}
+
+func TestSettingLayers(t *testing.T) {
+	s := &layerTestSetting{sites: map[string]map[string]string{
+		GlobalSettingSite: {"smtp.hostname": "smtp.global.com", "smtp.port": "25", "support_team.name": "Global Support"},
+		"a.com":           {"smtp.hostname": "smtp.a.com", "support_team.name": ""},
+	}}
+	t.Setenv(SettingEnvName("smtp.port"), "2525")
+
+	for _, c := range []struct {
+		site, name, value string
+		layer             SettingLayer
+	}{
+		{"a.com", "smtp.hostname", "smtp.a.com", SettingLayerSite},
+		{"b.com", "smtp.hostname", "smtp.global.com", SettingLayerGlobal},
+		{"a.com", "support_team.name", "Global Support", SettingLayerGlobal},
+		{"a.com", "smtp.port", "2525", SettingLayerEnvironment},
+		{"a.com", "session.expiry", "900", SettingLayerDefault},
+	} {
+		value, layer, found := ResolveSetting(s, c.site, c.name)
+		if !found || value != c.value || layer != c.layer {
+			t.Errorf("ResolveSetting(%q, %q) should return %q from %s, not %q from %s", c.site, c.name, c.value, c.layer, value, layer)
+		}
+	}
+	if _, _, found := ResolveSetting(s, "a.com", "unregistered.setting"); found {
+		t.Errorf("ResolveSetting() should not find an unset unregistered setting")
+	}
+	if SettingEnvName("smtp.reply-to.email") != "SETTING_SMTP_REPLY_TO_EMAIL" {
+		t.Errorf("SettingEnvName() returned %s", SettingEnvName("smtp.reply-to.email"))
+	}
+}
+
+// Test a change made through one settings cache reaches watchers of another
+func TestSettingWatch(t *testing.T) {
+	host := RandomString(20) + ".test.com"
+
+	s1, _, _ := NewGaeSetting(projectId)
+	s2, _, _ := NewGaeSetting(projectId)
+	defer s1.Close()
+	defer s2.Close()
+
+	values := make(chan string, 10)
+	cancel := s2.Watch(host, "custom.watched", func(value string) { values <- value })
+	defer cancel()
+
+	if err := s1.Put(host, "custom.watched", "v1"); err != nil {
+		t.Fatalf("settings.Put() failed: %v", err)
+	}
+	select {
+	case value := <-values:
+		if value != "v1" {
+			t.Fatalf("settings.Watch() received \"%s\", expected \"v1\"", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("settings.Watch() was not told of the change")
+	}
+	if value := s2.Get(host, "custom.watched"); value == nil || *value != "v1" {
+		t.Fatalf("settings.Get() should return the changed value")
+	}
+}
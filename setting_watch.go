@@ -0,0 +1,89 @@
+package security
+
+import (
+	"strings"
+	"sync"
+)
+
+// settingWatchers holds the functions registered with Setting.Watch(), and calls them
+// when the cached settings change.
+type settingWatchers struct {
+	lock     sync.Mutex
+	next     int
+	watchers map[int]*settingWatcher
+}
+
+type settingWatcher struct {
+	site string
+	name string
+	fn   func(value string)
+}
+
+func (w *settingWatchers) add(site, name string, fn func(value string)) func() {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.watchers == nil {
+		w.watchers = make(map[int]*settingWatcher)
+	}
+	id := w.next
+	w.next++
+	w.watchers[id] = &settingWatcher{site: site, name: strings.ToLower(name), fn: fn}
+	return func() {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		delete(w.watchers, id)
+	}
+}
+
+func (w *settingWatchers) active() bool {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.watchers) > 0
+}
+
+// notify compares the effective value of each watched setting before and after a
+// change to the cache, and calls the watchers of those that differ.
+func (w *settingWatchers) notify(before, after map[string]map[string]string) {
+	w.lock.Lock()
+	var changed []*settingWatcher
+	var values []string
+	for _, watcher := range w.watchers {
+		old, _, _ := resolveSetting(cachedSetting(before), watcher.site, watcher.name)
+		value, _, _ := resolveSetting(cachedSetting(after), watcher.site, watcher.name)
+		if old != value {
+			changed = append(changed, watcher)
+			values = append(values, value)
+		}
+	}
+	w.lock.Unlock()
+
+	for i, watcher := range changed {
+		watcher.fn(values[i])
+	}
+}
+
+// cachedSetting looks up settings in a cache of site -> name -> value.
+func cachedSetting(sites map[string]map[string]string) func(site, name string) *string {
+	return func(site, name string) *string {
+		if value, found := sites[site][strings.ToLower(name)]; found {
+			return &value
+		}
+		return nil
+	}
+}
+
+// withSetting returns a copy of a settings cache with one value changed. Cached maps are
+// never altered once in use, so a reader may keep using a map after the cache changes.
+func withSetting(sites map[string]map[string]string, site, name, value string) map[string]map[string]string {
+	updated := make(map[string]map[string]string, len(sites)+1)
+	for k, v := range sites {
+		updated[k] = v
+	}
+	sm := make(map[string]string, len(sites[site])+1)
+	for k, v := range sites[site] {
+		sm[k] = v
+	}
+	sm[name] = value
+	updated[site] = sm
+	return updated
+}
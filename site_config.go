@@ -0,0 +1,305 @@
+package security
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	SiteConfigJSON = "json"
+	SiteConfigYAML = "yaml"
+)
+
+// SiteConfig holds the configuration of a site: its settings, picklists and theme. It
+// may be exported from one site and applied to another, so that many similar sites can
+// be provisioned from a single YAML or JSON document.
+type SiteConfig struct {
+	Site      string                              `json:"site,omitempty"`
+	Settings  map[string]string                   `json:"settings"`
+	Picklists map[string][]SiteConfigPicklistItem `json:"picklists"`
+	Theme     *SiteConfigTheme                    `json:"theme,omitempty"`
+}
+
+type SiteConfigPicklistItem struct {
+	Key         string `json:"key"`
+	Value       string `json:"value"`
+	Description string `json:"description,omitempty"`
+	Index       int64  `json:"index,omitempty"`
+	Deprecated  bool   `json:"deprecated,omitempty"`
+}
+
+type SiteConfigTheme struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	CSS         string `json:"css,omitempty"`
+}
+
+// SiteConfigChange describes one difference between two site configurations.
+type SiteConfigChange struct {
+	Kind   string // "setting", "picklist" or "theme"
+	Action string // "add", "change" or "remove"
+	Name   string // Setting name, or picklist name and item key separated by a slash
+	Old    string
+	New    string
+	Secret bool // Old and New hold secret values that should not be displayed
+}
+
+// ExportSiteConfig returns the configuration stored for a site. Only values stored
+// against the site itself are included, not those inherited from the environment,
+// global settings or registered defaults. Secret settings are included, decrypted,
+// only if includeSecrets is true.
+func ExportSiteConfig(am AccessManager, site string, includeSecrets bool) (*SiteConfig, error) {
+	c := &SiteConfig{
+		Site:      site,
+		Settings:  make(map[string]string),
+		Picklists: make(map[string][]SiteConfigPicklistItem),
+	}
+
+	for name, value := range am.Setting().List(site) {
+		if d := LookupSettingDefinition(name); d != nil && d.Type == SettingSecret {
+			if !includeSecrets || value == "" {
+				continue
+			}
+			var err error
+			if value, err = DecryptSecret(value); err != nil {
+				return nil, fmt.Errorf("Failed decrypting setting %s: %v", name, err)
+			}
+		}
+		c.Settings[name] = value
+	}
+
+	if am.PicklistStore() != nil {
+		picklists, err := am.PicklistStore().GetPicklists(site)
+		if err != nil {
+			return nil, err
+		}
+		for name, items := range picklists {
+			for _, i := range items {
+				c.Picklists[name] = append(c.Picklists[name], SiteConfigPicklistItem{
+					Key:         i.GetKey(),
+					Value:       i.GetValue(),
+					Description: i.GetDescription(),
+					Index:       i.GetIndex(),
+					Deprecated:  i.IsDeprecated(),
+				})
+			}
+			sortSiteConfigPicklist(c.Picklists[name])
+		}
+	}
+
+	if theme := themes[site]; theme != nil {
+		c.Theme = &SiteConfigTheme{Name: theme.Name(), Description: theme.Description(), CSS: theme.CSS()}
+	}
+
+	return c, nil
+}
+
+func sortSiteConfigPicklist(items []SiteConfigPicklistItem) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].Index != items[j].Index {
+			return items[i].Index < items[j].Index
+		}
+		return items[i].Key < items[j].Key
+	})
+}
+
+// Marshal encodes the configuration as SiteConfigYAML or SiteConfigJSON.
+func (c *SiteConfig) Marshal(format string) ([]byte, error) {
+	switch strings.ToLower(format) {
+	case SiteConfigJSON:
+		return json.MarshalIndent(c, "", "  ")
+	case SiteConfigYAML, "yml", "":
+		return marshalYAML(c)
+	}
+	return nil, fmt.Errorf("Unsupported site configuration format \"%s\"", format)
+}
+
+// ParseSiteConfig decodes a site configuration document in either YAML or JSON format.
+func ParseSiteConfig(data []byte) (*SiteConfig, error) {
+	// Setting values are read loosely, so that unquoted numbers and booleans are accepted
+	var raw struct {
+		SiteConfig
+		Settings map[string]interface{} `json:"settings"`
+	}
+	if err := unmarshalYAML(data, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid site configuration: %v", err)
+	}
+	c := &raw.SiteConfig
+	if c.Picklists == nil {
+		c.Picklists = make(map[string][]SiteConfigPicklistItem)
+	}
+	c.Settings = make(map[string]string)
+	for name, value := range raw.Settings {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("Invalid site configuration: setting name is missing")
+		}
+		switch v := value.(type) {
+		case nil:
+			c.Settings[name] = ""
+		case string:
+			c.Settings[name] = v
+		case bool:
+			c.Settings[name] = strconv.FormatBool(v)
+		case float64:
+			c.Settings[name] = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("Invalid site configuration: setting %s must have a single value", name)
+		}
+	}
+	for name, items := range c.Picklists {
+		for _, i := range items {
+			if strings.TrimSpace(i.Key) == "" {
+				return nil, fmt.Errorf("Invalid site configuration: picklist %s has an item without a key", name)
+			}
+		}
+	}
+	if c.Theme != nil && strings.TrimSpace(c.Theme.Name) == "" {
+		return nil, fmt.Errorf("Invalid site configuration: theme name is missing")
+	}
+	return c, nil
+}
+
+// Validate checks every setting value is acceptable, see ValidateSetting().
+func (c *SiteConfig) Validate() error {
+	var names []string
+	for name := range c.Settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := ValidateSetting(name, c.Settings[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DiffSiteConfig lists the changes needed to make the configuration `from` match `to`,
+// sorted by kind then name.
+func DiffSiteConfig(from, to *SiteConfig) []SiteConfigChange {
+	var changes []SiteConfigChange
+
+	secret := func(name string) bool {
+		d := LookupSettingDefinition(name)
+		return d != nil && d.Type == SettingSecret
+	}
+	for name, value := range to.Settings {
+		if old, found := from.Settings[name]; !found {
+			changes = append(changes, SiteConfigChange{Kind: "setting", Action: "add", Name: name, New: value, Secret: secret(name)})
+		} else if old != value {
+			changes = append(changes, SiteConfigChange{Kind: "setting", Action: "change", Name: name, Old: old, New: value, Secret: secret(name)})
+		}
+	}
+	for name, value := range from.Settings {
+		if _, found := to.Settings[name]; !found {
+			changes = append(changes, SiteConfigChange{Kind: "setting", Action: "remove", Name: name, Old: value, Secret: secret(name)})
+		}
+	}
+
+	describe := func(i SiteConfigPicklistItem) string {
+		s := fmt.Sprintf("%s (index %d)", i.Value, i.Index)
+		if i.Description != "" {
+			s = s + ": " + i.Description
+		}
+		if i.Deprecated {
+			s = s + " [deprecated]"
+		}
+		return s
+	}
+	items := func(c *SiteConfig) map[string]SiteConfigPicklistItem {
+		m := make(map[string]SiteConfigPicklistItem)
+		for name, list := range c.Picklists {
+			for _, i := range list {
+				m[name+"/"+i.Key] = i
+			}
+		}
+		return m
+	}
+	fromItems, toItems := items(from), items(to)
+	for name, i := range toItems {
+		if old, found := fromItems[name]; !found {
+			changes = append(changes, SiteConfigChange{Kind: "picklist", Action: "add", Name: name, New: describe(i)})
+		} else if old != i {
+			changes = append(changes, SiteConfigChange{Kind: "picklist", Action: "change", Name: name, Old: describe(old), New: describe(i)})
+		}
+	}
+	for name, i := range fromItems {
+		if _, found := toItems[name]; !found {
+			changes = append(changes, SiteConfigChange{Kind: "picklist", Action: "remove", Name: name, Old: describe(i)})
+		}
+	}
+
+	switch {
+	case from.Theme == nil && to.Theme != nil:
+		changes = append(changes, SiteConfigChange{Kind: "theme", Action: "add", Name: to.Theme.Name, New: to.Theme.Description})
+	case from.Theme != nil && to.Theme == nil:
+		changes = append(changes, SiteConfigChange{Kind: "theme", Action: "remove", Name: from.Theme.Name, Old: from.Theme.Description})
+	case from.Theme != nil && *from.Theme != *to.Theme:
+		changes = append(changes, SiteConfigChange{Kind: "theme", Action: "change", Name: to.Theme.Name, Old: from.Theme.Name, New: to.Theme.Name})
+	}
+
+	order := map[string]int{"setting": 0, "picklist": 1, "theme": 2}
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Kind != changes[j].Kind {
+			return order[changes[i].Kind] < order[changes[j].Kind]
+		}
+		return changes[i].Name < changes[j].Name
+	})
+	return changes
+}
+
+// ApplySiteConfig updates a site to match a configuration document, returning the
+// changes made. With dryRun set, the changes that would be made are returned and the
+// site is left unchanged. Settings, picklist items and themes missing from the
+// document are left in place, so a document exported without secrets may be applied
+// without removing the secrets of the site being updated.
+func ApplySiteConfig(am AccessManager, site string, c *SiteConfig, updator Session, dryRun bool) ([]SiteConfigChange, error) {
+	if err := c.Validate(); err != nil {
+		return nil, err
+	}
+	current, err := ExportSiteConfig(am, site, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []SiteConfigChange
+	for _, change := range DiffSiteConfig(current, c) {
+		if change.Action != "remove" {
+			changes = append(changes, change)
+		}
+	}
+	if dryRun {
+		return changes, nil
+	}
+
+	for _, change := range changes {
+		switch change.Kind {
+		case "setting":
+			if err := am.Setting().PutAs(site, change.Name, change.New, updator); err != nil {
+				return nil, err
+			}
+		case "picklist":
+			name := change.Name[:strings.Index(change.Name, "/")]
+			key := change.Name[len(name)+1:]
+			for _, i := range c.Picklists[name] {
+				if i.Key != key {
+					continue
+				}
+				add := am.PicklistStore().AddPicklistItem
+				if i.Deprecated {
+					add = am.PicklistStore().AddPicklistItemDeprecated
+				}
+				if err := add(site, name, i.Key, i.Value, i.Description, i.Index); err != nil {
+					return nil, err
+				}
+			}
+		case "theme":
+			RegisterTheme(site, c.Theme.Name, c.Theme.Description, c.Theme.CSS)
+		}
+	}
+	return changes, nil
+}
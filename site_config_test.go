@@ -0,0 +1,91 @@
+package security
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSiteConfig(t *testing.T) {
+	c := &SiteConfig{
+		Site: "a.example.com",
+		Settings: map[string]string{
+			"base.url":       "https://a.example.com",
+			"session.expiry": "900",
+			"self.signup":    "yes",
+			"custom.note":    "line one\nline \"two\": #3",
+			"custom.empty":   "",
+		},
+		Picklists: map[string][]SiteConfigPicklistItem{
+			"sex": {
+				{Key: "m", Value: "Male", Index: 1},
+				{Key: "f", Value: "Female", Description: "- not: a key", Index: 2, Deprecated: true},
+			},
+			"empty": {},
+		},
+		Theme: &SiteConfigTheme{Name: "blue", CSS: "body { color: blue; }"},
+	}
+
+	for _, format := range []string{SiteConfigYAML, SiteConfigJSON} {
+		data, err := c.Marshal(format)
+		if err != nil {
+			t.Fatalf("Marshal(%s) failed: %v", format, err)
+		}
+		d, err := ParseSiteConfig(data)
+		if err != nil {
+			t.Fatalf("ParseSiteConfig(%s) failed: %v\n%s", format, err, data)
+		}
+		if !reflect.DeepEqual(c, d) {
+			t.Fatalf("ParseSiteConfig(%s) returned %#v, expected %#v\n%s", format, d, c, data)
+		}
+		if changes := DiffSiteConfig(c, d); len(changes) != 0 {
+			t.Fatalf("DiffSiteConfig(%s) of identical configuration returned %v", format, changes)
+		}
+	}
+
+	// Hand written documents
+	d, err := ParseSiteConfig([]byte("# Provisioning template\nsettings:\n  Smtp.Port: 2525\n  session.max_age: 2592000\n  self.signup: no\npicklists:\n  sex:\n  - key: m\n    value: 'Man''s'\n"))
+	if err != nil {
+		t.Fatalf("ParseSiteConfig() failed: %v", err)
+	}
+	if d.Settings["smtp.port"] != "2525" || d.Settings["session.max_age"] != "2592000" || d.Settings["self.signup"] != "no" || d.Picklists["sex"][0].Value != "Man's" {
+		t.Fatalf("ParseSiteConfig() returned %#v", d)
+	}
+	if _, err := ParseSiteConfig([]byte("settings:\n  a: 1\n  a: 2\n")); err == nil {
+		t.Fatalf("ParseSiteConfig() should reject duplicate keys")
+	}
+	if _, err := ParseSiteConfig([]byte("settings:\n  a: 1\n    b: 2\n")); err == nil {
+		t.Fatalf("ParseSiteConfig() should reject invalid indentation")
+	}
+	d.Settings["session.expiry"] = "soon"
+	if err := d.Validate(); err == nil || !strings.Contains(err.Error(), "session.expiry") {
+		t.Fatalf("Validate() should reject invalid setting values, returned %v", err)
+	}
+
+	// Diff
+	d = &SiteConfig{
+		Settings: map[string]string{"base.url": "https://b.example.com", "session.expiry": "900", "smtp.password": "x"},
+		Picklists: map[string][]SiteConfigPicklistItem{
+			"sex": {{Key: "m", Value: "Male", Index: 1}, {Key: "f", Value: "Female", Description: "- not: a key", Index: 2}},
+		},
+	}
+	var found []string
+	for _, change := range DiffSiteConfig(c, d) {
+		found = append(found, change.Kind+" "+change.Action+" "+change.Name)
+		if change.Name == "smtp.password" && !change.Secret {
+			t.Fatalf("DiffSiteConfig() should mark smtp.password as secret")
+		}
+	}
+	expected := []string{
+		"setting change base.url",
+		"setting remove custom.empty",
+		"setting remove custom.note",
+		"setting remove self.signup",
+		"setting add smtp.password",
+		"picklist change sex/f",
+		"theme remove blue",
+	}
+	if !reflect.DeepEqual(found, expected) {
+		t.Fatalf("DiffSiteConfig() returned %v, expected %v", found, expected)
+	}
+}
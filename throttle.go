@@ -1,7 +1,184 @@
 package security
 
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
 type Throttle interface {
 	IsThrottled(key string) (bool, error)
 	Increment(key string) error
 	Clear(key string) error
+
+	// Status reports how many attempts remain before a key is locked, and when a
+	// locked key will unlock, so that the user can be told how long to wait.
+	Status(key string) (*ThrottleStatus, error)
+}
+
+type ThrottleStatus struct {
+	Throttled bool
+	Remaining int64      // Attempts remaining before the key is locked
+	Unlock    *time.Time // Time the lockout ends, nil if not locked
+}
+
+// Throttle key classes. Each class has its own policy, which may be overridden
+// per site with the settings "throttle.<class>.attempts", "throttle.<class>.window",
+// "throttle.<class>.lockout" and "throttle.<class>.max_lockout".
+const (
+	ThrottleSigninEmail    = "signin.email"
+	ThrottleSigninIP       = "signin.ip"
+	ThrottleForgotPassword = "forgot"
+	ThrottleSignup         = "signup"         // Signups refused because the details were invalid
+	ThrottleSignupSuccess  = "signup.success" // Signups accepted, which many people behind one address may make
+)
+
+// ThrottlePolicy describes how many attempts are allowed within a window of
+// time, and how long a key is locked once the limit is exceeded. Each repeat
+// lockout doubles the lockout period, up to MaxLockout. All times are seconds.
+type ThrottlePolicy struct {
+	Attempts   int64
+	Window     int64
+	Lockout    int64
+	MaxLockout int64
+}
+
+// DefaultThrottlePolicies may only be changed during init. Use RegisterThrottlePolicy
+// to add a policy once requests are being served.
+var DefaultThrottlePolicies = map[string]ThrottlePolicy{
+	ThrottleSigninEmail:    {Attempts: 3, Window: 60, Lockout: 60, MaxLockout: 3600},
+	ThrottleSigninIP:       {Attempts: 3, Window: 60, Lockout: 60, MaxLockout: 3600},
+	ThrottleForgotPassword: {Attempts: 3, Window: 3600, Lockout: 3600, MaxLockout: 86400},
+	ThrottleSignup:         {Attempts: 5, Window: 3600, Lockout: 3600, MaxLockout: 86400},
+	ThrottleSignupSuccess:  {Attempts: 50, Window: 3600, Lockout: 3600, MaxLockout: 86400},
+}
+
+// registeredThrottlePolicies holds the policies added by RegisterThrottlePolicy
+var registeredThrottlePolicies = map[string]ThrottlePolicy{}
+var registeredThrottlePoliciesLock sync.RWMutex
+
+// RegisterThrottlePolicy sets the default policy of a class of throttle keys, unless
+// the class already has one. It is safe to call while requests are being served.
+func RegisterThrottlePolicy(class string, policy ThrottlePolicy) {
+	if _, found := DefaultThrottlePolicies[class]; found {
+		return
+	}
+	registeredThrottlePoliciesLock.Lock()
+	defer registeredThrottlePoliciesLock.Unlock()
+	if _, found := registeredThrottlePolicies[class]; !found {
+		registeredThrottlePolicies[class] = policy
+	}
+}
+
+func defaultThrottlePolicy(class string) (ThrottlePolicy, bool) {
+	if policy, found := DefaultThrottlePolicies[class]; found {
+		return policy, true
+	}
+	registeredThrottlePoliciesLock.RLock()
+	defer registeredThrottlePoliciesLock.RUnlock()
+	policy, found := registeredThrottlePolicies[class]
+	return policy, found
+}
+
+// ThrottleKey builds a throttle key for a value, i.e. an email address or ip address,
+// that belongs to a class of keys whose policy can be configured per site.
+func ThrottleKey(site, class, value string) string {
+	return class + "|" + site + "|" + value
+}
+
+// ThrottlePolicyForKey returns the policy that applies to a key built by ThrottleKey(). Keys
+// that were not built by ThrottleKey(), or that have an unknown class, use the fallback policy.
+func ThrottlePolicyForKey(settings Setting, key string, fallback ThrottlePolicy) ThrottlePolicy {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) != 3 {
+		return fallback
+	}
+	class, site := parts[0], parts[1]
+
+	policy, found := defaultThrottlePolicy(class)
+	if !found {
+		policy = fallback
+	}
+	if settings == nil {
+		return policy
+	}
+	policy.Attempts = int64(settings.GetInt(site, "throttle."+class+".attempts", int(policy.Attempts)))
+	policy.Window = int64(settings.GetInt(site, "throttle."+class+".window", int(policy.Window)))
+	policy.Lockout = int64(settings.GetInt(site, "throttle."+class+".lockout", int(policy.Lockout)))
+	policy.MaxLockout = int64(settings.GetInt(site, "throttle."+class+".max_lockout", int(policy.MaxLockout)))
+	if policy.MaxLockout < policy.Lockout {
+		policy.MaxLockout = policy.Lockout
+	}
+	return policy
+}
+
+// LockoutPeriod returns the lockout period for the n'th consecutive lockout, starting from zero.
+func (p ThrottlePolicy) LockoutPeriod(lockouts int64) int64 {
+	period := p.Lockout
+	for i := int64(0); i < lockouts && period < p.MaxLockout; i++ {
+		period = period * 2
+	}
+	if p.MaxLockout > 0 && period > p.MaxLockout {
+		period = p.MaxLockout
+	}
+	return period
+}
+
+// throttleState holds the counters recorded against a throttle key. Each Throttle
+// implementation persists these fields in its own way, but shares the logic below.
+type throttleState struct {
+	Attempts    int64 // Attempts within the current window
+	Updated     int64 // Time of the most recent attempt
+	LockedUntil int64 // Time the current lockout ends
+	Lockouts    int64 // Number of consecutive lockouts, used to grow the lockout period
+}
+
+// increment records an attempt at time now, locking the key if the policy limit is exceeded.
+func (s *throttleState) increment(policy ThrottlePolicy, now int64) {
+	if s.Updated < now-policy.MaxLockout-policy.Window {
+		// Quiet for long enough to forget about earlier lockouts
+		s.Lockouts = 0
+	}
+	if s.Updated < now-policy.Window && s.LockedUntil <= now {
+		// Last hit is dated longer than the window period, reset counter
+		s.Attempts = 0
+	}
+	s.Attempts = s.Attempts + 1
+	s.Updated = now
+	if s.Attempts > policy.Attempts && s.LockedUntil <= now {
+		s.LockedUntil = now + policy.LockoutPeriod(s.Lockouts)
+		s.Lockouts = s.Lockouts + 1
+	}
+}
+
+func (s *throttleState) status(policy ThrottlePolicy, now int64) *ThrottleStatus {
+	status := &ThrottleStatus{Remaining: policy.Attempts}
+	if s.Updated >= now-policy.Window || s.LockedUntil > now {
+		status.Remaining = policy.Attempts - s.Attempts
+	}
+	if status.Remaining < 0 {
+		status.Remaining = 0
+	}
+	if s.LockedUntil > now {
+		unlock := time.Unix(s.LockedUntil, 0)
+		status.Throttled = true
+		status.Unlock = &unlock
+	}
+	return status
+}
+
+// throttleWait describes how long until a locked key unlocks, i.e. "5 minutes"
+func throttleWait(status *ThrottleStatus) string {
+	if status == nil || status.Unlock == nil {
+		return "a few minutes"
+	}
+	minutes := int(time.Until(*status.Unlock).Minutes() + 0.999)
+	if minutes <= 1 {
+		return "a minute"
+	}
+	if minutes < 120 {
+		return fmt.Sprintf("%d minutes", minutes)
+	}
+	return fmt.Sprintf("%d hours", (minutes+59)/60)
 }
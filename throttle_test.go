@@ -1,13 +1,27 @@
 package security
 
 import (
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestThrottle(t *testing.T) {
-
 	s, client, ctx := NewGaeSetting(projectId)
-	throttle := NewGaeThrottle(s, client, ctx)
+	testThrottle(t, NewGaeThrottle(s, client, ctx))
+}
+
+func TestMemoryThrottle(t *testing.T) {
+	testThrottle(t, NewMemoryThrottle(nil))
+}
+
+func TestTokenBucketThrottle(t *testing.T) {
+	testThrottle(t, NewTokenBucketThrottle(nil))
+}
+
+// testThrottle checks behaviour common to all Throttle implementations, which
+// are expected to allow three attempts per minute for keys without a class.
+func testThrottle(t *testing.T, throttle Throttle) {
 
 	// Test basic operation
 	{
@@ -74,6 +88,138 @@ func TestThrottle(t *testing.T) {
 			t.Fatalf("throttle.IsThrottled() should be throttled")
 		}
 
+		status, err := throttle.Status(email)
+		if err != nil {
+			t.Fatalf("throttle.Status() failed: %v", err)
+		}
+		if !status.Throttled || status.Remaining != 0 || status.Unlock == nil || status.Unlock.Before(time.Now()) {
+			t.Fatalf("throttle.Status() should report a lockout in the future, got %+v", status)
+		}
+
+		// Clearing the key removes the lockout
+		err = throttle.Clear(email)
+		if err != nil {
+			t.Fatalf("throttle.Clear() failed: %v", err)
+		}
+		status, err = throttle.Status(email)
+		if err != nil {
+			t.Fatalf("throttle.Status() failed: %v", err)
+		}
+		if status.Throttled || status.Remaining != 3 {
+			t.Fatalf("throttle.Status() should have three attempts remaining after Clear(), got %+v", status)
+		}
+	}
+
+	// Concurrent increments are all counted
+	{
+		ip := RandomString(10)
+		key := ThrottleKey("example.com", ThrottleSignup, ip)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := throttle.Increment(key); err != nil {
+					t.Errorf("throttle.Increment() failed: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		status, err := throttle.Status(key)
+		if err != nil {
+			t.Fatalf("throttle.Status() failed: %v", err)
+		}
+		if status.Throttled || status.Remaining != 1 {
+			t.Fatalf("throttle.Status() should have one signup attempt remaining, got %+v", status)
+		}
+		throttle.Clear(key)
+	}
+}
+
+func TestMemoryThrottleEviction(t *testing.T) {
+	throttle := NewMemoryThrottle(nil).(*MemoryThrottle)
+	throttle.Increment("user@example.com")
+
+	shard := throttle.shards.get("user@example.com")
+	if len(shard.items) != 1 {
+		t.Fatalf("MemoryThrottle should hold one item, not %d", len(shard.items))
+	}
+
+	// Items are kept until they have been idle longer than the window and maximum lockout
+	shard.evict(time.Now().Unix() + 3600)
+	if len(shard.items) != 1 {
+		t.Fatalf("MemoryThrottle should not evict before the next sweep")
+	}
+	shard.evicted = 0
+	shard.evict(time.Now().Unix() + 60*60 + 61)
+	if len(shard.items) != 0 {
+		t.Fatalf("MemoryThrottle should have evicted the idle item")
+	}
+}
+
+func TestThrottlePolicy(t *testing.T) {
+	policy := ThrottlePolicy{Attempts: 3, Window: 60, Lockout: 60, MaxLockout: 300}
+
+	if p := policy.LockoutPeriod(0); p != 60 {
+		t.Fatalf("LockoutPeriod(0) should be 60, not %d", p)
+	}
+	if p := policy.LockoutPeriod(2); p != 240 {
+		t.Fatalf("LockoutPeriod(2) should be 240, not %d", p)
+	}
+	if p := policy.LockoutPeriod(5); p != 300 {
+		t.Fatalf("LockoutPeriod(5) should be capped at 300, not %d", p)
+	}
+
+	var state throttleState
+	now := int64(1000)
+	for i := 0; i < 3; i++ {
+		state.increment(policy, now)
+	}
+	if s := state.status(policy, now); s.Throttled || s.Remaining != 0 {
+		t.Fatalf("status() should not be throttled with no attempts remaining, got %+v", s)
 	}
 
+	state.increment(policy, now)
+	s := state.status(policy, now)
+	if !s.Throttled || s.Unlock == nil || s.Unlock.Unix() != now+60 {
+		t.Fatalf("status() should be locked for 60 seconds, got %+v", s)
+	}
+
+	// A second lockout lasts twice as long
+	now = now + 61
+	for i := 0; i < 4; i++ {
+		state.increment(policy, now)
+	}
+	s = state.status(policy, now)
+	if !s.Throttled || s.Unlock.Unix() != now+120 {
+		t.Fatalf("status() should be locked for 120 seconds, got %+v", s)
+	}
+
+	// Unlocks once the lockout period passes
+	if s := state.status(policy, now+121); s.Throttled {
+		t.Fatalf("status() should no longer be throttled, got %+v", s)
+	}
+
+	if k := ThrottleKey("example.com", ThrottleSignup, "127.0.0.1"); ThrottlePolicyForKey(nil, k, policy) != DefaultThrottlePolicies[ThrottleSignup] {
+		t.Fatalf("ThrottlePolicyForKey() should return the signup policy")
+	}
+	if k := ThrottleKey("example.com", ThrottleSignupSuccess, "127.0.0.1"); ThrottlePolicyForKey(nil, k, policy).Attempts <= DefaultThrottlePolicies[ThrottleSignup].Attempts {
+		t.Fatalf("ThrottlePolicyForKey() should allow more successful signups than failed ones")
+	}
+	if ThrottlePolicyForKey(nil, "user@example.com", policy) != policy {
+		t.Fatalf("ThrottlePolicyForKey() should return the fallback policy")
+	}
+
+	registered := ThrottlePolicy{Attempts: 7, Window: 70}
+	RegisterThrottlePolicy("test.registered", registered)
+	RegisterThrottlePolicy("test.registered", policy)
+	RegisterThrottlePolicy(ThrottleSignup, registered)
+	if ThrottlePolicyForKey(nil, ThrottleKey("example.com", "test.registered", "x"), policy) != registered {
+		t.Fatalf("ThrottlePolicyForKey() should return the first policy registered for a class")
+	}
+	if _, found := DefaultThrottlePolicies["test.registered"]; found || DefaultThrottlePolicies[ThrottleSignup] == registered {
+		t.Fatalf("RegisterThrottlePolicy() should not change DefaultThrottlePolicies")
+	}
 }
@@ -1,9 +1,15 @@
 package security
 
 import (
+	"io"
 	"time"
 )
 
+// TicketManager stores support tickets, and decides who may see them, see TicketSupportRole.
+// Methods return ErrTicketPermissionDenied when a session may not see or change a ticket.
+// Queues, such as tickets by status, tag or type, are only available to support desk
+// staff. Lists of tickets for a person or parent record include only the tickets the
+// session may see, and internal notes are left out of the responses seen by others.
 type TicketManager interface {
 	// GetTicket looks up a parentless ticket by ticked uuid
 	GetTicket(uuid string, session Session) (Ticket, error)
@@ -11,43 +17,180 @@ type TicketManager interface {
 	// GetTicketWithParent looks up a ticket by uuid with a specfic parent object
 	GetTicketWithParent(parentType, parentUuid, uuid string, session Session) (Ticket, error)
 
+	// FindTicket looks up a ticket by uuid, whether or not it has a parent object
+	FindTicket(uuid string, session Session) (Ticket, error)
+
+	// QueryTickets returns a page of the tickets matching every field set in a filter, newest
+	// first, and a cursor for the next page. The cursor is empty on the last page. Pass an
+	// empty cursor for the first page.
+	QueryTickets(filter TicketFilter, cursor string, limit int, session Session) ([]Ticket, string, error)
+
+	// The GetTicketsBy methods return at most the newest 200 tickets. Use QueryTickets to
+	// page through every matching ticket.
 	GetTicketsByStatus(status TicketStatus, session Session) ([]Ticket, error)
 	GetTicketsByEmail(email string, session Session) ([]Ticket, error)
 	GetTicketsByPersonUuid(personUuid string, session Session) ([]Ticket, error)
 	GetTicketsByParentRecord(parentType, parentUuid string, session Session) ([]Ticket, error)
 	GetTicketsByStatusParentRecord(status TicketStatus, recordType, recordUuid string, session Session) ([]Ticket, error)
+	GetTicketsByAssignee(personUuid string, session Session) ([]Ticket, error)
+	GetTicketsByTag(tag string, session Session) ([]Ticket, error)
+	GetTicketsByType(ticketType TicketType, session Session) ([]Ticket, error)
+
+	// GetTicketsByActionAfter returns open tickets whose ActionAfter time is before a time, earliest first
+	GetTicketsByActionAfter(before time.Time, session Session) ([]Ticket, error)
 
-	GetTicketResponses(uuid string) ([]TicketResponse, error)
+	// GetTicketResponses returns the responses to a parentless ticket, oldest first
+	GetTicketResponses(uuid string, session Session) ([]TicketResponse, error)
 
+	// GetParentedTicketResponses returns the responses to a ticket with a specific parent object, oldest first
+	GetParentedTicketResponses(parentType, parentUuid, uuid string, session Session) ([]TicketResponse, error)
+
+	// SearchTickets returns the first page of tickets matching every keyword, best matches first
 	SearchTickets(keyword string, session Session) ([]Ticket, error)
 
+	// SearchTicketsPage returns a page of tickets matching every keyword, best matches first,
+	// and the total number of matching tickets
+	SearchTicketsPage(keyword string, offset, limit int, session Session) ([]Ticket, int, error)
+
+	// ReindexTickets rebuilds the search terms of every ticket of a site, returning the
+	// number of tickets indexed
+	ReindexTickets(session Session) (int, error)
+
 	AddTicket(status TicketStatus, ticketType TicketType, personUuid, firstName, lastName, email, subject, message string, actionAfter *time.Time, tags []string, assignedTo, watchedBy []TicketViewer, session Session) (Ticket, error)
 	AddTicketWithParent(parentType, parentUuid string, status TicketStatus, ticketType TicketType, personUuid, firstName, lastName, email, subject, message string, actionAfter *time.Time, tags []string, assignedTo, watchedBy []TicketViewer, session Session) (Ticket, error)
 	AddTicketResponse(ticketUuid string, status TicketStatus, subject, message string, session Session) error
 	AddParentedTicketResponse(recordType string, recordUuid string, ticketUuid string, status TicketStatus, subject, message string, session Session) error
 
+	// AddParentedTicketResponseWithAttachments adds a response, or with internal set a note, with
+	// files attached to it. Every file is checked against the size and type limits of the site
+	// before any is stored.
+	AddParentedTicketResponseWithAttachments(recordType, recordUuid, ticketUuid string, status TicketStatus, subject, message string, internal bool, files []TicketFile, session Session) error
+
+	// AddTicketAttachments attaches files to a ticket itself, such as screenshots sent with feedback
+	AddTicketAttachments(parentType, parentUuid, ticketUuid string, files []TicketFile, session Session) ([]TicketAttachment, error)
+
+	// OpenTicketAttachment returns a file attached to a ticket or one of its responses, and
+	// its content, which must be closed. The response is nil if the file is attached to the
+	// ticket itself. Nil is returned if the attachment is not found.
+	OpenTicketAttachment(parentType, parentUuid, ticketUuid, uuid string, session Session) (*TicketAttachment, TicketResponse, io.ReadCloser, error)
+
+	// AddTicketNote adds an internal note to a ticket, seen only by staff. The ticket status is unchanged.
+	AddTicketNote(ticketUuid, message string, session Session) error
+	AddParentedTicketNote(recordType, recordUuid, ticketUuid, message string, session Session) error
+
+	// UpdateTicket changes the tags, assignees and watchers of a ticket, recording the change in the ticket history
+	UpdateTicket(parentType, parentUuid, uuid string, tags []string, assignedTo, watchedBy []TicketViewer, session Session) error
+
+	// SetTicketActionAfter changes, or with nil clears, the time after which a ticket needs attention
+	SetTicketActionAfter(parentType, parentUuid, uuid string, actionAfter *time.Time, session Session) error
+
+	// EscalateTicket adds tags and assignees to a ticket, recording why it was escalated. A
+	// ticket is escalated for missing each SLA target only once, so false is returned if it
+	// already has been. Escalating a ticket because its ActionAfter time has passed clears it.
+	EscalateTicket(parentType, parentUuid, uuid string, reason TicketEscalation, tags []string, assignTo []TicketViewer, session Session) (bool, error)
+
+	// MergeTicket moves the responses, watchers, tags and attachments of a ticket into another,
+	// and adds its message as a response to the other ticket. The merged ticket is kept, closed
+	// and without responses, to point to the ticket it was merged into.
+	MergeTicket(parentType, parentUuid, uuid, intoParentType, intoParentUuid, intoUuid string, session Session) error
+
+	// SplitTicketResponse moves a response, and the files attached to it, into a new ticket
+	// raised by the same requester. The subject of the original ticket is used if none is given.
+	SplitTicketResponse(parentType, parentUuid, uuid, responseUuid, subject string, session Session) (Ticket, error)
+
+	// LinkTickets relates one ticket to another, replacing any existing link between them.
+	// The inverse relation is added to the other ticket.
+	LinkTickets(parentType, parentUuid, uuid string, linkType TicketLinkType, toParentType, toParentUuid, toUuid string, session Session) error
+
+	// UnlinkTickets removes the link between two tickets from both of them
+	UnlinkTickets(parentType, parentUuid, uuid, toUuid string, session Session) error
+
+	// GetTicketNotificationPreference returns the notifications a person, identified by
+	// email address, does not wish to receive
+	GetTicketNotificationPreference(email string, session Session) (*TicketNotificationPreference, error)
+
+	// GetTicketNotificationPreferenceByToken looks up preferences by the token included in each notification
+	GetTicketNotificationPreferenceByToken(token string, session Session) (*TicketNotificationPreference, error)
+
+	PutTicketNotificationPreference(preference *TicketNotificationPreference, session Session) error
+
 	Setting() Setting
 	PicklistStore() PicklistStore
+
+	// BlobStore returns where attachment content is kept, or nil if attachments are not available
+	BlobStore() BlobStore
 }
 
+// TicketStatus is a key of the "ticket.status" picklist, see TicketWorkflow
 type TicketStatus string
 
+// Statuses available to sites that have not defined their own
 const (
 	TicketOpen     TicketStatus = "open"
 	TicketArchived TicketStatus = "archived"
 	TicketDeleted  TicketStatus = "deleted"
 )
 
+// TicketType is a key of the "ticket.type" picklist, see TicketWorkflow
 type TicketType string
 
+// Types available to sites that have not defined their own
+const (
+	EnquiryTicket          TicketType = "enquiry"
+	TechnicalSupportTicket TicketType = "support"
+	FeedbackTicket         TicketType = "feedback"
+	ComplaintTicket        TicketType = "complaint"
+)
+
+// Deprecated: these types are kept for existing tickets. Sites define their own
+// types in the "ticket.type" picklist.
 const (
 	CourseEnrolmentTicket  TicketType = "course"
 	SubjectEnrolmentTicket TicketType = "subject"
-	EnquiryTicket          TicketType = "enquiry"
 	AcademicTicket         TicketType = "academic"
-	TechnicalSupportTicket TicketType = "support"
 )
 
+// TicketEscalation is the reason a ticket was escalated
+type TicketEscalation string
+
+const (
+	TicketActionAfterEscalation   TicketEscalation = "action_after"   // The ActionAfter time passed
+	TicketFirstResponseEscalation TicketEscalation = "first_response" // The first response target was missed
+	TicketResolutionEscalation    TicketEscalation = "resolution"     // The resolution target was missed
+)
+
+// TicketEvent identifies a change to a ticket that people may be notified of
+type TicketEvent string
+
+const (
+	TicketCreatedEvent  TicketEvent = "created"
+	TicketReplyEvent    TicketEvent = "reply"
+	TicketNoteEvent     TicketEvent = "note"
+	TicketStatusEvent   TicketEvent = "status"
+	TicketAssignedEvent TicketEvent = "assigned"
+)
+
+var TicketEvents = []TicketEvent{TicketCreatedEvent, TicketReplyEvent, TicketNoteEvent, TicketStatusEvent, TicketAssignedEvent}
+
+// TicketNotificationPreference records the ticket notifications a person does not wish
+// to receive, and the language they are sent in.
+type TicketNotificationPreference struct {
+	Email  string
+	Lang   string        // Language of notifications, or empty for the site default
+	OptOut []TicketEvent // Events not notified
+	Token  string        // Allows the preference to be changed from a link in a notification
+}
+
+// Wants reports if a person wishes to be notified of an event.
+func (p *TicketNotificationPreference) Wants(event TicketEvent) bool {
+	for _, e := range p.OptOut {
+		if e == event || e == "all" {
+			return false
+		}
+	}
+	return true
+}
+
 // Information about a support ticket
 type Ticket interface {
 	ParentType() string
@@ -72,7 +215,34 @@ type Ticket interface {
 	AssignedTo() []TicketViewer
 	WatchedBy() []TicketViewer
 	Created() *time.Time
+	Updated() *time.Time // Updated is when the ticket, or its responses, last changed
 	ActionAfter() *time.Time
+
+	FirstResponse() *time.Time       // FirstResponse is when someone other than the requester first replied
+	Resolved() *time.Time            // Resolved is when the ticket was last closed, or nil while open
+	Escalations() []TicketEscalation // Escalations lists the SLA targets the ticket was escalated for missing
+	Attachments() []TicketAttachment // Attachments are files attached to the ticket itself, not to its responses
+	Links() []TicketLink             // Links relate the ticket to others
+	MergedInto() *TicketLink         // MergedInto is the ticket this one was merged into, or nil
+}
+
+// TicketFilter selects the tickets returned by QueryTickets. Fields left empty match every
+// ticket. Tickets may be filtered by a range of either their created or updated time, but
+// not both at once.
+type TicketFilter struct {
+	Status     TicketStatus
+	Type       TicketType
+	Tag        string
+	AssignedTo string // Person uuid of an assignee
+	PersonUuid string // Person uuid of the requester
+	Email      string // Email address of the requester
+	ParentType string // Parent record, set with ParentUuid
+	ParentUuid string
+
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	UpdatedAfter  *time.Time // Also orders the results by updated time, most recently updated first
+	UpdatedBefore *time.Time
 }
 
 type TicketViewer struct {
@@ -89,6 +259,8 @@ type TicketResponse interface {
 	PersonDisplayName() string
 	Subject() string // Optional subject for response
 	Message() string // Optional message for response
+	Internal() bool  // Internal notes are seen only by staff
+	Attachments() []TicketAttachment
 
 	IP() string
 	UserAgent() string
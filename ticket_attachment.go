@@ -0,0 +1,182 @@
+package security
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"unicode"
+)
+
+// TicketAttachment describes a file attached to a ticket, or to a response to it. The
+// content is kept in the BlobStore of the TicketManager, see ticketAttachmentBlobName.
+type TicketAttachment struct {
+	Uuid        string
+	Filename    string
+	ContentType string // Detected from the content of the file, not taken from the upload
+	Size        int64
+}
+
+// SizeText returns the size of the file for display, i.e. "1.2 MB".
+func (a TicketAttachment) SizeText() string {
+	return formatByteSize(int(a.Size))
+}
+
+// TicketFile is a file to be attached to a ticket.
+type TicketFile struct {
+	Filename string
+	Data     []byte
+}
+
+// AttachmentScanner is called with each file before it is attached, and returns an
+// error if the file should be rejected, such as when a virus is found.
+type AttachmentScanner func(site, filename string, data []byte) error
+
+// ticketAttachmentExtensions are trusted for files whose content is detected only as a
+// zip archive or as binary data, such as office documents.
+var ticketAttachmentExtensions = map[string]string{
+	".doc":  "application/msword",
+	".xls":  "application/vnd.ms-excel",
+	".ppt":  "application/vnd.ms-powerpoint",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+}
+
+// sniffContentType detects the type of a file from its content. The file extension is
+// only used where the content can not tell office documents apart from other files.
+func sniffContentType(filename string, data []byte) string {
+	detected := http.DetectContentType(data)
+	mediaType, _, err := mime.ParseMediaType(detected)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	if mediaType == "application/zip" || mediaType == "application/octet-stream" {
+		if t, found := ticketAttachmentExtensions[strings.ToLower(path.Ext(filename))]; found {
+			return t
+		}
+	}
+	return mediaType
+}
+
+// cleanAttachmentFilename removes any directory, and characters that do not belong in a
+// file name, from an uploaded file name.
+func cleanAttachmentFilename(filename string) string {
+	filename = path.Base(strings.ReplaceAll(filename, "\\", "/"))
+	filename = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+		return r
+	}, filename)
+	filename = strings.TrimSpace(filename)
+	if runes := []rune(filename); len(runes) > 200 {
+		filename = string(runes[len(runes)-200:])
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		return "attachment"
+	}
+	return filename
+}
+
+// allowedAttachmentType reports if a content type matches the "ticket.attachment.types"
+// setting. Entries ending in "*" match any type beginning with the entry.
+func allowedAttachmentType(allowed []string, contentType string) bool {
+	for _, a := range allowed {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if strings.HasSuffix(a, "*") && strings.HasPrefix(contentType, strings.TrimSuffix(a, "*")) {
+			return true
+		}
+		if a == contentType {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTicketFile applies the size and type limits of a site to a file, and returns a
+// description of the attachment it would become.
+func checkTicketFile(s Setting, site string, file TicketFile) (*TicketAttachment, error) {
+	a := &TicketAttachment{
+		Filename: cleanAttachmentFilename(file.Filename),
+		Size:     int64(len(file.Data)),
+	}
+	if max := ticketAttachmentMaxSize(s, site); a.Size > max {
+		return nil, fmt.Errorf("%s is too large to attach. Files may be up to %s.", a.Filename, formatByteSize(int(max)))
+	}
+	if a.Size == 0 {
+		return nil, fmt.Errorf("%s is empty.", a.Filename)
+	}
+	a.ContentType = sniffContentType(a.Filename, file.Data)
+	if !allowedAttachmentType(settingList(s, site, "ticket.attachment.types"), a.ContentType) {
+		return nil, fmt.Errorf("%s can not be attached. Files of type %s are not allowed.", a.Filename, a.ContentType)
+	}
+	return a, nil
+}
+
+func ticketAttachmentMaxSize(s Setting, site string) int64 {
+	return int64(settingInt(s, site, "ticket.attachment.size", 10*1024*1024))
+}
+
+// ticketAttachmentBlobName is the name attachment content is stored under in a BlobStore.
+func ticketAttachmentBlobName(ticketUuid, uuid string) string {
+	return "tickets/" + ticketUuid + "/" + uuid
+}
+
+// findTicketAttachment returns the attachment of a ticket or of one of its responses. The
+// response is nil if the file is attached to the ticket itself.
+func findTicketAttachment(ticket Ticket, responses []TicketResponse, uuid string) (*TicketAttachment, TicketResponse) {
+	for _, a := range ticket.Attachments() {
+		if a.Uuid == uuid {
+			return &a, nil
+		}
+	}
+	for _, r := range responses {
+		for _, a := range r.Attachments() {
+			if a.Uuid == uuid {
+				return &a, r
+			}
+		}
+	}
+	return nil, nil
+}
+
+// readTicketFiles reads the files uploaded in a form field. A file larger than the site
+// allows is rejected before it is read.
+func readTicketFiles(s Setting, site string, r *http.Request, field string) ([]TicketFile, error) {
+	if err := r.ParseMultipartForm(32 << 20); err == http.ErrNotMultipart {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	max := ticketAttachmentMaxSize(s, site)
+	var files []TicketFile
+	for _, header := range r.MultipartForm.File[field] {
+		if header.Size > max {
+			return nil, fmt.Errorf("%s is too large to attach. Files may be up to %s.", cleanAttachmentFilename(header.Filename), formatByteSize(int(max)))
+		}
+		f, err := header.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(io.LimitReader(f, max+1))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, TicketFile{Filename: header.Filename, Data: data})
+	}
+	return files, nil
+}
+
+func init() {
+	RegisterSetting(SettingDefinition{Name: "ticket.attachment.size", Type: SettingInt, Default: "10485760",
+		Description: "Largest file, in bytes, that may be attached to a ticket or response."})
+	RegisterSetting(SettingDefinition{Name: "ticket.attachment.types", Type: SettingList,
+		Default:     "image/png; image/jpeg; image/gif; image/webp; application/pdf; text/plain; application/msword; application/vnd.ms-excel; application/vnd.ms-powerpoint; application/vnd.openxmlformats-officedocument.*; application/vnd.oasis.opendocument.*",
+		Description: "Types of file that may be attached to tickets, separated by semicolons. The type is detected from the content of each file. An entry ending in * matches any type beginning with it."})
+}
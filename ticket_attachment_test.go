@@ -0,0 +1,94 @@
+package security
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestFileBlobStore(t *testing.T) {
+	s := NewFileBlobStore(t.TempDir())
+
+	if err := s.Put("example.com", "tickets/1/2", "text/plain", strings.NewReader("hello")); err != nil {
+		t.Fatalf("Put() failed: %v", err)
+	}
+	r, err := s.Get("example.com", "tickets/1/2")
+	if err != nil {
+		t.Fatalf("Get() failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	r.Close()
+	if string(data) != "hello" {
+		t.Fatalf("Get() returned %q", data)
+	}
+	if _, err := s.Get("other.com", "tickets/1/2"); err != ErrBlobNotFound {
+		t.Fatalf("Get() should not find content stored for another site: %v", err)
+	}
+
+	if err := s.Delete("example.com", "tickets/1/2"); err != nil {
+		t.Fatalf("Delete() failed: %v", err)
+	}
+	if _, err := s.Get("example.com", "tickets/1/2"); err != ErrBlobNotFound {
+		t.Fatalf("Get() should not find deleted content: %v", err)
+	}
+	if err := s.Delete("example.com", "tickets/1/2"); err != nil {
+		t.Fatalf("Delete() of missing content failed: %v", err)
+	}
+
+	for _, name := range []string{"../secret", "tickets/../../x", "/etc/passwd", "a\\b", ""} {
+		if err := s.Put("example.com", name, "text/plain", strings.NewReader("x")); err == nil {
+			t.Fatalf("Put(%q) should refuse the name", name)
+		}
+	}
+}
+
+func TestCheckTicketFile(t *testing.T) {
+	s := &schemaTestSetting{values: map[string]string{"ticket.attachment.size": "1000"}}
+	png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), make([]byte, 20)...)
+	zip := append([]byte("PK\x03\x04"), make([]byte, 20)...)
+
+	for _, c := range []struct {
+		filename    string
+		data        []byte
+		contentType string
+	}{
+		{"screen.png", png, "image/png"},
+		{"screen.jpg", png, "image/png"}, // Content, not the name, decides the type
+		{"notes.txt", []byte("Some notes"), "text/plain"},
+		{"report.docx", zip, "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"report.pdf", []byte("%PDF-1.4 ..."), "application/pdf"},
+	} {
+		a, err := checkTicketFile(s, "example.com", TicketFile{Filename: c.filename, Data: c.data})
+		if err != nil {
+			t.Fatalf("checkTicketFile(%s) failed: %v", c.filename, err)
+		}
+		if a.ContentType != c.contentType || a.Size != int64(len(c.data)) {
+			t.Fatalf("checkTicketFile(%s) returned %+v", c.filename, a)
+		}
+	}
+
+	for _, c := range []struct {
+		filename string
+		data     []byte
+	}{
+		{"page.png", []byte("<html><body>hello</body></html>")}, // Html is never allowed
+		{"archive.zip", zip},
+		{"large.png", append(png, make([]byte, 1000)...)},
+		{"empty.txt", nil},
+	} {
+		if _, err := checkTicketFile(s, "example.com", TicketFile{Filename: c.filename, Data: c.data}); err == nil {
+			t.Fatalf("checkTicketFile(%s) should refuse the file", c.filename)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"C:\\Users\\me\\screen.png": "screen.png",
+		"../../etc/passwd":          "passwd",
+		"say \"hi\".txt":            "say hi.txt",
+		"":                          "attachment",
+	} {
+		if cleaned := cleanAttachmentFilename(name); cleaned != expected {
+			t.Fatalf("cleanAttachmentFilename(%q) returned %q", name, cleaned)
+		}
+	}
+}
@@ -0,0 +1,656 @@
+package security
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Inbound email is turned into tickets. A message that refers to an existing ticket,
+// either through the ticket token in the address it was sent to, or through the
+// message ids of earlier notifications in its In-Reply-To or References headers, is
+// added to that ticket as a response. Any other message raises a new ticket.
+
+// InboundEmail is an email message received by the support desk.
+type InboundEmail struct {
+	MessageId  string
+	InReplyTo  string
+	References []string
+	FromName   string
+	FromEmail  string
+	To         []string // Addresses the message was delivered to, including Cc and Delivered-To
+	Subject    string
+	Date       *time.Time
+
+	// Body is the plain text of the message. Reply is the body with quoted text and
+	// signatures removed.
+	Body  string
+	Reply string
+
+	Attachments []EmailAttachment
+
+	// AutoReply is set for out of office and other automatic replies, which should
+	// not be added to a ticket, to avoid mail loops.
+	AutoReply bool
+}
+
+// EmailAttachment is a file attached to an inbound email message.
+type EmailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// Limit the size of a message that will be read
+const inboundEmailMaxSize = 25 * 1024 * 1024
+
+var wordDecoder = &mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+		// Messages are expected to be utf-8, or a subset of it. Other character sets are
+		// passed through unconverted rather than rejecting the message.
+		return input, nil
+	},
+}
+
+// ParseInboundEmail reads a MIME encoded email message.
+func ParseInboundEmail(r io.Reader) (*InboundEmail, error) {
+	m, err := mail.ReadMessage(bufio.NewReader(io.LimitReader(r, inboundEmailMaxSize)))
+	if err != nil {
+		return nil, err
+	}
+
+	e := &InboundEmail{
+		MessageId: strings.TrimSpace(m.Header.Get("Message-Id")),
+		InReplyTo: strings.TrimSpace(m.Header.Get("In-Reply-To")),
+		Subject:   decodeHeader(m.Header.Get("Subject")),
+	}
+	e.References = strings.Fields(m.Header.Get("References"))
+	if from, err := m.Header.AddressList("From"); err == nil && len(from) > 0 {
+		e.FromName = from[0].Name
+		e.FromEmail = strings.ToLower(from[0].Address)
+	} else if from := strings.TrimSpace(m.Header.Get("From")); from != "" {
+		e.FromEmail = strings.ToLower(strings.Trim(from, "<>"))
+	}
+	for _, h := range []string{"To", "Cc", "Delivered-To", "X-Original-To"} {
+		if list, err := m.Header.AddressList(h); err == nil {
+			for _, a := range list {
+				e.To = append(e.To, strings.ToLower(a.Address))
+			}
+		}
+	}
+	if d, err := m.Header.Date(); err == nil {
+		e.Date = &d
+	}
+	e.AutoReply = isAutoReply(m.Header)
+
+	var text, htm []string
+	if err := readEmailPart(m.Header, m.Body, e, &text, &htm, 0); err != nil {
+		return nil, err
+	}
+	if len(text) > 0 {
+		e.Body = strings.Join(text, "\n")
+	} else {
+		e.Body = htmlToText(strings.Join(htm, "\n"))
+	}
+	e.Body = strings.TrimSpace(strings.Replace(e.Body, "\r\n", "\n", -1))
+	e.Reply = StripQuotedText(e.Body)
+	return e, nil
+}
+
+// emailHeader is satisfied by both mail.Header and textproto.MIMEHeader.
+type emailHeader interface {
+	Get(key string) string
+}
+
+func readEmailPart(h emailHeader, body io.Reader, e *InboundEmail, text, htm *[]string, depth int) error {
+	if depth > 10 {
+		return errors.New("Email message is nested too deeply.")
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+		params = map[string]string{}
+	}
+
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			p, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if err := readEmailPart(p.Header, p, e, text, htm, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := ioutil.ReadAll(decodeTransfer(h.Get("Content-Transfer-Encoding"), body))
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	filename := decodeHeader(dparams["filename"])
+	if filename == "" {
+		filename = decodeHeader(params["name"])
+	}
+	if disposition == "attachment" || filename != "" || (mediaType != "text/plain" && mediaType != "text/html") {
+		if filename == "" {
+			filename = "attachment"
+			if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+				filename = filename + exts[0]
+			}
+		}
+		e.Attachments = append(e.Attachments, EmailAttachment{
+			Filename:    filepath.Base(filename),
+			ContentType: mediaType,
+			Data:        data,
+		})
+		return nil
+	}
+
+	if mediaType == "text/html" {
+		*htm = append(*htm, string(data))
+	} else {
+		*text = append(*text, string(data))
+	}
+	return nil
+}
+
+func decodeTransfer(encoding string, r io.Reader) io.Reader {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+		return base64.NewDecoder(base64.StdEncoding, &whitespaceStripper{r: r})
+	case "quoted-printable":
+		return quotedprintable.NewReader(r)
+	}
+	return r
+}
+
+// whitespaceStripper removes the line breaks found in base64 encoded content.
+type whitespaceStripper struct {
+	r io.Reader
+}
+
+func (s *whitespaceStripper) Read(p []byte) (int, error) {
+	for {
+		n, err := s.r.Read(p)
+		j := 0
+		for _, b := range p[:n] {
+			if b != '\r' && b != '\n' && b != ' ' && b != '\t' {
+				p[j] = b
+				j++
+			}
+		}
+		if j > 0 || err != nil {
+			return j, err
+		}
+	}
+}
+
+func decodeHeader(value string) string {
+	if d, err := wordDecoder.DecodeHeader(value); err == nil {
+		return strings.TrimSpace(d)
+	}
+	return strings.TrimSpace(value)
+}
+
+func isAutoReply(h mail.Header) bool {
+	if a := strings.ToLower(h.Get("Auto-Submitted")); a != "" && a != "no" {
+		return true
+	}
+	switch strings.ToLower(h.Get("Precedence")) {
+	case "bulk", "junk", "list", "auto_reply":
+		return true
+	}
+	return h.Get("X-Autoreply") != "" || h.Get("X-Autorespond") != ""
+}
+
+var htmlBreaks = regexp.MustCompile(`(?i)<br\s*/?>|</p\s*>|</div\s*>|</li\s*>|</tr\s*>|</h[1-6]\s*>`)
+var htmlQuotes = regexp.MustCompile(`(?is)<blockquote.*?</blockquote\s*>`)
+var htmlHidden = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)\s*>`)
+var htmlTags = regexp.MustCompile(`(?s)<[^>]*>`)
+var blankLines = regexp.MustCompile(`\n[ \t]*\n(\s*\n)+`)
+
+// htmlToText converts the html body of a message to plain text, for messages without one.
+func htmlToText(s string) string {
+	s = htmlHidden.ReplaceAllString(s, "")
+	s = htmlQuotes.ReplaceAllString(s, "")
+	s = htmlBreaks.ReplaceAllString(s, "\n")
+	s = htmlTags.ReplaceAllString(s, "")
+	s = html.UnescapeString(s)
+	s = strings.Replace(s, "\u00a0", " ", -1)
+	return strings.TrimSpace(blankLines.ReplaceAllString(s, "\n\n"))
+}
+
+// Lines that introduce the quoted message in a reply
+var replyHeaderLines = []*regexp.Regexp{
+	regexp.MustCompile(`^On .+ wrote:$`),
+	regexp.MustCompile(`^-+ ?Original Message ?-+$`),
+	regexp.MustCompile(`^-+ ?Forwarded message ?-+$`),
+	regexp.MustCompile(`^_{10,}$`), // Outlook separates the reply from the quoted message with a rule
+	regexp.MustCompile(`^Sent from my `),
+	regexp.MustCompile(`^Get Outlook for `),
+}
+
+// StripQuotedText removes quoted text, and the signature, from the plain text of a reply,
+// leaving only the new text written by the sender.
+func StripQuotedText(body string) string {
+	lines := strings.Split(strings.Replace(body, "\r\n", "\n", -1), "\n")
+	var kept []string
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if line == "-- " || trimmed == "--" || isReplyHeader(trimmed, lines[i+1:]) {
+			break
+		}
+		if strings.HasPrefix(trimmed, ">") {
+			continue
+		}
+		kept = append(kept, strings.TrimRight(line, " \t"))
+	}
+	return strings.TrimSpace(strings.Join(kept, "\n"))
+}
+
+func isReplyHeader(line string, following []string) bool {
+	for _, re := range replyHeaderLines {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	// "On <date>, <name> wrote:" may be wrapped over two lines
+	if strings.HasPrefix(line, "On ") && len(following) > 0 && strings.HasSuffix(strings.TrimSpace(following[0]), "wrote:") {
+		return true
+	}
+	if strings.HasPrefix(line, "From: ") {
+		return isQuotedHeaderBlock(following)
+	}
+	return false
+}
+
+// isQuotedHeaderBlock reports if the lines following a "From:" line hold the other
+// headers of a quoted message, as inserted by Outlook, i.e. "Sent:", "To:" and "Subject:".
+func isQuotedHeaderBlock(lines []string) bool {
+	found := 0
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		for _, h := range []string{"Sent:", "Date:", "To:", "Cc:", "Subject:"} {
+			if strings.HasPrefix(line, h) {
+				found++
+			}
+		}
+	}
+	return found >= 2
+}
+
+var ticketUuidPattern = regexp.MustCompile(`[0-9a-f]{8}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{4}-[0-9a-f]{12}`)
+
+// TicketReplyAddress returns the address that replies to a ticket should be sent to. The
+// ticket token is added to the support address, i.e. support+<ticket uuid>@example.com
+func TicketReplyAddress(address, ticketUuid string) string {
+	i := strings.LastIndex(address, "@")
+	if i < 0 || ticketUuid == "" {
+		return address
+	}
+	return address[:i] + "+" + ticketUuid + address[i:]
+}
+
+// TicketMessageId returns a new Message-Id for a message sent about a ticket. Replies
+// quote it in their In-Reply-To and References headers.
+func TicketMessageId(ticketUuid, domain string) string {
+	return fmt.Sprintf("<ticket.%s.%s@%s>", ticketUuid, strings.ToLower(RandomString(12)), domain)
+}
+
+// TicketToken returns the uuid of the ticket that a message replies to, or an empty
+// string if the message does not refer to a ticket.
+func (e *InboundEmail) TicketToken() string {
+	for _, to := range e.To {
+		i := strings.Index(to, "+")
+		j := strings.LastIndex(to, "@")
+		if i > 0 && j > i {
+			if uuid := to[i+1 : j]; ticketUuidPattern.MatchString(uuid) && len(uuid) == 36 {
+				return uuid
+			}
+		}
+	}
+	ids := append([]string{e.InReplyTo}, e.References...)
+	for _, id := range ids {
+		id = strings.ToLower(id)
+		if i := strings.Index(id, "ticket."); i >= 0 {
+			if uuid := ticketUuidPattern.FindString(id[i+7:]); uuid != "" && strings.HasPrefix(id[i+7:], uuid) {
+				return uuid
+			}
+		}
+	}
+	return ""
+}
+
+// inboundEmailSession attributes tickets and responses to the sender of a message.
+type inboundEmailSession struct {
+	Session
+	personUuid string
+	firstName  string
+	lastName   string
+	email      string
+}
+
+func (s *inboundEmailSession) PersonUuid() string {
+	return s.personUuid
+}
+
+func (s *inboundEmailSession) FirstName() string {
+	return s.firstName
+}
+
+func (s *inboundEmailSession) LastName() string {
+	return s.lastName
+}
+
+func (s *inboundEmailSession) DisplayName() string {
+	if name := strings.TrimSpace(s.firstName + " " + s.lastName); name != "" {
+		return name
+	}
+	return s.email
+}
+
+func (s *inboundEmailSession) Email() string {
+	return s.email
+}
+
+// IsAuthenticated is true so that a requester without an account, who is known only by
+// their email address, may reply to their own tickets. The session has no roles.
+func (s *inboundEmailSession) IsAuthenticated() bool {
+	return true
+}
+
+func (s *inboundEmailSession) IP() string {
+	return ""
+}
+
+func (s *inboundEmailSession) UserAgent() string {
+	return "email"
+}
+
+// TicketEmailIngester adds inbound email messages to tickets.
+type TicketEmailIngester struct {
+	am AccessManager
+	tm TicketManager
+
+	// KeepAttachments is called with the attachments of each message added to a
+	// ticket. If not set, attachments are stored in the BlobStore of the ticket manager.
+	// Attachments that can not be stored, or all of them if there is no BlobStore, are
+	// listed by name and size at the end of the ticket or response message instead.
+	KeepAttachments func(ticket Ticket, attachments []EmailAttachment, session Session) error
+}
+
+func NewTicketEmailIngester(am AccessManager, tm TicketManager) *TicketEmailIngester {
+	return &TicketEmailIngester{am: am, tm: tm}
+}
+
+// Ingest adds a message to the ticket it replies to, or raises a new ticket. The ticket
+// is returned, or nil if the message was ignored as an automatic reply.
+func (i *TicketEmailIngester) Ingest(site string, e *InboundEmail) (Ticket, error) {
+	if e.AutoReply {
+		return nil, nil
+	}
+	if e.FromEmail == "" {
+		return nil, errors.New("Email message has no sender.")
+	}
+
+	// The support desk role is used only to find the ticket a message replies to. The
+	// message itself is added with the rights of its sender.
+	system, err := i.am.GetSystemSessionWithRoles(site, "Support", "Email", TicketSupportRole)
+	if err != nil {
+		return nil, err
+	}
+	session := &inboundEmailSession{Session: i.am.GuestSession(site, "", "email", ""), email: e.FromEmail}
+	session.firstName, session.lastName = splitEmailName(e.FromName)
+	person, err := i.am.GetPersonByEmail(site, e.FromEmail, nil)
+	if err != nil {
+		return nil, err
+	}
+	if person != nil {
+		session.personUuid = person.Uuid()
+		session.firstName = person.FirstName()
+		session.lastName = person.LastName()
+	}
+
+	message := e.Reply
+	var files []TicketFile
+	if i.KeepAttachments == nil {
+		var listed []EmailAttachment
+		for _, a := range e.Attachments {
+			f := TicketFile{Filename: a.Filename, Data: a.Data}
+			if i.tm.BlobStore() == nil {
+				listed = append(listed, a)
+			} else if _, err := checkTicketFile(i.am.Setting(), site, f); err != nil {
+				listed = append(listed, a)
+			} else {
+				files = append(files, f)
+			}
+		}
+		message = strings.TrimSpace(message + "\n\n" + listEmailAttachments(listed))
+	}
+
+	workflow, err := GetTicketWorkflow(i.am.Setting(), i.am.PicklistStore(), site)
+	if err != nil {
+		return nil, err
+	}
+
+	var ticket Ticket
+	if token := e.TicketToken(); token != "" {
+		ticket, err = i.tm.FindTicket(token, system)
+		if err != nil {
+			return nil, err
+		}
+		// Replies to a merged ticket are added to the ticket it was merged into
+		ticket, err = followMergedTicket(i.tm, ticket, system)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var writer Session = session
+	if ticket != nil && !canViewTicket(session, ticket) {
+		// Anyone who knows the reply address of a ticket can write to it, so a message from
+		// someone who is not the requester, an assignee or a watcher is kept as an internal
+		// note, which neither reopens the ticket nor notifies the requester
+		writer = system
+		note := "Email from " + e.FromEmail
+		if e.Subject != "" {
+			note += ": " + e.Subject
+		}
+		note += "\n\n" + message
+		err := i.tm.AddParentedTicketResponseWithAttachments(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), "", "", note, true, files, system)
+		if err != nil && len(files) > 0 {
+			i.am.Warning(system, `ticket`, "Attachments of email from %s not kept. Error: %v", e.FromEmail, err)
+			err = i.tm.AddParentedTicketNote(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), strings.TrimSpace(note+"\n\n"+listTicketFiles(files)), system)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else if ticket != nil {
+		subject := e.Subject
+		if strings.EqualFold(stripSubjectPrefixes(subject), stripSubjectPrefixes(ticket.Subject())) {
+			subject = ""
+		}
+		// A reply from the person who raised the ticket reopens it
+		err := i.tm.AddParentedTicketResponseWithAttachments(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), workflow.DefaultStatus(), subject, message, false, files, session)
+		if err != nil && len(files) > 0 {
+			// The reply is kept even if its attachments are refused, such as by a virus scan
+			i.am.Warning(session, `ticket`, "Attachments of email from %s not kept. Error: %v", e.FromEmail, err)
+			message = strings.TrimSpace(message + "\n\n" + listTicketFiles(files))
+			err = i.tm.AddParentedTicketResponse(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), workflow.DefaultStatus(), subject, message, session)
+		}
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ticketType := TicketType(i.am.Setting().GetWithDefault(site, "ticket.email.type", string(EnquiryTicket)))
+		ticket, err = i.tm.AddTicket(workflow.DefaultStatus(), ticketType, session.personUuid, session.firstName, session.lastName, e.FromEmail,
+			stripSubjectPrefixes(e.Subject), message, nil, nil, nil, nil, session)
+		if err != nil {
+			return nil, err
+		}
+		if len(files) > 0 {
+			// The ticket has been raised, so failing here would raise it again when the email is resent
+			if _, err := i.tm.AddTicketAttachments(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), files, session); err != nil {
+				i.am.Warning(session, `ticket`, "Attachments of email from %s not kept. Error: %v", e.FromEmail, err)
+			}
+		}
+	}
+
+	if i.KeepAttachments != nil && len(e.Attachments) > 0 {
+		if err := i.KeepAttachments(ticket, e.Attachments, writer); err != nil {
+			return ticket, err
+		}
+	}
+	return ticket, nil
+}
+
+// IngestMessage parses and ingests a MIME encoded message.
+func (i *TicketEmailIngester) IngestMessage(site string, r io.Reader) (Ticket, error) {
+	e, err := ParseInboundEmail(r)
+	if err != nil {
+		return nil, err
+	}
+	return i.Ingest(site, e)
+}
+
+// IngestMaildir ingests each message waiting in the "new" folder of a maildir, moving
+// each message ingested to the "cur" folder. The number of messages ingested is returned.
+func (i *TicketEmailIngester) IngestMaildir(site, dir string) (int, error) {
+	files, err := ioutil.ReadDir(filepath.Join(dir, "new"))
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, f := range files {
+		if f.IsDir() || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+		name := filepath.Join(dir, "new", f.Name())
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return count, err
+		}
+		if _, err := i.IngestMessage(site, bytes.NewReader(data)); err != nil {
+			return count, fmt.Errorf("Failed ingesting %s: %v", f.Name(), err)
+		}
+		if err := os.Rename(name, filepath.Join(dir, "cur", f.Name()+":2,S")); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// IngestMbox ingests each message in an mbox file. The number of messages ingested is returned.
+func (i *TicketEmailIngester) IngestMbox(site string, r io.Reader) (int, error) {
+	count := 0
+	var message bytes.Buffer
+	ingest := func() error {
+		if message.Len() == 0 {
+			return nil
+		}
+		_, err := i.IngestMessage(site, bytes.NewReader(message.Bytes()))
+		message.Reset()
+		if err != nil {
+			return err
+		}
+		count++
+		return nil
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(make([]byte, 64*1024), inboundEmailMaxSize)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "From ") {
+			if err := ingest(); err != nil {
+				return count, err
+			}
+			continue
+		}
+		// Lines beginning with "From " in a message are escaped as ">From "
+		if strings.HasPrefix(line, ">") && strings.HasPrefix(strings.TrimLeft(line, ">"), "From ") {
+			line = line[1:]
+		}
+		message.WriteString(line)
+		message.WriteString("\r\n")
+	}
+	if err := s.Err(); err != nil {
+		return count, err
+	}
+	return count, ingest()
+}
+
+func listEmailAttachments(attachments []EmailAttachment) string {
+	var lines []string
+	for _, a := range attachments {
+		lines = append(lines, fmt.Sprintf("[Attachment: %s, %s]", a.Filename, formatByteSize(len(a.Data))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func listTicketFiles(files []TicketFile) string {
+	var lines []string
+	for _, f := range files {
+		lines = append(lines, fmt.Sprintf("[Attachment: %s, %s]", f.Filename, formatByteSize(len(f.Data))))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatByteSize(n int) string {
+	switch {
+	case n >= 1024*1024:
+		return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+	case n >= 1024:
+		return fmt.Sprintf("%.1f KB", float64(n)/1024)
+	}
+	return fmt.Sprintf("%d bytes", n)
+}
+
+var subjectPrefix = regexp.MustCompile(`(?i)^\s*((re|fw|fwd|aw|sv)(\[\d+\])?\s*:\s*)+`)
+
+func stripSubjectPrefixes(subject string) string {
+	return strings.TrimSpace(subjectPrefix.ReplaceAllString(subject, ""))
+}
+
+func splitEmailName(name string) (string, string) {
+	name = strings.TrimSpace(strings.Trim(name, `"'`))
+	if i := strings.Index(name, ","); i > 0 {
+		// "Smith, Bob"
+		return strings.TrimSpace(name[i+1:]), strings.TrimSpace(name[:i])
+	}
+	if i := strings.LastIndex(name, " "); i > 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+func init() {
+	RegisterSetting(SettingDefinition{Name: "ticket.email.type", Default: string(EnquiryTicket),
+		Description: "Type of ticket raised by email sent to the support desk, a key of the \"ticket.type\" picklist."})
+	RegisterSetting(SettingDefinition{Name: "ticket.email.webhook.secret", Type: SettingSecret,
+		Description: "Key that a mail service must send to deliver inbound email to /z/ticket.email."})
+}
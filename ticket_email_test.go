@@ -0,0 +1,101 @@
+package security
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseInboundEmail(t *testing.T) {
+	raw := strings.Join([]string{
+		"From: \"Smith, Bob\" <Bob.Smith@Example.com>",
+		"To: Support <support+0d4c6a2e-8f0b-11ee-b9d1-0242ac120002@example.com>",
+		"Subject: =?UTF-8?Q?Re:_Enrolment_=E2=80=93_help?=",
+		"Message-Id: <abc@mail.example.com>",
+		"In-Reply-To: <ticket.0d4c6a2e-8f0b-11ee-b9d1-0242ac120002.x1@example.com>",
+		"MIME-Version: 1.0",
+		"Content-Type: multipart/mixed; boundary=\"XYZ\"",
+		"",
+		"--XYZ",
+		"Content-Type: multipart/alternative; boundary=\"ALT\"",
+		"",
+		"--ALT",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Thanks, that fixed it.",
+		"",
+		"On Mon, 4 Dec 2023 at 10:00, Support <support@example.com> wrote:",
+		"> Please try again.",
+		"--ALT",
+		"Content-Type: text/html; charset=utf-8",
+		"",
+		"<p>Thanks, that fixed it.</p>",
+		"--ALT--",
+		"--XYZ",
+		"Content-Type: application/pdf; name=\"letter.pdf\"",
+		"Content-Disposition: attachment; filename=\"letter.pdf\"",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0x",
+		"LjQK",
+		"--XYZ--",
+		"",
+	}, "\r\n")
+
+	e, err := ParseInboundEmail(strings.NewReader(raw))
+	if err != nil {
+		t.Fatalf("ParseInboundEmail() failed: %v", err)
+	}
+	if e.FromEmail != "bob.smith@example.com" || e.FromName != "Smith, Bob" {
+		t.Fatalf("ParseInboundEmail() returned sender %q <%s>", e.FromName, e.FromEmail)
+	}
+	if e.Subject != "Re: Enrolment – help" {
+		t.Fatalf("ParseInboundEmail() did not decode the subject: %q", e.Subject)
+	}
+	if e.Reply != "Thanks, that fixed it." {
+		t.Fatalf("ParseInboundEmail() did not strip the quoted text: %q", e.Reply)
+	}
+	if len(e.Attachments) != 1 || e.Attachments[0].Filename != "letter.pdf" || string(e.Attachments[0].Data) != "%PDF-1.4\n" {
+		t.Fatalf("ParseInboundEmail() did not keep the attachment: %v", e.Attachments)
+	}
+	if e.TicketToken() != "0d4c6a2e-8f0b-11ee-b9d1-0242ac120002" {
+		t.Fatalf("TicketToken() returned %q", e.TicketToken())
+	}
+	if e.AutoReply {
+		t.Fatalf("ParseInboundEmail() should not treat a reply as automatic")
+	}
+	if first, last := splitEmailName(e.FromName); first != "Bob" || last != "Smith" {
+		t.Fatalf("splitEmailName() returned %q %q", first, last)
+	}
+
+	// The ticket may also be found through the References header
+	e, err = ParseInboundEmail(strings.NewReader("From: bob@example.com\r\nTo: support@example.com\r\nReferences: <a@b> <ticket.0d4c6a2e-8f0b-11ee-b9d1-0242ac120002.x1@example.com>\r\nAuto-Submitted: auto-replied\r\n\r\nOut of office\r\n"))
+	if err != nil {
+		t.Fatalf("ParseInboundEmail() failed: %v", err)
+	}
+	if e.TicketToken() != "0d4c6a2e-8f0b-11ee-b9d1-0242ac120002" {
+		t.Fatalf("TicketToken() should find the ticket in the References header")
+	}
+	if !e.AutoReply {
+		t.Fatalf("ParseInboundEmail() should recognise an automatic reply")
+	}
+
+	if a := TicketReplyAddress("support@example.com", "0d4c6a2e-8f0b-11ee-b9d1-0242ac120002"); a != "support+0d4c6a2e-8f0b-11ee-b9d1-0242ac120002@example.com" {
+		t.Fatalf("TicketReplyAddress() returned %s", a)
+	}
+}
+
+func TestStripQuotedText(t *testing.T) {
+	for body, expected := range map[string]string{
+		"Yes please.\n\n-- \nBob Smith\nStudent":                                                 "Yes please.",
+		"Yes please.\n\nOn Mon, 4 Dec 2023 at 10:00, Support\n<support@example.com> wrote:\n> x": "Yes please.",
+		"Yes please.\n\n-----Original Message-----\nFrom: Support":                               "Yes please.",
+		"Yes please.\nFrom: Support\nSent: Monday\nTo: Bob\nSubject: Help\n\nQuoted":             "Yes please.",
+		"From: the registrar, I was told to write.\n> quoted\nThanks":                            "From: the registrar, I was told to write.\nThanks",
+		"Yes please.\n\nSent from my iPhone":                                                     "Yes please.",
+	} {
+		if s := StripQuotedText(body); s != expected {
+			t.Fatalf("StripQuotedText(%q) returned %q, expected %q", body, s, expected)
+		}
+	}
+}
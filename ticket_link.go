@@ -0,0 +1,200 @@
+package security
+
+import (
+	"net/url"
+	"strings"
+)
+
+// TicketLinkType is the relation of one ticket to another. Links are kept on both tickets,
+// each holding the relation from its own side, see Inverse.
+type TicketLinkType string
+
+const (
+	TicketRelatedLink      TicketLinkType = "related"
+	TicketDuplicateOfLink  TicketLinkType = "duplicate_of"  // The ticket was merged into the other
+	TicketDuplicatedByLink TicketLinkType = "duplicated_by" // The other ticket was merged into this one
+	TicketSplitFromLink    TicketLinkType = "split_from"    // The ticket was split out of a response to the other
+	TicketSplitIntoLink    TicketLinkType = "split_into"
+	TicketBlocksLink       TicketLinkType = "blocks"
+	TicketBlockedByLink    TicketLinkType = "blocked_by"
+)
+
+// TicketLinkTypes are the relations staff may choose when linking tickets. The others are
+// made by merging and splitting tickets.
+var TicketLinkTypes = []TicketLinkType{TicketRelatedLink, TicketDuplicateOfLink, TicketDuplicatedByLink, TicketBlocksLink, TicketBlockedByLink}
+
+var ticketLinkInverses = map[TicketLinkType]TicketLinkType{
+	TicketRelatedLink:      TicketRelatedLink,
+	TicketDuplicateOfLink:  TicketDuplicatedByLink,
+	TicketDuplicatedByLink: TicketDuplicateOfLink,
+	TicketSplitFromLink:    TicketSplitIntoLink,
+	TicketSplitIntoLink:    TicketSplitFromLink,
+	TicketBlocksLink:       TicketBlockedByLink,
+	TicketBlockedByLink:    TicketBlocksLink,
+}
+
+var ticketLinkNames = map[TicketLinkType]string{
+	TicketRelatedLink:      "Related to",
+	TicketDuplicateOfLink:  "Duplicate of",
+	TicketDuplicatedByLink: "Duplicated by",
+	TicketSplitFromLink:    "Split from",
+	TicketSplitIntoLink:    "Split into",
+	TicketBlocksLink:       "Blocks",
+	TicketBlockedByLink:    "Blocked by",
+}
+
+// Inverse returns the relation seen from the other ticket, i.e. "blocked_by" for "blocks".
+func (l TicketLinkType) Inverse() TicketLinkType {
+	if inverse, found := ticketLinkInverses[l]; found {
+		return inverse
+	}
+	return TicketRelatedLink
+}
+
+// Name returns the relation for display, i.e. "Blocked by".
+func (l TicketLinkType) Name() string {
+	if name, found := ticketLinkNames[l]; found {
+		return name
+	}
+	return string(l)
+}
+
+// ValidTicketLinkType reports if staff may choose a relation when linking tickets.
+func ValidTicketLinkType(l TicketLinkType) bool {
+	for _, t := range TicketLinkTypes {
+		if t == l {
+			return true
+		}
+	}
+	return false
+}
+
+// TicketLink is a relation from one ticket to another.
+type TicketLink struct {
+	Type       TicketLinkType
+	ParentType string
+	ParentUuid string
+	Uuid       string
+	Subject    string // Subject of the other ticket when the link was made
+}
+
+// ticketLinkReference identifies the ticket a link refers to, in the same form as ticketReference.
+func ticketLinkReference(l TicketLink) string {
+	return l.ParentType + "|" + l.ParentUuid + "|" + l.Uuid
+}
+
+// ticketLinkTo returns a link of a given type to a ticket.
+func ticketLinkTo(linkType TicketLinkType, t Ticket) TicketLink {
+	return TicketLink{Type: linkType, ParentType: t.ParentType(), ParentUuid: t.ParentUuid(), Uuid: t.Uuid(), Subject: t.Subject()}
+}
+
+// withTicketLink adds a link, replacing any existing link to the same ticket.
+func withTicketLink(links []TicketLink, link TicketLink) []TicketLink {
+	return append(withoutTicketLink(links, link.Uuid), link)
+}
+
+func withoutTicketLink(links []TicketLink, uuid string) []TicketLink {
+	var remaining []TicketLink
+	for _, l := range links {
+		if l.Uuid != uuid {
+			remaining = append(remaining, l)
+		}
+	}
+	return remaining
+}
+
+func findTicketLink(links []TicketLink, uuid string) *TicketLink {
+	for _, l := range links {
+		if l.Uuid == uuid {
+			return &l
+		}
+	}
+	return nil
+}
+
+// ticketLinkDescription describes a link in the ticket history, i.e. "Blocks: Printer offline".
+func ticketLinkDescription(l TicketLink) string {
+	return l.Type.Name() + ": " + l.Subject
+}
+
+// ticketLinkPath returns the address of the support desk page for a linked ticket.
+func ticketLinkPath(l TicketLink) string {
+	p := Path("/z/ticket/") + url.PathEscape(l.Uuid)
+	if l.ParentType != "" {
+		p = p + "?pt=" + url.QueryEscape(l.ParentType) + "&pu=" + url.QueryEscape(l.ParentUuid)
+	}
+	return p
+}
+
+// ticketLinkPaths maps the uuid of each ticket linked to a ticket to its address.
+func ticketLinkPaths(t Ticket) map[string]string {
+	paths := make(map[string]string)
+	for _, l := range t.Links() {
+		paths[l.Uuid] = ticketLinkPath(l)
+	}
+	if m := t.MergedInto(); m != nil {
+		paths[m.Uuid] = ticketLinkPath(*m)
+	}
+	return paths
+}
+
+// mergedTicketTags returns the tags of one ticket followed by those of another that it
+// does not already have, ignoring case.
+func mergedTicketTags(tags, other []string) []string {
+	merged := append([]string{}, tags...)
+	for _, tag := range other {
+		found := false
+		for _, t := range merged {
+			if strings.EqualFold(strings.TrimSpace(t), strings.TrimSpace(tag)) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, tag)
+		}
+	}
+	return merged
+}
+
+// mergedTicketViewers returns the viewers of one ticket followed by those of another
+// that it does not already have.
+func mergedTicketViewers(viewers, other []TicketViewer) []TicketViewer {
+	merged := append([]TicketViewer{}, viewers...)
+	for _, v := range other {
+		if !hasTicketViewer(merged, v.Uuid) {
+			merged = append(merged, v)
+		}
+	}
+	return merged
+}
+
+// followMergedTicket returns the ticket a merged ticket now lives in, following merges of
+// the survivor in turn. Tickets that were never merged are returned unchanged.
+func followMergedTicket(tm TicketManager, ticket Ticket, session Session) (Ticket, error) {
+	for i := 0; i < 10 && ticket != nil && ticket.MergedInto() != nil; i++ {
+		m := ticket.MergedInto()
+		survivor, err := lookupTicket(tm, m.ParentType, m.ParentUuid, m.Uuid, session)
+		if err != nil || survivor == nil {
+			return ticket, err
+		}
+		ticket = survivor
+	}
+	return ticket, nil
+}
+
+// parseTicketInput reads the uuid of a ticket entered by staff, who may paste either the
+// uuid or the address of the ticket page.
+func parseTicketInput(value string) string {
+	value = strings.TrimSpace(value)
+	if i := strings.Index(value, "/z/ticket/"); i >= 0 {
+		value = value[i+len("/z/ticket/"):]
+	}
+	if i := strings.IndexAny(value, "?#/"); i >= 0 {
+		value = value[:i]
+	}
+	if uuid, err := url.PathUnescape(value); err == nil {
+		value = uuid
+	}
+	return strings.TrimSpace(value)
+}
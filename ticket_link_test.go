@@ -0,0 +1,64 @@
+package security
+
+import (
+	"testing"
+)
+
+func TestTicketLinks(t *testing.T) {
+	for _, l := range []TicketLinkType{TicketRelatedLink, TicketDuplicateOfLink, TicketDuplicatedByLink, TicketSplitFromLink, TicketSplitIntoLink, TicketBlocksLink, TicketBlockedByLink} {
+		if l.Inverse().Inverse() != l {
+			t.Fatalf("%s.Inverse() should be the inverse of %s", l.Inverse(), l)
+		}
+	}
+	if TicketBlocksLink.Inverse() != TicketBlockedByLink || TicketRelatedLink.Inverse() != TicketRelatedLink {
+		t.Fatalf("Inverse() returned the wrong relation")
+	}
+	if ValidTicketLinkType(TicketSplitIntoLink) || !ValidTicketLinkType(TicketBlocksLink) {
+		t.Fatalf("ValidTicketLinkType() should only allow the relations staff may choose")
+	}
+
+	links := withTicketLink(nil, TicketLink{Type: TicketRelatedLink, Uuid: "2"})
+	links = withTicketLink(links, TicketLink{Type: TicketBlocksLink, Uuid: "3"})
+	links = withTicketLink(links, TicketLink{Type: TicketBlockedByLink, Uuid: "2"})
+	if len(links) != 2 || findTicketLink(links, "2").Type != TicketBlockedByLink {
+		t.Fatalf("withTicketLink() should replace an existing link to the same ticket: %+v", links)
+	}
+	if links = withoutTicketLink(links, "3"); len(links) != 1 || findTicketLink(links, "3") != nil {
+		t.Fatalf("withoutTicketLink() did not remove the link: %+v", links)
+	}
+
+	// Links and merges are kept when a ticket is saved and loaded
+	ticket := &GaeTicket{uuid: "1", links: []TicketLink{
+		{Type: TicketBlocksLink, Uuid: "2", Subject: "Printer"},
+		{Type: TicketSplitIntoLink, ParentType: "Course", ParentUuid: "c1", Uuid: "3", Subject: "Fees"},
+	}, mergedInto: &TicketLink{Type: TicketDuplicateOfLink, Uuid: "4", Subject: "Kept"}}
+	props, err := ticket.Save()
+	if err != nil {
+		t.Fatalf("Save() failed: %v", err)
+	}
+	var loaded GaeTicket
+	if err := loaded.Load(props); err != nil {
+		t.Fatalf("Load() failed: %v", err)
+	}
+	if len(loaded.Links()) != 2 || loaded.Links()[1] != ticket.links[1] || loaded.MergedInto() == nil || *loaded.MergedInto() != *ticket.mergedInto {
+		t.Fatalf("Load() returned links %+v merged into %+v", loaded.Links(), loaded.MergedInto())
+	}
+
+	if tags := mergedTicketTags([]string{"Billing", "urgent"}, []string{"billing ", "refund"}); len(tags) != 3 || tags[2] != "refund" {
+		t.Fatalf("mergedTicketTags() returned %v", tags)
+	}
+	if viewers := mergedTicketViewers([]TicketViewer{{Uuid: "a"}}, []TicketViewer{{Uuid: "a"}, {Uuid: "b"}}); len(viewers) != 2 {
+		t.Fatalf("mergedTicketViewers() returned %v", viewers)
+	}
+
+	for value, expected := range map[string]string{
+		" 6f1c9a2e-0b1d-11ee-be56-0242ac120002 ":                          "6f1c9a2e-0b1d-11ee-be56-0242ac120002",
+		"https://example.com/z/ticket/6f1c9a2e-0b1d-11ee?pt=Course&pu=c1": "6f1c9a2e-0b1d-11ee",
+		"https://example.com/app/z/ticket/6f1c9a2e-0b1d-11ee#response":    "6f1c9a2e-0b1d-11ee",
+		"": "",
+	} {
+		if uuid := parseTicketInput(value); uuid != expected {
+			t.Fatalf("parseTicketInput(%q) returned %q", value, uuid)
+		}
+	}
+}
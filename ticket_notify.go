@@ -0,0 +1,430 @@
+package security
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+// Notification emails are rendered from templates named "ticket_<event>_subject",
+// "ticket_<event>_text" and "ticket_<event>_html". A translation is a template with
+// the same name followed by a language code, i.e. "ticket_reply_text.fr", and is
+// used for people whose preferred language, or the site's "ticket.notification.lang"
+// setting, matches.
+var ticketNotificationSources = []string{ticketNotificationTemplates}
+var ticketNotificationText = template.Must(template.New("ticket_notification").Parse(ticketNotificationTemplates))
+var ticketNotificationHtml = htmltemplate.Must(htmltemplate.New("ticket_notification").Parse(ticketNotificationTemplates))
+var ticketNotificationLock sync.RWMutex
+
+// RegisterTicketNotificationTemplates adds, or replaces, notification email templates.
+func RegisterTicketNotificationTemplates(text string) error {
+	ticketNotificationLock.Lock()
+	defer ticketNotificationLock.Unlock()
+
+	// Templates that have been used can not be changed, so both sets are parsed again
+	sources := append(ticketNotificationSources[:len(ticketNotificationSources):len(ticketNotificationSources)], text)
+	t := template.New("ticket_notification")
+	h := htmltemplate.New("ticket_notification")
+	for _, source := range sources {
+		var err error
+		if t, err = t.Parse(source); err != nil {
+			return err
+		}
+		if h, err = h.Parse(source); err != nil {
+			return err
+		}
+	}
+	ticketNotificationSources = sources
+	ticketNotificationText = t
+	ticketNotificationHtml = h
+	return nil
+}
+
+// ticketTemplateName returns the name of the most specific template available for a language.
+func ticketTemplateName(name, lang string, defined func(name string) bool) string {
+	lang = strings.ToLower(strings.TrimSpace(lang))
+	if lang != "" && defined(name+"."+lang) {
+		return name + "." + lang
+	}
+	if i := strings.IndexAny(lang, "-_"); i > 0 && defined(name+"."+lang[:i]) {
+		return name + "." + lang[:i]
+	}
+	return name
+}
+
+// TicketNotification holds the information available to notification templates.
+type TicketNotification struct {
+	Site           string
+	BaseURL        string
+	Event          TicketEvent
+	Ticket         Ticket
+	Response       TicketResponse // The response added, if any
+	ActorName      string         // Name of the person who made the change
+	ToName         string
+	ToEmail        string
+	Staff          bool   // Set if the recipient is assigned to, or watching, the ticket
+	Link           string // Address of the ticket on the support desk, for staff
+	PreferencesURL string // Address where the recipient can choose which notifications they receive
+	FromName       string
+}
+
+// Render returns the subject, text and html content of a notification in a language.
+func (n *TicketNotification) Render(lang string) (string, []byte, []byte, error) {
+	ticketNotificationLock.RLock()
+	t, h := ticketNotificationText, ticketNotificationHtml
+	ticketNotificationLock.RUnlock()
+
+	name := "ticket_" + string(n.Event)
+	var subject, text, html bytes.Buffer
+	if err := t.ExecuteTemplate(&subject, ticketTemplateName(name+"_subject", lang, func(s string) bool { return t.Lookup(s) != nil }), n); err != nil {
+		return "", nil, nil, err
+	}
+	if err := t.ExecuteTemplate(&text, ticketTemplateName(name+"_text", lang, func(s string) bool { return t.Lookup(s) != nil }), n); err != nil {
+		return "", nil, nil, err
+	}
+	if err := h.ExecuteTemplate(&html, ticketTemplateName(name+"_html", lang, func(s string) bool { return h.Lookup(s) != nil }), n); err != nil {
+		return "", nil, nil, err
+	}
+	return strings.Join(strings.Fields(subject.String()), " "), bytes.TrimSpace(text.Bytes()), bytes.TrimSpace(html.Bytes()), nil
+}
+
+// TicketNotifier emails the requester, assignees and watchers of a ticket when it changes.
+type TicketNotifier struct {
+	am AccessManager
+	tm TicketManager
+}
+
+func NewTicketNotifier(am AccessManager, tm TicketManager) *TicketNotifier {
+	return &TicketNotifier{am: am, tm: tm}
+}
+
+type ticketRecipient struct {
+	name  string
+	email string
+	staff bool
+}
+
+// Notify sends notifications of an event to everyone interested in it, except the person
+// who caused it. The requester is told of new tickets, replies and status changes.
+// Assignees and watchers are also told of internal notes. When a ticket is assigned,
+// only the people newly assigned to it are told.
+func (n *TicketNotifier) Notify(site string, event TicketEvent, ticketUuid, responseUuid, actorUuid, actorEmail string, assigned []string) error {
+	// Notifications are sent with the rights of the support desk, to see every ticket
+	session, err := n.am.GetSystemSessionWithRoles(site, "Ticket", "Notifications", "s1:s2:s3:s4:"+TicketSupportRole)
+	if err != nil {
+		return err
+	}
+	ticket, err := n.tm.FindTicket(ticketUuid, session)
+	if err != nil {
+		return err
+	}
+	if ticket == nil {
+		return errors.New("Ticket not found: " + ticketUuid)
+	}
+
+	var response TicketResponse
+	actorName := ""
+	if responseUuid != "" {
+		responses, err := n.tm.GetParentedTicketResponses(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), session)
+		if err != nil {
+			return err
+		}
+		for _, r := range responses {
+			if r.Uuid() == responseUuid {
+				response = r
+				actorName = r.PersonDisplayName()
+			}
+		}
+	}
+
+	var recipients []ticketRecipient
+	found := make(map[string]bool)
+	add := func(uuid, name, email string, staff bool) error {
+		if uuid != "" && email == "" {
+			person, err := n.am.GetPerson(uuid, session)
+			if err != nil {
+				return err
+			}
+			if person == nil {
+				return nil
+			}
+			email = person.Email()
+			if name == "" {
+				name = person.DisplayName()
+			}
+		}
+		email = strings.ToLower(strings.TrimSpace(email))
+		if email == "" || found[email] {
+			return nil
+		}
+		// People are not told of their own changes, except that a new ticket is acknowledged
+		actor := email == actorEmail || (uuid != "" && uuid == actorUuid)
+		if actor && (staff || event != TicketCreatedEvent) {
+			return nil
+		}
+		found[email] = true
+		recipients = append(recipients, ticketRecipient{name: name, email: email, staff: staff})
+		return nil
+	}
+
+	actorEmail = strings.ToLower(strings.TrimSpace(actorEmail))
+	if actorUuid != "" {
+		if actor, err := n.am.GetPerson(actorUuid, session); err == nil && actor != nil {
+			if actorEmail == "" {
+				actorEmail = strings.ToLower(actor.Email())
+			}
+			if actorName == "" {
+				actorName = actor.DisplayName()
+			}
+		}
+	}
+	if event == TicketAssignedEvent {
+		for _, v := range ticket.AssignedTo() {
+			for _, uuid := range assigned {
+				if v.Uuid == uuid {
+					if err := add(v.Uuid, v.DisplayName, "", true); err != nil {
+						return err
+					}
+				}
+			}
+		}
+	} else {
+		for _, v := range ticket.AssignedTo() {
+			if err := add(v.Uuid, v.DisplayName, "", true); err != nil {
+				return err
+			}
+		}
+		for _, v := range ticket.WatchedBy() {
+			if err := add(v.Uuid, v.DisplayName, "", true); err != nil {
+				return err
+			}
+		}
+		if event != TicketNoteEvent {
+			name := strings.TrimSpace(ticket.FirstName() + " " + ticket.LastName())
+			if err := add(ticket.PersonUuid(), name, ticket.Email(), false); err != nil {
+				return err
+			}
+		}
+	}
+
+	baseURL := strings.TrimSuffix(n.am.Setting().GetWithDefault(site, "base.url", "http://"+site), "/")
+	replyEmail := n.am.Setting().GetWithDefault(site, "support_team.reply.email", "")
+	if replyEmail == "" {
+		replyEmail = n.am.Setting().GetWithDefault(site, "support_team.email", "")
+	}
+	domain := replyEmail[strings.LastIndex(replyEmail, "@")+1:]
+	thread := fmt.Sprintf("<ticket.%s@%s>", ticket.Uuid(), domain)
+
+	var failures []string
+	for _, r := range recipients {
+		preference, err := n.tm.GetTicketNotificationPreference(r.email, session)
+		if err != nil {
+			return err
+		}
+		if !preference.Wants(event) {
+			continue
+		}
+		if preference.Token == "" {
+			if err := n.tm.PutTicketNotificationPreference(preference, session); err != nil {
+				return err
+			}
+		}
+
+		notification := &TicketNotification{
+			Site:           site,
+			BaseURL:        baseURL,
+			Event:          event,
+			Ticket:         ticket,
+			Response:       response,
+			ActorName:      actorName,
+			ToName:         r.name,
+			ToEmail:        r.email,
+			Staff:          r.staff,
+			PreferencesURL: baseURL + Path("/ticket.notifications/") + preference.Token,
+			FromName:       n.am.Setting().GetWithDefault(site, "support_team.name", ""),
+		}
+		if r.staff {
+			notification.Link = baseURL + ticketPath(ticket)
+		}
+		lang := preference.Lang
+		if lang == "" {
+			lang = n.am.Setting().GetWithDefault(site, "ticket.notification.lang", "")
+		}
+		subject, text, html, err := notification.Render(lang)
+		if err != nil {
+			return err
+		}
+
+		headers := map[string]string{
+			"Message-Id":       TicketMessageId(ticket.Uuid(), domain),
+			"In-Reply-To":      thread,
+			"References":       thread,
+			"Auto-Submitted":   "auto-generated",
+			"List-Unsubscribe": "<" + notification.PreferencesURL + ">",
+		}
+		if replyEmail != "" {
+			headers["Reply-To"] = TicketReplyAddress(replyEmail, ticket.Uuid())
+		}
+		if _, err := SendEmailWithHeaders(n.am, session, subject, r.email, r.name, text, html, headers); err != nil {
+			failures = append(failures, r.email+": "+err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return errors.New("Ticket notification failed. " + strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// queueTicketNotification creates a task to notify people of a change to a ticket.
+func queueTicketNotification(am AccessManager, event TicketEvent, ticket Ticket, responseUuid string, assigned []string, session Session) {
+	if !am.Setting().GetBool(session.Site(), "ticket.notifications", true) {
+		return
+	}
+	message := map[string]interface{}{
+		"type":        "ticket-notify",
+		"site":        session.Site(),
+		"event":       string(event),
+		"ticket":      ticket.Uuid(),
+		"response":    responseUuid,
+		"actor":       session.PersonUuid(),
+		"actor_email": session.Email(),
+		"assigned":    strings.Join(assigned, ":"),
+	}
+	go func() {
+		if _, err := am.CreateTask("ticket-notify", message); err != nil {
+			fmt.Println("Create 'ticket-notify' task failed", err)
+		}
+	}()
+}
+
+func ticketNotifyTask(am AccessManager, tm TicketManager) func(session Session, message map[string]interface{}) error {
+	return func(session Session, message map[string]interface{}) error {
+		value := func(name string) string {
+			if v, ok := message[name].(string); ok {
+				return v
+			}
+			return ""
+		}
+		var assigned []string
+		if a := value("assigned"); a != "" {
+			assigned = strings.Split(a, ":")
+		}
+		return NewTicketNotifier(am, tm).Notify(session.Site(), TicketEvent(value("event")), value("ticket"), value("response"), value("actor"), value("actor_email"), assigned)
+	}
+}
+
+func init() {
+	RegisterSetting(SettingDefinition{Name: "ticket.notifications", Type: SettingBool, Default: "yes", Allowed: []string{"yes", "no"},
+		Description: "Email requesters, assignees and watchers when tickets change."})
+	RegisterSetting(SettingDefinition{Name: "ticket.notification.lang",
+		Description: "Language of ticket notifications, for people who have not chosen one, i.e. \"fr\"."})
+}
+
+var ticketNotificationTemplates = `
+{{define "ticket_created_subject"}}[#{{slice .Ticket.Uuid 0 8}}] {{.Ticket.Subject}}{{end}}
+{{define "ticket_reply_subject"}}Re: [#{{slice .Ticket.Uuid 0 8}}] {{.Ticket.Subject}}{{end}}
+{{define "ticket_note_subject"}}Note: [#{{slice .Ticket.Uuid 0 8}}] {{.Ticket.Subject}}{{end}}
+{{define "ticket_status_subject"}}[#{{slice .Ticket.Uuid 0 8}}] {{.Ticket.Subject}} is now {{.Ticket.Status}}{{end}}
+{{define "ticket_assigned_subject"}}Assigned: [#{{slice .Ticket.Uuid 0 8}}] {{.Ticket.Subject}}{{end}}
+
+{{define "ticket_created_text"}}
+Hi {{.ToName}},
+
+{{if .Staff}}A new ticket has been raised by {{.Ticket.FirstName}} {{.Ticket.LastName}} {{.Ticket.Email}}.{{else}}Thanks for contacting us. We have received your request and will be in touch shortly.{{end}}
+
+  Subject: {{.Ticket.Subject}}
+
+{{.Ticket.Message}}
+{{template "ticket_footer_text" .}}
+{{end}}
+
+{{define "ticket_reply_text"}}
+Hi {{.ToName}},
+
+{{.ActorName}} has replied to "{{.Ticket.Subject}}":
+
+{{if .Response}}{{.Response.Message}}{{end}}
+{{template "ticket_footer_text" .}}
+{{end}}
+
+{{define "ticket_note_text"}}
+Hi {{.ToName}},
+
+{{.ActorName}} has added a note to "{{.Ticket.Subject}}":
+
+{{if .Response}}{{.Response.Message}}{{end}}
+{{template "ticket_footer_text" .}}
+{{end}}
+
+{{define "ticket_status_text"}}
+Hi {{.ToName}},
+
+The status of "{{.Ticket.Subject}}" has been changed to {{.Ticket.Status}}{{if .ActorName}} by {{.ActorName}}{{end}}.
+{{template "ticket_footer_text" .}}
+{{end}}
+
+{{define "ticket_assigned_text"}}
+Hi {{.ToName}},
+
+"{{.Ticket.Subject}}" has been assigned to you{{if .ActorName}} by {{.ActorName}}{{end}}.
+
+{{.Ticket.Message}}
+{{template "ticket_footer_text" .}}
+{{end}}
+
+{{define "ticket_footer_text"}}
+{{if .Link}}  {{.Link}}
+
+{{end}}Reply to this email to respond.
+
+--
+{{.FromName}}
+To choose which emails you receive about tickets, visit {{.PreferencesURL}}
+{{end}}
+
+{{define "ticket_created_html"}}
+<p>Hi {{.ToName}},</p>
+<p>{{if .Staff}}A new ticket has been raised by {{.Ticket.FirstName}} {{.Ticket.LastName}} {{.Ticket.Email}}.{{else}}Thanks for contacting us. We have received your request and will be in touch shortly.{{end}}</p>
+<p><b>Subject:</b> {{.Ticket.Subject}}</p>
+<p style="white-space:pre-wrap">{{.Ticket.Message}}</p>
+{{template "ticket_footer_html" .}}
+{{end}}
+
+{{define "ticket_reply_html"}}
+<p>Hi {{.ToName}},</p>
+<p>{{.ActorName}} has replied to "{{.Ticket.Subject}}":</p>
+{{if .Response}}<p style="white-space:pre-wrap">{{.Response.Message}}</p>{{end}}
+{{template "ticket_footer_html" .}}
+{{end}}
+
+{{define "ticket_note_html"}}
+<p>Hi {{.ToName}},</p>
+<p>{{.ActorName}} has added a note to "{{.Ticket.Subject}}":</p>
+{{if .Response}}<p style="white-space:pre-wrap">{{.Response.Message}}</p>{{end}}
+{{template "ticket_footer_html" .}}
+{{end}}
+
+{{define "ticket_status_html"}}
+<p>Hi {{.ToName}},</p>
+<p>The status of "{{.Ticket.Subject}}" has been changed to <b>{{.Ticket.Status}}</b>{{if .ActorName}} by {{.ActorName}}{{end}}.</p>
+{{template "ticket_footer_html" .}}
+{{end}}
+
+{{define "ticket_assigned_html"}}
+<p>Hi {{.ToName}},</p>
+<p>"{{.Ticket.Subject}}" has been assigned to you{{if .ActorName}} by {{.ActorName}}{{end}}.</p>
+<p style="white-space:pre-wrap">{{.Ticket.Message}}</p>
+{{template "ticket_footer_html" .}}
+{{end}}
+
+{{define "ticket_footer_html"}}
+{{if .Link}}<p><a href="{{.Link}}">{{.Link}}</a></p>{{end}}
+<p>Reply to this email to respond.</p>
+<p>{{.FromName}}</p>
+<p style="font-size:0.8em;color:#888"><a href="{{.PreferencesURL}}">Choose which emails you receive about tickets</a></p>
+{{end}}
+`
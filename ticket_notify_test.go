@@ -0,0 +1,41 @@
+package security
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTicketNotificationRender(t *testing.T) {
+	ticket := &GaeTicket{uuid: "0d4c6a2e-8f0b-11ee-b9d1-0242ac120002", subject: "Timetable <help>", message: "Where is it?", status: TicketArchived}
+	n := &TicketNotification{Event: TicketStatusEvent, Ticket: ticket, ToName: "Bob", ActorName: "Stacy", PreferencesURL: "https://example.com/ticket.notifications/x"}
+
+	subject, text, html, err := n.Render("")
+	if err != nil {
+		t.Fatalf("Render() failed: %v", err)
+	}
+	if subject != "[#0d4c6a2e] Timetable <help> is now archived" {
+		t.Fatalf("Render() returned subject %q", subject)
+	}
+	if !strings.Contains(string(text), "changed to archived by Stacy") || !strings.Contains(string(text), n.PreferencesURL) {
+		t.Fatalf("Render() returned text %q", text)
+	}
+	if !strings.Contains(string(html), "Timetable &lt;help&gt;") {
+		t.Fatalf("Render() should escape html content: %q", html)
+	}
+
+	err = RegisterTicketNotificationTemplates(`{{define "ticket_status_subject.fr"}}[#{{slice .Ticket.Uuid 0 8}}] {{.Ticket.Subject}} : {{.Ticket.Status}}{{end}}`)
+	if err != nil {
+		t.Fatalf("RegisterTicketNotificationTemplates() failed: %v", err)
+	}
+	if subject, _, _, _ := n.Render("fr-CA"); subject != "[#0d4c6a2e] Timetable <help> : archived" {
+		t.Fatalf("Render() should use the translated subject, not %q", subject)
+	}
+	if subject, _, _, _ := n.Render("de"); !strings.HasSuffix(subject, "is now archived") {
+		t.Fatalf("Render() should fall back to the default template, not %q", subject)
+	}
+
+	p := &TicketNotificationPreference{OptOut: []TicketEvent{TicketNoteEvent}}
+	if p.Wants(TicketNoteEvent) || !p.Wants(TicketReplyEvent) {
+		t.Fatalf("Wants() did not respect the opt out")
+	}
+}
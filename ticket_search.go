@@ -0,0 +1,196 @@
+package security
+
+import (
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// Tickets are indexed for keyword search by storing the search terms found in the
+// ticket, and in its responses, in the ticket's SearchTags property.
+
+// Tickets hold at most this many search terms, so the index entries of a single
+// ticket stay within datastore limits.
+const ticketSearchTermLimit = 800
+
+var searchStopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "from": true, "i": true, "if": true, "in": true,
+	"is": true, "it": true, "me": true, "my": true, "of": true, "on": true, "or": true,
+	"so": true, "that": true, "the": true, "this": true, "to": true, "was": true, "we": true,
+	"with": true, "you": true,
+}
+
+// SearchTerms splits text into lower case, stemmed search terms, without duplicates.
+// Email addresses are kept whole, and are also split into their parts, so that a
+// search for "bob@example.com", "bob", or "example.com" will match.
+func SearchTerms(text ...string) []string {
+	var terms []string
+	found := make(map[string]bool)
+	add := func(term string) {
+		if term != "" && !found[term] && !searchStopWords[term] {
+			found[term] = true
+			terms = append(terms, term)
+		}
+	}
+
+	for _, t := range text {
+		words := strings.FieldsFunc(strings.ToLower(t), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '@' && r != '.' && r != '-' && r != '_' && r != '\''
+		})
+		for _, word := range words {
+			word = strings.Trim(word, ".-_'@")
+			if word == "" {
+				continue
+			}
+			if i := strings.Index(word, "@"); i > 0 && i < len(word)-1 {
+				add(word)
+				add(word[i+1:])
+			}
+			parts := strings.FieldsFunc(word, func(r rune) bool {
+				return r == '@' || r == '.' || r == '-' || r == '_'
+			})
+			for _, part := range parts {
+				part = strings.TrimSuffix(strings.Trim(part, "'"), "'s")
+				part = strings.Replace(part, "'", "", -1)
+				if part == "" {
+					continue
+				}
+				if len([]rune(part)) > 1 || unicode.IsDigit([]rune(part)[0]) {
+					add(Stem(part))
+				}
+			}
+		}
+	}
+	return terms
+}
+
+// uniqueTerms removes duplicate and empty terms, keeping the first of each.
+func uniqueTerms(terms []string) []string {
+	var unique []string
+	found := make(map[string]bool)
+	for _, term := range terms {
+		if term != "" && !found[term] {
+			found[term] = true
+			unique = append(unique, term)
+		}
+	}
+	return unique
+}
+
+// Stem removes common English suffixes from a lower case word, so that different forms
+// of a word, such as "submit", "submits", "submitted" and "submitting" share one search term.
+func Stem(word string) string {
+	if len(word) <= 3 {
+		return word
+	}
+	for _, r := range word {
+		if r > unicode.MaxASCII || unicode.IsDigit(r) {
+			return word
+		}
+	}
+
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		word = word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") && !strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		word = word[:len(word)-1]
+	}
+
+	for _, suffix := range []string{"ingly", "edly", "ing", "ed", "ly"} {
+		if !strings.HasSuffix(word, suffix) {
+			continue
+		}
+		stem := word[:len(word)-len(suffix)]
+		if len(stem) < 3 || !strings.ContainsAny(stem, "aeiouy") {
+			break
+		}
+		word = stem
+		// Undouble a final consonant, i.e. "running" to "run"
+		if n := len(word); word[n-1] == word[n-2] && !strings.ContainsAny(word[n-1:], "aeiouls") {
+			word = word[:n-1]
+		}
+		break
+	}
+	return word
+}
+
+// ticketSearchScore ranks how well a ticket matches a set of search terms. Matches in
+// the subject or tags count more than matches in the message or responses. Zero is
+// returned if any term is not found.
+func ticketSearchScore(ticket Ticket, responseTerms []string, terms []string) int {
+	in := func(text ...string) map[string]bool {
+		m := make(map[string]bool)
+		for _, t := range SearchTerms(text...) {
+			m[t] = true
+		}
+		return m
+	}
+	subject := in(ticket.Subject())
+	tags := in(ticket.Tags()...)
+	person := in(ticket.FirstName(), ticket.LastName(), ticket.Email())
+	message := in(ticket.Message())
+	responses := make(map[string]bool)
+	for _, t := range responseTerms {
+		responses[t] = true
+	}
+
+	score := 0
+	for _, term := range terms {
+		s := 0
+		if subject[term] {
+			s += 4
+		}
+		if tags[term] {
+			s += 3
+		}
+		if person[term] {
+			s += 3
+		}
+		if message[term] {
+			s += 2
+		}
+		if responses[term] {
+			s += 1
+		}
+		if s == 0 {
+			return 0
+		}
+		score += s
+	}
+	return score
+}
+
+// rankTickets sorts tickets by score, then most recent first.
+func rankTickets(tickets []Ticket, scores map[string]int) {
+	sort.SliceStable(tickets, func(i, j int) bool {
+		si, sj := scores[tickets[i].Uuid()], scores[tickets[j].Uuid()]
+		if si != sj {
+			return si > sj
+		}
+		ci, cj := tickets[i].Created(), tickets[j].Created()
+		if ci == nil || cj == nil {
+			return cj == nil && ci != nil
+		}
+		return ci.After(*cj)
+	})
+}
+
+// ticketReindexTask rebuilds the search terms of the tickets of a site, so that tickets
+// raised before keyword search was added can be found. Queue a "ticket-reindex" task
+// for each site to index its existing tickets.
+func ticketReindexTask(am AccessManager, tm TicketManager) func(session Session, message map[string]interface{}) error {
+	return func(session Session, message map[string]interface{}) error {
+		system, err := am.GetSystemSessionWithRoles(session.Site(), "Ticket", "Search", TicketSupportRole)
+		if err != nil {
+			return err
+		}
+		count, err := tm.ReindexTickets(system)
+		if count > 0 {
+			am.Notice(session, `ticket`, "%d tickets reindexed for search", count)
+		}
+		return err
+	}
+}
@@ -0,0 +1,466 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// TicketSLAPolicy sets the business hours allowed for the first response to, and the
+// resolution of, tickets of a type or with a tag. Policies are held in the
+// "ticket.sla.policies" setting, and the first policy matching a ticket applies to it.
+type TicketSLAPolicy struct {
+	Type          TicketType    // Tickets of this type match, or tickets of any type if empty
+	Tag           string        // Tickets with this tag match, or tickets with any tags if empty
+	FirstResponse time.Duration // Business hours allowed before the first response, or zero for no target
+	Resolution    time.Duration // Business hours allowed before the ticket is resolved, or zero for no target
+}
+
+// ParseTicketSLAPolicy reads a policy written as "<type>#<tag>=<first response>/<resolution>",
+// i.e. "support#urgent=1h/8h". The type may be "*" to match any type, and either the type or
+// the tag may be left out. A target of "-" means there is none.
+func ParseTicketSLAPolicy(text string) (*TicketSLAPolicy, error) {
+	i := strings.Index(text, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("SLA policy \"%s\" must be written as type#tag=first response/resolution", text)
+	}
+	p := &TicketSLAPolicy{}
+	match, targets := strings.TrimSpace(text[:i]), strings.Split(text[i+1:], "/")
+	if j := strings.Index(match, "#"); j >= 0 {
+		p.Tag = strings.TrimSpace(match[j+1:])
+		match = strings.TrimSpace(match[:j])
+	}
+	if match != "*" {
+		p.Type = TicketType(match)
+	}
+	if len(targets) != 2 {
+		return nil, fmt.Errorf("SLA policy \"%s\" must have a first response and a resolution target", text)
+	}
+	for k, d := range []*time.Duration{&p.FirstResponse, &p.Resolution} {
+		target := strings.TrimSpace(targets[k])
+		if target == "-" || target == "" {
+			continue
+		}
+		v, err := time.ParseDuration(target)
+		if err != nil || v < 0 {
+			return nil, fmt.Errorf("SLA policy \"%s\" has an invalid target \"%s\", i.e. use 4h or 30m", text, target)
+		}
+		*d = v
+	}
+	return p, nil
+}
+
+// Matches reports if the policy applies to a ticket.
+func (p TicketSLAPolicy) Matches(ticket Ticket) bool {
+	if p.Type != "" && p.Type != ticket.Type() {
+		return false
+	}
+	return p.Tag == "" || hasTicketTag(ticket, p.Tag)
+}
+
+func (p TicketSLAPolicy) String() string {
+	match := string(p.Type)
+	if match == "" {
+		match = "*"
+	}
+	if p.Tag != "" {
+		match = match + "#" + p.Tag
+	}
+	target := func(d time.Duration) string {
+		if d == 0 {
+			return "-"
+		}
+		s := d.String()
+		if strings.HasSuffix(s, "m0s") {
+			s = strings.TrimSuffix(s, "0s")
+		}
+		if strings.HasSuffix(s, "h0m") {
+			s = strings.TrimSuffix(s, "0m")
+		}
+		return s
+	}
+	return match + "=" + target(p.FirstResponse) + "/" + target(p.Resolution)
+}
+
+// TicketBusinessHours is the working week against which SLA targets are measured.
+type TicketBusinessHours struct {
+	Location *time.Location
+	Open     time.Duration   // Time of day work starts
+	Close    time.Duration   // Time of day work ends
+	Days     [7]bool         // Days worked, indexed by time.Weekday
+	Holidays map[string]bool // Dates not worked, as "2006-01-02"
+}
+
+var weekdayNames = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseTicketBusinessHours reads business hours such as "09:00-17:00", the days worked
+// such as "mon", the dates of holidays as "2006-01-02", and a time zone name.
+func ParseTicketBusinessHours(hours string, days, holidays []string, timezone string) (*TicketBusinessHours, error) {
+	h := &TicketBusinessHours{Location: time.Local, Holidays: make(map[string]bool)}
+	if timezone = strings.TrimSpace(timezone); timezone != "" {
+		location, err := time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Unknown time zone \"%s\"", timezone)
+		}
+		h.Location = location
+	}
+
+	parts := strings.Split(hours, "-")
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("Business hours \"%s\" must be written as 09:00-17:00", hours)
+	}
+	for i, d := range []*time.Duration{&h.Open, &h.Close} {
+		t, err := time.Parse("15:04", strings.TrimSpace(parts[i]))
+		if err != nil {
+			return nil, fmt.Errorf("Business hours \"%s\" must be written as 09:00-17:00", hours)
+		}
+		*d = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if h.Close <= h.Open {
+		return nil, fmt.Errorf("Business hours \"%s\" must close after they open", hours)
+	}
+
+	for _, day := range days {
+		found := false
+		for i, name := range weekdayNames {
+			if strings.EqualFold(strings.TrimSpace(day), name) {
+				h.Days[i] = true
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown day \"%s\", i.e. use mon", day)
+		}
+	}
+	for _, holiday := range holidays {
+		d, err := time.Parse("2006-01-02", strings.TrimSpace(holiday))
+		if err != nil {
+			return nil, fmt.Errorf("Holiday \"%s\" must be a date such as 2006-01-02", holiday)
+		}
+		h.Holidays[d.Format("2006-01-02")] = true
+	}
+	return h, nil
+}
+
+// workingDay returns when work starts and ends on the day of a time, and false if the
+// day is not worked.
+func (h *TicketBusinessHours) workingDay(t time.Time) (time.Time, time.Time, bool) {
+	t = t.In(h.Location)
+	if !h.Days[t.Weekday()] || h.Holidays[t.Format("2006-01-02")] {
+		return time.Time{}, time.Time{}, false
+	}
+	y, m, d := t.Date()
+	open := time.Date(y, m, d, 0, int(h.Open/time.Minute), 0, 0, h.Location)
+	close := time.Date(y, m, d, 0, int(h.Close/time.Minute), 0, 0, h.Location)
+	return open, close, true
+}
+
+// Add returns the time a number of business hours after a time.
+func (h *TicketBusinessHours) Add(t time.Time, d time.Duration) time.Time {
+	working := false
+	for _, w := range h.Days {
+		working = working || w
+	}
+	if !working {
+		return t.Add(d)
+	}
+
+	t = t.In(h.Location)
+	for {
+		if open, close, ok := h.workingDay(t); ok && t.Before(close) {
+			if t.Before(open) {
+				t = open
+			}
+			remaining := close.Sub(t)
+			if d <= remaining {
+				return t.Add(d)
+			}
+			d = d - remaining
+		}
+		y, m, n := t.Date()
+		t = time.Date(y, m, n+1, 0, 0, 0, 0, h.Location)
+	}
+}
+
+// TicketSLAConfig holds the SLA policies and business hours of a site, and its workflow
+// which decides when a ticket is resolved.
+type TicketSLAConfig struct {
+	Policies []TicketSLAPolicy
+	Hours    *TicketBusinessHours
+	Workflow *TicketWorkflow
+}
+
+// GetTicketSLAConfig reads the SLA policies and business hours of a site from its settings.
+func GetTicketSLAConfig(s Setting, ps PicklistStore, site string) (*TicketSLAConfig, error) {
+	c := &TicketSLAConfig{}
+	for _, text := range settingList(s, site, "ticket.sla.policies") {
+		p, err := ParseTicketSLAPolicy(text)
+		if err != nil {
+			return nil, err
+		}
+		c.Policies = append(c.Policies, *p)
+	}
+	var err error
+	c.Hours, err = ParseTicketBusinessHours(settingValue(s, site, "ticket.sla.hours", "09:00-17:00"),
+		settingList(s, site, "ticket.sla.days"), settingList(s, site, "ticket.sla.holidays"),
+		settingValue(s, site, "ticket.sla.timezone", ""))
+	if err != nil {
+		return nil, err
+	}
+	c.Workflow, err = GetTicketWorkflow(s, ps, site)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Evaluate measures a ticket against the first policy that matches it, returning nil if
+// there is none.
+func (c *TicketSLAConfig) Evaluate(ticket Ticket, now time.Time) *TicketSLA {
+	if ticket.Created() == nil {
+		return nil
+	}
+	for _, p := range c.Policies {
+		if !p.Matches(ticket) {
+			continue
+		}
+		s := &TicketSLA{Policy: p, FirstResponse: ticket.FirstResponse(), Resolved: ticket.Resolved(), Closed: !c.Workflow.IsOpen(ticket.Status())}
+		if !s.Closed {
+			s.Resolved = nil
+		}
+		if p.FirstResponse > 0 {
+			due := c.Hours.Add(*ticket.Created(), p.FirstResponse)
+			s.FirstResponseDue = &due
+			s.FirstResponseBreached = ticketTargetMissed(s.FirstResponse, due, now)
+		}
+		if p.Resolution > 0 {
+			due := c.Hours.Add(*ticket.Created(), p.Resolution)
+			s.ResolutionDue = &due
+			// Tickets closed before resolution times were recorded are not measured
+			s.ResolutionBreached = (s.Resolved != nil || !s.Closed) && ticketTargetMissed(s.Resolved, due, now)
+		}
+		return s
+	}
+	return nil
+}
+
+func ticketTargetMissed(met *time.Time, due, now time.Time) bool {
+	if met != nil {
+		return met.After(due)
+	}
+	return now.After(due)
+}
+
+// TicketSLA describes how a ticket is tracking against its SLA targets.
+type TicketSLA struct {
+	Policy                TicketSLAPolicy
+	FirstResponseDue      *time.Time // Nil if the policy has no first response target
+	ResolutionDue         *time.Time // Nil if the policy has no resolution target
+	FirstResponse         *time.Time
+	Resolved              *time.Time
+	Closed                bool // Set once the ticket no longer has an open status
+	FirstResponseBreached bool
+	ResolutionBreached    bool
+}
+
+// Status summarises the SLA of a ticket as "breached", "met" or "on track".
+func (s *TicketSLA) Status() string {
+	if s.FirstResponseBreached || s.ResolutionBreached {
+		return "breached"
+	}
+	if (s.FirstResponseDue == nil || s.FirstResponse != nil) && (s.ResolutionDue == nil || s.Closed) {
+		return "met"
+	}
+	return "on track"
+}
+
+// Breaches lists the targets missed while the ticket was open.
+func (s *TicketSLA) Breaches() []TicketEscalation {
+	var breaches []TicketEscalation
+	if s.Closed {
+		return breaches
+	}
+	if s.FirstResponseBreached && s.FirstResponse == nil {
+		breaches = append(breaches, TicketFirstResponseEscalation)
+	}
+	if s.ResolutionBreached {
+		breaches = append(breaches, TicketResolutionEscalation)
+	}
+	return breaches
+}
+
+// TicketEscalator escalates open tickets whose ActionAfter time has passed, or which have
+// missed an SLA target. Escalated tickets are given the tags in the "ticket.escalation.tags"
+// setting, assigned to the person in the "ticket.escalation.assign" setting, and an internal
+// note explaining why is added, which notifies the people assigned to and watching them.
+type TicketEscalator struct {
+	am AccessManager
+	tm TicketManager
+}
+
+func NewTicketEscalator(am AccessManager, tm TicketManager) *TicketEscalator {
+	return &TicketEscalator{am: am, tm: tm}
+}
+
+// Escalate checks the open tickets of a site, returning the number escalated.
+func (e *TicketEscalator) Escalate(site string, now time.Time) (int, error) {
+	session, err := e.am.GetSystemSessionWithRoles(site, "Ticket", "Escalation", "s1:s2:s3:s4:"+TicketSupportRole)
+	if err != nil {
+		return 0, err
+	}
+	config, err := GetTicketSLAConfig(e.am.Setting(), e.am.PicklistStore(), site)
+	if err != nil {
+		return 0, err
+	}
+
+	tags := settingList(e.am.Setting(), site, "ticket.escalation.tags")
+	var assignTo []TicketViewer
+	if email := settingValue(e.am.Setting(), site, "ticket.escalation.assign", ""); email != "" {
+		person, err := e.am.GetPersonByEmail(site, email, session)
+		if err != nil {
+			return 0, err
+		}
+		if person == nil {
+			e.am.Warning(session, `ticket`, "Tickets can not be assigned on escalation, no account has the email address %s", email)
+		} else {
+			assignTo = append(assignTo, TicketViewer{Uuid: person.Uuid(), DisplayName: person.DisplayName()})
+		}
+	}
+
+	count := 0
+	escalate := func(ticket Ticket, reason TicketEscalation, note string) error {
+		escalated, err := e.tm.EscalateTicket(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), reason, tags, assignTo, session)
+		if err != nil || !escalated {
+			return err
+		}
+		count++
+		return e.tm.AddParentedTicketNote(ticket.ParentType(), ticket.ParentUuid(), ticket.Uuid(), note, session)
+	}
+
+	due, err := e.tm.GetTicketsByActionAfter(now, session)
+	if err != nil {
+		return count, err
+	}
+	for _, ticket := range due {
+		note := "Escalated as this ticket needed attention after " + config.Hours.format(ticket.ActionAfter()) + "."
+		if err := escalate(ticket, TicketActionAfterEscalation, note); err != nil {
+			return count, err
+		}
+	}
+
+	if len(config.Policies) == 0 {
+		return count, nil
+	}
+	var open []Ticket
+	for _, status := range config.Workflow.OpenStatuses() {
+		cursor := ""
+		for {
+			tickets, next, err := e.tm.QueryTickets(TicketFilter{Status: status}, cursor, 500, session)
+			if err != nil {
+				return count, err
+			}
+			open = append(open, tickets...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+	}
+	for _, ticket := range open {
+		sla := config.Evaluate(ticket, now)
+		if sla == nil {
+			continue
+		}
+		for _, reason := range sla.Breaches() {
+			if ticketEscalated(ticket, reason) {
+				continue
+			}
+			note := "Escalated as the first response was due by " + config.Hours.format(sla.FirstResponseDue) + "."
+			if reason == TicketResolutionEscalation {
+				note = "Escalated as this ticket was due to be resolved by " + config.Hours.format(sla.ResolutionDue) + "."
+			}
+			if err := escalate(ticket, reason, note); err != nil {
+				return count, err
+			}
+		}
+	}
+	return count, nil
+}
+
+func ticketEscalated(ticket Ticket, reason TicketEscalation) bool {
+	for _, e := range ticket.Escalations() {
+		if e == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func (h *TicketBusinessHours) format(t *time.Time) string {
+	if t == nil {
+		return ""
+	}
+	return t.In(h.Location).Format("2 Jan 2006 15:04 MST")
+}
+
+// queueTicketEscalation creates a task to escalate the tickets of a site.
+func queueTicketEscalation(am AccessManager, site string) error {
+	message := map[string]interface{}{
+		"type": "ticket-escalate",
+		"site": site,
+	}
+	_, err := am.CreateTask("ticket-escalate", message)
+	return err
+}
+
+func ticketEscalateTask(am AccessManager, tm TicketManager) func(session Session, message map[string]interface{}) error {
+	return func(session Session, message map[string]interface{}) error {
+		count, err := NewTicketEscalator(am, tm).Escalate(session.Site(), time.Now())
+		if count > 0 {
+			am.Notice(session, `ticket`, "%d tickets escalated", count)
+		}
+		return err
+	}
+}
+
+func init() {
+	RegisterSetting(SettingDefinition{Name: "ticket.escalation", Type: SettingBool, Default: "yes", Allowed: []string{"yes", "no"},
+		Description: "Escalate open tickets once their action after time passes, or they miss an SLA target."})
+	RegisterSetting(SettingDefinition{Name: "ticket.escalation.tags", Type: SettingList, Default: "escalated",
+		Description: "Tags added to escalated tickets, separated by semicolons."})
+	RegisterSetting(SettingDefinition{Name: "ticket.escalation.assign", Type: SettingEmail,
+		Description: "Email address of the support desk account escalated tickets are assigned to."})
+	RegisterSetting(SettingDefinition{Name: "ticket.sla.policies", Type: SettingList,
+		Description: "SLA targets in business hours, i.e. \"support#urgent=1h/8h; support=4h/40h; *=8h/-\". The first policy matching a ticket's type and tag applies.",
+		Validate: func(value string) error {
+			for _, text := range splitSettingList(value) {
+				if _, err := ParseTicketSLAPolicy(text); err != nil {
+					return err
+				}
+			}
+			return nil
+		}})
+	RegisterSetting(SettingDefinition{Name: "ticket.sla.hours", Default: "09:00-17:00",
+		Description: "Business hours SLA targets are measured in.",
+		Validate: func(value string) error {
+			_, err := ParseTicketBusinessHours(value, nil, nil, "")
+			return err
+		}})
+	RegisterSetting(SettingDefinition{Name: "ticket.sla.days", Type: SettingList, Default: "mon;tue;wed;thu;fri", Allowed: weekdayNames,
+		Description: "Days of the week SLA targets are measured in."})
+	RegisterSetting(SettingDefinition{Name: "ticket.sla.holidays", Type: SettingList,
+		Description: "Dates not counted towards SLA targets, i.e. \"2024-12-25; 2024-12-26\".",
+		Validate: func(value string) error {
+			_, err := ParseTicketBusinessHours("09:00-17:00", nil, splitSettingList(value), "")
+			return err
+		}})
+	RegisterSetting(SettingDefinition{Name: "ticket.sla.timezone",
+		Description: "Time zone of the business hours, i.e. \"Australia/Melbourne\".",
+		Validate: func(value string) error {
+			if _, err := time.LoadLocation(value); err != nil {
+				return errors.New("must be a time zone name such as Australia/Melbourne")
+			}
+			return nil
+		}})
+}
@@ -0,0 +1,88 @@
+package security
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTicketBusinessHours(t *testing.T) {
+	h, err := ParseTicketBusinessHours("09:00-17:00", []string{"mon", "tue", "wed", "thu", "fri"}, []string{"2023-12-25"}, "Australia/Melbourne")
+	if err != nil {
+		t.Fatalf("ParseTicketBusinessHours() failed: %v", err)
+	}
+	at := func(s string) time.Time {
+		v, err := time.ParseInLocation("2006-01-02 15:04", s, h.Location)
+		if err != nil {
+			t.Fatalf("time.ParseInLocation() failed: %v", err)
+		}
+		return v
+	}
+
+	for _, c := range []struct {
+		start    string
+		hours    time.Duration
+		expected string
+	}{
+		{"2023-12-20 10:00", 4 * time.Hour, "2023-12-20 14:00"},    // Within a day
+		{"2023-12-20 15:00", 4 * time.Hour, "2023-12-21 11:00"},    // Overnight
+		{"2023-12-20 06:00", time.Hour, "2023-12-20 10:00"},        // Before opening
+		{"2023-12-22 16:00", 2 * time.Hour, "2023-12-26 10:00"},    // Over a weekend and a holiday
+		{"2023-12-23 12:00", 30 * time.Minute, "2023-12-26 09:30"}, // Raised on a weekend
+		{"2023-12-20 09:00", 16 * time.Hour, "2023-12-21 17:00"},   // Two full days
+	} {
+		if due := h.Add(at(c.start), c.hours); !due.Equal(at(c.expected)) {
+			t.Fatalf("Add(%s, %v) returned %v, expected %s", c.start, c.hours, due, c.expected)
+		}
+	}
+
+	for _, invalid := range []string{"9-5", "17:00-09:00", "09:00"} {
+		if _, err := ParseTicketBusinessHours(invalid, nil, nil, ""); err == nil {
+			t.Fatalf("ParseTicketBusinessHours(%q) should fail", invalid)
+		}
+	}
+}
+
+func TestTicketSLAPolicy(t *testing.T) {
+	hours, _ := ParseTicketBusinessHours("09:00-17:00", []string{"mon", "tue", "wed", "thu", "fri"}, nil, "UTC")
+	config := &TicketSLAConfig{Hours: hours, Workflow: &TicketWorkflow{Statuses: append([]TicketStatusOption{}, DefaultTicketStatuses...)}}
+	config.Workflow.Statuses[0].Open = true
+	for _, text := range []string{"support#urgent=1h/8h", "support=4h/-", "*=8h30m/40h"} {
+		p, err := ParseTicketSLAPolicy(text)
+		if err != nil {
+			t.Fatalf("ParseTicketSLAPolicy(%q) failed: %v", text, err)
+		}
+		if p.String() != text {
+			t.Fatalf("ParseTicketSLAPolicy(%q) returned %s", text, p)
+		}
+		config.Policies = append(config.Policies, *p)
+	}
+	for _, invalid := range []string{"support", "support=4h", "support=soon/8h"} {
+		if _, err := ParseTicketSLAPolicy(invalid); err == nil {
+			t.Fatalf("ParseTicketSLAPolicy(%q) should fail", invalid)
+		}
+	}
+
+	created := time.Date(2023, 12, 20, 10, 0, 0, 0, time.UTC)
+	responded := time.Date(2023, 12, 20, 10, 30, 0, 0, time.UTC)
+	now := time.Date(2023, 12, 20, 15, 0, 0, 0, time.UTC)
+
+	urgent := &GaeTicket{ticketType: TechnicalSupportTicket, status: TicketOpen, tags: []string{"Urgent"}, created: &created, firstResponse: &responded}
+	sla := config.Evaluate(urgent, now)
+	if sla == nil || sla.Policy.Tag != "urgent" || sla.FirstResponseBreached || sla.Status() != "on track" || len(sla.Breaches()) != 0 {
+		t.Fatalf("Evaluate() should find the first response to the urgent ticket was on time: %+v", sla)
+	}
+	if sla := config.Evaluate(urgent, now.Add(24*time.Hour)); !sla.ResolutionBreached || len(sla.Breaches()) != 1 || sla.Breaches()[0] != TicketResolutionEscalation {
+		t.Fatalf("Evaluate() should find the urgent ticket was not resolved in time: %+v", sla)
+	}
+
+	waiting := &GaeTicket{ticketType: TechnicalSupportTicket, status: TicketOpen, created: &created}
+	if sla := config.Evaluate(waiting, now); sla == nil || sla.ResolutionDue != nil || !sla.FirstResponseBreached || sla.Status() != "breached" {
+		t.Fatalf("Evaluate() should find the support ticket missed its first response target: %+v", sla)
+	}
+
+	resolved := time.Date(2023, 12, 21, 9, 0, 0, 0, time.UTC)
+	enquiry := &GaeTicket{ticketType: EnquiryTicket, status: TicketArchived, created: &created, firstResponse: &responded, resolved: &resolved}
+	if sla := config.Evaluate(enquiry, now.Add(240*time.Hour)); sla == nil || sla.Status() != "met" {
+		t.Fatalf("Evaluate() should find the enquiry met its targets: %+v", sla)
+	}
+}
@@ -1,6 +1,9 @@
 package security
 
 import (
+	"bytes"
+	"io"
+	"strings"
 	"testing"
 	"time"
 
@@ -20,7 +23,7 @@ func TestTicketManager(t *testing.T) {
 	tm := NewGaeTicketManager(client, context, am)
 
 	// Setup accounts for peopel to participate in the test workflow
-	_, err = am.AddPerson(TestSite, "ticketmanager", "tmp", "ticketmanager.tmp1@example.com", "s1:s2:s3:s4:c1:c2:c3:c4:c5:c6", HashPassword("tmpA@9040hi"), "127.0.0.1", nil)
+	_, err = am.AddPerson(TestSite, "ticketmanager", "tmp", "ticketmanager.tmp1@example.com", "s1:s2:s3:s4:s5:c1:c2:c3:c4:c5:c6", HashPassword("tmpA@9040hi"), "127.0.0.1", nil)
 	if err != nil {
 		t.Fatalf("AddPerson() failed: %v", err)
 	}
@@ -29,6 +32,20 @@ func TestTicketManager(t *testing.T) {
 		t.Fatalf("Authenticate() failed: %v", err)
 	}
 
+	// Statuses and types must be defined by the site workflow
+	{
+		_, err := tm.AddTicket("nosuchstatus", EnquiryTicket, "", "Invalid", "Person", "invalid@example.com",
+			"Invalid status", "Invalid status", nil, nil, nil, nil, user)
+		if err != ErrInvalidTicketStatus {
+			t.Fatalf("tm.AddTicket() should reject an unknown status: %v", err)
+		}
+		_, err = tm.AddTicket(TicketOpen, "nosuchtype", "", "Invalid", "Person", "invalid@example.com",
+			"Invalid type", "Invalid type", nil, nil, nil, nil, user)
+		if err != ErrInvalidTicketType {
+			t.Fatalf("tm.AddTicket() should reject an unknown type: %v", err)
+		}
+	}
+
 	// Basic ticket creation
 	{
 		ticket, err := tm.AddTicket(
@@ -183,4 +200,502 @@ func TestTicketManager(t *testing.T) {
 
 	}
 
+	// Responses are returned oldest first
+	{
+		err := tm.AddParentedTicketResponse("Student", "uuid2", uuid2, TicketOpen, "Second response", "Reopened to discuss timetabling.", user)
+		if err != nil {
+			t.Fatalf("tm.AddParentedTicketResponse() failed: %v", err)
+		}
+		responses, err := tm.GetParentedTicketResponses("Student", "uuid2", uuid2, user)
+		if err != nil {
+			t.Fatalf("tm.GetParentedTicketResponses() failed: %v", err)
+		}
+		if len(responses) != 2 {
+			t.Fatalf("tm.GetParentedTicketResponses() expecting 2 responses, not %d", len(responses))
+		}
+		if responses[0].Subject() != "This is a response" || responses[1].Subject() != "Second response" {
+			t.Fatalf("tm.GetParentedTicketResponses() returned responses out of order")
+		}
+		if responses[0].PersonUuid() != user.PersonUuid() {
+			t.Fatalf("tm.GetParentedTicketResponses() did not return the responder %s", user.PersonUuid())
+		}
+		ticket, err := tm.GetTicketWithParent("Student", "uuid2", uuid2, user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketWithParent() failed: %v", err)
+		}
+		if ticket.ResponseCount() != 2 {
+			t.Fatalf("tm.GetTicketWithParent() expecting a response count of 2, not %d", ticket.ResponseCount())
+		}
+	}
+
+	// Search matches stemmed keywords in the subject, message, responses and requester
+	{
+		keyword := RandomString(12)
+		_, err := tm.AddTicket(TicketOpen, EnquiryTicket, "", "Searchable", "Person", "searchable@example.com",
+			"Question about "+keyword, "When do classes start?", nil, []string{"timetable"}, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		other, err := tm.AddTicket(TicketOpen, EnquiryTicket, "", "Other", "Person", "other@example.com",
+			"Another question", "Mentions "+keyword+" in the message, and a class", nil, nil, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+
+		tickets, total, err := tm.SearchTicketsPage(keyword, 0, 10, user)
+		if err != nil {
+			t.Fatalf("tm.SearchTicketsPage() failed: %v", err)
+		}
+		if total != 2 || len(tickets) != 2 {
+			t.Fatalf("tm.SearchTicketsPage() expecting 2 tickets, not %d", total)
+		}
+		if tickets[0].FirstName() != "Searchable" {
+			t.Fatalf("tm.SearchTicketsPage() should rank a subject match first")
+		}
+		tickets, _, err = tm.SearchTicketsPage(keyword+" classes", 0, 10, user)
+		if err != nil {
+			t.Fatalf("tm.SearchTicketsPage() failed: %v", err)
+		}
+		if len(tickets) != 2 {
+			t.Fatalf("tm.SearchTicketsPage() expecting 2 tickets matching \"class\", not %d", len(tickets))
+		}
+		tickets, total, err = tm.SearchTicketsPage(keyword, 1, 10, user)
+		if err != nil || total != 2 || len(tickets) != 1 {
+			t.Fatalf("tm.SearchTicketsPage() expecting the second page to hold 1 of 2 tickets")
+		}
+
+		err = tm.AddTicketResponse(other.Uuid(), TicketOpen, "", "Forwarded to the registrar "+keyword+"x", user)
+		if err != nil {
+			t.Fatalf("tm.AddTicketResponse() failed: %v", err)
+		}
+		tickets, err = tm.SearchTickets(keyword+"x registrar", user)
+		if err != nil {
+			t.Fatalf("tm.SearchTickets() failed: %v", err)
+		}
+		if len(tickets) != 1 || tickets[0].Uuid() != other.Uuid() {
+			t.Fatalf("tm.SearchTickets() should match text in responses")
+		}
+
+		// Reindexing rebuilds the same search terms from the ticket and its responses
+		if count, err := tm.ReindexTickets(user); err != nil || count < 2 {
+			t.Fatalf("tm.ReindexTickets() indexed %d tickets: %v", count, err)
+		}
+		tickets, err = tm.SearchTickets(keyword+"x registrar", user)
+		if err != nil || len(tickets) != 1 || tickets[0].Uuid() != other.Uuid() {
+			t.Fatalf("tm.SearchTickets() should match text in responses after reindexing")
+		}
+	}
+
+	// Internal notes leave the status unchanged, and assignment changes are recorded in the ticket history
+	{
+		tag := RandomString(10)
+		ticket, err := tm.AddTicket(TicketOpen, TechnicalSupportTicket, "", "Desk", "Person", "desk@example.com",
+			"Cannot sign in", "My password does not work", nil, nil, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		if err := tm.AddTicketNote(ticket.Uuid(), "Checked the account, it is locked.", user); err != nil {
+			t.Fatalf("tm.AddTicketNote() failed: %v", err)
+		}
+		responses, err := tm.GetTicketResponses(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketResponses() failed: %v", err)
+		}
+		if len(responses) != 1 || !responses[0].Internal() {
+			t.Fatalf("tm.GetTicketResponses() should return the internal note")
+		}
+
+		me := TicketViewer{Uuid: user.PersonUuid(), DisplayName: user.DisplayName()}
+		err = tm.UpdateTicket("", "", ticket.Uuid(), []string{tag}, []TicketViewer{me}, []TicketViewer{me}, user)
+		if err != nil {
+			t.Fatalf("tm.UpdateTicket() failed: %v", err)
+		}
+		ticket, err = tm.GetTicket(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicket() failed: %v", err)
+		}
+		if ticket.Status() != TicketOpen {
+			t.Fatalf("tm.AddTicketNote() should not change the ticket status")
+		}
+		if len(ticket.AssignedTo()) != 1 || ticket.AssignedTo()[0] != me || len(ticket.WatchedBy()) != 1 {
+			t.Fatalf("tm.UpdateTicket() did not save assignment changes")
+		}
+
+		tickets, err := tm.GetTicketsByAssignee(user.PersonUuid(), user)
+		if err != nil || len(tickets) == 0 {
+			t.Fatalf("tm.GetTicketsByAssignee() should return the assigned ticket. %v", err)
+		}
+		tickets, err = tm.GetTicketsByTag(strings.ToUpper(tag), user)
+		if err != nil || len(tickets) != 1 || tickets[0].Uuid() != ticket.Uuid() {
+			t.Fatalf("tm.GetTicketsByTag() should return the tagged ticket. %v", err)
+		}
+
+		changes, err := am.GetEntityChangeLog(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("GetEntityChangeLog() failed: %v", err)
+		}
+		if len(changes) != 1 {
+			t.Fatalf("tm.UpdateTicket() should record one change in the ticket history, not %d", len(changes))
+		}
+	}
+
+	// Tickets past their action after time are escalated once, and replies from staff are recorded as the first response
+	{
+		past := time.Now().Add(-time.Hour)
+		ticket, err := tm.AddTicket(TicketOpen, TechnicalSupportTicket, "", "Late", "Person", "late@example.com",
+			"Still waiting", "Nobody has replied", &past, nil, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		tickets, err := tm.GetTicketsByActionAfter(time.Now(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketsByActionAfter() failed: %v", err)
+		}
+		found := false
+		for _, i := range tickets {
+			found = found || i.Uuid() == ticket.Uuid()
+		}
+		if !found {
+			t.Fatalf("tm.GetTicketsByActionAfter() should return the overdue ticket")
+		}
+
+		for reason, expected := range map[TicketEscalation]bool{TicketActionAfterEscalation: true, TicketFirstResponseEscalation: true} {
+			escalated, err := tm.EscalateTicket("", "", ticket.Uuid(), reason, []string{"escalated"}, nil, user)
+			if err != nil || escalated != expected {
+				t.Fatalf("tm.EscalateTicket(%s) returned %v %v", reason, escalated, err)
+			}
+			if escalated, _ := tm.EscalateTicket("", "", ticket.Uuid(), reason, []string{"escalated"}, nil, user); escalated {
+				t.Fatalf("tm.EscalateTicket(%s) should only escalate a ticket once", reason)
+			}
+		}
+		if err := tm.AddTicketResponse(ticket.Uuid(), TicketOpen, "", "Looking into it", user); err != nil {
+			t.Fatalf("tm.AddTicketResponse() failed: %v", err)
+		}
+		ticket, err = tm.GetTicket(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicket() failed: %v", err)
+		}
+		if ticket.ActionAfter() != nil || len(ticket.Tags()) != 1 || len(ticket.Escalations()) != 1 {
+			t.Fatalf("tm.EscalateTicket() did not save the escalation")
+		}
+		if ticket.FirstResponse() == nil || ticket.Resolved() != nil {
+			t.Fatalf("tm.AddTicketResponse() should record the first response")
+		}
+	}
+
+	// Inbound email raises a ticket, and replies to it are added as responses
+	{
+		ingester := NewTicketEmailIngester(am, tm)
+		subject := "Email " + RandomString(8)
+		ticket, err := ingester.IngestMessage(TestSite, strings.NewReader("From: Email Person <email.person@example.com>\r\nTo: support@example.com\r\nSubject: "+subject+"\r\n\r\nWhere is my timetable?\r\n"))
+		if err != nil {
+			t.Fatalf("IngestMessage() failed: %v", err)
+		}
+		if ticket == nil || ticket.Subject() != subject || ticket.Email() != "email.person@example.com" || ticket.Message() != "Where is my timetable?" {
+			t.Fatalf("IngestMessage() did not raise a ticket from the message")
+		}
+
+		reply := "From: email.person@example.com\r\nTo: " + TicketReplyAddress("support@example.com", ticket.Uuid()) + "\r\nSubject: Re: " + subject + "\r\n\r\nFound it, thanks.\r\n\r\nOn Monday, Support wrote:\r\n> Try again\r\n"
+		replied, err := ingester.IngestMessage(TestSite, strings.NewReader(reply))
+		if err != nil {
+			t.Fatalf("IngestMessage() failed: %v", err)
+		}
+		if replied == nil || replied.Uuid() != ticket.Uuid() {
+			t.Fatalf("IngestMessage() should add a reply to the ticket it refers to")
+		}
+		responses, err := tm.GetTicketResponses(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketResponses() failed: %v", err)
+		}
+		if len(responses) != 1 || responses[0].Message() != "Found it, thanks." || responses[0].Subject() != "" {
+			t.Fatalf("IngestMessage() did not add the reply as a response")
+		}
+
+		// Someone not involved in the ticket who writes to its reply address only adds a note
+		stranger := "From: stranger@example.com\r\nTo: " + TicketReplyAddress("support@example.com", ticket.Uuid()) + "\r\nSubject: Re: " + subject + "\r\n\r\nPlease close this.\r\n"
+		if _, err := ingester.IngestMessage(TestSite, strings.NewReader(stranger)); err != nil {
+			t.Fatalf("IngestMessage() failed: %v", err)
+		}
+		responses, err = tm.GetTicketResponses(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketResponses() failed: %v", err)
+		}
+		if len(responses) != 2 || !responses[1].Internal() || !strings.HasPrefix(responses[1].Message(), "Email from stranger@example.com") {
+			t.Fatalf("IngestMessage() should add a message from someone not involved in the ticket as an internal note")
+		}
+	}
+
+	// Files attached to responses are stored in the blob store, and rejected if their type is not allowed
+	{
+		tm.SetBlobStore(NewFileBlobStore(t.TempDir()))
+		ticket, err := tm.AddTicket(TicketOpen, TechnicalSupportTicket, "", "Attach", "Person", "attach.person@example.com", "Attachment "+RandomString(8), "See the screenshot", nil, nil, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		png := append([]byte("\x89PNG\x0D\x0A\x1A\x0A"), make([]byte, 100)...)
+		if err := tm.AddParentedTicketResponseWithAttachments("", "", ticket.Uuid(), TicketOpen, "", "Screenshot attached", false, []TicketFile{{Filename: "C:\\Users\\screen.png", Data: png}}, user); err != nil {
+			t.Fatalf("tm.AddParentedTicketResponseWithAttachments() failed: %v", err)
+		}
+		if err := tm.AddParentedTicketResponseWithAttachments("", "", ticket.Uuid(), TicketOpen, "", "", false, []TicketFile{{Filename: "page.png", Data: []byte("<html><script>alert(1)</script></html>")}}, user); err == nil {
+			t.Fatalf("tm.AddParentedTicketResponseWithAttachments() should refuse a html file")
+		}
+		responses, err := tm.GetTicketResponses(ticket.Uuid(), user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketResponses() failed: %v", err)
+		}
+		if len(responses) != 1 || len(responses[0].Attachments()) != 1 {
+			t.Fatalf("tm.AddParentedTicketResponseWithAttachments() should save one response with an attachment")
+		}
+		a := responses[0].Attachments()[0]
+		if a.Filename != "screen.png" || a.ContentType != "image/png" || a.Size != int64(len(png)) {
+			t.Fatalf("tm.AddParentedTicketResponseWithAttachments() saved %+v", a)
+		}
+		found, response, content, err := tm.OpenTicketAttachment("", "", ticket.Uuid(), a.Uuid, user)
+		if err != nil {
+			t.Fatalf("tm.OpenTicketAttachment() failed: %v", err)
+		}
+		if found == nil || response == nil || response.Uuid() != responses[0].Uuid() {
+			t.Fatalf("tm.OpenTicketAttachment() did not find the attachment")
+		}
+		data, _ := io.ReadAll(content)
+		content.Close()
+		if !bytes.Equal(data, png) {
+			t.Fatalf("tm.OpenTicketAttachment() returned different content")
+		}
+	}
+
+	// Requesters see their own tickets, but not internal notes, the queues, or the tickets of others
+	{
+		_, err = am.AddPerson(TestSite, "ticketrequester", "tmp", "ticketrequester.tmp1@example.com", "", HashPassword("tmpA@9040hi"), "127.0.0.1", nil)
+		if err != nil {
+			t.Fatalf("AddPerson() failed: %v", err)
+		}
+		requester, _, err := am.Authenticate(TestSite, "ticketrequester.tmp1@example.com", "tmpA@9040hi", "127.0.0.1", "Safari", "en-AU")
+		if err != nil {
+			t.Fatalf("Authenticate() failed: %v", err)
+		}
+		ticket, err := tm.AddTicket(TicketOpen, TechnicalSupportTicket, requester.PersonUuid(), "", "", "", "Visibility "+RandomString(8), "Where is my timetable?", nil, nil, nil, nil, requester)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		if err := tm.AddTicketNote(ticket.Uuid(), "Requester is a student", user); err != nil {
+			t.Fatalf("tm.AddTicketNote() failed: %v", err)
+		}
+		if err := tm.AddTicketResponse(ticket.Uuid(), TicketOpen, "", "Any news?", requester); err != nil {
+			t.Fatalf("tm.AddTicketResponse() failed: %v", err)
+		}
+		if err := tm.AddTicketNote(ticket.Uuid(), "Note from the requester", requester); err != ErrTicketPermissionDenied {
+			t.Fatalf("tm.AddTicketNote() should refuse a note from the requester: %v", err)
+		}
+		if err := tm.AddTicketResponse(ticket.Uuid(), TicketArchived, "", "Never mind", requester); err != ErrTicketPermissionDenied {
+			t.Fatalf("tm.AddTicketResponse() should refuse a status change by the requester: %v", err)
+		}
+
+		responses, err := tm.GetTicketResponses(ticket.Uuid(), requester)
+		if err != nil {
+			t.Fatalf("tm.GetTicketResponses() failed: %v", err)
+		}
+		if len(responses) != 1 || responses[0].Internal() {
+			t.Fatalf("tm.GetTicketResponses() should hide internal notes from the requester")
+		}
+		if responses, _ := tm.GetTicketResponses(ticket.Uuid(), user); len(responses) != 2 {
+			t.Fatalf("tm.GetTicketResponses() should show internal notes to support staff")
+		}
+
+		other, err := tm.AddTicket(TicketOpen, EnquiryTicket, "", "Someone", "Else", "someone.else@example.com", "Other "+RandomString(8), "Hello", nil, nil, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		if _, err := tm.GetTicket(other.Uuid(), requester); err != ErrTicketPermissionDenied {
+			t.Fatalf("tm.GetTicket() should refuse the ticket of another person: %v", err)
+		}
+		if found, err := tm.GetTicket(ticket.Uuid(), requester); err != nil || found == nil {
+			t.Fatalf("tm.GetTicket() should return the requester's own ticket: %v", err)
+		}
+		if _, err := tm.GetTicketsByStatus(TicketOpen, requester); err != ErrTicketPermissionDenied {
+			t.Fatalf("tm.GetTicketsByStatus() should only be available to support staff: %v", err)
+		}
+		if tickets, err := tm.GetTicketsByEmail("someone.else@example.com", requester); err != nil || len(tickets) != 0 {
+			t.Fatalf("tm.GetTicketsByEmail() should not return the tickets of another person: %v", err)
+		}
+		if err := tm.UpdateTicket("", "", ticket.Uuid(), []string{"urgent"}, nil, nil, requester); err != ErrTicketPermissionDenied {
+			t.Fatalf("tm.UpdateTicket() should only be available to support staff: %v", err)
+		}
+		watcher := []TicketViewer{{Uuid: user.PersonUuid(), DisplayName: user.DisplayName()}}
+		if _, err := tm.AddTicket(TicketOpen, TechnicalSupportTicket, requester.PersonUuid(), "", "", "", "Watched", "Hello", nil, nil, nil, watcher, requester); err != ErrTicketPermissionDenied {
+			t.Fatalf("tm.AddTicket() should not let a requester add someone else as a watcher: %v", err)
+		}
+		closed, err := tm.AddTicket(TicketArchived, TechnicalSupportTicket, requester.PersonUuid(), "", "", "", "Closed", "Hello", nil, nil, nil, nil, requester)
+		if err != nil || closed.Status() != TicketOpen {
+			t.Fatalf("tm.AddTicket() should raise a requester's ticket in the first status: %v", err)
+		}
+	}
+
+	// Queries combine filters, and page through every matching ticket with a cursor
+	{
+		tag := "page" + strings.ToLower(RandomString(8))
+		for i := 0; i < 3; i++ {
+			if _, err := tm.AddTicket(TicketOpen, EnquiryTicket, "", "Page", "Person", "page.person@example.com", "Page "+RandomString(8), "Hello", nil, []string{tag}, nil, nil, user); err != nil {
+				t.Fatalf("tm.AddTicket() failed: %v", err)
+			}
+		}
+		if _, err := tm.AddTicket(TicketArchived, EnquiryTicket, "", "Page", "Person", "page.person@example.com", "Page "+RandomString(8), "Hello", nil, []string{tag}, nil, nil, user); err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		filter := TicketFilter{Status: TicketOpen, Tag: tag}
+		first, cursor, err := tm.QueryTickets(filter, "", 2, user)
+		if err != nil {
+			t.Fatalf("tm.QueryTickets() failed: %v", err)
+		}
+		if len(first) != 2 || cursor == "" {
+			t.Fatalf("tm.QueryTickets() should return a full page and a cursor, returned %d tickets", len(first))
+		}
+		second, cursor, err := tm.QueryTickets(filter, cursor, 2, user)
+		if err != nil {
+			t.Fatalf("tm.QueryTickets() failed: %v", err)
+		}
+		if len(second) != 1 || cursor != "" || second[0].Uuid() == first[0].Uuid() || second[0].Uuid() == first[1].Uuid() {
+			t.Fatalf("tm.QueryTickets() should return the last open ticket on the second page")
+		}
+		if !first[0].Created().After(*first[1].Created()) || second[0].Updated() == nil {
+			t.Fatalf("tm.QueryTickets() should return the newest tickets first")
+		}
+	}
+
+	// Duplicate tickets are merged, responses are split out, and tickets are linked
+	{
+		duplicate, err := tm.AddTicket(TicketOpen, EnquiryTicket, "", "Merge", "Person", "merge.person@example.com", "Duplicate "+RandomString(8), "Is the library open?", nil, []string{"library"}, nil, []TicketViewer{{Uuid: "watcher", DisplayName: "Watcher"}}, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+		if _, err := tm.AddTicketAttachments("", "", duplicate.Uuid(), []TicketFile{{Filename: "map.txt", Data: []byte("Level 2")}}, user); err != nil {
+			t.Fatalf("tm.AddTicketAttachments() failed: %v", err)
+		}
+		if err := tm.AddTicketResponse(duplicate.Uuid(), TicketOpen, "", "On Sunday?", user); err != nil {
+			t.Fatalf("tm.AddTicketResponse() failed: %v", err)
+		}
+		survivor, err := tm.AddTicket(TicketOpen, EnquiryTicket, "", "Merge", "Person", "merge.person@example.com", "Library "+RandomString(8), "When is the library open?", nil, []string{"Hours"}, nil, nil, user)
+		if err != nil {
+			t.Fatalf("tm.AddTicket() failed: %v", err)
+		}
+
+		if err := tm.MergeTicket("", "", duplicate.Uuid(), "", "", survivor.Uuid(), user); err != nil {
+			t.Fatalf("tm.MergeTicket() failed: %v", err)
+		}
+		if err := tm.MergeTicket("", "", duplicate.Uuid(), "", "", survivor.Uuid(), user); err == nil {
+			t.Fatalf("tm.MergeTicket() should refuse a ticket that is already merged")
+		}
+		stub, _ := tm.GetTicket(duplicate.Uuid(), user)
+		if stub.MergedInto() == nil || stub.MergedInto().Uuid != survivor.Uuid() || stub.Status() != TicketArchived || stub.ResponseCount() != 0 {
+			t.Fatalf("tm.MergeTicket() should leave a closed ticket pointing to the survivor")
+		}
+		if responses, _ := tm.GetTicketResponses(duplicate.Uuid(), user); len(responses) != 0 {
+			t.Fatalf("tm.MergeTicket() should move the responses of the merged ticket")
+		}
+		merged, _ := tm.GetTicket(survivor.Uuid(), user)
+		if len(merged.Tags()) != 2 || !hasTicketViewer(merged.WatchedBy(), "watcher") || merged.ResponseCount() != 2 || len(merged.Links()) != 1 || merged.Links()[0].Type != TicketDuplicatedByLink {
+			t.Fatalf("tm.MergeTicket() should move the tags, watchers and responses to the survivor")
+		}
+		responses, err := tm.GetTicketResponses(survivor.Uuid(), user)
+		if err != nil || len(responses) != 2 {
+			t.Fatalf("tm.GetTicketResponses() failed: %v", err)
+		}
+		if responses[0].Message() != "Is the library open?" || len(responses[0].Attachments()) != 1 {
+			t.Fatalf("tm.MergeTicket() should add the merged message, and its files, as a response")
+		}
+		a, _, content, err := tm.OpenTicketAttachment("", "", survivor.Uuid(), responses[0].Attachments()[0].Uuid, user)
+		if err != nil || a == nil {
+			t.Fatalf("tm.OpenTicketAttachment() should find the moved file: %v", err)
+		}
+		content.Close()
+
+		split, err := tm.SplitTicketResponse("", "", survivor.Uuid(), responses[1].Uuid(), "Sunday hours", user)
+		if err != nil {
+			t.Fatalf("tm.SplitTicketResponse() failed: %v", err)
+		}
+		if split.Message() != "On Sunday?" || split.Email() != "merge.person@example.com" || split.Links()[0].Type != TicketSplitFromLink {
+			t.Fatalf("tm.SplitTicketResponse() should raise a ticket for the same requester")
+		}
+		if remaining, _ := tm.GetTicketResponses(survivor.Uuid(), user); len(remaining) != 1 {
+			t.Fatalf("tm.SplitTicketResponse() should remove the response from the original ticket")
+		}
+
+		if err := tm.LinkTickets("", "", split.Uuid(), TicketBlocksLink, "", "", survivor.Uuid(), user); err != nil {
+			t.Fatalf("tm.LinkTickets() failed: %v", err)
+		}
+		linked, _ := tm.GetTicket(survivor.Uuid(), user)
+		if l := findTicketLink(linked.Links(), split.Uuid()); l == nil || l.Type != TicketBlockedByLink {
+			t.Fatalf("tm.LinkTickets() should add the inverse relation to the other ticket")
+		}
+		if err := tm.UnlinkTickets("", "", survivor.Uuid(), split.Uuid(), user); err != nil {
+			t.Fatalf("tm.UnlinkTickets() failed: %v", err)
+		}
+		if unlinked, _ := tm.GetTicket(split.Uuid(), user); len(unlinked.Links()) != 0 {
+			t.Fatalf("tm.UnlinkTickets() should remove the link from both tickets")
+		}
+		changeLog, err := am.GetEntityChangeLog(survivor.Uuid(), user)
+		if err != nil || len(changeLog) < 4 {
+			t.Fatalf("Merging, splitting and linking should be recorded in the change log: %v", err)
+		}
+	}
+
+	// Notification preferences are found by email address, or by their token
+	{
+		email := "notify." + strings.ToLower(RandomString(8)) + "@example.com"
+		preference, err := tm.GetTicketNotificationPreference(email, user)
+		if err != nil {
+			t.Fatalf("tm.GetTicketNotificationPreference() failed: %v", err)
+		}
+		if !preference.Wants(TicketReplyEvent) || preference.Token != "" {
+			t.Fatalf("tm.GetTicketNotificationPreference() should default to all notifications")
+		}
+		preference.OptOut = []TicketEvent{TicketReplyEvent}
+		if err := tm.PutTicketNotificationPreference(preference, user); err != nil {
+			t.Fatalf("tm.PutTicketNotificationPreference() failed: %v", err)
+		}
+		found, err := tm.GetTicketNotificationPreferenceByToken(preference.Token, am.GuestSession(TestSite, "127.0.0.1", "", ""))
+		if err != nil {
+			t.Fatalf("tm.GetTicketNotificationPreferenceByToken() failed: %v", err)
+		}
+		if found == nil || found.Email != email || found.Wants(TicketReplyEvent) || !found.Wants(TicketStatusEvent) {
+			t.Fatalf("tm.GetTicketNotificationPreferenceByToken() did not return the saved preference")
+		}
+	}
+
+}
+
+func TestSearchTerms(t *testing.T) {
+	terms := strings.Join(SearchTerms("The Student's enrolments were SUBMITTED, and re-submitting isn't needed.", "Bob.Smith@Example.com"), " ")
+	expected := "student enrolment were submit re isnt need bob.smith@example.com example.com bob smith example com"
+	if terms != expected {
+		t.Fatalf("SearchTerms() returned \"%s\", expected \"%s\"", terms, expected)
+	}
+
+	for word, stem := range map[string]string{"classes": "class", "studies": "study", "running": "run", "quickly": "quick", "bus": "bus", "status": "status", "2019": "2019", "ελληνικά": "ελληνικά"} {
+		if s := Stem(word); s != stem {
+			t.Fatalf("Stem(\"%s\") returned \"%s\", expected \"%s\"", word, s, stem)
+		}
+	}
+}
+
+func TestTicketFilterQuery(t *testing.T) {
+	now := time.Now()
+	for _, f := range []TicketFilter{
+		{},
+		{Status: TicketOpen, Type: EnquiryTicket, Tag: " Urgent ", AssignedTo: "a", PersonUuid: "p", Email: "e@example.com"},
+		{ParentType: "Person", ParentUuid: "1", CreatedAfter: &now, CreatedBefore: &now},
+		{UpdatedAfter: &now},
+	} {
+		if _, err := ticketFilterQuery(f, "example.com"); err != nil {
+			t.Fatalf("ticketFilterQuery(%+v) failed: %v", f, err)
+		}
+	}
+	for _, f := range []TicketFilter{
+		{ParentType: "Person"},
+		{CreatedAfter: &now, UpdatedBefore: &now},
+	} {
+		if _, err := ticketFilterQuery(f, "example.com"); err == nil {
+			t.Fatalf("ticketFilterQuery(%+v) should fail", f)
+		}
+	}
 }
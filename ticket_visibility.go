@@ -0,0 +1,83 @@
+package security
+
+import (
+	"errors"
+	"strings"
+)
+
+// Tickets are visible to the support desk, and to the people involved in them. People with
+// the support role see every ticket and work the queues. Anyone else sees only the tickets
+// they raised, are assigned to or watch, and never sees internal notes.
+const TicketSupportRole = "s5"
+
+var ErrTicketPermissionDenied = errors.New("Permission denied.")
+
+// isTicketSupport reports if a session belongs to support desk staff.
+func isTicketSupport(session Session) bool {
+	return session != nil && session.HasRole(TicketSupportRole)
+}
+
+// canViewTicket reports if a session may see a ticket and the responses to it.
+func canViewTicket(session Session, ticket Ticket) bool {
+	if session == nil || ticket == nil {
+		return false
+	}
+	if isTicketSupport(session) {
+		return true
+	}
+	if isTicketRequester(session, ticket) {
+		return true
+	}
+	if session.PersonUuid() == "" {
+		return false
+	}
+	return hasTicketViewer(ticket.AssignedTo(), session.PersonUuid()) || hasTicketViewer(ticket.WatchedBy(), session.PersonUuid())
+}
+
+// isTicketRequester reports if a session belongs to the person who raised a ticket.
+func isTicketRequester(session Session, ticket Ticket) bool {
+	if session.PersonUuid() != "" && session.PersonUuid() == ticket.PersonUuid() {
+		return true
+	}
+	return session.IsAuthenticated() && ticket.Email() != "" && strings.EqualFold(session.Email(), ticket.Email())
+}
+
+// isPersonalTicketFilter reports if a filter is limited to the tickets of the person a
+// session belongs to, or to those of a parent record.
+func isPersonalTicketFilter(f TicketFilter, session Session) bool {
+	if f.ParentType != "" {
+		return true
+	}
+	if session.PersonUuid() != "" && (f.PersonUuid == session.PersonUuid() || f.AssignedTo == session.PersonUuid()) {
+		return true
+	}
+	return session.IsAuthenticated() && f.Email != "" && strings.EqualFold(f.Email, session.Email())
+}
+
+// visibleTickets returns the tickets a session may see.
+func visibleTickets(session Session, tickets []Ticket) []Ticket {
+	if isTicketSupport(session) {
+		return tickets
+	}
+	var visible []Ticket
+	for _, t := range tickets {
+		if canViewTicket(session, t) {
+			visible = append(visible, t)
+		}
+	}
+	return visible
+}
+
+// visibleTicketResponses removes internal notes from the responses seen by anyone other than support desk staff.
+func visibleTicketResponses(session Session, responses []TicketResponse) []TicketResponse {
+	if isTicketSupport(session) {
+		return responses
+	}
+	var visible []TicketResponse
+	for _, r := range responses {
+		if !r.Internal() {
+			visible = append(visible, r)
+		}
+	}
+	return visible
+}
@@ -0,0 +1,59 @@
+package security
+
+import (
+	"testing"
+)
+
+func TestTicketVisibility(t *testing.T) {
+	support := &GaeSession{personUUID: "staff", authenticated: true, roles: "s1:s5"}
+	requester := &GaeSession{personUUID: "requester", email: "requester@example.com", authenticated: true}
+	byEmail := &GaeSession{personUUID: "other", email: "Guest@Example.com", authenticated: true}
+	watcher := &GaeSession{personUUID: "watcher", authenticated: true}
+	stranger := &GaeSession{personUUID: "stranger", email: "stranger@example.com", authenticated: true}
+	guest := &GaeSession{email: "guest@example.com"}
+
+	raised := &GaeTicket{uuid: "1", personUuid: "requester"}
+	emailed := &GaeTicket{uuid: "2", email: "guest@example.com", watchedBy: []TicketViewer{{Uuid: "watcher"}}}
+
+	for _, c := range []struct {
+		session Session
+		ticket  Ticket
+		visible bool
+	}{
+		{support, raised, true},
+		{support, emailed, true},
+		{requester, raised, true},
+		{requester, emailed, false},
+		{byEmail, emailed, true}, // Email addresses match regardless of case
+		{watcher, emailed, true},
+		{watcher, raised, false},
+		{stranger, raised, false},
+		{guest, emailed, false}, // Email is only trusted once authenticated
+	} {
+		if canViewTicket(c.session, c.ticket) != c.visible {
+			t.Fatalf("canViewTicket(%s, %s) should return %v", c.session.PersonUuid(), c.ticket.Uuid(), c.visible)
+		}
+	}
+
+	if tickets := visibleTickets(requester, []Ticket{raised, emailed}); len(tickets) != 1 || tickets[0].Uuid() != "1" {
+		t.Fatalf("visibleTickets() should only return the tickets raised by the requester")
+	}
+	if tickets := visibleTickets(support, []Ticket{raised, emailed}); len(tickets) != 2 {
+		t.Fatalf("visibleTickets() should return every ticket to support staff")
+	}
+
+	if !isPersonalTicketFilter(TicketFilter{PersonUuid: "requester"}, requester) || !isPersonalTicketFilter(TicketFilter{Email: "guest@example.com"}, byEmail) {
+		t.Fatalf("isPersonalTicketFilter() should allow a person to query their own tickets")
+	}
+	if isPersonalTicketFilter(TicketFilter{Status: TicketOpen}, requester) || isPersonalTicketFilter(TicketFilter{Email: "guest@example.com"}, guest) {
+		t.Fatalf("isPersonalTicketFilter() should not allow a queue to be queried")
+	}
+
+	responses := []TicketResponse{&GaeTicketResponse{uuid: "reply"}, &GaeTicketResponse{uuid: "note", internal: true}}
+	if visible := visibleTicketResponses(requester, responses); len(visible) != 1 || visible[0].Uuid() != "reply" {
+		t.Fatalf("visibleTicketResponses() should hide internal notes from the requester")
+	}
+	if visible := visibleTicketResponses(support, responses); len(visible) != 2 {
+		t.Fatalf("visibleTicketResponses() should show internal notes to support staff")
+	}
+}
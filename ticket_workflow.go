@@ -0,0 +1,309 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Ticket statuses and types are defined per site by the "ticket.status" and "ticket.type"
+// picklists. The statuses that count as open, and the changes of status staff may make,
+// are set by the "ticket.status.open" and "ticket.status.transitions" settings.
+const (
+	TicketStatusPicklist = "ticket.status"
+	TicketTypePicklist   = "ticket.type"
+)
+
+var ErrInvalidTicketStatus = errors.New("Please select a valid ticket status.")
+var ErrInvalidTicketType = errors.New("Please select a valid ticket type.")
+var ErrTicketStatusChange = errors.New("The ticket can not be changed to that status.")
+
+// TicketStatusOption describes a ticket status available on a site.
+type TicketStatusOption struct {
+	Status      TicketStatus
+	Name        string
+	Description string
+	Open        bool // Open tickets are yet to be resolved
+	Deprecated  bool // Deprecated statuses are kept for existing tickets, but can not be chosen
+}
+
+// TicketTypeOption describes a type of ticket available on a site.
+type TicketTypeOption struct {
+	Type        TicketType
+	Name        string
+	Description string
+	Deprecated  bool
+}
+
+// DefaultTicketStatuses are used by sites without a "ticket.status" picklist.
+var DefaultTicketStatuses = []TicketStatusOption{
+	{Status: TicketOpen, Name: "Open", Description: "Awaiting a response from support staff"},
+	{Status: TicketArchived, Name: "Archived", Description: "Resolved, and no further action is needed"},
+	{Status: TicketDeleted, Name: "Deleted", Description: "Raised in error, or spam"},
+}
+
+// DefaultTicketTypes are used by sites without a "ticket.type" picklist.
+var DefaultTicketTypes = []TicketTypeOption{
+	{Type: EnquiryTicket, Name: "Enquiry", Description: "General enquiry"},
+	{Type: TechnicalSupportTicket, Name: "Technical Support", Description: "General support request"},
+	{Type: FeedbackTicket, Name: "Feedback", Description: "General feedback comment"},
+	{Type: ComplaintTicket, Name: "Complaint", Description: "Customer complaint"},
+}
+
+// TicketWorkflow holds the ticket statuses and types of a site, and the changes of
+// status allowed between them.
+type TicketWorkflow struct {
+	Statuses []TicketStatusOption
+	Types    []TicketTypeOption
+
+	// transitions lists the statuses each status may change to. A status without an
+	// entry may change to any other.
+	transitions map[TicketStatus][]TicketStatus
+}
+
+// GetTicketWorkflow reads the ticket workflow of a site from its picklists and settings. The
+// picklist store may be nil, in which case the default statuses and types are used.
+func GetTicketWorkflow(s Setting, ps PicklistStore, site string) (*TicketWorkflow, error) {
+	w := &TicketWorkflow{}
+
+	if ps != nil {
+		statuses, err := ps.GetPicklistOrdered(site, TicketStatusPicklist)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range statuses {
+			w.Statuses = append(w.Statuses, TicketStatusOption{Status: TicketStatus(i.GetKey()), Name: i.GetValue(), Description: i.GetDescription(), Deprecated: i.IsDeprecated()})
+		}
+		types, err := ps.GetPicklistOrdered(site, TicketTypePicklist)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range types {
+			w.Types = append(w.Types, TicketTypeOption{Type: TicketType(i.GetKey()), Name: i.GetValue(), Description: i.GetDescription(), Deprecated: i.IsDeprecated()})
+		}
+	}
+	if len(w.Statuses) == 0 {
+		w.Statuses = append(w.Statuses, DefaultTicketStatuses...)
+	}
+	if len(w.Types) == 0 {
+		w.Types = append(w.Types, DefaultTicketTypes...)
+	}
+
+	open := settingList(s, site, "ticket.status.open")
+	for i := range w.Statuses {
+		for _, o := range open {
+			if strings.EqualFold(o, string(w.Statuses[i].Status)) {
+				w.Statuses[i].Open = true
+			}
+		}
+	}
+
+	var err error
+	w.transitions, err = parseTicketTransitions(settingValue(s, site, "ticket.status.transitions", ""))
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// parseTicketTransitions reads changes of status written as "open=pending,archived; pending=open".
+func parseTicketTransitions(value string) (map[TicketStatus][]TicketStatus, error) {
+	transitions := make(map[TicketStatus][]TicketStatus)
+	for _, entry := range splitSettingList(value) {
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("Status transition \"%s\" must be written as status=status,status", entry)
+		}
+		from := TicketStatus(strings.ToLower(strings.TrimSpace(entry[:i])))
+		transitions[from] = []TicketStatus{}
+		for _, to := range strings.Split(entry[i+1:], ",") {
+			if to = strings.ToLower(strings.TrimSpace(to)); to != "" {
+				transitions[from] = append(transitions[from], TicketStatus(to))
+			}
+		}
+	}
+	return transitions, nil
+}
+
+func (w *TicketWorkflow) status(status TicketStatus) *TicketStatusOption {
+	for i := range w.Statuses {
+		if w.Statuses[i].Status == status {
+			return &w.Statuses[i]
+		}
+	}
+	return nil
+}
+
+// IsOpen reports if tickets with a status are yet to be resolved.
+func (w *TicketWorkflow) IsOpen(status TicketStatus) bool {
+	o := w.status(status)
+	return o != nil && o.Open
+}
+
+// OpenStatuses lists the statuses of tickets yet to be resolved.
+func (w *TicketWorkflow) OpenStatuses() []TicketStatus {
+	var open []TicketStatus
+	for _, o := range w.Statuses {
+		if o.Open {
+			open = append(open, o.Status)
+		}
+	}
+	return open
+}
+
+// DefaultStatus is the status given to new tickets, and to tickets reopened by a reply
+// from their requester. It is the first open status.
+func (w *TicketWorkflow) DefaultStatus() TicketStatus {
+	for _, o := range w.Statuses {
+		if o.Open && !o.Deprecated {
+			return o.Status
+		}
+	}
+	return TicketOpen
+}
+
+// ClosedStatus is given to tickets merged into another. It is the first resolved status.
+func (w *TicketWorkflow) ClosedStatus() TicketStatus {
+	for _, o := range w.Statuses {
+		if !o.Open && !o.Deprecated {
+			return o.Status
+		}
+	}
+	return TicketArchived
+}
+
+// ValidStatus reports if a status may be chosen.
+func (w *TicketWorkflow) ValidStatus(status TicketStatus) bool {
+	o := w.status(status)
+	return o != nil && !o.Deprecated
+}
+
+// CanChange reports if staff may change a ticket from one status to another. A ticket may
+// always keep its status.
+func (w *TicketWorkflow) CanChange(from, to TicketStatus) bool {
+	if from == to {
+		return true
+	}
+	if !w.ValidStatus(to) {
+		return false
+	}
+	allowed, found := w.transitions[from]
+	if !found {
+		return true
+	}
+	for _, s := range allowed {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// NextStatuses lists the statuses a ticket may be changed to, including its current status.
+func (w *TicketWorkflow) NextStatuses(from TicketStatus) []TicketStatusOption {
+	var next []TicketStatusOption
+	for _, o := range w.Statuses {
+		if w.CanChange(from, o.Status) {
+			next = append(next, o)
+		}
+	}
+	return next
+}
+
+// StatusName returns the name of a status, or the status itself if it is unknown.
+func (w *TicketWorkflow) StatusName(status TicketStatus) string {
+	if o := w.status(status); o != nil && o.Name != "" {
+		return o.Name
+	}
+	return string(status)
+}
+
+// ValidType reports if a type of ticket may be chosen.
+func (w *TicketWorkflow) ValidType(ticketType TicketType) bool {
+	for _, o := range w.Types {
+		if o.Type == ticketType {
+			return !o.Deprecated
+		}
+	}
+	return false
+}
+
+// definesType reports if a site has a type of ticket, even if it is deprecated. The types
+// once built in to the package are always defined, so that existing callers still work.
+func (w *TicketWorkflow) definesType(ticketType TicketType) bool {
+	for _, o := range append(w.Types[:len(w.Types):len(w.Types)], legacyTicketTypes...) {
+		if o.Type == ticketType {
+			return true
+		}
+	}
+	return false
+}
+
+// TypeName returns the name of a type of ticket, or the type itself if it is unknown.
+func (w *TicketWorkflow) TypeName(ticketType TicketType) string {
+	for _, o := range w.Types {
+		if o.Type == ticketType && o.Name != "" {
+			return o.Name
+		}
+	}
+	return string(ticketType)
+}
+
+// legacyTicketTypes were once the only types of ticket. They are kept as deprecated
+// picklist items so that existing tickets still show a name.
+var legacyTicketTypes = []TicketTypeOption{
+	{Type: CourseEnrolmentTicket, Name: "Course Enrolment", Deprecated: true},
+	{Type: SubjectEnrolmentTicket, Name: "Subject Enrolment", Deprecated: true},
+	{Type: AcademicTicket, Name: "Academic", Deprecated: true},
+}
+
+// prefilTicketPicklists adds the default ticket statuses and types to the picklists of a
+// site. Picklist items first seeded for ticket types, whose codes no ticket uses, are
+// deprecated if they have not been changed.
+func prefilTicketPicklists(site string, ps PicklistStore) error {
+	for i, o := range DefaultTicketStatuses {
+		if err := addMissingPicklistItem(site, ps, TicketStatusPicklist, string(o.Status), o.Name, o.Description, int64(i+1), false); err != nil {
+			return err
+		}
+	}
+	types := append(DefaultTicketTypes[:len(DefaultTicketTypes):len(DefaultTicketTypes)], legacyTicketTypes...)
+	for i, o := range types {
+		if err := addMissingPicklistItem(site, ps, TicketTypePicklist, string(o.Type), o.Name, o.Description, int64(i+1), o.Deprecated); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range map[string]string{"f": "Feedback", "s": "Technical Support", "c": "Complaint"} {
+		i, err := ps.GetPicklistItem(site, TicketTypePicklist, key)
+		if err != nil {
+			return err
+		}
+		if i != nil && i.GetValue() == value && !i.IsDeprecated() {
+			if err := ps.DeprecatePicklistItem(site, TicketTypePicklist, key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func addMissingPicklistItem(site string, ps PicklistStore, picklist, key, value, description string, index int64, deprecated bool) error {
+	if i, err := ps.GetPicklistItem(site, picklist, key); err != nil || (i != nil && i.GetValue() != "") {
+		return err
+	}
+	if deprecated {
+		return ps.AddPicklistItemDeprecated(site, picklist, key, value, description, index)
+	}
+	return ps.AddPicklistItem(site, picklist, key, value, description, index)
+}
+
+func init() {
+	RegisterSetting(SettingDefinition{Name: "ticket.status.open", Type: SettingList, Default: string(TicketOpen),
+		Description: "Ticket statuses that count as open, separated by semicolons. Tickets with other statuses are resolved."})
+	RegisterSetting(SettingDefinition{Name: "ticket.status.transitions", Type: SettingList,
+		Description: "Changes of ticket status staff may make, i.e. \"open=pending,archived; pending=open,archived; archived=open\". A status not listed may change to any other.",
+		Validate: func(value string) error {
+			_, err := parseTicketTransitions(value)
+			return err
+		}})
+}
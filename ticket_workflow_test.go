@@ -0,0 +1,82 @@
+package security
+
+import (
+	"testing"
+)
+
+// workflowTestPicklists provides the PicklistStore methods used by GetTicketWorkflow
+type workflowTestPicklists struct {
+	PicklistStore
+	items map[string][]PicklistItem
+}
+
+func (p *workflowTestPicklists) GetPicklistOrdered(site, picklist string) ([]PicklistItem, error) {
+	return p.items[picklist], nil
+}
+
+func TestTicketWorkflow(t *testing.T) {
+	// Sites without picklists use the default statuses and types
+	w, err := GetTicketWorkflow(&schemaTestSetting{values: map[string]string{}}, nil, "example.com")
+	if err != nil {
+		t.Fatalf("GetTicketWorkflow() failed: %v", err)
+	}
+	if w.DefaultStatus() != TicketOpen || !w.IsOpen(TicketOpen) || w.IsOpen(TicketArchived) || w.TypeName(TechnicalSupportTicket) != "Technical Support" {
+		t.Fatalf("GetTicketWorkflow() did not use the default workflow: %+v", w)
+	}
+	if !w.CanChange(TicketArchived, TicketDeleted) || w.CanChange(TicketOpen, "pending") {
+		t.Fatalf("CanChange() should allow any change to a known status")
+	}
+
+	ps := &workflowTestPicklists{items: map[string][]PicklistItem{
+		TicketStatusPicklist: {
+			&GaePicklistItem{TicketStatusPicklist, "new", "New", "", false, 1},
+			&GaePicklistItem{TicketStatusPicklist, "pending", "Waiting on customer", "", false, 2},
+			&GaePicklistItem{TicketStatusPicklist, "closed", "Closed", "", false, 3},
+			&GaePicklistItem{TicketStatusPicklist, "archived", "Archived", "", true, 4},
+		},
+		TicketTypePicklist: {
+			&GaePicklistItem{TicketTypePicklist, "billing", "Billing", "", false, 1},
+			&GaePicklistItem{TicketTypePicklist, "course", "Course Enrolment", "", true, 2},
+		},
+	}}
+	s := &schemaTestSetting{values: map[string]string{
+		"ticket.status.open":        "new; pending",
+		"ticket.status.transitions": "new=pending,closed; closed=new",
+	}}
+	w, err = GetTicketWorkflow(s, ps, "example.com")
+	if err != nil {
+		t.Fatalf("GetTicketWorkflow() failed: %v", err)
+	}
+	if w.DefaultStatus() != "new" || !w.IsOpen("pending") || w.IsOpen("closed") || len(w.OpenStatuses()) != 2 || w.ClosedStatus() != "closed" {
+		t.Fatalf("GetTicketWorkflow() did not read the open statuses: %+v", w)
+	}
+	for _, c := range []struct {
+		from, to TicketStatus
+		allowed  bool
+	}{
+		{"new", "pending", true},
+		{"new", "closed", true},
+		{"closed", "pending", false},
+		{"pending", "closed", true}, // No transitions are listed for pending
+		{"archived", "archived", true},
+		{"archived", "new", true},
+		{"new", "archived", false}, // Deprecated
+	} {
+		if w.CanChange(c.from, c.to) != c.allowed {
+			t.Fatalf("CanChange(%s, %s) should return %v", c.from, c.to, c.allowed)
+		}
+	}
+	if next := w.NextStatuses("closed"); len(next) != 2 || next[0].Status != "new" || next[1].Status != "closed" {
+		t.Fatalf("NextStatuses() returned %+v", next)
+	}
+	if w.ValidType("course") || !w.ValidType("billing") || w.TypeName("course") != "Course Enrolment" || w.StatusName("pending") != "Waiting on customer" {
+		t.Fatalf("GetTicketWorkflow() did not read the ticket types: %+v", w.Types)
+	}
+	if !w.definesType("course") || !w.definesType(AcademicTicket) || w.definesType("nosuchtype") {
+		t.Fatalf("definesType() should accept deprecated and legacy types only")
+	}
+
+	if err := ValidateSetting("ticket.status.transitions", "open pending"); err == nil {
+		t.Fatalf("ValidateSetting() should reject an invalid transition")
+	}
+}
@@ -0,0 +1,132 @@
+package security
+
+import (
+	"time"
+)
+
+// TokenBucketThrottle limits the rate of events using the generic cell rate
+// algorithm (GCRA), which behaves like a token bucket that holds Attempts
+// tokens and refills at a rate of Attempts tokens per Window. Unlike the
+// attempt counting throttles there is no fixed lockout, a key becomes usable
+// again as soon as one token has been refilled. This suits request rate
+// limiting, where steady traffic should be allowed while bursts are not.
+//
+// Each key stores a single theoretical arrival time (TAT). Every event moves
+// the TAT one emission interval (Window/Attempts) into the future, and the
+// key is throttled while the TAT is more than one Window ahead of now.
+type TokenBucketThrottle struct {
+	settings Setting
+	shards   throttleShards
+
+	// Policy used for keys not created with ThrottleKey()
+	Window   int64
+	Attempts int64
+}
+
+func NewTokenBucketThrottle(settings Setting) Throttle {
+	t := &TokenBucketThrottle{
+		settings: settings,
+		Window:   60,
+		Attempts: 3, // Default to a burst of three, refilling at three per minute.
+	}
+	t.shards.init()
+	return t
+}
+
+func (t *TokenBucketThrottle) policy(key string) ThrottlePolicy {
+	return ThrottlePolicyForKey(t.settings, key, ThrottlePolicy{
+		Attempts: t.Attempts,
+		Window:   t.Window,
+	})
+}
+
+func (t *TokenBucketThrottle) IsThrottled(key string) (bool, error) {
+	status, err := t.Status(key)
+	if err != nil {
+		return false, err
+	}
+	return status.Throttled, nil
+}
+
+func (t *TokenBucketThrottle) Status(key string) (*ThrottleStatus, error) {
+	policy := t.policy(key)
+	now := time.Now()
+
+	shard := t.shards.get(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.evict(now.Unix())
+
+	var tat int64
+	if item, found := shard.items[key]; found {
+		tat = item.tat
+	}
+	return gcraStatus(policy, tat, now.UnixNano()), nil
+}
+
+// Increment takes a token from the bucket. Events that arrive while the key
+// is throttled are not counted, so the key unlocks on schedule even while a
+// client continues to retry.
+func (t *TokenBucketThrottle) Increment(key string) error {
+	policy := t.policy(key)
+	now := time.Now()
+
+	shard := t.shards.get(key)
+	shard.Lock()
+	defer shard.Unlock()
+	shard.evict(now.Unix())
+
+	item, found := shard.items[key]
+	if !found {
+		item = &memoryThrottleItem{}
+		shard.items[key] = item
+	}
+
+	window, interval := gcraPeriods(policy)
+	tat := item.tat
+	if tat < now.UnixNano() {
+		tat = now.UnixNano()
+	}
+	if tat-now.UnixNano() > window {
+		return nil
+	}
+	item.tat = tat + interval
+	item.expires = item.tat/int64(time.Second) + 1
+	return nil
+}
+
+func (t *TokenBucketThrottle) Clear(key string) error {
+	shard := t.shards.get(key)
+	shard.Lock()
+	defer shard.Unlock()
+	delete(shard.items, key)
+	return nil
+}
+
+// gcraPeriods returns the window and emission interval of a policy in nanoseconds
+func gcraPeriods(policy ThrottlePolicy) (window int64, interval int64) {
+	attempts := policy.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	window = policy.Window * int64(time.Second)
+	return window, window / attempts
+}
+
+// gcraStatus reports the tokens remaining in a bucket with the theoretical arrival
+// time tat, and when the bucket will next hold a token if it is empty.
+func gcraStatus(policy ThrottlePolicy, tat, now int64) *ThrottleStatus {
+	window, interval := gcraPeriods(policy)
+	if tat < now {
+		tat = now
+	}
+	status := &ThrottleStatus{}
+	if tat-now > window {
+		unlock := time.Unix(0, tat-window)
+		status.Throttled = true
+		status.Unlock = &unlock
+		return status
+	}
+	status.Remaining = (window - (tat - now)) / interval
+	return status
+}
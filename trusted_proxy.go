@@ -0,0 +1,181 @@
+package security
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// PrivateNetworkProxies lists loopback, private and link local address ranges.
+// Proxies and load balancers on the local network are trusted by default.
+var PrivateNetworkProxies = []string{
+	"127.0.0.0/8",
+	"10.0.0.0/8",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"169.254.0.0/16",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+}
+
+// GoogleCloudProxies lists the address ranges used by the Google Front End and
+// Google Cloud load balancers when forwarding requests to App Engine, Cloud Run
+// and Compute Engine backends.
+var GoogleCloudProxies = []string{
+	"35.191.0.0/16",
+	"130.211.0.0/22",
+	"169.254.0.0/16",
+}
+
+// CloudflareProxies lists the address ranges published by Cloudflare at
+// https://www.cloudflare.com/ips/
+var CloudflareProxies = []string{
+	"173.245.48.0/20",
+	"103.21.244.0/22",
+	"103.22.200.0/22",
+	"103.31.4.0/22",
+	"141.101.64.0/18",
+	"108.162.192.0/18",
+	"190.93.240.0/20",
+	"188.114.96.0/20",
+	"197.234.240.0/22",
+	"198.41.128.0/17",
+	"162.158.0.0/15",
+	"104.16.0.0/13",
+	"104.24.0.0/14",
+	"172.64.0.0/13",
+	"131.0.72.0/22",
+	"2400:cb00::/32",
+	"2606:4700::/32",
+	"2803:f800::/32",
+	"2405:b500::/32",
+	"2405:8100::/32",
+	"2a06:98c0::/29",
+	"2c0f:f248::/32",
+}
+
+var trustedProxies = mustParseCIDRs(PrivateNetworkProxies)
+
+// Headers in which trusted proxies record the addresses a request was forwarded for
+const (
+	XForwardedForHeader = "X-Forwarded-For"
+	ForwardedHeader     = "Forwarded" // RFC 7239
+)
+
+var forwardingHeader = XForwardedForHeader
+
+// SetForwardingHeader chooses the header that the trusted proxies maintain, either
+// XForwardedForHeader, the default, or ForwardedHeader. Only that header is read.
+// Most proxies, such as the Google Front End and nginx, append to X-Forwarded-For and
+// pass any other forwarding header through from the client unchanged.
+func SetForwardingHeader(header string) error {
+	switch http.CanonicalHeaderKey(header) {
+	case XForwardedForHeader:
+		forwardingHeader = XForwardedForHeader
+	case ForwardedHeader:
+		forwardingHeader = ForwardedHeader
+	default:
+		return errors.New("Unsupported forwarding header: " + header)
+	}
+	return nil
+}
+
+// SetTrustedProxies replaces the list of proxy and load balancer address ranges
+// whose forwarding header is believed, see SetForwardingHeader(). For example:
+//
+//	security.SetTrustedProxies(security.PrivateNetworkProxies...)
+//	security.AddTrustedProxies(security.GoogleCloudProxies...)
+//
+// Calling SetTrustedProxies() with no arguments stops all forwarding headers
+// from being trusted.
+func SetTrustedProxies(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	trustedProxies = nets
+	return nil
+}
+
+// AddTrustedProxies adds address ranges to the list of trusted proxies.
+func AddTrustedProxies(cidrs ...string) error {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		return err
+	}
+	trustedProxies = append(trustedProxies, nets...)
+	return nil
+}
+
+// IsTrustedProxy reports whether an ip address falls within a trusted proxy range.
+func IsTrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// forwardedFor returns the list of client and proxy addresses recorded by proxies
+// in the forwarding header chosen by SetForwardingHeader(). Addresses are ordered
+// from client to proxy.
+func forwardedFor(r *http.Request) []string {
+	var hops []string
+	if forwardingHeader == ForwardedHeader {
+		for _, header := range r.Header.Values(ForwardedHeader) {
+			for _, element := range strings.Split(header, ",") {
+				for _, pair := range strings.Split(element, ";") {
+					pair = strings.TrimSpace(pair)
+					if len(pair) > 4 && strings.EqualFold(pair[0:4], "for=") {
+						hops = append(hops, strings.Trim(pair[4:], `"`))
+					}
+				}
+			}
+		}
+		return hops
+	}
+	for _, header := range r.Header.Values(XForwardedForHeader) {
+		for _, hop := range strings.Split(header, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	return hops
+}
+
+// parseHop extracts the ip address from a forwarding header entry, which may
+// include a port number and square brackets, i.e. "[2001:db8::1]:4711"
+func parseHop(hop string) net.IP {
+	if ip := net.ParseIP(hop); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(strings.Trim(hop, "[]"))
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(c))
+		if err != nil {
+			return nil, errors.New("Invalid trusted proxy address range: " + c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func mustParseCIDRs(cidrs []string) []*net.IPNet {
+	nets, err := parseCIDRs(cidrs)
+	if err != nil {
+		panic(err)
+	}
+	return nets
+}
@@ -0,0 +1,87 @@
+package security
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIpFromRequest(t *testing.T) {
+
+	defer SetTrustedProxies(PrivateNetworkProxies...)
+	defer SetForwardingHeader(XForwardedForHeader)
+	SetTrustedProxies(PrivateNetworkProxies...)
+
+	for _, v := range [][]string{
+		// remote address, X-Forwarded-For, Forwarded, expected client ip
+		[]string{"203.0.113.9:4000", "", "", "203.0.113.9"},
+		[]string{"203.0.113.9:4000", "198.51.100.1", "", "203.0.113.9"},
+		[]string{"172.217.0.1:4000", "198.51.100.1", "", "172.217.0.1"},
+		[]string{"172.16.0.1:4000", "198.51.100.1", "", "198.51.100.1"},
+		[]string{"10.0.0.1:4000", "1.1.1.1, 198.51.100.1", "", "198.51.100.1"},
+		[]string{"10.0.0.1:4000", "198.51.100.1, 10.0.0.2", "", "198.51.100.1"},
+		[]string{"10.0.0.1:4000", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		[]string{"10.0.0.1:4000", "unknown", "", "10.0.0.1"},
+		[]string{"[::1]:4000", "2001:db8::1", "", "2001:db8::1"},
+		// A Forwarded header passed through from the client is ignored
+		[]string{"10.0.0.1:4000", "1.1.1.1", `for=198.51.100.1`, "1.1.1.1"},
+		[]string{"10.0.0.1:4000", "", `for=198.51.100.1`, "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = v[0]
+		if v[1] != "" {
+			r.Header.Set("X-Forwarded-For", v[1])
+		}
+		if v[2] != "" {
+			r.Header.Set("Forwarded", v[2])
+		}
+		if ip := IpFromRequest(r); ip != v[3] {
+			t.Fatalf("IpFromRequest() remote %s X-Forwarded-For %q Forwarded %q returned %s, expected %s", v[0], v[1], v[2], ip, v[3])
+		}
+	}
+
+	// Proxies that maintain the Forwarded header are read once chosen, and then a client
+	// supplied X-Forwarded-For header is ignored
+	if err := SetForwardingHeader("forwarded"); err != nil {
+		t.Fatalf("SetForwardingHeader() failed: %v", err)
+	}
+	for _, v := range [][]string{
+		[]string{"10.0.0.1:4000", "1.1.1.1", `for=198.51.100.1;proto=https, for="[2001:db8::2]:4711"`, "2001:db8::2"},
+		[]string{"10.0.0.1:4000", "", `for=198.51.100.1, for=10.0.0.7`, "198.51.100.1"},
+		[]string{"10.0.0.1:4000", "198.51.100.1", "", "10.0.0.1"},
+	} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = v[0]
+		if v[1] != "" {
+			r.Header.Set("X-Forwarded-For", v[1])
+		}
+		if v[2] != "" {
+			r.Header.Set("Forwarded", v[2])
+		}
+		if ip := IpFromRequest(r); ip != v[3] {
+			t.Fatalf("IpFromRequest() remote %s X-Forwarded-For %q Forwarded %q returned %s, expected %s", v[0], v[1], v[2], ip, v[3])
+		}
+	}
+	SetForwardingHeader(XForwardedForHeader)
+	if err := SetForwardingHeader("X-Real-IP"); err == nil {
+		t.Fatalf("SetForwardingHeader() should reject unsupported headers")
+	}
+
+	// Cloud load balancer addresses are only trusted once added
+	{
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "35.191.1.1:4000"
+		r.Header.Set("X-Forwarded-For", "198.51.100.1, 130.211.0.5")
+		if ip := IpFromRequest(r); ip != "35.191.1.1" {
+			t.Fatalf("IpFromRequest() should not trust GFE addresses by default, returned %s", ip)
+		}
+		AddTrustedProxies(GoogleCloudProxies...)
+		if ip := IpFromRequest(r); ip != "198.51.100.1" {
+			t.Fatalf("IpFromRequest() should trust GFE addresses once added, returned %s", ip)
+		}
+	}
+
+	if err := SetTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Fatalf("SetTrustedProxies() should reject invalid address ranges")
+	}
+
+}
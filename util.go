@@ -10,7 +10,9 @@ import (
 	"fmt"
 	"hash"
 	"math/rand"
+	"mime"
 	"net/smtp"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -285,10 +287,23 @@ func SendEmail(am AccessManager, session Session, subject, toEmail, toName strin
 // smtp settings. Returns with a list of strings to present to the user if sending fails, or an
 // error object if a system error has occured.
 func SendEmailWithAttachment(am AccessManager, session Session, subject, toEmail, toName string, textContent, htmlContent []byte, attachmentName, attachmentType string, attachment []byte) (*[]string, error) {
+	return sendEmail(am, session, subject, toEmail, toName, textContent, htmlContent, attachmentName, attachmentType, attachment, nil)
+}
+
+// SendEmailWithHeaders delivers an email message with additional headers, such as
+// Message-Id or References. A Reply-To header replaces the "support_team.reply.email" setting.
+func SendEmailWithHeaders(am AccessManager, session Session, subject, toEmail, toName string, textContent, htmlContent []byte, headers map[string]string) (*[]string, error) {
+	return sendEmail(am, session, subject, toEmail, toName, textContent, htmlContent, "", "", nil, headers)
+}
+
+func sendEmail(am AccessManager, session Session, subject, toEmail, toName string, textContent, htmlContent []byte, attachmentName, attachmentType string, attachment []byte, headers map[string]string) (*[]string, error) {
 	var results []string
 
 	smtpHostname := am.Setting().GetWithDefault(session.Site(), "smtp.hostname", "")
-	smtpPassword := am.Setting().GetWithDefault(session.Site(), "smtp.password", "")
+	smtpPassword, err := am.Setting().GetSecret(session.Site(), "smtp.password")
+	if err != nil {
+		return nil, err
+	}
 	smtpPort := am.Setting().GetWithDefault(session.Site(), "smtp.port", "")
 	smtpUser := am.Setting().GetWithDefault(session.Site(), "smtp.user", "")
 	supportName := am.Setting().GetWithDefault(session.Site(), "support_team.name", "")
@@ -318,7 +333,7 @@ func SendEmailWithAttachment(am AccessManager, session Session, subject, toEmail
 	var w bytes.Buffer
 	boundary := RandomString(20)
 	w.Write([]byte("Subject: "))
-	w.Write([]byte(subject))
+	w.Write([]byte(mime.QEncoding.Encode("utf-8", subject)))
 	w.Write([]byte("\r\n"))
 	w.Write([]byte(fmt.Sprintf("From: %s <%s>\r\n", supportName, supportEmail)))
 	if toName != "" {
@@ -326,9 +341,22 @@ func SendEmailWithAttachment(am AccessManager, session Session, subject, toEmail
 	} else {
 		w.Write([]byte(fmt.Sprintf("To: %s\r\n", toEmail)))
 	}
+	if replyTo, found := headers["Reply-To"]; found {
+		supportReplyEmail = replyTo
+	}
 	if supportReplyEmail != "" {
 		w.Write([]byte(fmt.Sprintf("Reply-To: %s\r\n", supportReplyEmail)))
 	}
+	var names []string
+	for name := range headers {
+		if name != "Reply-To" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w.Write([]byte(fmt.Sprintf("%s: %s\r\n", name, strings.NewReplacer("\r", "", "\n", "").Replace(headers[name]))))
+	}
 	if supportBounceEmail != "" {
 		w.Write([]byte(fmt.Sprintf("Return-Path: %s\r\n", supportBounceEmail)))
 	}
@@ -372,7 +400,7 @@ func SendEmailWithAttachment(am AccessManager, session Session, subject, toEmail
 	if smtpUser != "" && smtpPassword != "" {
 		auth = smtp.PlainAuth("", smtpUser, smtpPassword, smtpHostname)
 	}
-	err := smtp.SendMail(fmt.Sprintf("%s:%s", smtpHostname, smtpPort), auth, supportEmail, []string{toEmail}, w.Bytes())
+	err = smtp.SendMail(fmt.Sprintf("%s:%s", smtpHostname, smtpPort), auth, supportEmail, []string{toEmail}, w.Bytes())
 	if err != nil {
 		am.Error(session, `email`, "Email delivery failed. To: %s Subject: %s Error: %v", toName, subject, err)
 		results = append(results, "Email delivery failed. Please retry shortly.")
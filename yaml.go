@@ -0,0 +1,315 @@
+package security
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A small YAML encoder and decoder, sufficient for configuration documents such as
+// SiteConfig. It supports block mappings and sequences, quoted and plain scalars,
+// empty {} and [] values, and # comments. Values are converted to and from Go types
+// by way of encoding/json, so json struct tags control field names.
+
+// marshalYAML encodes a value as YAML. Mapping keys are sorted.
+func marshalYAML(v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var generic interface{}
+	d := json.NewDecoder(bytes.NewReader(j))
+	d.UseNumber()
+	if err := d.Decode(&generic); err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if m, ok := generic.(map[string]interface{}); ok && len(m) > 0 {
+		writeYAMLMap(&b, m, 0)
+	} else {
+		b.WriteString(yamlScalar(generic) + "\n")
+	}
+	return b.Bytes(), nil
+}
+
+func writeYAMLMap(b *bytes.Buffer, m map[string]interface{}, indent int) {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		b.WriteString(strings.Repeat(" ", indent) + yamlKey(k) + ":")
+		writeYAMLValue(b, m[k], indent)
+	}
+}
+
+// writeYAMLValue writes the remainder of a line following "key:" or "-".
+func writeYAMLValue(b *bytes.Buffer, v interface{}, indent int) {
+	switch x := v.(type) {
+	case map[string]interface{}:
+		if len(x) == 0 {
+			b.WriteString(" {}\n")
+			return
+		}
+		b.WriteString("\n")
+		writeYAMLMap(b, x, indent+2)
+	case []interface{}:
+		if len(x) == 0 {
+			b.WriteString(" []\n")
+			return
+		}
+		b.WriteString("\n")
+		for _, i := range x {
+			if m, ok := i.(map[string]interface{}); ok && len(m) > 0 {
+				// Place the first key of a mapping on the same line as the dash
+				var nested bytes.Buffer
+				writeYAMLMap(&nested, m, indent+4)
+				b.WriteString(strings.Repeat(" ", indent+2) + "- " + strings.TrimLeft(nested.String(), " "))
+			} else {
+				b.WriteString(strings.Repeat(" ", indent+2) + "-")
+				writeYAMLValue(b, i, indent+2)
+			}
+		}
+	default:
+		b.WriteString(" " + yamlScalar(v) + "\n")
+	}
+}
+
+func yamlKey(k string) string {
+	if k != "" && strings.IndexAny(k, ":#{}[],&*!|>'\"%@` \t") < 0 && !strings.HasPrefix(k, "-") {
+		return k
+	}
+	return yamlScalar(k)
+}
+
+func yamlScalar(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(x)
+	case json.Number:
+		return x.String()
+	case string:
+		j, _ := json.Marshal(x)
+		return string(j)
+	}
+	j, _ := json.Marshal(v)
+	return string(j)
+}
+
+// unmarshalYAML decodes a YAML document into v. JSON documents are also accepted.
+func unmarshalYAML(data []byte, v interface{}) error {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) > 0 && (trimmed[0] == '{' || trimmed[0] == '[') {
+		return json.Unmarshal(trimmed, v)
+	}
+
+	p := &yamlParser{}
+	for n, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, " \t\r")
+		content := strings.TrimLeft(line, " ")
+		if content == "" || strings.HasPrefix(content, "#") || content == "---" {
+			continue
+		}
+		if strings.HasPrefix(content, "\t") {
+			return fmt.Errorf("yaml line %d: tabs may not be used for indentation", n+1)
+		}
+		p.lines = append(p.lines, yamlLine{n + 1, len(line) - len(content), content})
+	}
+	if len(p.lines) == 0 {
+		return errors.New("yaml document is empty")
+	}
+
+	generic, err := p.parseBlock(p.lines[0].indent)
+	if err != nil {
+		return err
+	}
+	if p.pos < len(p.lines) {
+		return fmt.Errorf("yaml line %d: unexpected indentation", p.lines[p.pos].number)
+	}
+	j, err := json.Marshal(generic)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(j, v)
+}
+
+type yamlLine struct {
+	number  int
+	indent  int
+	content string
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseBlock parses a mapping or sequence whose entries start at the given indentation.
+func (p *yamlParser) parseBlock(indent int) (interface{}, error) {
+	if strings.HasPrefix(p.lines[p.pos].content, "- ") || p.lines[p.pos].content == "-" {
+		return p.parseSequence(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseMapping(indent int) (interface{}, error) {
+	m := make(map[string]interface{})
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent {
+		line := p.lines[p.pos]
+		key, rest, err := splitYAMLKey(line.content)
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: %v", line.number, err)
+		}
+		if _, found := m[key]; found {
+			return nil, fmt.Errorf("yaml line %d: duplicate key %s", line.number, key)
+		}
+		p.pos++
+		if rest != "" {
+			if m[key], err = parseYAMLScalar(rest); err != nil {
+				return nil, fmt.Errorf("yaml line %d: %v", line.number, err)
+			}
+			continue
+		}
+		// A nested block, which may be a sequence at the same indentation as the key
+		if p.pos < len(p.lines) && (p.lines[p.pos].indent > indent ||
+			(p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].content, "-"))) {
+			if m[key], err = p.parseBlock(p.lines[p.pos].indent); err != nil {
+				return nil, err
+			}
+		} else {
+			m[key] = nil
+		}
+	}
+	return m, nil
+}
+
+func (p *yamlParser) parseSequence(indent int) (interface{}, error) {
+	s := []interface{}{}
+	for p.pos < len(p.lines) && p.lines[p.pos].indent == indent && strings.HasPrefix(p.lines[p.pos].content, "-") {
+		line := p.lines[p.pos]
+		rest := strings.TrimLeft(strings.TrimPrefix(line.content, "-"), " ")
+		if rest == "" {
+			p.pos++
+			if p.pos < len(p.lines) && p.lines[p.pos].indent > indent {
+				v, err := p.parseBlock(p.lines[p.pos].indent)
+				if err != nil {
+					return nil, err
+				}
+				s = append(s, v)
+			} else {
+				s = append(s, nil)
+			}
+			continue
+		}
+		if _, _, err := splitYAMLKey(rest); err == nil && !strings.HasPrefix(rest, "\"") && !strings.HasPrefix(rest, "'") {
+			// A mapping whose first key follows the dash. Treat the dash as indentation.
+			p.lines[p.pos] = yamlLine{line.number, line.indent + len(line.content) - len(rest), rest}
+			v, err := p.parseMapping(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			s = append(s, v)
+			continue
+		}
+		v, err := parseYAMLScalar(rest)
+		if err != nil {
+			return nil, fmt.Errorf("yaml line %d: %v", line.number, err)
+		}
+		s = append(s, v)
+		p.pos++
+	}
+	return s, nil
+}
+
+// splitYAMLKey splits "key: value" into its key and value.
+func splitYAMLKey(content string) (string, string, error) {
+	if strings.HasPrefix(content, "\"") || strings.HasPrefix(content, "'") {
+		end := closingQuote(content)
+		if end < 0 || !strings.HasPrefix(content[end+1:], ":") {
+			return "", "", errors.New("expected a key followed by a colon")
+		}
+		key, err := parseYAMLScalar(content[:end+1])
+		if err != nil {
+			return "", "", err
+		}
+		return fmt.Sprint(key), strings.TrimSpace(content[end+2:]), nil
+	}
+	i := strings.Index(content, ": ")
+	if i < 0 {
+		if strings.HasSuffix(content, ":") {
+			return content[:len(content)-1], "", nil
+		}
+		return "", "", errors.New("expected a key followed by a colon")
+	}
+	return content[:i], strings.TrimSpace(content[i+2:]), nil
+}
+
+// closingQuote returns the index of the quote ending a quoted scalar.
+func closingQuote(s string) int {
+	q := s[0]
+	for i := 1; i < len(s); i++ {
+		if q == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == q {
+			if q == '\'' && i+1 < len(s) && s[i+1] == '\'' {
+				i++
+				continue
+			}
+			return i
+		}
+	}
+	return -1
+}
+
+func parseYAMLScalar(s string) (interface{}, error) {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, "\""):
+		end := closingQuote(s)
+		if end < 0 {
+			return nil, errors.New("unterminated string")
+		}
+		var v string
+		if err := json.Unmarshal([]byte(s[:end+1]), &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	case strings.HasPrefix(s, "'"):
+		end := closingQuote(s)
+		if end < 0 {
+			return nil, errors.New("unterminated string")
+		}
+		return strings.Replace(s[1:end], "''", "'", -1), nil
+	case s == "{}":
+		return map[string]interface{}{}, nil
+	case s == "[]":
+		return []interface{}{}, nil
+	}
+	if i := strings.Index(s, " #"); i >= 0 {
+		s = strings.TrimSpace(s[:i])
+	}
+	switch s {
+	case "", "~", "null":
+		return nil, nil
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	}
+	if i, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(s, 64); err == nil {
+		return f, nil
+	}
+	return s, nil
+}